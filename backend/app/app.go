@@ -9,6 +9,7 @@ import (
 	"github.com/aritrosaha10/frasertickets/lib"
 	"github.com/aritrosaha10/frasertickets/models"
 	"github.com/aritrosaha10/frasertickets/util"
+	"github.com/aritrosaha10/frasertickets/workers"
 	"github.com/joho/godotenv"
 	"github.com/rs/zerolog/log"
 )
@@ -36,11 +37,25 @@ func Run() {
 	lib.Auth = auth
 	log.Debug().Msg("connected to auth server")
 
+	// Set up identity policy for sign ups
+	lib.Identity = lib.CreateNewIdentityPolicy()
+	log.Debug().Strs("domains", lib.Identity.AllowedDomains).Msg("loaded identity policy")
+
+	// Set up which admin actions need a second admin's approval
+	lib.Approvals = lib.CreateNewApprovalPolicy()
+	log.Debug().Any("actions", lib.Approvals.RequiredActions).Dur("ttl", lib.Approvals.TTL).Msg("loaded approval policy")
+
 	// Set up authentication
 	cloudStorage := lib.CreateNewStorage()
 	lib.CloudStorage = cloudStorage
 	log.Debug().Msg("connected to cloud storage")
 
+	// Set up Google Wallet passes, if configured
+	lib.GoogleWallet = lib.CreateNewGoogleWallet(context.Background())
+	if lib.GoogleWallet != nil {
+		log.Debug().Str("api", lib.GoogleWallet.APIURL).Msg("connected to google wallet")
+	}
+
 	// Initialize all indices on the database
 	err := models.CreateTicketIndices(context.Background())
 	if err != nil {
@@ -60,6 +75,56 @@ func Run() {
 	}
 	log.Debug().Msg("created queued ticket indices")
 
+	err = models.CreateRosterIndices(context.Background())
+	if err != nil {
+		log.Fatal().Err(err).Msg("could not set up roster indices")
+	}
+	log.Debug().Msg("created roster indices")
+
+	err = models.CreateCoatCheckIndices(context.Background())
+	if err != nil {
+		log.Fatal().Err(err).Msg("could not set up coat check indices")
+	}
+	log.Debug().Msg("created coat check indices")
+
+	err = models.CreateChangeHistoryIndices(context.Background())
+	if err != nil {
+		log.Fatal().Err(err).Msg("could not set up change history indices")
+	}
+	log.Debug().Msg("created change history indices")
+
+	err = models.CreateApprovalIndices(context.Background())
+	if err != nil {
+		log.Fatal().Err(err).Msg("could not set up approval indices")
+	}
+	log.Debug().Msg("created approval indices")
+
+	err = models.CreateEventTemplateIndices(context.Background())
+	if err != nil {
+		log.Fatal().Err(err).Msg("could not set up event template indices")
+	}
+	log.Debug().Msg("created event template indices")
+
+	err = models.CreateWalletSyncJobIndices(context.Background())
+	if err != nil {
+		log.Fatal().Err(err).Msg("could not set up wallet sync job indices")
+	}
+	log.Debug().Msg("created wallet sync job indices")
+
+	// Start background workers
+	reconciler := workers.CreateNewQueuedTicketReconciler()
+	workers.QueuedTicketReconciler = reconciler
+	go reconciler.Start(context.Background())
+	log.Debug().Dur("interval", reconciler.Interval).Msg("started queued ticket reconciliation worker")
+
+	trashPurger := workers.CreateNewTrashRetentionWorker()
+	go trashPurger.Start(context.Background())
+	log.Debug().Dur("interval", trashPurger.Interval).Dur("retention", trashPurger.Retention).Msg("started trash retention worker")
+
+	walletSyncer := workers.CreateNewWalletSyncWorker()
+	go walletSyncer.Start(context.Background())
+	log.Debug().Dur("interval", walletSyncer.Interval).Int("max_attempts", walletSyncer.MaxAttempts).Msg("started wallet sync worker")
+
 	// Set up server
 	s := config.CreateNewServer()
 	s.MountHandlers()
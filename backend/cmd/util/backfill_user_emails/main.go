@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"firebase.google.com/go/auth"
+	"github.com/aritrosaha10/frasertickets/lib"
+	"github.com/aritrosaha10/frasertickets/models"
+	"github.com/aritrosaha10/frasertickets/util"
+	"github.com/joho/godotenv"
+	"github.com/rs/zerolog/log"
+)
+
+// Firebase only looks up this many accounts at once
+const firebaseLookupBatchSize = 100
+
+// Copies emails from Firebase Auth onto users that signed up before emails were stored, so that
+// queued tickets and allowlists can match them by email
+func main() {
+	// Just assume we're running in dev
+	godotenv.Load(".env.development")
+
+	// Create new auth & DB refs
+	lib.Auth = lib.CreateNewAuth()
+	lib.Datastore = lib.CreateNewDB()
+	lib.Datastore.Connect()
+	defer lib.Datastore.Disconnect()
+
+	ctx := context.Background()
+
+	// Start logging
+	util.ConfigureZeroLog()
+
+	users, err := models.GetUsersMissingEmail(ctx)
+	if err != nil {
+		log.Fatal().Err(err).Msg("could not fetch users missing emails")
+	}
+
+	updated, missing, failed, failedBatches := 0, 0, 0, 0
+	for start := 0; start < len(users); start += firebaseLookupBatchSize {
+		end := start + firebaseLookupBatchSize
+		if end > len(users) {
+			end = len(users)
+		}
+
+		identifiers := []auth.UserIdentifier{}
+		for _, user := range users[start:end] {
+			identifiers = append(identifiers, auth.UIDIdentifier{UID: user.ID})
+		}
+		result, err := lib.Auth.Client.GetUsers(ctx, identifiers)
+		if err != nil {
+			// Keep going so one bad batch doesn't stop the rest from being backfilled
+			log.Error().Err(err).Int("start", start).Int("end", end).Msg("could not look up firebase users")
+			failedBatches++
+			failed += end - start
+			continue
+		}
+		missing += len(result.NotFound)
+
+		for _, userRecord := range result.Users {
+			if userRecord.Email == "" {
+				missing++
+				continue
+			}
+
+			_, err := models.UpdateExistingUserByKeys(ctx, userRecord.UID, map[string]interface{}{
+				"email": models.NormalizeEmail(userRecord.Email),
+			}, models.UpdateMeta{})
+			if err != nil && err != models.ErrNoDocumentModified {
+				log.Error().Err(err).Str("uid", userRecord.UID).Msg("could not set user email")
+				failed++
+				continue
+			}
+			updated++
+		}
+	}
+
+	fmt.Printf("users missing emails: %d\n", len(users))
+	fmt.Printf("updated: %d\n", updated)
+	fmt.Printf("no email in firebase: %d\n", missing)
+	fmt.Printf("failed: %d\n", failed)
+	fmt.Printf("failed firebase lookups: %d\n", failedBatches)
+
+	if failed > 0 {
+		lib.Datastore.Disconnect()
+		os.Exit(1)
+	}
+}
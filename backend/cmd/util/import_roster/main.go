@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/aritrosaha10/frasertickets/lib"
+	"github.com/aritrosaha10/frasertickets/models"
+	"github.com/aritrosaha10/frasertickets/util"
+	"github.com/joho/godotenv"
+	"github.com/rs/zerolog/log"
+)
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: %s [--deactivate-missing=true/false] [CSV FILENAME]\n", os.Args[0])
+	flag.PrintDefaults()
+	os.Exit(2)
+}
+
+func main() {
+	// Just assume we're running in dev
+	godotenv.Load(".env.development")
+
+	flag.Usage = usage
+	deactivateMissingPtr := flag.Bool("deactivate-missing", false, "whether students missing from the csv should be marked as inactive")
+	flag.Parse()
+
+	args := flag.Args()
+	if len(args) < 1 {
+		usage()
+	}
+
+	// Create new DB refs
+	lib.Datastore = lib.CreateNewDB()
+	lib.Datastore.Connect()
+	defer lib.Datastore.Disconnect()
+
+	ctx := context.Background()
+
+	// Start logging
+	util.ConfigureZeroLog()
+
+	f, err := os.Open(args[0])
+	if err != nil {
+		log.Fatal().Err(err).Msg("could not open csv")
+	}
+	defer f.Close()
+
+	entries, columns, err := models.ParseRosterCSV(f)
+	if err != nil {
+		log.Fatal().Err(err).Msg("could not parse roster csv")
+	}
+
+	if err := models.CreateRosterIndices(ctx); err != nil {
+		log.Fatal().Err(err).Msg("could not set up roster indices")
+	}
+
+	result, err := models.ImportRoster(ctx, entries, columns, *deactivateMissingPtr, "")
+	if err != nil {
+		log.Fatal().Err(err).Msg("could not import roster")
+	}
+
+	fmt.Printf("students in csv: %d\n", result.Received)
+	fmt.Printf("students added: %d\n", result.Inserted)
+	fmt.Printf("students updated: %d\n", result.Updated)
+	fmt.Printf("students deactivated: %d\n", result.Deactivated)
+	fmt.Printf("users with updated grade/homeroom: %d\n", result.UsersUpdated)
+}
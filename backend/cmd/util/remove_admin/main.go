@@ -58,7 +58,7 @@ func main() {
 
 	// Update user data on MongoDB
 	fmt.Printf("setting user data in mongodb of user %s\n", user.ID)
-	err = models.UpdateExistingUserByKeys(context.Background(), user.ID, claims)
+	_, err = models.UpdateExistingUserByKeys(context.Background(), user.ID, claims, models.UpdateMeta{})
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "err while updating user data in mongodb: %v\n", err)
 		os.Exit(3)
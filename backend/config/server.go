@@ -48,7 +48,8 @@ func (s *Server) MountHandlers() {
 	s.Router.Use(cors.Handler(cors.Options{
 		AllowedOrigins: []string{"https://*", "http://*"}, // !! CHANGE THIS LATER
 		AllowedMethods: []string{"GET", "POST", "PUT", "DELETE", "OPTIONS", "PATCH"},
-		AllowedHeaders: []string{"Accept", "Authorization", "Content-Type", "sentry-trace", "baggage"},
+		AllowedHeaders: []string{"Accept", "Authorization", "Content-Type", "If-Match", "sentry-trace", "baggage"},
+		ExposedHeaders: []string{"X-Next-Cursor", "X-Has-More", "ETag"}, // Pagination metadata for list endpoints & document versions
 	}))
 	s.Router.Use(httprate.LimitByRealIP(100, 1*time.Second))
 	s.Router.Use(render.SetContentType(render.ContentTypeJSON))
@@ -66,4 +67,10 @@ func (s *Server) MountHandlers() {
 	s.Router.Mount("/events", controllers.EventController{}.Routes())
 	s.Router.Mount("/tickets", controllers.TicketController{}.Routes())
 	s.Router.Mount("/queuedtickets", controllers.QueuedTicketController{}.Routes())
+	s.Router.Mount("/roster", controllers.RosterController{}.Routes())
+	s.Router.Mount("/coatcheck", controllers.CoatCheckController{}.Routes())
+	s.Router.Mount("/trash", controllers.TrashController{}.Routes())
+	s.Router.Mount("/approvals", controllers.ApprovalController{}.Routes())
+	s.Router.Mount("/event-templates", controllers.EventTemplateController{}.Routes())
+	s.Router.Mount("/wallet", controllers.WalletController{}.Routes())
 }
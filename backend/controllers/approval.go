@@ -0,0 +1,380 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"firebase.google.com/go/auth"
+
+	"github.com/aritrosaha10/frasertickets/lib"
+	"github.com/aritrosaha10/frasertickets/middleware"
+	"github.com/aritrosaha10/frasertickets/models"
+	"github.com/aritrosaha10/frasertickets/util"
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/render"
+	"github.com/rs/zerolog/log"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+type approvalControllerDecisionRequestBody struct {
+	Reason string `json:"reason"` // optional note saved with the decision
+}
+
+// Approved actions and their outcomes are saved even if the approver disconnects, for up to this long
+const approvedActionTimeout = 10 * time.Minute
+
+type ApprovalController struct{}
+
+func (ctrl ApprovalController) Routes() chi.Router {
+	r := chi.NewRouter()
+	r.Use(middleware.AuthenticatorMiddleware) // User must be authenticated before using any of these endpoints
+
+	// Admin-only routes
+	r.Group(func(r chi.Router) {
+		r.Use(middleware.AdminAuthorizerMiddleware)
+		r.Get("/", ctrl.List)                 // GET /approvals - returns approval requests, only available to admins
+		r.Get("/{id}", ctrl.Get)              // GET /approvals/{id} - returns an approval request, only available to admins
+		r.Post("/{id}/approve", ctrl.Approve) // POST /approvals/{id}/approve - approves a request and runs its action, only available to admins other than the requester
+		r.Post("/{id}/reject", ctrl.Reject)   // POST /approvals/{id}/reject - rejects a request so it never runs, only available to admins
+	})
+
+	return r
+}
+
+// requestApproval saves an action for another admin to approve, and responds with the pending
+// request instead of running it.
+func requestApproval(w http.ResponseWriter, r *http.Request, controller string, request models.ApprovalRequest) {
+	created, err := models.CreateApprovalRequest(r.Context(), request)
+	if err == models.ErrAlreadyExists {
+		render.Render(w, r, util.ErrConflict(fmt.Errorf("an approval request for this is already pending")))
+		return
+	} else if err != nil {
+		log.Error().Err(err).Str("action", request.Action).Msg("could not create approval request")
+		render.Render(w, r, util.ErrServer(err))
+		return
+	}
+	request = created
+
+	render.Status(r, http.StatusAccepted)
+	if err := render.Render(w, r, &request); err != nil {
+		render.Render(w, r, util.ErrRender(err))
+		return
+	}
+
+	// Write audit info log
+	log.Info().
+		Str("type", "audit").
+		Str("controller", controller).
+		Str("requester_uid", request.RequestedBy).
+		Str("approval_id", request.ID.Hex()).
+		Any("approval", request).
+		Str("action", "requestApproval").
+		Bool("privileged", true).
+		Msg("requested approval for " + request.Action)
+}
+
+// checkRequesterAccess makes sure whoever made a request could still run its action themselves, since
+// their access might have been taken away while it waited for approval.
+func checkRequesterAccess(ctx context.Context, request models.ApprovalRequest) error {
+	requester, err := lib.Auth.Client.GetUser(ctx, request.RequestedBy)
+	if auth.IsUserNotFound(err) {
+		return fmt.Errorf("requester no longer exists")
+	} else if err != nil {
+		return err
+	}
+
+	isAdmin, _ := requester.CustomClaims["admin"].(bool)
+	isSuperAdmin, _ := requester.CustomClaims["superadmin"].(bool)
+	if !isAdmin {
+		return fmt.Errorf("requester is no longer an admin")
+	}
+	if request.Action == lib.ApprovalActionGrantAdmin && !isSuperAdmin {
+		return fmt.Errorf("requester is no longer a superadmin")
+	}
+	return nil
+}
+
+// runApprovedAction runs the action of a request that has just been approved, on behalf of
+// whoever requested it, as long as they still have access to it.
+func runApprovedAction(ctx context.Context, request models.ApprovalRequest) ([]models.BulkTicketResult, error) {
+	if err := checkRequesterAccess(ctx, request); err != nil {
+		return nil, err
+	}
+
+	switch request.Action {
+	case lib.ApprovalActionDeleteEvent:
+		return nil, models.DeleteEvent(ctx, request.EventID, request.RequestedBy)
+	case lib.ApprovalActionBulkDeleteTickets:
+		response, err := runBulkTicketOperations(ctx, &auth.Token{UID: request.RequestedBy}, ticketControllerBulkRequestBody{
+			Delete: request.TicketIDs,
+			Atomic: request.Atomic,
+		})
+		if err != nil {
+			return nil, err
+		}
+		failed := 0
+		for _, result := range response.Results {
+			if !result.Success {
+				failed++
+			}
+		}
+		if failed > 0 {
+			return response.Results, fmt.Errorf("%d of %d ticket deletions failed", failed, len(response.Results))
+		}
+		return response.Results, nil
+	case lib.ApprovalActionGrantAdmin:
+		return nil, setAdminAccess(ctx, request.UserID, request.Admin, request.SuperAdmin, request.RequestedBy)
+	default:
+		return nil, fmt.Errorf("unknown approval action '%s'", request.Action)
+	}
+}
+
+// parseApprovalDecision reads the ID and optional body of an approve or reject request, rendering an
+// error and returning false if they're invalid.
+func parseApprovalDecision(w http.ResponseWriter, r *http.Request) (primitive.ObjectID, approvalControllerDecisionRequestBody, bool) {
+	var body approvalControllerDecisionRequestBody
+
+	id, err := primitive.ObjectIDFromHex(chi.URLParam(r, "id"))
+	if err != nil {
+		log.Error().Err(err).Msg("could not convert id to objectid")
+		render.Render(w, r, util.ErrInvalidRequest(err))
+		return primitive.NilObjectID, body, false
+	}
+
+	// The body is optional
+	bodyDecoder := json.NewDecoder(r.Body)
+	bodyDecoder.DisallowUnknownFields()
+	if err := bodyDecoder.Decode(&body); err != nil && !errors.Is(err, io.EOF) {
+		log.Error().Err(err).Msg("could not parse body")
+		render.Render(w, r, util.ErrInvalidRequest(err))
+		return primitive.NilObjectID, body, false
+	}
+
+	return id, body, true
+}
+
+// List returns approval requests.
+//
+//	@Summary		List approval requests
+//	@Description	Lists approval requests, newest first. Pending requests past their time limit are shown as expired. Only available to admins.
+//	@Tags			approval
+//	@Produce		json
+//	@Param			status	query		string	false	"pending, approved, executed, failed, rejected, expired or all (default)"
+//	@Success		200		{object}	[]models.ApprovalRequest
+//	@Failure		400
+//	@Failure		500
+//	@Security		ApiKeyAuth
+//	@Router			/approvals [get]
+func (ctrl ApprovalController) List(w http.ResponseWriter, r *http.Request) {
+	filter, err := models.ApprovalStatusFilter(r.URL.Query().Get("status"))
+	if err != nil {
+		render.Render(w, r, util.ErrInvalidRequest(err))
+		return
+	}
+
+	requests, err := models.GetApprovalRequests(r.Context(), filter)
+	if err != nil {
+		log.Error().Err(err).Msg("could not fetch approval requests")
+		render.Render(w, r, util.ErrServer(err))
+		return
+	}
+
+	// Convert into list of renderers to turn into JSON
+	list := []render.Renderer{}
+	for _, request := range requests {
+		rq := request // Duplicate it before passing by reference to avoid only passing the last request
+		list = append(list, &rq)
+	}
+
+	// Return as JSON array, fallback if it fails
+	if err := render.RenderList(w, r, list); err != nil {
+		render.Render(w, r, util.ErrRender(err))
+		return
+	}
+}
+
+// Get returns a single approval request.
+//
+//	@Summary		Get an approval request
+//	@Description	Returns an approval request, including who decided on it and how running its action went. Only available to admins.
+//	@Tags			approval
+//	@Produce		json
+//	@Param			id	path		string	true	"Approval request ID"
+//	@Success		200	{object}	models.ApprovalRequest
+//	@Failure		400
+//	@Failure		404
+//	@Failure		500
+//	@Security		ApiKeyAuth
+//	@Router			/approvals/{id} [get]
+func (ctrl ApprovalController) Get(w http.ResponseWriter, r *http.Request) {
+	id, err := primitive.ObjectIDFromHex(chi.URLParam(r, "id"))
+	if err != nil {
+		log.Error().Err(err).Msg("could not convert id to objectid")
+		render.Render(w, r, util.ErrInvalidRequest(err))
+		return
+	}
+
+	request, err := models.GetApprovalRequest(r.Context(), id)
+	if err == models.ErrNotFound {
+		render.Render(w, r, util.ErrNotFound)
+		return
+	} else if err != nil {
+		log.Error().Err(err).Msg("could not fetch approval request")
+		render.Render(w, r, util.ErrServer(err))
+		return
+	}
+
+	if err := render.Render(w, r, &request); err != nil {
+		render.Render(w, r, util.ErrRender(err))
+		return
+	}
+}
+
+// Approve approves a pending request and runs its action.
+//
+//	@Summary		Approve a request
+//	@Description	Approves a pending request and runs its action on behalf of the requester. Requests can't be approved by whoever made them, and admin grants can only be approved by superadmins. The action fails if the requester has lost the access it needs since asking. Only available to admins.
+//	@Tags			approval
+//	@Accept			json
+//	@Produce		json
+//	@Param			id			path		string									true	"Approval request ID"
+//	@Param			decision	body		approvalControllerDecisionRequestBody	false	"Optional note"
+//	@Success		200			{object}	models.ApprovalRequest
+//	@Failure		400
+//	@Failure		403
+//	@Failure		404
+//	@Failure		409
+//	@Failure		500
+//	@Security		ApiKeyAuth
+//	@Router			/approvals/{id}/approve [post]
+func (ctrl ApprovalController) Approve(w http.ResponseWriter, r *http.Request) {
+	id, body, ok := parseApprovalDecision(w, r)
+	if !ok {
+		return
+	}
+
+	token, err := util.GetUserTokenFromContext(r.Context())
+	if err != nil {
+		log.Error().Err(err).Msg("could not fetch user token from context")
+		render.Render(w, r, util.ErrServer(err))
+		return
+	}
+	isSuperAdmin, _ := util.CheckIfSuperAdmin(r.Context()) // error doesn't matter, bool defaults to false anyways
+
+	request, err := models.ClaimApprovalRequest(r.Context(), id, token.UID, isSuperAdmin, body.Reason)
+	if err == models.ErrNotFound {
+		render.Render(w, r, util.ErrNotFound)
+		return
+	} else if err == models.ErrApproverNotAllowed {
+		log.Warn().Str("uid", token.UID).Str("approval_id", id.Hex()).Msg("admin attempted to approve a request they can't approve")
+		render.Render(w, r, util.ErrForbidden)
+		return
+	} else if err == models.ErrApprovalClosed {
+		render.Render(w, r, util.ErrConflict(err))
+		return
+	} else if err != nil {
+		log.Error().Err(err).Msg("could not approve request")
+		render.Render(w, r, util.ErrServer(err))
+		return
+	}
+
+	// The request is claimed now, so see it through even if the approver goes away
+	ctx, cancel := context.WithTimeout(context.Background(), approvedActionTimeout)
+	defer cancel()
+
+	ticketResults, executionErr := runApprovedAction(ctx, request)
+	if executionErr != nil {
+		log.Error().Err(executionErr).Any("approval", request).Msg("could not run approved action")
+	}
+	request, err = models.FinishApprovalRequest(ctx, id, ticketResults, executionErr)
+	if err != nil {
+		log.Error().Err(err).Msg("could not save outcome of approved action")
+		render.Render(w, r, util.ErrServer(err))
+		return
+	}
+
+	if err := render.Render(w, r, &request); err != nil {
+		render.Render(w, r, util.ErrRender(err))
+		return
+	}
+
+	// Write audit info log
+	log.Info().
+		Str("type", "audit").
+		Str("controller", "approval").
+		Str("requester_uid", token.UID).
+		Str("approval_id", id.Hex()).
+		Str("approved_action", request.Action).
+		Str("requested_by", request.RequestedBy).
+		Str("outcome", request.Status).
+		Str("execution_error", request.ExecutionError).
+		Str("action", "approveRequest").
+		Bool("privileged", true).
+		Msg("approved request")
+}
+
+// Reject turns down a pending request.
+//
+//	@Summary		Reject a request
+//	@Description	Rejects a pending request so that its action never runs. Requesters can reject their own requests to cancel them. Only available to admins.
+//	@Tags			approval
+//	@Accept			json
+//	@Produce		json
+//	@Param			id			path		string									true	"Approval request ID"
+//	@Param			decision	body		approvalControllerDecisionRequestBody	false	"Optional note"
+//	@Success		200			{object}	models.ApprovalRequest
+//	@Failure		400
+//	@Failure		404
+//	@Failure		409
+//	@Failure		500
+//	@Security		ApiKeyAuth
+//	@Router			/approvals/{id}/reject [post]
+func (ctrl ApprovalController) Reject(w http.ResponseWriter, r *http.Request) {
+	id, body, ok := parseApprovalDecision(w, r)
+	if !ok {
+		return
+	}
+
+	token, err := util.GetUserTokenFromContext(r.Context())
+	if err != nil {
+		log.Error().Err(err).Msg("could not fetch user token from context")
+		render.Render(w, r, util.ErrServer(err))
+		return
+	}
+
+	request, err := models.RejectApprovalRequest(r.Context(), id, token.UID, body.Reason)
+	if err == models.ErrNotFound {
+		render.Render(w, r, util.ErrNotFound)
+		return
+	} else if err == models.ErrApprovalClosed {
+		render.Render(w, r, util.ErrConflict(err))
+		return
+	} else if err != nil {
+		log.Error().Err(err).Msg("could not reject request")
+		render.Render(w, r, util.ErrServer(err))
+		return
+	}
+
+	if err := render.Render(w, r, &request); err != nil {
+		render.Render(w, r, util.ErrRender(err))
+		return
+	}
+
+	// Write audit info log
+	log.Info().
+		Str("type", "audit").
+		Str("controller", "approval").
+		Str("requester_uid", token.UID).
+		Str("approval_id", id.Hex()).
+		Str("rejected_action", request.Action).
+		Str("requested_by", request.RequestedBy).
+		Str("reason", request.Reason).
+		Str("action", "rejectRequest").
+		Bool("privileged", true).
+		Msg("rejected request")
+}
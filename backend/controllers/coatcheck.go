@@ -0,0 +1,578 @@
+package controllers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/aritrosaha10/frasertickets/middleware"
+	"github.com/aritrosaha10/frasertickets/models"
+	"github.com/aritrosaha10/frasertickets/util"
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/render"
+	"github.com/rs/zerolog/log"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+type coatCheckControllerCreateRackRequestBody struct {
+	Name             string `json:"name"             validate:"required"`
+	StartNumber      int    `json:"startNumber"      validate:"gte=0"`
+	EndNumber        int    `json:"endNumber"        validate:"gtefield=StartNumber"`
+	PreassignedField string `json:"preassignedField"` // optional, custom field holding pre-assigned numbers
+}
+
+type coatCheckControllerScanRequestBody struct {
+	TicketID string `json:"ticketID" validate:"required,mongodb"`
+	RackID   string `json:"rackID"   validate:"omitempty,mongodb"` // optional, rack to take a number from
+}
+
+type CoatCheckController struct{}
+
+func (ctrl CoatCheckController) Routes() chi.Router {
+	r := chi.NewRouter()
+	r.Use(middleware.AuthenticatorMiddleware) // User must be authenticated before using any of these endpoints
+
+	r.Route("/{eventId}", func(r chi.Router) {
+		// Admin-only routes
+		r.Group(func(r chi.Router) {
+			r.Use(middleware.AdminAuthorizerMiddleware)
+			r.Get("/racks", ctrl.ListRacks)              // GET /coatcheck/{eventId}/racks - returns the event's coat racks, only available to admins
+			r.Post("/racks", ctrl.CreateRack)            // POST /coatcheck/{eventId}/racks - adds a coat rack to the event, only available to admins
+			r.Delete("/racks/{rackId}", ctrl.DeleteRack) // DELETE /coatcheck/{eventId}/racks/{rackId} - deletes an empty coat rack, only available to admins
+			r.Post("/scan", ctrl.Scan)                   // POST /coatcheck/{eventId}/scan - checks a ticket's coat in or out, only available to admins
+			r.Get("/lookup", ctrl.Lookup)                // GET /coatcheck/{eventId}/lookup - finds coats by ticket, student or number, only available to admins
+			r.Get("/unclaimed", ctrl.ListUnclaimed)      // GET /coatcheck/{eventId}/unclaimed - returns coats that were never picked up, only available to admins
+		})
+	})
+
+	return r
+}
+
+// parseCoatCheckEventID reads the event ID from the URL and makes sure the event exists, rendering
+// an error and returning false if it doesn't.
+func parseCoatCheckEventID(w http.ResponseWriter, r *http.Request) (models.Event, bool) {
+	eventID, err := primitive.ObjectIDFromHex(chi.URLParam(r, "eventId"))
+	if err != nil {
+		log.Error().Err(err).Msg("could not convert url param to object id")
+		render.Render(w, r, util.ErrInvalidRequest(err))
+		return models.Event{}, false
+	}
+
+	event, err := models.GetEvent(r.Context(), bson.M{"_id": eventID})
+	if err == mongo.ErrNoDocuments {
+		render.Render(w, r, util.ErrNotFound)
+		return models.Event{}, false
+	} else if err != nil {
+		log.Error().Err(err).Msg("could not fetch event")
+		render.Render(w, r, util.ErrServer(err))
+		return models.Event{}, false
+	}
+
+	return event, true
+}
+
+// renderCoatChecks renders a list of coat checks as a JSON array.
+func renderCoatChecks(w http.ResponseWriter, r *http.Request, coatChecks []models.CoatCheck) error {
+	list := []render.Renderer{}
+	for _, coatCheck := range coatChecks {
+		c := coatCheck // Duplicate it before passing by reference to avoid only passing the last coat check
+		list = append(list, &c)
+	}
+	return render.RenderList(w, r, list)
+}
+
+// ListRacks returns an event's coat racks.
+//
+//	@Summary		List coat racks
+//	@Description	Lists an event's coat racks, along with how many coats are on each. Only available to admins.
+//	@Tags			coatcheck
+//	@Produce		json
+//	@Param			eventId	path		string	true	"Event ID"
+//	@Success		200		{object}	[]models.CoatRack
+//	@Failure		400
+//	@Failure		404
+//	@Failure		500
+//	@Security		ApiKeyAuth
+//	@Router			/coatcheck/{eventId}/racks [get]
+func (ctrl CoatCheckController) ListRacks(w http.ResponseWriter, r *http.Request) {
+	event, ok := parseCoatCheckEventID(w, r)
+	if !ok {
+		return
+	}
+
+	racks, err := models.GetCoatRacks(r.Context(), event.ID)
+	if err != nil {
+		log.Error().Err(err).Msg("could not fetch coat racks")
+		render.Render(w, r, util.ErrServer(err))
+		return
+	}
+
+	// Convert into list of renderers to turn into JSON
+	list := []render.Renderer{}
+	for _, rack := range racks {
+		rk := rack // Duplicate it before passing by reference to avoid only passing the last rack
+		list = append(list, &rk)
+	}
+
+	// Return as JSON array, fallback if it fails
+	if err := render.RenderList(w, r, list); err != nil {
+		render.Render(w, r, util.ErrRender(err))
+		return
+	}
+}
+
+// CreateRack adds a coat rack to an event.
+//
+//	@Summary		Create a coat rack
+//	@Description	Adds a pool of coat check numbers to an event. If a custom field is given, the rack only hands out the numbers pre-assigned to tickets through that field. Only available to admins.
+//	@Tags			coatcheck
+//	@Accept			json
+//	@Produce		json
+//	@Param			eventId	path		string										true	"Event ID"
+//	@Param			rack	body		coatCheckControllerCreateRackRequestBody	true	"Rack to create"
+//	@Success		200		{object}	models.CoatRack
+//	@Failure		400
+//	@Failure		404
+//	@Failure		409
+//	@Failure		500
+//	@Security		ApiKeyAuth
+//	@Router			/coatcheck/{eventId}/racks [post]
+func (ctrl CoatCheckController) CreateRack(w http.ResponseWriter, r *http.Request) {
+	event, ok := parseCoatCheckEventID(w, r)
+	if !ok {
+		return
+	}
+
+	var rackRaw coatCheckControllerCreateRackRequestBody
+
+	// Parse JSON body
+	bodyDecoder := json.NewDecoder(r.Body)
+	bodyDecoder.DisallowUnknownFields()
+	if err := bodyDecoder.Decode(&rackRaw); err != nil {
+		log.Error().Err(err).Msg("could not parse body")
+		render.Render(w, r, util.ErrInvalidRequest(err))
+		return
+	}
+
+	// Validate JSON body
+	validate := util.NewValidator()
+	if err := validate.Struct(rackRaw); err != nil {
+		log.Error().Err(err).Msg("could not validate body")
+		render.Render(w, r, util.ErrInvalidRequest(err))
+		return
+	}
+
+	// Pre-assigned numbers have to come from a custom field of the event
+	if rackRaw.PreassignedField != "" {
+		schema := util.CustomFieldsSchema{}
+		if len(event.RawCustomFieldsSchema) != 0 {
+			var err error
+			schema, err = util.ConvertRawCustomFieldsSchema(event.RawCustomFieldsSchema)
+			if err != nil {
+				log.Error().Err(err).Msg("could not parse custom fields schema of event")
+				render.Render(w, r, util.ErrServer(err))
+				return
+			}
+		}
+		if _, found := schema.Properties[rackRaw.PreassignedField]; !found {
+			render.Render(w, r, util.ErrInvalidRequest(fmt.Errorf("'%s' is not a custom field of this event", rackRaw.PreassignedField)))
+			return
+		}
+	}
+
+	rack := models.CoatRack{
+		EventID:          event.ID,
+		Name:             rackRaw.Name,
+		StartNumber:      rackRaw.StartNumber,
+		EndNumber:        rackRaw.EndNumber,
+		PreassignedField: rackRaw.PreassignedField,
+	}
+	id, err := models.CreateCoatRack(r.Context(), rack)
+	if err == models.ErrAlreadyExists {
+		render.Render(w, r, util.ErrConflict(fmt.Errorf("a rack named '%s' already exists", rack.Name)))
+		return
+	} else if err != nil {
+		log.Error().Err(err).Msg("could not create coat rack")
+		render.Render(w, r, util.ErrServer(err))
+		return
+	}
+	rack.ID = id
+
+	// Return as JSON, fallback if it fails
+	if err := render.Render(w, r, &rack); err != nil {
+		render.Render(w, r, util.ErrRender(err))
+		return
+	}
+
+	// Write audit info log
+	token, err := util.GetUserTokenFromContext(r.Context())
+	requesterUID := ""
+	if err == nil {
+		requesterUID = token.UID
+	}
+	log.Info().
+		Str("type", "audit").
+		Str("controller", "coatcheck").
+		Str("requester_uid", requesterUID).
+		Any("rack", rack).
+		Str("action", "createCoatRack").
+		Bool("privileged", true).
+		Msg("created coat rack")
+}
+
+// DeleteRack deletes a coat rack.
+//
+//	@Summary		Delete a coat rack
+//	@Description	Deletes a coat rack, as long as no coats are still on it. Only available to admins.
+//	@Tags			coatcheck
+//	@Param			eventId	path	string	true	"Event ID"
+//	@Param			rackId	path	string	true	"Rack ID"
+//	@Success		200
+//	@Failure		400
+//	@Failure		404
+//	@Failure		409
+//	@Failure		500
+//	@Security		ApiKeyAuth
+//	@Router			/coatcheck/{eventId}/racks/{rackId} [delete]
+func (ctrl CoatCheckController) DeleteRack(w http.ResponseWriter, r *http.Request) {
+	event, ok := parseCoatCheckEventID(w, r)
+	if !ok {
+		return
+	}
+
+	rackID, err := primitive.ObjectIDFromHex(chi.URLParam(r, "rackId"))
+	if err != nil {
+		log.Error().Err(err).Msg("could not convert url param to object id")
+		render.Render(w, r, util.ErrInvalidRequest(err))
+		return
+	}
+
+	err = models.DeleteCoatRack(r.Context(), event.ID, rackID)
+	if err == models.ErrNotFound {
+		render.Render(w, r, util.ErrNotFound)
+		return
+	} else if err == models.ErrCoatRackInUse {
+		render.Render(w, r, util.ErrConflict(err))
+		return
+	} else if err != nil {
+		log.Error().Err(err).Msg("could not delete coat rack")
+		render.Render(w, r, util.ErrServer(err))
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+
+	// Write audit info log
+	token, err := util.GetUserTokenFromContext(r.Context())
+	requesterUID := ""
+	if err == nil {
+		requesterUID = token.UID
+	}
+	log.Info().
+		Str("type", "audit").
+		Str("controller", "coatcheck").
+		Str("requester_uid", requesterUID).
+		Str("event_id", event.ID.Hex()).
+		Str("rack_id", rackID.Hex()).
+		Str("action", "deleteCoatRack").
+		Bool("privileged", true).
+		Msg("deleted coat rack")
+}
+
+// Scan checks a ticket's coat in or out.
+//
+//	@Summary		Scan a ticket at coat check
+//	@Description	Checks a ticket's coat in if it doesn't have one in, taking its pre-assigned number or the lowest free number, or checks it back out if it does. The returned status says which one happened. Only available to admins.
+//	@Tags			coatcheck
+//	@Accept			json
+//	@Produce		json
+//	@Param			eventId	path		string								true	"Event ID"
+//	@Param			scan	body		coatCheckControllerScanRequestBody	true	"Ticket to scan"
+//	@Success		200		{object}	models.CoatCheck
+//	@Failure		400
+//	@Failure		404
+//	@Failure		409
+//	@Failure		500
+//	@Security		ApiKeyAuth
+//	@Router			/coatcheck/{eventId}/scan [post]
+func (ctrl CoatCheckController) Scan(w http.ResponseWriter, r *http.Request) {
+	event, ok := parseCoatCheckEventID(w, r)
+	if !ok {
+		return
+	}
+
+	var scanRaw coatCheckControllerScanRequestBody
+
+	// Parse JSON body
+	bodyDecoder := json.NewDecoder(r.Body)
+	bodyDecoder.DisallowUnknownFields()
+	if err := bodyDecoder.Decode(&scanRaw); err != nil {
+		log.Error().Err(err).Msg("could not parse body")
+		render.Render(w, r, util.ErrInvalidRequest(err))
+		return
+	}
+
+	// Validate JSON body
+	validate := util.NewValidator()
+	if err := validate.Struct(scanRaw); err != nil {
+		log.Error().Err(err).Msg("could not validate body")
+		render.Render(w, r, util.ErrInvalidRequest(err))
+		return
+	}
+
+	// Validated above, so these can't fail
+	ticketID, _ := primitive.ObjectIDFromHex(scanRaw.TicketID)
+	rackID := primitive.NilObjectID
+	if scanRaw.RackID != "" {
+		rackID, _ = primitive.ObjectIDFromHex(scanRaw.RackID)
+	}
+
+	token, err := util.GetUserTokenFromContext(r.Context())
+	requesterUID := ""
+	if err == nil {
+		requesterUID = token.UID
+	}
+
+	coatCheck, err := models.ScanCoatCheck(r.Context(), event.ID, ticketID, rackID, requesterUID)
+	switch {
+	case err == nil:
+	case err == models.ErrNotFound:
+		render.Render(w, r, util.ErrNotFound)
+		return
+	case err == models.ErrAlreadyExists:
+		render.Render(w, r, util.ErrConflict(fmt.Errorf("coat check number is already in use")))
+		return
+	case err == models.ErrNoFreeCoatNumber:
+		render.Render(w, r, util.ErrConflict(err))
+		return
+	default:
+		log.Error().Err(err).Msg("could not scan ticket at coat check")
+		render.Render(w, r, util.ErrServer(err))
+		return
+	}
+
+	// Return as JSON, fallback if it fails
+	if err := render.Render(w, r, &coatCheck); err != nil {
+		render.Render(w, r, util.ErrRender(err))
+		return
+	}
+
+	// Write audit info log
+	log.Info().
+		Str("type", "audit").
+		Str("controller", "coatcheck").
+		Str("requester_uid", requesterUID).
+		Any("coat_check", coatCheck).
+		Str("action", "scanCoatCheck").
+		Bool("privileged", true).
+		Msgf("coat %s", coatCheck.Status)
+}
+
+// Lookup finds coats by ticket, student or number.
+//
+//	@Summary		Look up coats
+//	@Description	Finds the coats checked in for an event by ticket ID, student number or rack name and number, ex. when someone loses their number. Checked out coats are included so disputes can be settled. Only available to admins.
+//	@Tags			coatcheck
+//	@Produce		json
+//	@Param			eventId			path		string	true	"Event ID"
+//	@Param			ticketId		query		string	false	"Ticket ID"
+//	@Param			studentNumber	query		string	false	"Student number of the ticket holder"
+//	@Param			rack			query		string	false	"Rack name, used with number"
+//	@Param			number			query		int		false	"Coat check number, used with rack"
+//	@Success		200				{object}	[]models.CoatCheck
+//	@Failure		400
+//	@Failure		404
+//	@Failure		500
+//	@Security		ApiKeyAuth
+//	@Router			/coatcheck/{eventId}/lookup [get]
+func (ctrl CoatCheckController) Lookup(w http.ResponseWriter, r *http.Request) {
+	event, ok := parseCoatCheckEventID(w, r)
+	if !ok {
+		return
+	}
+
+	query := r.URL.Query()
+	filter := bson.M{"event_id": event.ID}
+	switch {
+	case query.Get("ticketId") != "":
+		ticketID, err := primitive.ObjectIDFromHex(query.Get("ticketId"))
+		if err != nil {
+			render.Render(w, r, util.ErrInvalidRequest(err))
+			return
+		}
+		filter["ticket_id"] = ticketID
+	case query.Get("studentNumber") != "":
+		user, err := models.GetUserByKey(r.Context(), "student_number", query.Get("studentNumber"))
+		if err == mongo.ErrNoDocuments {
+			render.Render(w, r, util.ErrNotFound)
+			return
+		} else if err != nil {
+			log.Error().Err(err).Msg("could not fetch user by student number")
+			render.Render(w, r, util.ErrServer(err))
+			return
+		}
+		filter["owner_id"] = user.ID
+	case query.Get("rack") != "" && query.Get("number") != "":
+		number, err := strconv.Atoi(query.Get("number"))
+		if err != nil {
+			render.Render(w, r, util.ErrInvalidRequest(fmt.Errorf("number must be a number")))
+			return
+		}
+		filter["rack_name"] = query.Get("rack")
+		filter["number"] = number
+	default:
+		render.Render(w, r, util.ErrInvalidRequest(errors.New("ticketId, studentNumber or rack and number must be given")))
+		return
+	}
+
+	coatChecks, err := models.GetCoatChecks(r.Context(), filter)
+	if err != nil {
+		log.Error().Err(err).Msg("could not look up coat checks")
+		render.Render(w, r, util.ErrServer(err))
+		return
+	}
+
+	// Return as JSON array, fallback if it fails
+	if err := renderCoatChecks(w, r, coatChecks); err != nil {
+		render.Render(w, r, util.ErrRender(err))
+		return
+	}
+
+	// Write audit info log
+	token, err := util.GetUserTokenFromContext(r.Context())
+	requesterUID := ""
+	if err == nil {
+		requesterUID = token.UID
+	}
+	log.Info().
+		Str("type", "audit").
+		Str("controller", "coatcheck").
+		Str("requester_uid", requesterUID).
+		Any("filter", filter).
+		Str("action", "lookupCoatCheck").
+		Bool("privileged", true).
+		Msg("looked up coat checks")
+}
+
+// ListUnclaimed returns coats that are still checked in.
+//
+//	@Summary		List unclaimed coats
+//	@Description	Lists the coats for an event that were checked in but never checked out, with their owners, ordered by rack and number. Can be downloaded as a CSV, NDJSON or XLSX file. Only available to admins.
+//	@Tags			coatcheck
+//	@Produce		json
+//	@Produce		text/csv
+//	@Produce		application/x-ndjson
+//	@Produce		application/vnd.openxmlformats-officedocument.spreadsheetml.sheet
+//	@Param			eventId	path		string	true	"Event ID"
+//	@Param			format	query		string	false	"json (default), csv, ndjson or xlsx"
+//	@Success		200		{object}	[]models.CoatCheck
+//	@Failure		400
+//	@Failure		404
+//	@Failure		500
+//	@Security		ApiKeyAuth
+//	@Router			/coatcheck/{eventId}/unclaimed [get]
+func (ctrl CoatCheckController) ListUnclaimed(w http.ResponseWriter, r *http.Request) {
+	event, ok := parseCoatCheckEventID(w, r)
+	if !ok {
+		return
+	}
+
+	format := r.URL.Query().Get("format")
+	var tabularWriter util.TabularWriter
+	if format != "" && format != "json" {
+		// Catch bad formats before doing any work
+		var err error
+		tabularWriter, err = util.NewTabularWriter(format, w)
+		if err != nil {
+			render.Render(w, r, util.ErrInvalidRequest(err))
+			return
+		}
+	}
+
+	coatChecks, err := models.GetUnclaimedCoats(r.Context(), event.ID)
+	if err != nil {
+		log.Error().Err(err).Msg("could not fetch unclaimed coats")
+		render.Render(w, r, util.ErrServer(err))
+		return
+	}
+
+	if tabularWriter == nil {
+		// Return as JSON array, fallback if it fails
+		if err := renderCoatChecks(w, r, coatChecks); err != nil {
+			render.Render(w, r, util.ErrRender(err))
+			return
+		}
+	} else if err := writeUnclaimedCoats(w, format, tabularWriter, event, coatChecks); err != nil {
+		// Headers are already sent, so the best we can do is cut the download short
+		log.Error().Err(err).Msg("could not finish writing unclaimed coats")
+		return
+	}
+
+	// Write audit info log
+	token, err := util.GetUserTokenFromContext(r.Context())
+	requesterUID := ""
+	if err == nil {
+		requesterUID = token.UID
+	}
+	log.Info().
+		Str("type", "audit").
+		Str("controller", "coatcheck").
+		Str("requester_uid", requesterUID).
+		Str("event_id", event.ID.Hex()).
+		Int("count", len(coatChecks)).
+		Str("format", format).
+		Str("action", "listUnclaimedCoats").
+		Bool("privileged", true).
+		Msg("fetched unclaimed coats")
+}
+
+// writeUnclaimedCoats writes unclaimed coats as a file, one row per coat.
+func writeUnclaimedCoats(
+	w http.ResponseWriter,
+	format string,
+	tabularWriter util.TabularWriter,
+	event models.Event,
+	coatChecks []models.CoatCheck,
+) error {
+	contentType, extension := util.TabularContentType(format)
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"unclaimed-coats-%s.%s\"", event.ID.Hex(), extension))
+
+	header := []util.TabularColumn{
+		{Key: "rack", Header: "Rack"},
+		{Key: "number", Header: "Number"},
+		{Key: "fullName", Header: "Full Name"},
+		{Key: "studentNumber", Header: "Student Number"},
+		{Key: "email", Header: "Email"},
+		{Key: "ticketId", Header: "Ticket ID"},
+		{Key: "checkInTimestamp", Header: "Checked In At"},
+	}
+	if err := tabularWriter.WriteHeader(header); err != nil {
+		return err
+	}
+
+	for _, coatCheck := range coatChecks {
+		owner := models.User{}
+		if coatCheck.OwnerData != nil {
+			owner = *coatCheck.OwnerData
+		}
+		row := []interface{}{
+			coatCheck.RackName,
+			coatCheck.Number,
+			owner.FullName,
+			owner.StudentNumber,
+			owner.Email,
+			coatCheck.TicketID.Hex(),
+			coatCheck.CheckInTimestamp,
+		}
+		if err := tabularWriter.WriteRow(row); err != nil {
+			return err
+		}
+	}
+
+	return tabularWriter.Close()
+}
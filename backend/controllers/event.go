@@ -9,6 +9,7 @@ import (
 	"math"
 	"net/http"
 	"strconv"
+	"strings"
 	"time"
 
 	"cloud.google.com/go/storage"
@@ -19,7 +20,6 @@ import (
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/httprate"
 	"github.com/go-chi/render"
-	"github.com/go-playground/validator/v10"
 	"github.com/google/uuid"
 	"github.com/h2non/bimg"
 	"github.com/rs/zerolog/log"
@@ -29,6 +29,13 @@ import (
 	"go.mongodb.org/mongo-driver/mongo"
 )
 
+type eventControllerUpdateSchemaRequestBody struct {
+	Schema         map[string]interface{}             `json:"schema"         validate:"required"`
+	Migration      models.CustomFieldsSchemaMigration `json:"migration"`
+	DryRun         bool                               `json:"dryRun"`         // only report what would happen
+	AcceptBreaking bool                               `json:"acceptBreaking"` // apply even with breaking changes, as long as every ticket still matches
+}
+
 type eventControllerCreateRequestBody struct {
 	Name                  string                 `json:"name"            validate:"required"`
 	Description           string                 `json:"description"     validate:"required"`
@@ -37,6 +44,12 @@ type eventControllerCreateRequestBody struct {
 	StartTimestamp        string                 `json:"start_timestamp" validate:"required"`
 	EndTimestamp          string                 `json:"end_timestamp"   validate:"required"`
 	RawCustomFieldsSchema map[string]interface{} `json:"custom_fields_schema" validate:"required"`
+	OwnerEditCutoff       string                 `json:"owner_edit_cutoff"` // optional, RFC3339
+}
+
+type eventControllerCloneRequestBody struct {
+	Name           string `json:"name"            validate:"required"`
+	StartTimestamp string `json:"start_timestamp" validate:"required"` // RFC3339, every other date is moved along with it
 }
 
 type EventController struct{}
@@ -67,10 +80,16 @@ func (ctrl EventController) Routes() chi.Router {
 		// Admin-only routes
 		r.Group(func(r chi.Router) {
 			r.Use(middleware.AdminAuthorizerMiddleware)
-			r.Get("/tickets", ctrl.GetTickets)          // GET /events/{id}/tickets - returns all tickets for an event, only for admins
-			r.Get("/ticket-count", ctrl.GetTicketCount) // GET /events/{id}/ticket-count - returns # of tickets for an event, only for admins
-			r.Patch("/", ctrl.Update)                   // PATCH /events/{id} - updates event data, only available to admins
-			r.Delete("/", ctrl.Delete)                  // DELETE /events/{id} - deletes event, only available to admins
+			r.Get("/tickets", ctrl.GetTickets)                            // GET /events/{id}/tickets - returns all tickets for an event, only for admins
+			r.Get("/ticket-count", ctrl.GetTicketCount)                   // GET /events/{id}/ticket-count - returns # of tickets for an event, only for admins
+			r.Get("/export", ctrl.Export)                                 // GET /events/{id}/export - streams the attendee list as csv, ndjson or xlsx, only for admins
+			r.Get("/stats", ctrl.GetStats)                                // GET /events/{id}/stats - returns attendance and scan stats for an event, only for admins
+			r.Get("/report", ctrl.GetReport)                              // GET /events/{id}/report - groups tickets by custom field values as json, csv, ndjson or xlsx, only for admins
+			r.Get("/history", ctrl.GetHistory)                            // GET /events/{id}/history - lists every change made to the event, only for admins
+			r.Patch("/", ctrl.Update)                                     // PATCH /events/{id} - updates event data, only available to admins
+			r.Put("/custom-fields-schema", ctrl.UpdateCustomFieldsSchema) // PUT /events/{id}/custom-fields-schema - checks and applies a new custom fields schema, only available to admins
+			r.Post("/clone", ctrl.Clone)                                  // POST /events/{id}/clone - copies event into a new draft with shifted dates, only available to admins
+			r.Delete("/", ctrl.Delete)                                    // DELETE /events/{id} - deletes event, only available to admins
 		})
 	})
 
@@ -80,7 +99,7 @@ func (ctrl EventController) Routes() chi.Router {
 // List godoc
 //
 //	@Summary		List all events
-//	@Description	Lists all events in the database. Available to all users.
+//	@Description	Lists all events in the database. Draft events are only listed for admins. Available to all users.
 //	@Tags			event
 //	@Produce		json
 //	@Success		200	{object}	[]models.Event
@@ -88,7 +107,8 @@ func (ctrl EventController) Routes() chi.Router {
 //	@Security		ApiKeyAuth
 //	@Router			/events [get]
 func (ctrl EventController) List(w http.ResponseWriter, r *http.Request) {
-	events, err := models.GetAllEvents(r.Context())
+	isAdmin, _ := util.CheckIfAdmin(r.Context()) // error doesn't matter, bool defaults to false anyways
+	events, err := models.GetAllEvents(r.Context(), isAdmin)
 	if err != nil {
 		log.Error().Err(err).Msg("could not fetch events")
 		render.Render(w, r, util.ErrServer(err))
@@ -156,6 +176,7 @@ func (ctrl EventController) Create(w http.ResponseWriter, r *http.Request) {
 	eventRaw.Address = r.PostFormValue("address")
 	eventRaw.StartTimestamp = r.PostFormValue("start_timestamp")
 	eventRaw.EndTimestamp = r.PostFormValue("end_timestamp")
+	eventRaw.OwnerEditCutoff = r.PostFormValue("owner_edit_cutoff")
 	// Can't provide a JSON object into FormData, so we need to parse it beforehand
 	var rawCustomFieldsSchema map[string]interface{}
 	if err = json.Unmarshal([]byte(r.PostFormValue("custom_fields_schema")), &rawCustomFieldsSchema); err != nil {
@@ -163,9 +184,22 @@ func (ctrl EventController) Create(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	eventRaw.RawCustomFieldsSchema = rawCustomFieldsSchema
+	// Audience is optional, and also needs to be parsed beforehand
+	var rawAudience interface{}
+	if audienceStr := r.PostFormValue("audience"); audienceStr != "" {
+		if err = json.Unmarshal([]byte(audienceStr), &rawAudience); err != nil {
+			render.Render(w, r, util.ErrInvalidRequest(err))
+			return
+		}
+	}
+	audience, err := models.ParseEventAudience(rawAudience)
+	if err != nil {
+		render.Render(w, r, util.ErrInvalidRequest(err))
+		return
+	}
 
 	// Validate body
-	validate := validator.New()
+	validate := util.NewValidator()
 	err = validate.Struct(eventRaw)
 	if err != nil {
 		log.Error().Err(err).Msg("could not validate body")
@@ -355,6 +389,17 @@ func (ctrl EventController) Create(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Owners can edit their tickets until the start of the event unless told otherwise
+	if eventRaw.OwnerEditCutoff != "" {
+		cutoff, err := time.Parse(time.RFC3339, eventRaw.OwnerEditCutoff)
+		if err != nil {
+			log.Error().Err(err).Msg("could not parse owner edit cutoff")
+			render.Render(w, r, util.ErrInvalidRequest(err))
+			return
+		}
+		event.OwnerEditCutoff = &cutoff
+	}
+
 	// Validate custom fields schema
 	schemaLoader := gojsonschema.NewGoLoader(eventRaw.RawCustomFieldsSchema)
 	_, err = gojsonschema.NewSchema(schemaLoader)
@@ -364,6 +409,7 @@ func (ctrl EventController) Create(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	event.RawCustomFieldsSchema = eventRaw.RawCustomFieldsSchema
+	event.Audience = audience
 
 	// Try to add to DB
 	id, err := models.CreateNewEvent(r.Context(), event)
@@ -518,7 +564,7 @@ func (ctrl EventController) UploadPhoto(w http.ResponseWriter, r *http.Request)
 // List godoc
 //
 //	@Summary		Get an event
-//	@Description	Get the data for one event from the DB. Available to all users.
+//	@Description	Get the data for one event from the DB. Draft events are only returned to admins. Available to all users.
 //	@Tags			event
 //	@Produce		json
 //	@Param			id	path		string	true	"Event ID"
@@ -555,7 +601,14 @@ func (ctrl EventController) Get(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Drafts aren't public yet
+	if isAdmin, _ := util.CheckIfAdmin(r.Context()); event.Draft && !isAdmin {
+		render.Render(w, r, util.ErrNotFound)
+		return
+	}
+
 	// Return as JSON, fallback if it fails
+	w.Header().Set("ETag", util.ETag(event.Version))
 	if err := render.Render(w, r, &event); err != nil {
 		render.Render(w, r, util.ErrRender(err))
 		return
@@ -580,11 +633,16 @@ func (ctrl EventController) Get(w http.ResponseWriter, r *http.Request) {
 // Get event tickets godoc
 //
 //	@Summary		Get tickets for event
-//	@Description	Get every ticket for an event. Only available to admins.
+//	@Description	Get every ticket for an event. Tickets can also be filtered by any field in TicketListSpec (ex. scanCount[gte]=1) or custom field (ex. customFields.table=4). Only available to admins.
 //	@Tags			event
 //	@Produce		json
 //	@Param			id	path		string	true	"Event ID"
+//	@Param			limit	query	int		false	"Page size, results are only paginated if this or cursor is given (max 200)"
+//	@Param			cursor	query	string	false	"Cursor from the X-Next-Cursor header of the previous page"
+//	@Param			sort	query	string	false	"Comma separated fields to sort by, prefixed with - for descending"
 //	@Success		200	{object}	[]models.Ticket
+//	@Header			200	{string}	X-Next-Cursor	"Cursor for the next page, if there is one"
+//	@Header			200	{boolean}	X-Has-More		"Whether there are more results"
 //	@Failure		400
 //	@Failure		404
 //	@Failure		500
@@ -614,9 +672,21 @@ func (ctrl EventController) GetTickets(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Parse pagination, sorting and any extra filters
+	filter, page, err := parseListOptions(r, models.TicketListSpec)
+	if err != nil {
+		render.Render(w, r, util.ErrInvalidRequest(err))
+		return
+	}
+
 	// Fetch list of tickets
-	tickets, err := models.GetTickets(r.Context(), bson.M{"event": eventID})
+	tickets, pageInfo, err := models.GetTicketsPage(r.Context(), bson.M{"$and": bson.A{filter, bson.M{"event": eventID}}}, page)
 	if err != nil {
+		if errors.Is(err, models.ErrInvalidCursor) {
+			render.Render(w, r, util.ErrInvalidRequest(err))
+			return
+		}
+
 		log.Error().Err(err).Msg("could not fetch tickets of event")
 		render.Render(w, r, util.ErrServer(err))
 		return
@@ -630,6 +700,7 @@ func (ctrl EventController) GetTickets(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Return as JSON array, fallback if it fails
+	setPageHeaders(w, pageInfo)
 	if err := render.RenderList(w, r, renderers); err != nil {
 		render.Render(w, r, util.ErrRender(err))
 		return
@@ -724,10 +795,12 @@ func (ctrl EventController) GetTicketCount(w http.ResponseWriter, r *http.Reques
 //	@Produce		json
 //	@Param			id	path	string	true	"Event ID"
 //	@Param			updates	body	models.Event	true	"Updates to make (not all attributes below are required, and id cannot be changed)"
+//	@Param			If-Match	header	string	false	"ETag of the version last fetched, fails with 412 if it was changed since"
 //	@Success		200
 //	@Failure		304
 //	@Failure		400
 //	@Failure		404
+//	@Failure		412
 //	@Failure		500
 //	@Security		ApiKeyAuth
 //	@Router			/events/{id} [patch]
@@ -760,14 +833,32 @@ func (ctrl EventController) Update(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Only overwrite the version the requester last saw, if they told us which one that was
+	expectedVersion, err := util.IfMatchVersion(r)
+	if err != nil {
+		render.Render(w, r, util.ErrInvalidRequest(err))
+		return
+	}
+	token, err := util.GetUserTokenFromContext(r.Context())
+	uid := ""
+	if err == nil {
+		uid = token.UID
+	}
+
 	// Try updating the appropriate document
-	err = models.UpdateExistingEvent(r.Context(), id, requestedUpdates)
+	version, err := models.UpdateExistingEvent(r.Context(), id, requestedUpdates, models.UpdateMeta{
+		ChangedBy:       uid,
+		ExpectedVersion: expectedVersion,
+	})
 	if err != nil {
 		if err == models.ErrNoDocumentModified {
 			log.Error().Stack().Err(err).Send()
 			render.Render(w, r, util.ErrUnmodified)
 			return
-		} else if err == models.ErrEditNotAllowed {
+		} else if err == models.ErrVersionMismatch {
+			render.Render(w, r, util.ErrPreconditionFailed(err))
+			return
+		} else if errors.Is(err, models.ErrEditNotAllowed) {
 			render.Render(w, r, util.ErrInvalidRequest(err))
 			return
 		}
@@ -777,8 +868,91 @@ func (ctrl EventController) Update(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	w.Header().Set("ETag", util.ETag(version))
 	w.WriteHeader(http.StatusOK)
 
+	// Write audit info log
+	log.Info().
+		Str("type", "audit").
+		Str("controller", "event").
+		Str("requester_uid", uid).
+		Str("action", "updateEvent").
+		Str("eventId", id).
+		Any("requestedUpdates", requestedUpdates).
+		Bool("privileged", true).
+		Msg("updated event details")
+}
+
+// Get event stats godoc
+//
+//	@Summary		Get attendance stats for event
+//	@Description	Get issued vs. scanned ticket counts, no-shows, admissions over time and breakdowns by custom field value for an event. Only available to admins.
+//	@Tags			event
+//	@Produce		json
+//	@Param			id			path		string	true	"Event ID"
+//	@Param			interval	query		string	false	"Size of each admissions bucket (ex. 5m, 1h), defaults to 15m"
+//	@Param			fields		query		string	false	"Comma separated custom fields to break down, defaults to all but sensitive ones"
+//	@Success		200			{object}	models.EventStats
+//	@Failure		400
+//	@Failure		404
+//	@Failure		500
+//	@Security		ApiKeyAuth
+//	@Router			/events/{id}/stats [get]
+func (ctrl EventController) GetStats(w http.ResponseWriter, r *http.Request) {
+	// Get ID of requested event
+	id := chi.URLParam(r, "id")
+
+	// Try to convert the given ID into an Object ID
+	eventID, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		log.Error().Err(err).Msg("could not convert url param to object id")
+		render.Render(w, r, util.ErrInvalidRequest(err))
+		return
+	}
+
+	interval := models.DefaultStatsInterval
+	if intervalRaw := r.URL.Query().Get("interval"); intervalRaw != "" {
+		interval, err = time.ParseDuration(intervalRaw)
+		if err != nil {
+			render.Render(w, r, util.ErrInvalidRequest(fmt.Errorf("interval must be a duration (ex. 5m, 1h)")))
+			return
+		}
+	}
+	var fields []string
+	if fieldsRaw := r.URL.Query().Get("fields"); fieldsRaw != "" {
+		for _, field := range strings.Split(fieldsRaw, ",") {
+			fields = append(fields, strings.TrimSpace(field))
+		}
+	}
+
+	// Check if event exists
+	event, err := models.GetEvent(r.Context(), bson.M{"_id": eventID})
+	if err == mongo.ErrNoDocuments {
+		render.Render(w, r, util.ErrNotFound)
+		return
+	} else if err != nil {
+		log.Error().Err(err).Msg("could not fetch event")
+		render.Render(w, r, util.ErrServer(err))
+		return
+	}
+
+	stats, err := models.GetEventStats(r.Context(), event, interval, fields)
+	if err != nil {
+		if errors.Is(err, models.ErrInvalidReport) {
+			render.Render(w, r, util.ErrInvalidRequest(err))
+			return
+		}
+		log.Error().Err(err).Str("eventId", id).Msg("could not compute event stats")
+		render.Render(w, r, util.ErrServer(err))
+		return
+	}
+
+	// Return as JSON, fallback if it fails
+	if err := render.Render(w, r, &stats); err != nil {
+		render.Render(w, r, util.ErrRender(err))
+		return
+	}
+
 	// Write audit info log
 	token, err := util.GetUserTokenFromContext(r.Context())
 	uid := ""
@@ -789,23 +963,398 @@ func (ctrl EventController) Update(w http.ResponseWriter, r *http.Request) {
 		Str("type", "audit").
 		Str("controller", "event").
 		Str("requester_uid", uid).
-		Str("action", "updateEvent").
+		Str("action", "getEventStats").
 		Str("eventId", id).
-		Any("requestedUpdates", requestedUpdates).
 		Bool("privileged", true).
-		Msg("updated event details")
+		Msg("fetched stats for event")
+}
+
+// Get event custom field report godoc
+//
+//	@Summary		Get custom field report for event
+//	@Description	Groups an event's tickets by the values of one or more custom fields (ex. meal choice), with counts and optionally the holders of each combination of values. Can be downloaded as a CSV, NDJSON or XLSX file, with one row per group or per holder. Only available to admins.
+//	@Tags			event
+//	@Produce		json
+//	@Produce		text/csv
+//	@Produce		application/x-ndjson
+//	@Produce		application/vnd.openxmlformats-officedocument.spreadsheetml.sheet
+//	@Param			id		path		string	true	"Event ID"
+//	@Param			fields	query		string	true	"Comma separated custom fields to group by (ex. mealChoice,jacketNumber)"
+//	@Param			holders	query		bool	false	"Whether to list the holders of each group"
+//	@Param			format	query		string	false	"json (default), csv, ndjson or xlsx"
+//	@Success		200		{object}	models.CustomFieldReport
+//	@Failure		400
+//	@Failure		404
+//	@Failure		500
+//	@Security		ApiKeyAuth
+//	@Router			/events/{id}/report [get]
+func (ctrl EventController) GetReport(w http.ResponseWriter, r *http.Request) {
+	// Get ID of requested event
+	id := chi.URLParam(r, "id")
+
+	// Try to convert the given ID into an Object ID
+	eventID, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		log.Error().Err(err).Msg("could not convert url param to object id")
+		render.Render(w, r, util.ErrInvalidRequest(err))
+		return
+	}
+
+	var fields []string
+	if fieldsRaw := r.URL.Query().Get("fields"); fieldsRaw != "" {
+		for _, field := range strings.Split(fieldsRaw, ",") {
+			fields = append(fields, strings.TrimSpace(field))
+		}
+	}
+	includeHolders := false
+	if holdersRaw := r.URL.Query().Get("holders"); holdersRaw != "" {
+		includeHolders, err = strconv.ParseBool(holdersRaw)
+		if err != nil {
+			render.Render(w, r, util.ErrInvalidRequest(fmt.Errorf("holders must be true or false")))
+			return
+		}
+	}
+	format := r.URL.Query().Get("format")
+	if format != "" && format != "json" {
+		// Catch bad formats before doing any work
+		if _, err := util.NewTabularWriter(format, io.Discard); err != nil {
+			render.Render(w, r, util.ErrInvalidRequest(err))
+			return
+		}
+	}
+
+	// Check if event exists
+	event, err := models.GetEvent(r.Context(), bson.M{"_id": eventID})
+	if err == mongo.ErrNoDocuments {
+		render.Render(w, r, util.ErrNotFound)
+		return
+	} else if err != nil {
+		log.Error().Err(err).Msg("could not fetch event")
+		render.Render(w, r, util.ErrServer(err))
+		return
+	}
+
+	report, err := models.GetCustomFieldReport(r.Context(), event, fields, includeHolders)
+	if err != nil {
+		if errors.Is(err, models.ErrInvalidReport) {
+			render.Render(w, r, util.ErrInvalidRequest(err))
+			return
+		}
+		log.Error().Err(err).Str("eventId", id).Msg("could not generate custom field report")
+		render.Render(w, r, util.ErrServer(err))
+		return
+	}
+
+	if format == "" || format == "json" {
+		// Return as JSON, fallback if it fails
+		if err := render.Render(w, r, &report); err != nil {
+			render.Render(w, r, util.ErrRender(err))
+			return
+		}
+	} else if err := writeCustomFieldReport(w, format, report, includeHolders); err != nil {
+		// Headers are already sent, so the best we can do is cut the download short
+		log.Error().Err(err).Str("eventId", id).Msg("could not finish writing custom field report")
+		return
+	}
+
+	// Write audit info log
+	token, err := util.GetUserTokenFromContext(r.Context())
+	uid := ""
+	if err == nil {
+		uid = token.UID
+	}
+	log.Info().
+		Str("type", "audit").
+		Str("controller", "event").
+		Str("requester_uid", uid).
+		Str("action", "getEventReport").
+		Str("eventId", id).
+		Strs("fields", fields).
+		Bool("holders", includeHolders).
+		Str("format", format).
+		Bool("privileged", true).
+		Msg("fetched custom field report for event")
+}
+
+// writeCustomFieldReport writes a report as a file, with one row per group or, if holders were
+// included, one row per holder.
+func writeCustomFieldReport(w http.ResponseWriter, format string, report models.CustomFieldReport, includeHolders bool) error {
+	tabularWriter, err := util.NewTabularWriter(format, w)
+	if err != nil {
+		return err
+	}
+	contentType, extension := util.TabularContentType(format)
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"report-%s.%s\"", report.EventID.Hex(), extension))
+
+	return models.WriteCustomFieldReport(tabularWriter, report, includeHolders)
+}
+
+// Get event change history godoc
+//
+//	@Summary		Get event change history
+//	@Description	Lists every change made to an event, newest first, with who made it and what each field changed from and to. Only available to admins.
+//	@Tags			event
+//	@Produce		json
+//	@Param			id	path		string	true	"Event ID"
+//	@Success		200	{object}	[]models.ChangeRecord
+//	@Failure		400
+//	@Failure		500
+//	@Security		ApiKeyAuth
+//	@Router			/events/{id}/history [get]
+func (ctrl EventController) GetHistory(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	if _, err := primitive.ObjectIDFromHex(id); err != nil {
+		log.Error().Err(err).Msg("could not convert url param to object id")
+		render.Render(w, r, util.ErrInvalidRequest(err))
+		return
+	}
+
+	renderChangeHistory(w, r, "event", models.ChangeDocumentEvent, id)
+}
+
+// Update event custom fields schema godoc
+//
+//	@Summary		Update custom fields schema for event
+//	@Description	Compares a new custom fields schema to the current one, classifying each change as compatible or breaking, and checks every existing ticket against it after applying the optional migration (renames, defaults and dropped fields). The schema and migrated tickets are only saved if every ticket matches and there are no breaking changes, unless acceptBreaking is set. Rejected updates return 409 along with the report. Only available to admins.
+//	@Tags			event
+//	@Accept			json
+//	@Produce		json
+//	@Param			id		path		string									true	"Event ID"
+//	@Param			update	body		eventControllerUpdateSchemaRequestBody	true	"New schema and migration"
+//	@Param			If-Match	header	string	false	"ETag of the version last fetched, fails with 412 if it was changed since"
+//	@Success		200		{object}	models.CustomFieldsSchemaUpdateResult
+//	@Failure		400
+//	@Failure		404
+//	@Failure		409		{object}	models.CustomFieldsSchemaUpdateResult
+//	@Failure		412
+//	@Failure		500
+//	@Security		ApiKeyAuth
+//	@Router			/events/{id}/custom-fields-schema [put]
+func (ctrl EventController) UpdateCustomFieldsSchema(w http.ResponseWriter, r *http.Request) {
+	// Get ID of requested event
+	id := chi.URLParam(r, "id")
+
+	// Try to convert the given ID into an Object ID
+	eventID, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		log.Error().Err(err).Msg("could not convert url param to object id")
+		render.Render(w, r, util.ErrInvalidRequest(err))
+		return
+	}
+
+	var updateReq eventControllerUpdateSchemaRequestBody
+
+	// Parse JSON body
+	bodyDecoder := json.NewDecoder(r.Body)
+	bodyDecoder.DisallowUnknownFields()
+	if err := bodyDecoder.Decode(&updateReq); err != nil {
+		log.Error().Err(err).Msg("could not parse body")
+		render.Render(w, r, util.ErrInvalidRequest(err))
+		return
+	}
+
+	// Validate JSON body
+	validate := util.NewValidator()
+	if err := validate.Struct(updateReq); err != nil {
+		log.Error().Err(err).Msg("could not validate body")
+		render.Render(w, r, util.ErrInvalidRequest(err))
+		return
+	}
+
+	expectedVersion, err := util.IfMatchVersion(r)
+	if err != nil {
+		render.Render(w, r, util.ErrInvalidRequest(err))
+		return
+	}
+	token, err := util.GetUserTokenFromContext(r.Context())
+	uid := ""
+	if err == nil {
+		uid = token.UID
+	}
+
+	result, err := models.UpdateEventCustomFieldsSchema(
+		r.Context(),
+		eventID,
+		updateReq.Schema,
+		updateReq.Migration,
+		updateReq.DryRun,
+		updateReq.AcceptBreaking,
+		models.UpdateMeta{ChangedBy: uid, ExpectedVersion: expectedVersion},
+	)
+	switch {
+	case err == nil:
+	case err == models.ErrNotFound:
+		render.Render(w, r, util.ErrNotFound)
+		return
+	case err == models.ErrVersionMismatch:
+		render.Render(w, r, util.ErrPreconditionFailed(err))
+		return
+	case errors.Is(err, models.ErrInvalidSchemaUpdate):
+		render.Render(w, r, util.ErrInvalidRequest(err))
+		return
+	case err == models.ErrSchemaUpdateRejected:
+		// Send the report back so admins can see what needs fixing
+		render.Status(r, http.StatusConflict)
+	default:
+		log.Error().Err(err).Str("eventId", id).Msg("could not update custom fields schema")
+		render.Render(w, r, util.ErrServer(err))
+		return
+	}
+
+	// Return as JSON, fallback if it fails
+	if err := render.Render(w, r, &result); err != nil {
+		render.Render(w, r, util.ErrRender(err))
+		return
+	}
+
+	// Write audit info log
+	log.Info().
+		Str("type", "audit").
+		Str("controller", "event").
+		Str("requester_uid", uid).
+		Str("action", "updateEventCustomFieldsSchema").
+		Str("eventId", id).
+		Any("migration", updateReq.Migration).
+		Bool("dry_run", updateReq.DryRun).
+		Bool("accept_breaking", updateReq.AcceptBreaking).
+		Bool("applied", result.Applied).
+		Int("tickets_migrated", result.TicketsMigrated).
+		Bool("privileged", true).
+		Msg("checked custom fields schema update for event")
+}
+
+// Export event attendees godoc
+//
+//	@Summary		Export attendees for event
+//	@Description	Streams every ticket for an event with owner data, scan status and custom fields as a CSV, NDJSON or XLSX file. NDJSON rows are keyed by column ID, while CSV and XLSX files use column headers. Text that spreadsheets would run as a formula is prefixed with an apostrophe. Only available to admins.
+//	@Tags			event
+//	@Produce		text/csv
+//	@Produce		application/x-ndjson
+//	@Produce		application/vnd.openxmlformats-officedocument.spreadsheetml.sheet
+//	@Param			id		path	string	true	"Event ID"
+//	@Param			format	query	string	false	"csv (default), ndjson or xlsx"
+//	@Param			columns	query	string	false	"Comma separated column IDs to include (ex. fullName,studentNumber,scanned,customFields.table), defaults to all but sensitive custom fields"
+//	@Success		200
+//	@Failure		400
+//	@Failure		404
+//	@Failure		500
+//	@Security		ApiKeyAuth
+//	@Router			/events/{id}/export [get]
+func (ctrl EventController) Export(w http.ResponseWriter, r *http.Request) {
+	// Get ID of requested event
+	id := chi.URLParam(r, "id")
+
+	// Try to convert the given ID into an Object ID
+	eventID, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		log.Error().Err(err).Msg("could not convert url param to object id")
+		render.Render(w, r, util.ErrInvalidRequest(err))
+		return
+	}
+
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = util.TabularFormatCSV
+	}
+
+	// Check if event exists
+	event, err := models.GetEvent(r.Context(), bson.M{"_id": eventID})
+	if err == mongo.ErrNoDocuments {
+		render.Render(w, r, util.ErrNotFound)
+		return
+	} else if err != nil {
+		log.Error().Err(err).Msg("could not fetch event")
+		render.Render(w, r, util.ErrServer(err))
+		return
+	}
+
+	// Figure out which columns to include
+	columns, err := models.TicketExportColumns(event)
+	if err != nil {
+		log.Error().Err(err).Msg("could not parse custom fields schema of event")
+		render.Render(w, r, util.ErrServer(err))
+		return
+	}
+	var columnIDs []string
+	if columnsRaw := r.URL.Query().Get("columns"); columnsRaw != "" {
+		columnIDs = strings.Split(columnsRaw, ",")
+	}
+	columns, err = models.SelectTicketExportColumns(columns, columnIDs)
+	if err != nil {
+		render.Render(w, r, util.ErrInvalidRequest(err))
+		return
+	}
+
+	// Nothing can be sent as an error once the headers are written, so catch bad formats first
+	tabularWriter, err := util.NewTabularWriter(format, w)
+	if err != nil {
+		render.Render(w, r, util.ErrInvalidRequest(err))
+		return
+	}
+	contentType, extension := util.TabularContentType(format)
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"attendees-%s.%s\"", eventID.Hex(), extension))
+
+	if err := tabularWriter.WriteHeader(models.TabularColumns(columns)); err != nil {
+		log.Error().Err(err).Msg("could not write export header")
+		return
+	}
+
+	// Stream rows straight from the cursor, flushing every so often so the download keeps moving
+	flusher, _ := w.(http.Flusher)
+	rowCount := 0
+	err = models.StreamEventTickets(r.Context(), eventID, func(ticket models.Ticket) error {
+		if err := tabularWriter.WriteRow(models.TabularRow(columns, ticket)); err != nil {
+			return err
+		}
+
+		rowCount++
+		if flusher != nil && rowCount%500 == 0 {
+			flusher.Flush()
+		}
+		return nil
+	})
+	if err != nil {
+		// Headers are already sent, so the best we can do is cut the download short
+		log.Error().Err(err).Str("eventId", id).Int("rows", rowCount).Msg("could not finish streaming event export")
+		return
+	}
+	if err := tabularWriter.Close(); err != nil {
+		log.Error().Err(err).Str("eventId", id).Msg("could not finish writing event export")
+		return
+	}
+
+	// Write audit info log
+	token, err := util.GetUserTokenFromContext(r.Context())
+	uid := ""
+	if err == nil {
+		uid = token.UID
+	}
+	log.Info().
+		Str("type", "audit").
+		Str("controller", "event").
+		Str("requester_uid", uid).
+		Str("action", "exportEventTickets").
+		Str("eventId", id).
+		Str("format", format).
+		Int("rows", rowCount).
+		Bool("privileged", true).
+		Msg("exported tickets for event")
 }
 
 // Delete event godoc
 //
 //	@Summary		Delete event
-//	@Description	Delete event from database. Only available to admins.
+//	@Description	Move event to the trash along with all of its tickets and queued tickets. Superadmins can restore it until it is purged. If deleting events needs approval, an approval request for another admin is saved instead. Only available to admins.
 //	@Tags			event
 //	@Produce		json
 //	@Param			id	path		string	true	"Event ID"
 //	@Success		200
+//	@Success		202	{object}	models.ApprovalRequest
 //	@Failure		400
 //	@Failure		404
+//	@Failure		409
 //	@Failure		500
 //	@Security		ApiKeyAuth
 //	@Router			/events/{id} [delete]
@@ -820,8 +1369,34 @@ func (ctrl EventController) Delete(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Try to delete document
-	err = models.DeleteEvent(r.Context(), objID)
+	token, err := util.GetUserTokenFromContext(r.Context())
+	uid := ""
+	if err == nil {
+		uid = token.UID
+	}
+
+	// Wait for a second admin to sign off if needed
+	if lib.Approvals.Requires(lib.ApprovalActionDeleteEvent) {
+		exists, err := models.CheckIfEventExists(r.Context(), objID)
+		if err != nil {
+			log.Error().Err(err).Msg("could not check if event exists")
+			render.Render(w, r, util.ErrServer(err))
+			return
+		} else if !exists {
+			render.Render(w, r, util.ErrNotFound)
+			return
+		}
+
+		requestApproval(w, r, "event", models.ApprovalRequest{
+			Action:      lib.ApprovalActionDeleteEvent,
+			EventID:     objID,
+			RequestedBy: uid,
+		})
+		return
+	}
+
+	// Try to trash document
+	err = models.DeleteEvent(r.Context(), objID, uid)
 	if err == models.ErrNotFound {
 		log.Error().Err(err).Msg("could not find event to delete")
 		render.Render(w, r, util.ErrNotFound)
@@ -834,6 +1409,86 @@ func (ctrl EventController) Delete(w http.ResponseWriter, r *http.Request) {
 
 	w.WriteHeader(http.StatusOK)
 
+	// Write audit info log
+	log.Info().
+		Str("type", "audit").
+		Str("controller", "event").
+		Str("requester_uid", uid).
+		Str("action", "deleteEvent").
+		Str("eventId", id).
+		Bool("privileged", true).
+		Msg("moved event to trash")
+}
+
+// Clone godoc
+//
+//	@Summary		Clone an event
+//	@Description	Copies an event's description, location, images, audience and custom fields schema into a new draft event. The start, end and owner edit cutoff are all moved so the new event starts at the given time. Tickets aren't copied. Only available to admins.
+//	@Tags			event
+//	@Accept			json
+//	@Produce		json
+//	@Param			id		path		string							true	"Event ID"
+//	@Param			clone	body		eventControllerCloneRequestBody	true	"Name and start of the new event"
+//	@Success		201		{object}	models.Event
+//	@Failure		400
+//	@Failure		404
+//	@Failure		500
+//	@Security		ApiKeyAuth
+//	@Router			/events/{id}/clone [post]
+func (ctrl EventController) Clone(w http.ResponseWriter, r *http.Request) {
+	// Get ID of requested event
+	id := chi.URLParam(r, "id")
+	// Convert to ObjectID
+	objID, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		log.Error().Err(err).Msg("could not convert id to objectid")
+		render.Render(w, r, util.ErrInvalidRequest(err))
+		return
+	}
+
+	var cloneReq eventControllerCloneRequestBody
+
+	// Parse JSON body
+	bodyDecoder := json.NewDecoder(r.Body)
+	bodyDecoder.DisallowUnknownFields()
+	if err := bodyDecoder.Decode(&cloneReq); err != nil {
+		log.Error().Err(err).Msg("could not parse body")
+		render.Render(w, r, util.ErrInvalidRequest(err))
+		return
+	}
+
+	// Validate JSON body
+	validate := util.NewValidator()
+	if err := validate.Struct(cloneReq); err != nil {
+		log.Error().Err(err).Msg("could not validate body")
+		render.Render(w, r, util.ErrInvalidRequest(err))
+		return
+	}
+
+	startTs, err := time.Parse(time.RFC3339, cloneReq.StartTimestamp)
+	if err != nil {
+		log.Error().Err(err).Msg("could not parse start timestamp")
+		render.Render(w, r, util.ErrInvalidRequest(err))
+		return
+	}
+
+	event, err := models.CloneEvent(r.Context(), objID, cloneReq.Name, startTs)
+	if err == models.ErrNotFound {
+		render.Render(w, r, util.ErrNotFound)
+		return
+	} else if err != nil {
+		log.Error().Err(err).Str("eventId", id).Msg("could not clone event")
+		render.Render(w, r, util.ErrServer(err))
+		return
+	}
+
+	// Return as JSON, fallback if it fails
+	render.Status(r, http.StatusCreated)
+	if err := render.Render(w, r, &event); err != nil {
+		render.Render(w, r, util.ErrRender(err))
+		return
+	}
+
 	// Write audit info log
 	token, err := util.GetUserTokenFromContext(r.Context())
 	uid := ""
@@ -844,8 +1499,9 @@ func (ctrl EventController) Delete(w http.ResponseWriter, r *http.Request) {
 		Str("type", "audit").
 		Str("controller", "event").
 		Str("requester_uid", uid).
-		Str("action", "deleteEvent").
-		Str("eventId", id).
+		Str("action", "cloneEvent").
+		Str("sourceEventId", id).
+		Any("eventData", event).
 		Bool("privileged", true).
-		Msg("deleted event")
+		Msg("event cloned into draft")
 }
@@ -0,0 +1,468 @@
+package controllers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/aritrosaha10/frasertickets/middleware"
+	"github.com/aritrosaha10/frasertickets/models"
+	"github.com/aritrosaha10/frasertickets/util"
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/render"
+	"github.com/rs/zerolog/log"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+type eventTemplateControllerRequestBody struct {
+	Name                  string                 `json:"name"          validate:"required"`
+	FromEventID           string                 `json:"from_event_id"` // optional, copies every setting from an event instead of the ones below
+	Description           string                 `json:"description"`
+	ImageURLs             []string               `json:"img_urls"`
+	Location              string                 `json:"location"`
+	Address               string                 `json:"address"`
+	DurationMinutes       int                    `json:"duration_minutes"`
+	OwnerEditCutoffBefore int                    `json:"owner_edit_cutoff_minutes_before"`
+	RawCustomFieldsSchema map[string]interface{} `json:"custom_fields_schema"`
+	Audience              interface{}            `json:"audience"`
+}
+
+type eventTemplateControllerCreateEventRequestBody struct {
+	Name           string `json:"name"            validate:"required"`
+	StartTimestamp string `json:"start_timestamp" validate:"required"` // RFC3339
+	EndTimestamp   string `json:"end_timestamp"`                       // optional, RFC3339, defaults to the template's duration
+}
+
+type EventTemplateController struct{}
+
+func (ctrl EventTemplateController) Routes() chi.Router {
+	r := chi.NewRouter()
+	r.Use(middleware.AuthenticatorMiddleware) // User must be authenticated before using any of these endpoints
+
+	// Admin-only routes
+	r.Group(func(r chi.Router) {
+		r.Use(middleware.AdminAuthorizerMiddleware)
+		r.Get("/", ctrl.List)                    // GET /event-templates - returns all event templates, only available to admins
+		r.Post("/", ctrl.Create)                 // POST /event-templates - adds a new event template, only available to admins
+		r.Get("/{id}", ctrl.Get)                 // GET /event-templates/{id} - returns an event template, only available to admins
+		r.Put("/{id}", ctrl.Replace)             // PUT /event-templates/{id} - replaces an event template's settings, only available to admins
+		r.Delete("/{id}", ctrl.Delete)           // DELETE /event-templates/{id} - deletes an event template, only available to admins
+		r.Post("/{id}/events", ctrl.CreateEvent) // POST /event-templates/{id}/events - creates a draft event from a template, only available to admins
+	})
+
+	return r
+}
+
+// parseEventTemplateBody reads a template from the request body, rendering an error and returning
+// false if it's invalid.
+func parseEventTemplateBody(w http.ResponseWriter, r *http.Request) (models.EventTemplate, bool) {
+	var templateReq eventTemplateControllerRequestBody
+
+	// Parse JSON body
+	bodyDecoder := json.NewDecoder(r.Body)
+	bodyDecoder.DisallowUnknownFields()
+	if err := bodyDecoder.Decode(&templateReq); err != nil {
+		log.Error().Err(err).Msg("could not parse body")
+		render.Render(w, r, util.ErrInvalidRequest(err))
+		return models.EventTemplate{}, false
+	}
+
+	// Validate JSON body
+	validate := util.NewValidator()
+	if err := validate.Struct(templateReq); err != nil {
+		log.Error().Err(err).Msg("could not validate body")
+		render.Render(w, r, util.ErrInvalidRequest(err))
+		return models.EventTemplate{}, false
+	}
+
+	// Copy everything from an existing event if asked to
+	if templateReq.FromEventID != "" {
+		eventID, err := primitive.ObjectIDFromHex(templateReq.FromEventID)
+		if err != nil {
+			render.Render(w, r, util.ErrInvalidRequest(err))
+			return models.EventTemplate{}, false
+		}
+		event, err := models.GetEvent(r.Context(), bson.M{"_id": eventID})
+		if err == mongo.ErrNoDocuments {
+			render.Render(w, r, util.ErrInvalidRequest(fmt.Errorf("event to copy from could not be found")))
+			return models.EventTemplate{}, false
+		} else if err != nil {
+			log.Error().Err(err).Msg("could not fetch event to copy from")
+			render.Render(w, r, util.ErrServer(err))
+			return models.EventTemplate{}, false
+		}
+		return models.EventTemplateFromEvent(event, templateReq.Name), true
+	}
+
+	audience, err := models.ParseEventAudience(templateReq.Audience)
+	if err != nil {
+		render.Render(w, r, util.ErrInvalidRequest(err))
+		return models.EventTemplate{}, false
+	}
+
+	return models.EventTemplate{
+		Name:                  templateReq.Name,
+		Description:           templateReq.Description,
+		ImageURLs:             templateReq.ImageURLs,
+		Location:              templateReq.Location,
+		Address:               templateReq.Address,
+		DurationMinutes:       templateReq.DurationMinutes,
+		OwnerEditCutoffBefore: templateReq.OwnerEditCutoffBefore,
+		RawCustomFieldsSchema: templateReq.RawCustomFieldsSchema,
+		Audience:              audience,
+	}, true
+}
+
+// List returns all event templates.
+//
+//	@Summary		List event templates
+//	@Description	Lists all event templates by name. Only available to admins.
+//	@Tags			event template
+//	@Produce		json
+//	@Success		200	{object}	[]models.EventTemplate
+//	@Failure		500
+//	@Security		ApiKeyAuth
+//	@Router			/event-templates [get]
+func (ctrl EventTemplateController) List(w http.ResponseWriter, r *http.Request) {
+	templates, err := models.GetEventTemplates(r.Context())
+	if err != nil {
+		log.Error().Err(err).Msg("could not fetch event templates")
+		render.Render(w, r, util.ErrServer(err))
+		return
+	}
+
+	// Convert into list of renderers to turn into JSON
+	list := []render.Renderer{}
+	for _, template := range templates {
+		tmpl := template // Duplicate it before passing by reference to avoid only passing the last template
+		list = append(list, &tmpl)
+	}
+
+	// Return as JSON array, fallback if it fails
+	if err := render.RenderList(w, r, list); err != nil {
+		render.Render(w, r, util.ErrRender(err))
+		return
+	}
+}
+
+// Get returns a single event template.
+//
+//	@Summary		Get an event template
+//	@Description	Returns an event template. Only available to admins.
+//	@Tags			event template
+//	@Produce		json
+//	@Param			id	path		string	true	"Event template ID"
+//	@Success		200	{object}	models.EventTemplate
+//	@Failure		400
+//	@Failure		404
+//	@Failure		500
+//	@Security		ApiKeyAuth
+//	@Router			/event-templates/{id} [get]
+func (ctrl EventTemplateController) Get(w http.ResponseWriter, r *http.Request) {
+	id, err := primitive.ObjectIDFromHex(chi.URLParam(r, "id"))
+	if err != nil {
+		log.Error().Err(err).Msg("could not convert id to objectid")
+		render.Render(w, r, util.ErrInvalidRequest(err))
+		return
+	}
+
+	template, err := models.GetEventTemplate(r.Context(), id)
+	if err == models.ErrNotFound {
+		render.Render(w, r, util.ErrNotFound)
+		return
+	} else if err != nil {
+		log.Error().Err(err).Msg("could not fetch event template")
+		render.Render(w, r, util.ErrServer(err))
+		return
+	}
+
+	if err := render.Render(w, r, &template); err != nil {
+		render.Render(w, r, util.ErrRender(err))
+		return
+	}
+}
+
+// Create adds a new event template.
+//
+//	@Summary		Create an event template
+//	@Description	Saves a named event template with a custom fields schema and default settings. If from_event_id is given, every setting is copied from that event instead. Template names must be unique. Only available to admins.
+//	@Tags			event template
+//	@Accept			json
+//	@Produce		json
+//	@Param			template	body		eventTemplateControllerRequestBody	true	"Template settings"
+//	@Success		201			{object}	models.EventTemplate
+//	@Failure		400
+//	@Failure		409
+//	@Failure		500
+//	@Security		ApiKeyAuth
+//	@Router			/event-templates [post]
+func (ctrl EventTemplateController) Create(w http.ResponseWriter, r *http.Request) {
+	template, ok := parseEventTemplateBody(w, r)
+	if !ok {
+		return
+	}
+
+	token, err := util.GetUserTokenFromContext(r.Context())
+	uid := ""
+	if err == nil {
+		uid = token.UID
+	}
+	template.CreatedBy = uid
+
+	template.ID, err = models.CreateEventTemplate(r.Context(), template)
+	if errors.Is(err, models.ErrInvalidEventTemplate) {
+		render.Render(w, r, util.ErrInvalidRequest(err))
+		return
+	} else if err == models.ErrAlreadyExists {
+		render.Render(w, r, util.ErrConflict(fmt.Errorf("an event template with this name already exists")))
+		return
+	} else if err != nil {
+		log.Error().Err(err).Msg("could not create event template")
+		render.Render(w, r, util.ErrServer(err))
+		return
+	}
+
+	// Return as JSON, fallback if it fails
+	render.Status(r, http.StatusCreated)
+	if err := render.Render(w, r, &template); err != nil {
+		render.Render(w, r, util.ErrRender(err))
+		return
+	}
+
+	// Write audit info log
+	log.Info().
+		Str("type", "audit").
+		Str("controller", "eventTemplate").
+		Str("requester_uid", uid).
+		Str("action", "createEventTemplate").
+		Any("templateData", template).
+		Bool("privileged", true).
+		Msg("event template created")
+}
+
+// Replace overwrites an event template's settings.
+//
+//	@Summary		Replace an event template
+//	@Description	Replaces every setting of an event template. If from_event_id is given, every setting is copied from that event instead. Events already made from the template aren't changed. Only available to admins.
+//	@Tags			event template
+//	@Accept			json
+//	@Produce		json
+//	@Param			id			path		string								true	"Event template ID"
+//	@Param			template	body		eventTemplateControllerRequestBody	true	"Template settings"
+//	@Success		200			{object}	models.EventTemplate
+//	@Failure		400
+//	@Failure		404
+//	@Failure		409
+//	@Failure		500
+//	@Security		ApiKeyAuth
+//	@Router			/event-templates/{id} [put]
+func (ctrl EventTemplateController) Replace(w http.ResponseWriter, r *http.Request) {
+	id, err := primitive.ObjectIDFromHex(chi.URLParam(r, "id"))
+	if err != nil {
+		log.Error().Err(err).Msg("could not convert id to objectid")
+		render.Render(w, r, util.ErrInvalidRequest(err))
+		return
+	}
+
+	template, ok := parseEventTemplateBody(w, r)
+	if !ok {
+		return
+	}
+
+	template, err = models.ReplaceEventTemplate(r.Context(), id, template)
+	if errors.Is(err, models.ErrInvalidEventTemplate) {
+		render.Render(w, r, util.ErrInvalidRequest(err))
+		return
+	} else if err == models.ErrNotFound {
+		render.Render(w, r, util.ErrNotFound)
+		return
+	} else if err == models.ErrAlreadyExists {
+		render.Render(w, r, util.ErrConflict(fmt.Errorf("an event template with this name already exists")))
+		return
+	} else if err != nil {
+		log.Error().Err(err).Msg("could not replace event template")
+		render.Render(w, r, util.ErrServer(err))
+		return
+	}
+
+	// Return as JSON, fallback if it fails
+	if err := render.Render(w, r, &template); err != nil {
+		render.Render(w, r, util.ErrRender(err))
+		return
+	}
+
+	// Write audit info log
+	token, err := util.GetUserTokenFromContext(r.Context())
+	uid := ""
+	if err == nil {
+		uid = token.UID
+	}
+	log.Info().
+		Str("type", "audit").
+		Str("controller", "eventTemplate").
+		Str("requester_uid", uid).
+		Str("action", "replaceEventTemplate").
+		Str("templateId", id.Hex()).
+		Any("templateData", template).
+		Bool("privileged", true).
+		Msg("event template replaced")
+}
+
+// Delete removes an event template.
+//
+//	@Summary		Delete an event template
+//	@Description	Deletes an event template. Events already made from it aren't changed. Only available to admins.
+//	@Tags			event template
+//	@Param			id	path	string	true	"Event template ID"
+//	@Success		200
+//	@Failure		400
+//	@Failure		404
+//	@Failure		500
+//	@Security		ApiKeyAuth
+//	@Router			/event-templates/{id} [delete]
+func (ctrl EventTemplateController) Delete(w http.ResponseWriter, r *http.Request) {
+	id, err := primitive.ObjectIDFromHex(chi.URLParam(r, "id"))
+	if err != nil {
+		log.Error().Err(err).Msg("could not convert id to objectid")
+		render.Render(w, r, util.ErrInvalidRequest(err))
+		return
+	}
+
+	err = models.DeleteEventTemplate(r.Context(), id)
+	if err == models.ErrNotFound {
+		render.Render(w, r, util.ErrNotFound)
+		return
+	} else if err != nil {
+		log.Error().Err(err).Msg("could not delete event template")
+		render.Render(w, r, util.ErrServer(err))
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+
+	// Write audit info log
+	token, err := util.GetUserTokenFromContext(r.Context())
+	uid := ""
+	if err == nil {
+		uid = token.UID
+	}
+	log.Info().
+		Str("type", "audit").
+		Str("controller", "eventTemplate").
+		Str("requester_uid", uid).
+		Str("action", "deleteEventTemplate").
+		Str("templateId", id.Hex()).
+		Bool("privileged", true).
+		Msg("event template deleted")
+}
+
+// CreateEvent makes a new draft event from a template.
+//
+//	@Summary		Create an event from a template
+//	@Description	Creates a draft event with a template's description, location, images, audience, custom fields schema and owner edit cutoff. The end defaults to the template's duration after the start. Only available to admins.
+//	@Tags			event template
+//	@Accept			json
+//	@Produce		json
+//	@Param			id		path		string											true	"Event template ID"
+//	@Param			event	body		eventTemplateControllerCreateEventRequestBody	true	"Name and dates of the new event"
+//	@Success		201		{object}	models.Event
+//	@Failure		400
+//	@Failure		404
+//	@Failure		500
+//	@Security		ApiKeyAuth
+//	@Router			/event-templates/{id}/events [post]
+func (ctrl EventTemplateController) CreateEvent(w http.ResponseWriter, r *http.Request) {
+	id, err := primitive.ObjectIDFromHex(chi.URLParam(r, "id"))
+	if err != nil {
+		log.Error().Err(err).Msg("could not convert id to objectid")
+		render.Render(w, r, util.ErrInvalidRequest(err))
+		return
+	}
+
+	var eventReq eventTemplateControllerCreateEventRequestBody
+
+	// Parse JSON body
+	bodyDecoder := json.NewDecoder(r.Body)
+	bodyDecoder.DisallowUnknownFields()
+	if err := bodyDecoder.Decode(&eventReq); err != nil {
+		log.Error().Err(err).Msg("could not parse body")
+		render.Render(w, r, util.ErrInvalidRequest(err))
+		return
+	}
+
+	// Validate JSON body
+	validate := util.NewValidator()
+	if err := validate.Struct(eventReq); err != nil {
+		log.Error().Err(err).Msg("could not validate body")
+		render.Render(w, r, util.ErrInvalidRequest(err))
+		return
+	}
+
+	// Time needs to parsed separately
+	startTs, err := time.Parse(time.RFC3339, eventReq.StartTimestamp)
+	if err != nil {
+		log.Error().Err(err).Msg("could not parse start timestamp")
+		render.Render(w, r, util.ErrInvalidRequest(err))
+		return
+	}
+	var endTs time.Time
+	if eventReq.EndTimestamp != "" {
+		endTs, err = time.Parse(time.RFC3339, eventReq.EndTimestamp)
+		if err != nil {
+			log.Error().Err(err).Msg("could not parse end timestamp")
+			render.Render(w, r, util.ErrInvalidRequest(err))
+			return
+		}
+	}
+
+	template, err := models.GetEventTemplate(r.Context(), id)
+	if err == models.ErrNotFound {
+		render.Render(w, r, util.ErrNotFound)
+		return
+	} else if err != nil {
+		log.Error().Err(err).Msg("could not fetch event template")
+		render.Render(w, r, util.ErrServer(err))
+		return
+	}
+
+	event, err := template.NewEvent(eventReq.Name, startTs, endTs)
+	if err != nil {
+		render.Render(w, r, util.ErrInvalidRequest(err))
+		return
+	}
+
+	// Try to add to DB
+	event.ID, err = models.CreateNewEvent(r.Context(), event)
+	if err != nil {
+		log.Error().Err(err).Msg("could not create event from template")
+		render.Render(w, r, util.ErrServer(err))
+		return
+	}
+
+	// Return as JSON, fallback if it fails
+	render.Status(r, http.StatusCreated)
+	if err := render.Render(w, r, &event); err != nil {
+		render.Render(w, r, util.ErrRender(err))
+		return
+	}
+
+	// Write audit info log
+	token, err := util.GetUserTokenFromContext(r.Context())
+	uid := ""
+	if err == nil {
+		uid = token.UID
+	}
+	log.Info().
+		Str("type", "audit").
+		Str("controller", "eventTemplate").
+		Str("requester_uid", uid).
+		Str("action", "createEventFromTemplate").
+		Str("templateId", id.Hex()).
+		Any("eventData", event).
+		Bool("privileged", true).
+		Msg("event created from template")
+}
@@ -0,0 +1,48 @@
+package controllers
+
+import (
+	"net/http"
+
+	"github.com/aritrosaha10/frasertickets/models"
+	"github.com/aritrosaha10/frasertickets/util"
+	"github.com/go-chi/render"
+	"github.com/rs/zerolog/log"
+)
+
+// renderChangeHistory renders every saved edit to a document as a JSON array, and logs who asked.
+func renderChangeHistory(w http.ResponseWriter, r *http.Request, controller string, documentKind string, documentID string) {
+	records, err := models.GetChangeHistory(r.Context(), documentKind, documentID)
+	if err != nil {
+		log.Error().Err(err).Str("kind", documentKind).Str("id", documentID).Msg("could not fetch change history")
+		render.Render(w, r, util.ErrServer(err))
+		return
+	}
+
+	// Convert into list of renderers to turn into JSON
+	list := []render.Renderer{}
+	for _, record := range records {
+		rc := record // Duplicate it before passing by reference to avoid only passing the last record
+		list = append(list, &rc)
+	}
+
+	// Return as JSON array, fallback if it fails
+	if err := render.RenderList(w, r, list); err != nil {
+		render.Render(w, r, util.ErrRender(err))
+		return
+	}
+
+	// Write audit info log
+	token, err := util.GetUserTokenFromContext(r.Context())
+	requesterUID := ""
+	if err == nil {
+		requesterUID = token.UID
+	}
+	log.Info().
+		Str("type", "audit").
+		Str("controller", controller).
+		Str("requester_uid", requesterUID).
+		Str("document_id", documentID).
+		Str("action", "getChangeHistory").
+		Bool("privileged", true).
+		Msg("fetched change history")
+}
@@ -0,0 +1,58 @@
+package controllers
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/aritrosaha10/frasertickets/models"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// parsePageOptions reads the limit and cursor query params shared by paginated endpoints.
+func parsePageOptions(r *http.Request) (models.PageOptions, error) {
+	page := models.PageOptions{
+		Cursor: r.URL.Query().Get("cursor"),
+	}
+
+	if limitRaw := r.URL.Query().Get("limit"); limitRaw != "" {
+		limit, err := strconv.Atoi(limitRaw)
+		if err != nil || limit < 1 || limit > models.MaxPageLimit {
+			return page, fmt.Errorf("limit must be a number between 1 and %d", models.MaxPageLimit)
+		}
+		page.Limit = limit
+	}
+
+	return page, nil
+}
+
+// setPageHeaders adds pagination metadata to the response. It's sent as headers so paginated
+// endpoints can keep returning plain JSON arrays.
+func setPageHeaders(w http.ResponseWriter, info models.PageInfo) {
+	if info.NextCursor != "" {
+		w.Header().Set("X-Next-Cursor", info.NextCursor)
+	}
+	w.Header().Set("X-Has-More", strconv.FormatBool(info.HasMore))
+}
+
+// parseListOptions reads the pagination, sort and filter query params for a list endpoint. Results
+// are only paginated if a limit or cursor is given, so older clients still get the whole list.
+func parseListOptions(r *http.Request, spec models.ListSpec) (bson.M, models.PageOptions, error) {
+	page, err := parsePageOptions(r)
+	if err != nil {
+		return nil, page, err
+	}
+	page.Unlimited = !r.URL.Query().Has("limit") && !r.URL.Query().Has("cursor")
+
+	page.Sort, err = spec.ParseSort(r.URL.Query().Get("sort"))
+	if err != nil {
+		return nil, page, err
+	}
+
+	filter, err := spec.ParseFilters(r.URL.Query())
+	if err != nil {
+		return nil, page, err
+	}
+
+	return filter, page, nil
+}
@@ -1,6 +1,8 @@
 package controllers
 
 import (
+	"context"
+	"encoding/csv"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -10,9 +12,9 @@ import (
 	"github.com/aritrosaha10/frasertickets/middleware"
 	"github.com/aritrosaha10/frasertickets/models"
 	"github.com/aritrosaha10/frasertickets/util"
+	"github.com/aritrosaha10/frasertickets/workers"
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/render"
-	"github.com/go-playground/validator/v10"
 	"github.com/rs/zerolog/log"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
@@ -20,11 +22,18 @@ import (
 )
 
 type queuedTicketControllerCreateRequestBody struct {
-	StudentNumber string `json:"studentNumber" validate:"required"`
-	EventID       string `json:"eventID" validate:"required,mongodb"`
-	MaxScanCount  int    `json:"maxScanCount" validate:"gte=0"`
+	StudentNumber string    `json:"studentNumber" validate:"required_without_all=Email ExternalID"`
+	Email         string    `json:"email" validate:"omitempty,email"`
+	ExternalID    string    `json:"externalID"`
+	EventID       string    `json:"eventID" validate:"required,mongodb"`
+	MaxScanCount  int       `json:"maxScanCount" validate:"gte=0"`
+	ExpiresAt     time.Time `json:"expiresAt"` // optional, RFC3339
 }
 
+// manualReconciliationTimeout caps how long a reconciliation run started by an admin can take, since
+// it isn't tied to the request.
+const manualReconciliationTimeout = 10 * time.Minute
+
 type QueuedTicketController struct{}
 
 func (ctrl QueuedTicketController) Routes() chi.Router {
@@ -34,9 +43,14 @@ func (ctrl QueuedTicketController) Routes() chi.Router {
 	// Admin-only routes
 	r.Group(func(r chi.Router) {
 		r.Use(middleware.AdminAuthorizerMiddleware)
-		r.Post("/", ctrl.Create)       // POST /queuedtickets - create a new ticket, only available to admins
-		r.Get("/", ctrl.ListAll)       // GET /queuedtickets - returns all tickets, only available to admins
-		r.Delete("/{id}", ctrl.Delete) // DELETE /queuedtickets/{id} - deletes a queued ticket, only available to admins
+		r.Post("/", ctrl.Create)                // POST /queuedtickets - create a new ticket, only available to admins
+		r.Get("/", ctrl.ListAll)                // GET /queuedtickets - returns all tickets, only available to admins
+		r.Get("/unclaimed", ctrl.ListUnclaimed) // GET /queuedtickets/unclaimed - returns students who haven't claimed their queued ticket for an event, only available to admins
+		r.Patch("/{id}", ctrl.Update)           // PATCH /queuedtickets/{id} - updates a queued ticket, only available to admins
+		r.Delete("/{id}", ctrl.Delete)          // DELETE /queuedtickets/{id} - deletes a queued ticket, only available to admins
+
+		r.Get("/reconciliation", ctrl.GetReconciliation)  // GET /queuedtickets/reconciliation - returns stats from the last reconciliation run, only available to admins
+		r.Post("/reconciliation", ctrl.RunReconciliation) // POST /queuedtickets/reconciliation - runs reconciliation right away, only available to admins
 	})
 
 	return r
@@ -45,18 +59,49 @@ func (ctrl QueuedTicketController) Routes() chi.Router {
 // ListAll fetches all queued tickets that exist.
 //
 //	@Summary		List all queued tickets
-//	@Description	List all queued tickets. Only available to admins.
+//	@Description	List all queued tickets, optionally filtered by event, status or any field in QueuedTicketListSpec. Only pending queued tickets are returned by default. Only available to admins.
 //	@Tags			queuedticket
+//	@Param			eventId	query	string	false	"filter by event ID"
+//	@Param			status	query	string	false	"filter by status (pending, converted, expired or all)"
+//	@Param			limit	query	int		false	"Page size, results are only paginated if this or cursor is given (max 200)"
+//	@Param			cursor	query	string	false	"Cursor from the X-Next-Cursor header of the previous page"
+//	@Param			sort	query	string	false	"Comma separated fields to sort by, prefixed with - for descending"
 //	@Produce		json
 //	@Success		200	{object}	[]models.QueuedTicket
+//	@Header			200	{string}	X-Next-Cursor	"Cursor for the next page, if there is one"
+//	@Header			200	{boolean}	X-Has-More		"Whether there are more results"
+//	@Failure		400
 //	@Failure		403
 //	@Failure		500
 //	@Security		ApiKeyAuth
 //	@Router			/queuedtickets [get]
 func (ctrl QueuedTicketController) ListAll(w http.ResponseWriter, r *http.Request) {
+	// Filter by status, defaulting to only pending ones
+	status := r.URL.Query().Get("status")
+	if status == "" {
+		status = models.QueuedTicketStatusPending
+	}
+	statusFilter, err := models.QueuedTicketStatusFilter(status)
+	if err != nil {
+		render.Render(w, r, util.ErrInvalidRequest(err))
+		return
+	}
+
+	// Filter by event (or any other field) if search query provided
+	filter, page, err := parseListOptions(r, models.QueuedTicketListSpec)
+	if err != nil {
+		render.Render(w, r, util.ErrInvalidRequest(err))
+		return
+	}
+
 	// Try to get tickets
-	queuedTickets, err := models.GetAllQueuedTickets(r.Context())
+	queuedTickets, pageInfo, err := models.GetQueuedTicketsPage(r.Context(), bson.M{"$and": bson.A{statusFilter, filter}}, page)
 	if err != nil {
+		if errors.Is(err, models.ErrInvalidCursor) {
+			render.Render(w, r, util.ErrInvalidRequest(err))
+			return
+		}
+
 		log.Error().Err(err).Msg("could not fetch all queued tickets")
 		render.Render(w, r, util.ErrServer(err))
 		return
@@ -70,6 +115,7 @@ func (ctrl QueuedTicketController) ListAll(w http.ResponseWriter, r *http.Reques
 	}
 
 	// Return as JSON array, fallback if it fails
+	setPageHeaders(w, pageInfo)
 	if err := render.RenderList(w, r, renderers); err != nil {
 		render.Render(w, r, util.ErrRender(err))
 		return
@@ -123,7 +169,7 @@ func (ctrl QueuedTicketController) Create(w http.ResponseWriter, r *http.Request
 	}
 
 	// Validate JSON body
-	validate := validator.New()
+	validate := util.NewValidator()
 	err = validate.Struct(queuedTicketRaw)
 	if err != nil {
 		log.Error().Err(err).Msg("could not validate body")
@@ -133,12 +179,20 @@ func (ctrl QueuedTicketController) Create(w http.ResponseWriter, r *http.Request
 
 	// Confirm that max scan count >= 0 (validator doesn't want to do this for some reason)
 	if queuedTicketRaw.MaxScanCount < 0 {
-		err := fmt.Errorf("max scan count must be greater than or equal to 0")
+		err := util.NewValidationError(nil, util.AppCodeInvalidBody, "maxScanCount", "gte", "max scan count must be greater than or equal to 0")
 		log.Error().Err(err).Msg("invalid max scan count")
 		render.Render(w, r, util.ErrInvalidRequest(err))
 		return
 	}
 
+	// Expiry is optional, but can't already be over
+	if !queuedTicketRaw.ExpiresAt.IsZero() && queuedTicketRaw.ExpiresAt.Before(time.Now()) {
+		err := util.NewValidationError(nil, util.AppCodeInvalidBody, "expiresAt", "future", "expiry timestamp must be in the future")
+		log.Error().Err(err).Time("expiresAt", queuedTicketRaw.ExpiresAt).Msg("invalid expiry timestamp")
+		render.Render(w, r, util.ErrInvalidRequest(err))
+		return
+	}
+
 	// Convert to ObjectID from string
 	eventID, err := primitive.ObjectIDFromHex(queuedTicketRaw.EventID)
 	if err != nil {
@@ -159,40 +213,65 @@ func (ctrl QueuedTicketController) Create(w http.ResponseWriter, r *http.Request
 		return
 	}
 
-	// Try to find the user object associated with student number
-	user, err := models.GetUserByKey(r.Context(), "student_number", queuedTicketRaw.StudentNumber)
+	// Transfer all data from raw to actual ticket
+	queuedTicket.EventID = eventID
+	queuedTicket.MaxScanCount = queuedTicketRaw.MaxScanCount
+	queuedTicket.StudentNumber = queuedTicketRaw.StudentNumber
+	queuedTicket.Email = queuedTicketRaw.Email
+	queuedTicket.ExternalID = queuedTicketRaw.ExternalID
+	if !queuedTicketRaw.ExpiresAt.IsZero() {
+		queuedTicket.ExpiresAt = &queuedTicketRaw.ExpiresAt
+	}
+	queuedTicket.Timestamp = time.Now()
+
+	// Try to find the user object associated with the student number, email or external ID
+	user, err := models.FindUserForMatcher(r.Context(), queuedTicket.Matcher())
 	if err == nil {
-		log.Error().Err(err).Str("id", queuedTicketRaw.StudentNumber).Msg("user already exists, no need to make queued ticket")
+		log.Error().Err(err).Any("matcher", queuedTicket.Matcher()).Msg("user already exists, no need to make queued ticket")
 		render.Render(w, r, util.ErrInvalidRequest(fmt.Errorf("user already exists, no need to make queued ticket")))
 		return
 	} else if err != nil && err != mongo.ErrNoDocuments {
-		log.Error().Err(err).Str("id", queuedTicketRaw.StudentNumber).Msg("could not fetch user data")
+		log.Error().Err(err).Any("matcher", queuedTicket.Matcher()).Msg("could not fetch user data")
 		render.Render(w, r, util.ErrServer(err))
 		return
 	}
 
-	// Transfer all data from raw to actual ticket
-	queuedTicket.EventID = eventID
-	queuedTicket.MaxScanCount = queuedTicketRaw.MaxScanCount
-	queuedTicket.StudentNumber = queuedTicketRaw.StudentNumber
-	queuedTicket.Timestamp = time.Now()
-
 	// Try to add to DB
 	id, err := models.CreateQueuedTicket(r.Context(), queuedTicket)
-	if err != nil {
+	var rosterErr *models.RosterMismatchError
+	if errors.As(err, &rosterErr) {
+		log.Warn().Err(err).Str("studentNumber", queuedTicket.StudentNumber).Msg("student number is not on the roster")
+		render.Render(w, r, util.ErrInvalidRequestWithSuggestions(err, rosterErr.Suggestions))
+		return
+	} else if err != nil {
 		var (
 			renderErr render.Renderer
 			errMsg    string
 		)
 
 		// Customize logged err msg & err sent to user depending on error
-		switch err {
-		case models.ErrAlreadyExists:
+		switch {
+		case errors.Is(err, models.ErrNotEligible):
+			{
+				errMsg = "user is not eligible for the event"
+				renderErr = util.ErrInvalidRequest(err)
+			}
+		case errors.Is(err, models.ErrEditNotAllowed):
+			{
+				errMsg = "auto-numbered custom fields can't be set"
+				renderErr = util.ErrInvalidRequest(err)
+			}
+		case errors.Is(err, models.ErrInvalidCustomFields):
+			{
+				errMsg = "custom fields don't match the event's schema"
+				renderErr = util.ErrInvalidRequest(err)
+			}
+		case err == models.ErrAlreadyExists:
 			{
 				errMsg = "ticket with given event and owner already exists"
 				renderErr = util.ErrConflict(errors.New(errMsg))
 			}
-		case models.ErrNotFound:
+		case err == models.ErrNotFound:
 			{
 				errMsg = "event given was not found"
 				renderErr = util.ErrInvalidRequest(errors.New(errMsg))
@@ -232,6 +311,218 @@ func (ctrl QueuedTicketController) Create(w http.ResponseWriter, r *http.Request
 		Msg("created a new ticket")
 }
 
+// Update updates a queued ticket.
+//
+//	@Summary		Update a queued ticket
+//	@Description	Updates a queued ticket that hasn't been converted yet. If the update changes who it is for or brings it back from being expired, and that person already signed up, the queued ticket is converted right away. Only available to admins.
+//	@Tags			queuedticket
+//	@Accept			json
+//	@Param			id		path	string					true	"Queued ticket ID"
+//	@Param			updates	body	models.QueuedTicket		true	"Updates to make (only student_number, email, external_id, max_scan_count, full_name_update, customFields and expires_at can be changed)"
+//	@Success		200
+//	@Failure		304
+//	@Failure		400
+//	@Failure		403
+//	@Failure		404
+//	@Failure		409
+//	@Failure		500
+//	@Security		ApiKeyAuth
+//	@Router			/queuedtickets/{id} [patch]
+func (ctrl QueuedTicketController) Update(w http.ResponseWriter, r *http.Request) {
+	// Get ID of requested queued ticket
+	id := chi.URLParam(r, "id")
+
+	// Convert to ObjectID
+	objID, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		log.Error().Err(err).Msg("could not convert id to objectid")
+		render.Render(w, r, util.ErrInvalidRequest(err))
+		return
+	}
+
+	// Get JSON body
+	var requestedUpdates map[string]interface{}
+	err = json.NewDecoder(r.Body).Decode(&requestedUpdates)
+	if err != nil {
+		log.Error().Stack().Err(err).Send()
+		render.Render(w, r, util.ErrInvalidRequest(err))
+		return
+	}
+
+	// Try updating the appropriate document
+	convertible, err := models.UpdateExistingQueuedTicketByKeys(r.Context(), objID, requestedUpdates)
+	if err != nil {
+		var (
+			rosterErr     *models.RosterMismatchError
+			validationErr *util.ValidationError
+		)
+		switch {
+		case err == mongo.ErrNoDocuments:
+			render.Render(w, r, util.ErrNotFound)
+		case err == models.ErrNoDocumentModified:
+			render.Render(w, r, util.ErrUnmodified)
+		case err == models.ErrAlreadyExists:
+			render.Render(w, r, util.ErrConflict(fmt.Errorf("queued ticket with given event and student number already exists")))
+		case errors.As(err, &rosterErr):
+			render.Render(w, r, util.ErrInvalidRequestWithSuggestions(err, rosterErr.Suggestions))
+		case errors.As(err, &validationErr):
+			render.Render(w, r, util.ErrInvalidRequest(err))
+		default:
+			log.Error().Err(err).Str("id", id).Msg("could not update queued ticket")
+			render.Render(w, r, util.ErrServer(err))
+		}
+		return
+	}
+
+	// A fixed student number or revived queued ticket might belong to someone who already signed up,
+	// so try converting it now
+	var convertedTicket *models.Ticket
+	if convertible {
+		queuedTicket, err := models.GetQueuedTicket(r.Context(), objID)
+		if err != nil {
+			log.Error().Err(err).Str("id", id).Msg("could not fetch updated queued ticket")
+		} else if queuedTicket.ExpiresAt == nil || queuedTicket.ExpiresAt.After(time.Now()) {
+			ticket, err := models.ConvertQueuedTicketToTicket(r.Context(), queuedTicket, true)
+			if err == nil {
+				convertedTicket = &ticket
+			} else if err != models.ErrNotFound {
+				log.Error().Err(err).Any("queuedTicket", queuedTicket).Msg("could not convert updated queued ticket")
+			}
+		}
+	}
+
+	w.WriteHeader(http.StatusOK)
+
+	// Write audit info log
+	token, err := util.GetUserTokenFromContext(r.Context())
+	requesterUID := ""
+	if err == nil {
+		requesterUID = token.UID
+	}
+	log.Info().
+		Str("type", "audit").
+		Str("controller", "queuedticket").
+		Str("requester_uid", requesterUID).
+		Str("queued_ticket_id", id).
+		Any("requested_updates", requestedUpdates).
+		Any("converted_ticket", convertedTicket).
+		Str("action", "updateQueuedTicket").
+		Bool("privileged", true).
+		Msg("updated queued ticket")
+}
+
+// ListUnclaimed lists the students who still have unclaimed queued tickets for an event.
+//
+//	@Summary		List students with unclaimed queued tickets
+//	@Description	List the students with pending queued tickets for an event, i.e. the ones who still need to sign in to get their ticket. Returns CSV if format=csv. Only available to admins.
+//	@Tags			queuedticket
+//	@Param			eventId	query	string	true	"Event ID"
+//	@Param			format	query	string	false	"json (default) or csv"
+//	@Produce		json
+//	@Produce		text/csv
+//	@Success		200	{object}	[]models.QueuedTicket
+//	@Failure		400
+//	@Failure		403
+//	@Failure		404
+//	@Failure		500
+//	@Security		ApiKeyAuth
+//	@Router			/queuedtickets/unclaimed [get]
+func (ctrl QueuedTicketController) ListUnclaimed(w http.ResponseWriter, r *http.Request) {
+	eventIdRaw := r.URL.Query().Get("eventId")
+	eventID, err := primitive.ObjectIDFromHex(eventIdRaw)
+	if err != nil {
+		log.Error().Err(err).Msg("could not convert event id to object id")
+		render.Render(w, r, util.ErrInvalidRequest(err))
+		return
+	}
+
+	format := r.URL.Query().Get("format")
+	if format != "" && format != "json" && format != "csv" {
+		render.Render(w, r, util.ErrInvalidRequest(fmt.Errorf("unknown format '%s'", format)))
+		return
+	}
+
+	// Check if event exists
+	event, err := models.GetEvent(r.Context(), bson.M{"_id": eventID})
+	if err == mongo.ErrNoDocuments {
+		render.Render(w, r, util.ErrNotFound)
+		return
+	} else if err != nil {
+		log.Error().Err(err).Str("id", eventIdRaw).Msg("could not fetch event data")
+		render.Render(w, r, util.ErrServer(err))
+		return
+	}
+
+	statusFilter, _ := models.QueuedTicketStatusFilter(models.QueuedTicketStatusPending)
+	queuedTickets, err := models.GetQueuedTickets(r.Context(), bson.M{"$and": bson.A{
+		statusFilter,
+		bson.M{"event_id": eventID},
+	}})
+	if err != nil {
+		log.Error().Err(err).Msg("could not fetch unclaimed queued tickets")
+		render.Render(w, r, util.ErrServer(err))
+		return
+	}
+
+	if format == "csv" {
+		w.Header().Set("Content-Type", "text/csv")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"unclaimed-%s.csv\"", eventID.Hex()))
+
+		csvWriter := csv.NewWriter(w)
+		csvWriter.Write([]string{"Student Number", "Email", "External ID", "Full Name", "Event", "Queued At", "Expires At"})
+		for _, queuedTicket := range queuedTickets {
+			expiresAt := ""
+			if queuedTicket.ExpiresAt != nil {
+				expiresAt = queuedTicket.ExpiresAt.Format(time.RFC3339)
+			}
+			csvWriter.Write([]string{
+				queuedTicket.StudentNumber,
+				queuedTicket.Email,
+				queuedTicket.ExternalID,
+				queuedTicket.FullNameUpdate,
+				event.Name,
+				queuedTicket.Timestamp.Format(time.RFC3339),
+				expiresAt,
+			})
+		}
+		csvWriter.Flush()
+		if err := csvWriter.Error(); err != nil {
+			log.Error().Err(err).Msg("could not write unclaimed queued tickets csv")
+			return
+		}
+	} else {
+		// Convert into list of renderers to turn into JSON
+		renderers := []render.Renderer{}
+		for _, queuedTicket := range queuedTickets {
+			t := queuedTicket // Duplicate it before passing by reference to avoid only passing the last obj
+			renderers = append(renderers, &t)
+		}
+
+		// Return as JSON array, fallback if it fails
+		if err := render.RenderList(w, r, renderers); err != nil {
+			render.Render(w, r, util.ErrRender(err))
+			return
+		}
+	}
+
+	// Write audit info log
+	token, err := util.GetUserTokenFromContext(r.Context())
+	requesterUID := ""
+	if err == nil {
+		requesterUID = token.UID
+	}
+	log.Info().
+		Str("type", "audit").
+		Str("controller", "queuedticket").
+		Str("requester_uid", requesterUID).
+		Str("event_id", eventIdRaw).
+		Str("format", format).
+		Int("count", len(queuedTickets)).
+		Str("action", "listUnclaimedQueuedTickets").
+		Bool("privileged", true).
+		Msg("listed unclaimed queued tickets")
+}
+
 // Delete deletes a queued ticket.
 //
 //	@Summary		Delete a queued ticket
@@ -291,3 +582,91 @@ func (ctrl QueuedTicketController) Delete(w http.ResponseWriter, r *http.Request
 		Bool("privileged", true).
 		Msg("deleted queued ticket")
 }
+
+// GetReconciliation returns the stats of the last queued ticket reconciliation run.
+//
+//	@Summary		Get last queued ticket reconciliation stats
+//	@Description	Get the stats from the last run of the background worker that converts and cleans up queued tickets. Only available to admins.
+//	@Tags			queuedticket
+//	@Produce		json
+//	@Success		200	{object}	workers.QueuedTicketReconciliationStats
+//	@Failure		403
+//	@Failure		404
+//	@Security		ApiKeyAuth
+//	@Router			/queuedtickets/reconciliation [get]
+func (ctrl QueuedTicketController) GetReconciliation(w http.ResponseWriter, r *http.Request) {
+	stats, ok := workers.QueuedTicketReconciler.LastRun()
+	if !ok {
+		render.Render(w, r, util.ErrNotFound)
+		return
+	}
+
+	// Return as JSON, fallback if it fails
+	if err := render.Render(w, r, &stats); err != nil {
+		render.Render(w, r, util.ErrRender(err))
+		return
+	}
+
+	// Write audit info log
+	token, err := util.GetUserTokenFromContext(r.Context())
+	requesterUID := ""
+	if err == nil {
+		requesterUID = token.UID
+	}
+	log.Info().
+		Str("type", "audit").
+		Str("controller", "queuedticket").
+		Str("requester_uid", requesterUID).
+		Str("action", "getQueuedTicketReconciliation").
+		Bool("privileged", true).
+		Msg("fetched queued ticket reconciliation stats")
+}
+
+// RunReconciliation runs the queued ticket reconciliation worker immediately.
+//
+//	@Summary		Run queued ticket reconciliation
+//	@Description	Immediately match queued tickets to users, converting them or cleaning them up, instead of waiting for the next scheduled run. Only available to admins.
+//	@Tags			queuedticket
+//	@Produce		json
+//	@Success		200	{object}	workers.QueuedTicketReconciliationStats
+//	@Failure		403
+//	@Failure		409
+//	@Failure		500
+//	@Security		ApiKeyAuth
+//	@Router			/queuedtickets/reconciliation [post]
+func (ctrl QueuedTicketController) RunReconciliation(w http.ResponseWriter, r *http.Request) {
+	// Runs can take a while, so don't leave it half done if the admin's request goes away
+	ctx, cancel := context.WithTimeout(context.Background(), manualReconciliationTimeout)
+	defer cancel()
+
+	stats, err := workers.QueuedTicketReconciler.RunOnce(ctx)
+	if err == workers.ErrReconciliationInProgress {
+		render.Render(w, r, util.ErrConflict(err))
+		return
+	} else if err != nil {
+		log.Error().Err(err).Msg("could not run queued ticket reconciliation")
+		render.Render(w, r, util.ErrServer(err))
+		return
+	}
+
+	// Return as JSON, fallback if it fails
+	if err := render.Render(w, r, &stats); err != nil {
+		render.Render(w, r, util.ErrRender(err))
+		return
+	}
+
+	// Write audit info log
+	token, err := util.GetUserTokenFromContext(r.Context())
+	requesterUID := ""
+	if err == nil {
+		requesterUID = token.UID
+	}
+	log.Info().
+		Str("type", "audit").
+		Str("controller", "queuedticket").
+		Str("requester_uid", requesterUID).
+		Any("stats", stats).
+		Str("action", "runQueuedTicketReconciliation").
+		Bool("privileged", true).
+		Msg("ran queued ticket reconciliation")
+}
@@ -0,0 +1,266 @@
+package controllers
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/aritrosaha10/frasertickets/middleware"
+	"github.com/aritrosaha10/frasertickets/models"
+	"github.com/aritrosaha10/frasertickets/util"
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/render"
+	"github.com/rs/zerolog/log"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+type RosterController struct{}
+
+func (ctrl RosterController) Routes() chi.Router {
+	r := chi.NewRouter()
+	r.Use(middleware.AuthenticatorMiddleware) // User must be authenticated before using any of these endpoints
+
+	// Admin-only routes
+	r.Group(func(r chi.Router) {
+		r.Use(middleware.AdminAuthorizerMiddleware)
+		r.Get("/", ctrl.List)                             // GET /roster - returns the student directory, only available to admins
+		r.Post("/import", ctrl.Import)                    // POST /roster/import - imports the roster from a CSV, only available to admins
+		r.Get("/validate/{studentNumber}", ctrl.Validate) // GET /roster/validate/{studentNumber} - checks a student number and suggests corrections, only available to admins
+		r.Get("/{studentNumber}", ctrl.Get)               // GET /roster/{studentNumber} - returns a single student, only available to admins
+	})
+
+	return r
+}
+
+// List returns students on the roster.
+//
+//	@Summary		List students on the roster
+//	@Description	Lists students on the roster, sorted by legal name. Only available to admins.
+//	@Tags			roster
+//	@Produce		json
+//	@Param			q			query		string	false	"Partial legal name or student number prefix"
+//	@Param			grade		query		int		false	"Grade to filter by"
+//	@Param			homeroom	query		string	false	"Homeroom to filter by"
+//	@Param			active		query		bool	false	"Whether to only show active or inactive students"
+//	@Success		200			{object}	[]models.RosterEntry
+//	@Failure		400
+//	@Failure		500
+//	@Security		ApiKeyAuth
+//	@Router			/roster [get]
+func (ctrl RosterController) List(w http.ResponseWriter, r *http.Request) {
+	filter := models.RosterFilter{
+		Query:    r.URL.Query().Get("q"),
+		Homeroom: r.URL.Query().Get("homeroom"),
+	}
+	if gradeRaw := r.URL.Query().Get("grade"); gradeRaw != "" {
+		grade, err := strconv.Atoi(gradeRaw)
+		if err != nil {
+			render.Render(w, r, util.ErrInvalidRequest(fmt.Errorf("grade must be a number")))
+			return
+		}
+		filter.Grade = grade
+	}
+	if activeRaw := r.URL.Query().Get("active"); activeRaw != "" {
+		active, err := strconv.ParseBool(activeRaw)
+		if err != nil {
+			render.Render(w, r, util.ErrInvalidRequest(fmt.Errorf("active must be true or false")))
+			return
+		}
+		filter.Active = &active
+	}
+
+	entries, err := models.GetRosterEntries(r.Context(), filter)
+	if err != nil {
+		log.Error().Err(err).Msg("could not fetch roster")
+		render.Render(w, r, util.ErrServer(err))
+		return
+	}
+
+	// Convert into list of renderers to turn into JSON
+	list := []render.Renderer{}
+	for _, entry := range entries {
+		e := entry // Duplicate it before passing by reference to avoid only passing the last entry
+		list = append(list, &e)
+	}
+
+	// Return as JSON array, fallback if it fails
+	if err := render.RenderList(w, r, list); err != nil {
+		render.Render(w, r, util.ErrRender(err))
+		return
+	}
+
+	// Write audit info log
+	token, err := util.GetUserTokenFromContext(r.Context())
+	requesterUID := ""
+	if err == nil {
+		requesterUID = token.UID
+	}
+	log.Info().
+		Str("type", "audit").
+		Str("controller", "roster").
+		Str("requester_uid", requesterUID).
+		Any("filter", filter).
+		Str("action", "listRoster").
+		Bool("privileged", true).
+		Msg("fetched roster")
+}
+
+// Get returns a single student on the roster.
+//
+//	@Summary		Get a student on the roster
+//	@Description	Get a student on the roster by their student number. Only available to admins.
+//	@Tags			roster
+//	@Produce		json
+//	@Param			studentNumber	path		string	true	"Student number"
+//	@Success		200				{object}	models.RosterEntry
+//	@Failure		404
+//	@Failure		500
+//	@Security		ApiKeyAuth
+//	@Router			/roster/{studentNumber} [get]
+func (ctrl RosterController) Get(w http.ResponseWriter, r *http.Request) {
+	studentNumber := chi.URLParam(r, "studentNumber")
+
+	entry, err := models.GetRosterEntry(r.Context(), studentNumber)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			render.Render(w, r, util.ErrNotFound)
+			return
+		}
+
+		log.Error().Err(err).Str("studentNumber", studentNumber).Msg("could not fetch roster entry")
+		render.Render(w, r, util.ErrServer(err))
+		return
+	}
+
+	// Return as JSON, fallback if it fails
+	if err := render.Render(w, r, &entry); err != nil {
+		render.Render(w, r, util.ErrRender(err))
+		return
+	}
+
+	// Write audit info log
+	token, err := util.GetUserTokenFromContext(r.Context())
+	requesterUID := ""
+	if err == nil {
+		requesterUID = token.UID
+	}
+	log.Info().
+		Str("type", "audit").
+		Str("controller", "roster").
+		Str("requester_uid", requesterUID).
+		Str("student_number", studentNumber).
+		Str("action", "getRosterEntry").
+		Bool("privileged", true).
+		Msg("fetched roster entry")
+}
+
+// Validate checks whether a student number is on the roster.
+//
+//	@Summary		Validate a student number
+//	@Description	Checks whether a student number belongs to an active student on the roster, suggesting close matches if it doesn't. Only available to admins.
+//	@Tags			roster
+//	@Produce		json
+//	@Param			studentNumber	path	string	true	"Student number"
+//	@Success		200
+//	@Failure		400
+//	@Failure		500
+//	@Security		ApiKeyAuth
+//	@Router			/roster/validate/{studentNumber} [get]
+func (ctrl RosterController) Validate(w http.ResponseWriter, r *http.Request) {
+	studentNumber := chi.URLParam(r, "studentNumber")
+
+	err := models.ValidateStudentNumber(r.Context(), studentNumber)
+	var rosterErr *models.RosterMismatchError
+	if errors.As(err, &rosterErr) {
+		render.Render(w, r, util.ErrInvalidRequestWithSuggestions(err, rosterErr.Suggestions))
+		return
+	} else if err != nil {
+		log.Error().Err(err).Str("studentNumber", studentNumber).Msg("could not validate student number against roster")
+		render.Render(w, r, util.ErrServer(err))
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// Import imports the roster from a CSV.
+//
+//	@Summary		Import the roster
+//	@Description	Imports students from a CSV with student_number, legal_name and optionally grade, homeroom and active columns. Existing students are updated by student number, leaving their grade and homeroom alone if those columns are missing. Only available to admins.
+//	@Tags			roster
+//	@Accept			multipart/form-data
+//	@Produce		json
+//	@Param			roster				formData	file	true	"Roster CSV"
+//	@Param			deactivateMissing	query		bool	false	"Mark students missing from the CSV as inactive"
+//	@Success		200					{object}	models.RosterImportResult
+//	@Failure		400
+//	@Failure		500
+//	@Security		ApiKeyAuth
+//	@Router			/roster/import [post]
+func (ctrl RosterController) Import(w http.ResponseWriter, r *http.Request) {
+	deactivateMissing := false
+	if deactivateMissingRaw := r.URL.Query().Get("deactivateMissing"); deactivateMissingRaw != "" {
+		var err error
+		deactivateMissing, err = strconv.ParseBool(deactivateMissingRaw)
+		if err != nil {
+			render.Render(w, r, util.ErrInvalidRequest(fmt.Errorf("deactivateMissing must be true or false")))
+			return
+		}
+	}
+
+	err := r.ParseMultipartForm(10 << 20) // 10 MB
+	if err != nil {
+		render.Render(w, r, util.ErrInvalidRequest(fmt.Errorf("raw form data is invalid")))
+		return
+	}
+
+	fileHeaders := r.MultipartForm.File["roster"]
+	if len(fileHeaders) != 1 {
+		render.Render(w, r, util.ErrInvalidRequest(fmt.Errorf("more/less than 1 roster provided")))
+		return
+	}
+
+	file, err := fileHeaders[0].Open()
+	if err != nil {
+		render.Render(w, r, util.ErrInvalidRequest(errors.Join(fmt.Errorf("could not open provided roster"), err)))
+		return
+	}
+	defer file.Close()
+
+	entries, columns, err := models.ParseRosterCSV(file)
+	if err != nil {
+		render.Render(w, r, util.ErrInvalidRequest(err))
+		return
+	}
+
+	token, err := util.GetUserTokenFromContext(r.Context())
+	requesterUID := ""
+	if err == nil {
+		requesterUID = token.UID
+	}
+
+	result, err := models.ImportRoster(r.Context(), entries, columns, deactivateMissing, requesterUID)
+	if err != nil {
+		log.Error().Err(err).Msg("could not import roster")
+		render.Render(w, r, util.ErrServer(err))
+		return
+	}
+
+	// Return as JSON, fallback if it fails
+	if err := render.Render(w, r, &result); err != nil {
+		render.Render(w, r, util.ErrRender(err))
+		return
+	}
+
+	// Write audit info log
+	log.Info().
+		Str("type", "audit").
+		Str("controller", "roster").
+		Str("requester_uid", requesterUID).
+		Any("result", result).
+		Bool("deactivate_missing", deactivateMissing).
+		Str("action", "importRoster").
+		Bool("privileged", true).
+		Msg("imported roster")
+}
@@ -1,18 +1,21 @@
 package controllers
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"net/http"
+	"sort"
 	"time"
 
+	"firebase.google.com/go/auth"
+	"github.com/aritrosaha10/frasertickets/lib"
 	"github.com/aritrosaha10/frasertickets/middleware"
 	"github.com/aritrosaha10/frasertickets/models"
 	"github.com/aritrosaha10/frasertickets/util"
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/render"
-	"github.com/go-playground/validator/v10"
 	"github.com/rs/zerolog/log"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
@@ -40,6 +43,64 @@ type ticketControllerUpdateRequestBody struct {
 	CustomFields map[string]interface{} `json:"customFields"`
 }
 
+type ticketControllerBulkUpdateItem struct {
+	ID           string                 `json:"id" validate:"required,mongodb"`
+	MaxScanCount int                    `json:"maxScanCount"`
+	CustomFields map[string]interface{} `json:"customFields"`
+	Version      *int                   `json:"version"` // optional, only update if the ticket is still at this version
+}
+
+type ticketControllerBulkRequestBody struct {
+	Create []ticketControllerCreateRequestBody `json:"create" validate:"dive"`
+	Update []ticketControllerBulkUpdateItem    `json:"update" validate:"dive"`
+	Delete []string                            `json:"delete" validate:"dive,mongodb"`
+	Atomic bool                                `json:"atomic"` // if true, either every operation succeeds or none are saved
+}
+
+// Maximum number of operations (creates + updates + deletes) allowed in one bulk request
+const maxBulkTicketOperations = 500
+
+// Returned from a bulk transaction to make the driver abort it
+var errBulkTicketAborted = errors.New("bulk ticket operation failed, aborting transaction")
+
+// bulkTicketError is why a single bulk ticket operation failed, along with the app code to report.
+type bulkTicketError struct {
+	appCode int64
+	err     error
+}
+
+func (e *bulkTicketError) Error() string {
+	return e.err.Error()
+}
+
+func (e *bulkTicketError) Unwrap() error {
+	return e.err
+}
+
+func newBulkTicketError(appCode int64, format string, args ...interface{}) error {
+	return &bulkTicketError{appCode: appCode, err: fmt.Errorf(format, args...)}
+}
+
+// bulkTicketErrorCode picks the app code and field details that a failed bulk operation is
+// reported with, the same way they'd be reported for a single request.
+func bulkTicketErrorCode(err error) (int64, []util.ErrDetail) {
+	var (
+		bulkErr       *bulkTicketError
+		validationErr *util.ValidationError
+		rosterErr     *models.RosterMismatchError
+	)
+	switch {
+	case errors.As(err, &bulkErr):
+		return bulkErr.appCode, nil
+	case errors.As(err, &validationErr):
+		return validationErr.AppCode, validationErr.Details
+	case errors.As(err, &rosterErr):
+		return util.AppCodeNotOnRoster, []util.ErrDetail{{Field: "studentNumber", Rule: "roster", Message: rosterErr.Error()}}
+	default:
+		return util.AppCodeServer, nil
+	}
+}
+
 type TicketController struct{}
 
 func (ctrl TicketController) Routes() chi.Router {
@@ -55,6 +116,7 @@ func (ctrl TicketController) Routes() chi.Router {
 		r.Get("/all", ctrl.ListAll)    // GET /tickets/all - returns all tickets, only available to admins
 		r.Post("/search", ctrl.Search) // POST /tickets/search - search for a ticket given an owner and event, only available to admins
 		r.Post("/scan", ctrl.Scan)     // POST /tickets/scan - scan a ticket, only available to admins
+		r.Post("/bulk", ctrl.Bulk)     // POST /tickets/bulk - create, update & delete many tickets at once, only available to admins
 	})
 
 	r.Route("/user/{uid}", func(r chi.Router) {
@@ -63,13 +125,16 @@ func (ctrl TicketController) Routes() chi.Router {
 	})
 
 	r.Route("/{id}", func(r chi.Router) {
-		r.Get("/", ctrl.Get) // GET /tickets/{id} - returns ticket data, available to admins & ticket owner
+		r.Get("/", ctrl.Get)                            // GET /tickets/{id} - returns ticket data, available to admins & ticket owner
+		r.Get("/wallet", ctrl.GetWalletPass)            // GET /tickets/{id}/wallet - returns a save to google wallet link, available to admins & ticket owner
+		r.Patch("/custom-fields", ctrl.UpdateOwnFields) // PATCH /tickets/{id}/custom-fields - update owner editable custom fields, available to ticket owner
 
 		// Admin-only routes
 		r.Group(func(r chi.Router) {
 			r.Use(middleware.AdminAuthorizerMiddleware)
-			r.Patch("/", ctrl.Update)  // PATCH /tickets/{id} - update ticket, only available to admins
-			r.Delete("/", ctrl.Delete) // DELETE /tickets/{id} - delete ticket, only available to admins
+			r.Patch("/", ctrl.Update)          // PATCH /tickets/{id} - update ticket, only available to admins
+			r.Delete("/", ctrl.Delete)         // DELETE /tickets/{id} - delete ticket, only available to admins
+			r.Get("/history", ctrl.GetHistory) // GET /tickets/{id}/history - lists every change made to the ticket, only available to admins
 		})
 	})
 
@@ -128,6 +193,11 @@ func (ctrl TicketController) ListSelf(w http.ResponseWriter, r *http.Request) {
 	for _, ticket := range tickets {
 		t := ticket // Duplicate it before passing by reference to avoid only passing the last user obj
 
+		// Tickets for draft events stay hidden until the event is published
+		if !isAdmin && t.EventData.Draft {
+			continue
+		}
+
 		if !isAdmin {
 			// Remove any sensitive custom data fields before handing it to user
 			customDataSchema, err := util.ConvertRawCustomFieldsSchema(t.EventData.RawCustomFieldsSchema)
@@ -233,30 +303,37 @@ func (ctrl TicketController) ListUser(w http.ResponseWriter, r *http.Request) {
 // ListAll fetches all tickets that exist.
 //
 //	@Summary		List all tickets
-//	@Description	List all tickets. Only available to admins.
+//	@Description	List all tickets. Tickets can also be filtered by any field in TicketListSpec (ex. scanCount[gte]=1) or custom field (ex. customFields.table=4). Only available to admins.
 //	@Tags			ticket
 //	@Param          eventId	query string false "filter by event ID"
+//	@Param			limit	query	int		false	"Page size, results are only paginated if this or cursor is given (max 200)"
+//	@Param			cursor	query	string	false	"Cursor from the X-Next-Cursor header of the previous page"
+//	@Param			sort	query	string	false	"Comma separated fields to sort by, prefixed with - for descending"
 //	@Produce		json
 //	@Success		200	{object}	[]models.Ticket
+//	@Header			200	{string}	X-Next-Cursor	"Cursor for the next page, if there is one"
+//	@Header			200	{boolean}	X-Has-More		"Whether there are more results"
+//	@Failure		400
 //	@Failure		403
 //	@Failure		500
 //	@Security		ApiKeyAuth
 //	@Router			/tickets/all [get]
 func (ctrl TicketController) ListAll(w http.ResponseWriter, r *http.Request) {
-	// Filter by event if search query provided
-	eventIdRaw := r.URL.Query().Get("eventId")
-	filter := bson.M{}
-
-	if eventIdRaw != "" {
-		eventId, err := primitive.ObjectIDFromHex(eventIdRaw)
-		if err == nil {
-			filter["event"] = eventId
-		}
+	// Filter by event (or any other field) if search query provided
+	filter, page, err := parseListOptions(r, models.TicketListSpec)
+	if err != nil {
+		render.Render(w, r, util.ErrInvalidRequest(err))
+		return
 	}
 
 	// Try to get tickets
-	tickets, err := models.GetTickets(r.Context(), filter)
+	tickets, pageInfo, err := models.GetTicketsPage(r.Context(), filter, page)
 	if err != nil {
+		if errors.Is(err, models.ErrInvalidCursor) {
+			render.Render(w, r, util.ErrInvalidRequest(err))
+			return
+		}
+
 		log.Error().Err(err).Msg("could not fetch all tickets")
 		render.Render(w, r, util.ErrServer(err))
 		return
@@ -270,6 +347,7 @@ func (ctrl TicketController) ListAll(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Return as JSON array, fallback if it fails
+	setPageHeaders(w, pageInfo)
 	if err := render.RenderList(w, r, renderers); err != nil {
 		render.Render(w, r, util.ErrRender(err))
 		return
@@ -323,7 +401,7 @@ func (ctrl TicketController) Create(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Validate JSON body
-	validate := validator.New()
+	validate := util.NewValidator()
 	err = validate.Struct(ticketRaw)
 	if err != nil {
 		log.Error().Err(err).Msg("could not validate body")
@@ -333,7 +411,7 @@ func (ctrl TicketController) Create(w http.ResponseWriter, r *http.Request) {
 
 	// Confirm that max scan count >= 0 (validator doesn't want to do this for some reason)
 	if ticketRaw.MaxScanCount < 0 {
-		err := fmt.Errorf("max scan count must be greater than or equal to 0")
+		err := util.NewValidationError(nil, util.AppCodeInvalidBody, "maxScanCount", "gte", "max scan count must be greater than or equal to 0")
 		log.Error().Err(err).Msg("invalid max scan count")
 		render.Render(w, r, util.ErrInvalidRequest(err))
 		return
@@ -359,6 +437,19 @@ func (ctrl TicketController) Create(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Make sure the student number is real before looking for the user
+	err = models.ValidateStudentNumber(r.Context(), ticketRaw.StudentNumber)
+	var rosterErr *models.RosterMismatchError
+	if errors.As(err, &rosterErr) {
+		log.Warn().Err(err).Str("id", ticketRaw.StudentNumber).Msg("student number is not on the roster")
+		render.Render(w, r, util.ErrInvalidRequestWithSuggestions(err, rosterErr.Suggestions))
+		return
+	} else if err != nil {
+		log.Error().Err(err).Str("id", ticketRaw.StudentNumber).Msg("could not validate student number against roster")
+		render.Render(w, r, util.ErrServer(err))
+		return
+	}
+
 	// Try to find the user object associated with student number
 	user, err := models.GetUserByKey(r.Context(), "student_number", ticketRaw.StudentNumber)
 	if err == mongo.ErrNoDocuments {
@@ -398,13 +489,28 @@ func (ctrl TicketController) Create(w http.ResponseWriter, r *http.Request) {
 		)
 
 		// Customize logged err msg & err sent to user depending on error
-		switch err {
-		case models.ErrAlreadyExists:
+		switch {
+		case errors.Is(err, models.ErrNotEligible):
+			{
+				errMsg = "user is not eligible for the event"
+				renderErr = util.ErrInvalidRequest(err)
+			}
+		case errors.Is(err, models.ErrEditNotAllowed):
+			{
+				errMsg = "auto-numbered custom fields can't be set"
+				renderErr = util.ErrInvalidRequest(err)
+			}
+		case errors.Is(err, models.ErrInvalidCustomFields):
+			{
+				errMsg = "custom fields don't match the event's schema"
+				renderErr = util.ErrInvalidRequest(err)
+			}
+		case err == models.ErrAlreadyExists:
 			{
 				errMsg = "ticket with given event and owner ID already exists"
 				renderErr = util.ErrConflict(errors.New(errMsg))
 			}
-		case models.ErrNotFound:
+		case err == models.ErrNotFound:
 			{
 				errMsg = "event or user given was not found"
 				renderErr = util.ErrInvalidRequest(errors.New(errMsg))
@@ -503,6 +609,12 @@ func (ctrl TicketController) Get(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Tickets for draft events stay hidden until the event is published
+	if !isAdmin && ticket.EventData.Draft {
+		render.Render(w, r, util.ErrNotFound)
+		return
+	}
+
 	// Remove any sensitive custom data fields before handing it to user if they aren't admin
 	if !isAdmin {
 		customDataSchema, err := util.ConvertRawCustomFieldsSchema(ticket.EventData.RawCustomFieldsSchema)
@@ -519,6 +631,7 @@ func (ctrl TicketController) Get(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Return as JSON, fallback if it fails
+	w.Header().Set("ETag", util.ETag(ticket.Version))
 	if err := render.Render(w, r, &ticket); err != nil {
 		render.Render(w, r, util.ErrRender(err))
 		return
@@ -540,6 +653,103 @@ func (ctrl TicketController) Get(w http.ResponseWriter, r *http.Request) {
 		Msg("fetched ticket")
 }
 
+// GetWalletPass returns a link to save a ticket to Google Wallet.
+//
+//	@Summary		Get Google Wallet link for ticket
+//	@Description	Creates or updates the ticket's Google Wallet pass, and returns a link for the owner to save it to their wallet. Available to admins and the ticket owner.
+//	@Tags			ticket
+//	@Produce		json
+//	@Param			id	path		string	true	"Ticket ID"
+//	@Success		200	{object}	models.WalletPass
+//	@Failure		400
+//	@Failure		403
+//	@Failure		404
+//	@Failure		500
+//	@Failure		502
+//	@Failure		503
+//	@Security		ApiKeyAuth
+//	@Router			/tickets/{id}/wallet [get]
+func (ctrl TicketController) GetWalletPass(w http.ResponseWriter, r *http.Request) {
+	// Get ID of requested ticket
+	id := chi.URLParam(r, "id")
+
+	// Try to convert the given ID into an Object ID
+	objID, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		log.Error().Err(err).Msg("could not convert url param to object id")
+		render.Render(w, r, util.ErrInvalidRequest(err))
+		return
+	}
+
+	// Try to fetch from DB
+	ticket, err := models.GetTicket(r.Context(), objID)
+	if err == mongo.ErrNoDocuments {
+		render.Render(w, r, util.ErrNotFound)
+		return
+	} else if err != nil {
+		log.Error().Err(err).Msg("could not find ticket")
+		render.Render(w, r, util.ErrServer(err))
+		return
+	}
+
+	// Check if they are authorized to use endpoint (admin or ticket owner)
+	isAdmin, err := util.CheckIfAdmin(r.Context())
+	if err != nil {
+		log.Error().Err(err).Msg("could not check if requester is admin")
+		render.Render(w, r, util.ErrServer(err))
+		return
+	}
+	idToken, _ := util.GetUserTokenFromContext(r.Context()) // Not error-checking because this gets fetched in admin check
+	if !(isAdmin || ticket.Owner == idToken.UID) {
+		log.Warn().Str("uid", idToken.UID).Msg("unauthorized user attempting to get another person's wallet pass")
+		render.Render(w, r, util.ErrForbidden)
+		return
+	}
+	if !isAdmin && ticket.EventData.Draft {
+		render.Render(w, r, util.ErrNotFound)
+		return
+	}
+
+	pass, err := models.IssueWalletPass(r.Context(), ticket)
+	var walletErr *lib.WalletAPIError
+	if err == models.ErrWalletDisabled {
+		render.Render(w, r, util.ErrUnavailable)
+		return
+	} else if errors.As(err, &walletErr) {
+		// The response body can have details about our setup, so it's only logged
+		log.Error().Int("status", walletErr.StatusCode).Str("body", walletErr.Body).Str("ticket_id", id).Msg("google wallet rejected pass")
+		render.Render(w, r, &util.ErrResponse{
+			Err:            err,
+			HTTPStatusCode: http.StatusBadGateway,
+			StatusText:     "Could not create wallet pass.",
+			AppCode:        util.AppCodeServer,
+			ErrorText:      "google wallet could not create the pass",
+		})
+		return
+	} else if err != nil {
+		log.Error().Err(err).Str("ticket_id", id).Msg("could not issue wallet pass")
+		render.Render(w, r, util.ErrServer(err))
+		return
+	}
+
+	// Return as JSON, fallback if it fails
+	if err := render.Render(w, r, &pass); err != nil {
+		render.Render(w, r, util.ErrRender(err))
+		return
+	}
+
+	// Write audit info log
+	log.Info().
+		Str("type", "audit").
+		Str("controller", "ticket").
+		Str("requester_uid", idToken.UID).
+		Str("ticket_id", ticket.ID.Hex()).
+		Str("wallet_object_id", pass.ObjectID).
+		Str("action", "getTicketWalletPass").
+		Bool("privileged", idToken.UID != ticket.Owner).
+		Msg("issued wallet pass for ticket")
+}
+
 // Search gets a ticket based on its owner and an event.
 //
 //	@Summary		Search for ticket using owner and event
@@ -568,7 +778,7 @@ func (ctrl TicketController) Search(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Validate JSON body
-	validate := validator.New()
+	validate := util.NewValidator()
 	err = validate.Struct(searchQuery)
 	if err != nil {
 		log.Error().Err(err).Msg("could not validate body")
@@ -646,6 +856,7 @@ func (ctrl TicketController) Search(w http.ResponseWriter, r *http.Request) {
 //	@Success		200	{object}	models.TicketScan
 //	@Failure		403
 //	@Failure		404
+//	@Failure		409
 //	@Failure		500
 //	@Security		ApiKeyAuth
 //	@Router			/tickets/scan [post]
@@ -663,7 +874,7 @@ func (ctrl TicketController) Scan(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Validate JSON body
-	validate := validator.New()
+	validate := util.NewValidator()
 	err = validate.Struct(searchQuery)
 	if err != nil {
 		log.Error().Err(err).Msg("could not validate body")
@@ -679,51 +890,28 @@ func (ctrl TicketController) Scan(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Try to fetch from DB
-	ticket, err := models.GetTicket(r.Context(), ticketID)
-
-	// Handle errors
-	if err != nil {
-		if err == mongo.ErrNoDocuments {
-			render.Render(w, r, util.ErrNotFound)
-			return
-		}
-
-		log.Error().Err(err).Msg("could not find ticket")
-		render.Render(w, r, util.ErrServer(err))
-		return
+	// Record the scan, unless the ticket has been used up
+	scannerUID := ""
+	if token, err := util.GetUserTokenFromContext(r.Context()); err == nil {
+		scannerUID = token.UID
 	}
-
-	// Get user associated with ticket
-	ticketOwner, err := models.GetUserByKey(r.Context(), "_id", ticket.Owner)
-	// Handle errors
-	if err != nil {
-		log.Error().Err(err).Msg("could not find user associated with ticket")
+	scanData, err := models.ScanTicket(r.Context(), ticketID, scannerUID)
+	if err == mongo.ErrNoDocuments {
+		render.Render(w, r, util.ErrNotFound)
+		return
+	} else if err == models.ErrVersionMismatch {
+		log.Warn().Str("id", searchQuery.TicketID).Msg("ticket kept changing while it was being scanned")
+		render.Render(w, r, util.ErrConflict(errors.New("ticket is being scanned somewhere else, try again")))
+		return
+	} else if err != nil {
+		log.Error().Err(err).Msg("could not scan ticket")
 		render.Render(w, r, util.ErrServer(err))
 		return
 	}
 
-	// Create scan info obj to return
-	scanData := models.TicketScan{
-		Index:           ticket.ScanCount + 1,
-		Timestamp:       time.Now(),
-		TicketData:      ticket,
-		UserData:        ticketOwner,
-		Processed:       true,
-		NoProcessReason: "",
-	}
-
-	// Check if max scan count has been exceeded
-	// Max scan count of 0 means unlimited
-	if scanData.Index > ticket.MaxScanCount && ticket.MaxScanCount != 0 {
+	if !scanData.Processed {
 		log.Warn().Msg("could not scan ticket since max scan count exceeded")
 
-		// Reset scan data to show previous scan
-		scanData.Index = ticket.ScanCount
-		scanData.Timestamp = ticket.LastScanTimestamp
-		scanData.Processed = false
-		scanData.NoProcessReason = "max scan count exceeded"
-
 		// Return as JSON, fallback if it fails
 		if err := render.Render(w, r, &scanData); err != nil {
 			render.Render(w, r, util.ErrRender(err))
@@ -731,15 +919,10 @@ func (ctrl TicketController) Scan(w http.ResponseWriter, r *http.Request) {
 		}
 
 		// Write audit info log
-		token, err := util.GetUserTokenFromContext(r.Context())
-		requesterUID := ""
-		if err == nil {
-			requesterUID = token.UID
-		}
 		log.Info().
 			Str("type", "audit").
 			Str("controller", "ticket").
-			Str("requester_uid", requesterUID).
+			Str("requester_uid", scannerUID).
 			Str("ticket_id", searchQuery.TicketID).
 			Any("scan_data", scanData).
 			Str("action", "scanTicket").
@@ -749,20 +932,6 @@ func (ctrl TicketController) Scan(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Update ticket info with new scan data
-	ticket.ScanCount = scanData.Index
-	ticket.LastScanTimestamp = scanData.Timestamp
-	err = models.UpdateExistingTicketByKeys(r.Context(), ticket.ID, map[string]interface{}{
-		"lastScanTime": scanData.Timestamp,
-		"scanCount":    scanData.Index,
-	})
-	// Handle errors
-	if err != nil {
-		log.Error().Err(err).Msg("could not update ticket with new info")
-		render.Render(w, r, util.ErrServer(err))
-		return
-	}
-
 	// Return as JSON, fallback if it fails
 	if err := render.Render(w, r, &scanData); err != nil {
 		render.Render(w, r, util.ErrRender(err))
@@ -770,15 +939,10 @@ func (ctrl TicketController) Scan(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Write audit info log
-	token, err := util.GetUserTokenFromContext(r.Context())
-	requesterUID := ""
-	if err == nil {
-		requesterUID = token.UID
-	}
 	log.Info().
 		Str("type", "audit").
 		Str("controller", "ticket").
-		Str("requester_uid", requesterUID).
+		Str("requester_uid", scannerUID).
 		Str("ticket_id", searchQuery.TicketID).
 		Any("scan_data", scanData).
 		Str("action", "scanTicket").
@@ -793,10 +957,12 @@ func (ctrl TicketController) Scan(w http.ResponseWriter, r *http.Request) {
 //	@Tags			ticket
 //	@Accept			json
 //	@Param			id	path		string	true	"Ticket ID"
+//	@Param			If-Match	header	string	false	"ETag of the version last fetched, fails with 412 if it was changed since"
 //	@Success		200
 //	@Failure		400
 //	@Failure		403
 //	@Failure		404
+//	@Failure		412
 //	@Failure		500
 //	@Security		ApiKeyAuth
 //	@Router			/tickets/{id} [patch]
@@ -817,7 +983,7 @@ func (ctrl TicketController) Update(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Validate JSON body
-	validate := validator.New()
+	validate := util.NewValidator()
 	err = validate.Struct(updateReq)
 	if err != nil {
 		log.Error().Err(err).Msg("could not validate body")
@@ -862,21 +1028,44 @@ func (ctrl TicketController) Update(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	err = models.UpdateExistingTicketByKeys(r.Context(), objID, updateBody)
+	// Only overwrite the version the requester last saw, if they told us which one that was
+	expectedVersion, err := util.IfMatchVersion(r)
 	if err != nil {
+		render.Render(w, r, util.ErrInvalidRequest(err))
+		return
+	}
+	token, err := util.GetUserTokenFromContext(r.Context())
+	requesterUID := ""
+	if err == nil {
+		requesterUID = token.UID
+	}
+
+	version, err := models.UpdateExistingTicketByKeys(r.Context(), objID, updateBody, models.UpdateMeta{
+		ChangedBy:       requesterUID,
+		ExpectedVersion: expectedVersion,
+	})
+	switch {
+	case err == nil:
+	case errors.Is(err, models.ErrEditNotAllowed), errors.Is(err, models.ErrInvalidCustomFields):
+		log.Warn().Err(err).Msg("ticket update is invalid")
+		render.Render(w, r, util.ErrInvalidRequest(err))
+		return
+	case err == models.ErrVersionMismatch:
+		render.Render(w, r, util.ErrPreconditionFailed(err))
+		return
+	case err == models.ErrNoDocumentModified:
+		render.Render(w, r, util.ErrUnmodified)
+		return
+	default:
 		log.Error().Err(err).Msg("could not update ticket")
 		render.Render(w, r, util.ErrServer(err))
 		return
 	}
 
+	w.Header().Set("ETag", util.ETag(version))
 	w.WriteHeader(http.StatusOK)
 
 	// Write audit info log
-	token, err := util.GetUserTokenFromContext(r.Context())
-	requesterUID := ""
-	if err == nil {
-		requesterUID = token.UID
-	}
 	log.Info().
 		Str("type", "audit").
 		Str("controller", "ticket").
@@ -888,10 +1077,141 @@ func (ctrl TicketController) Update(w http.ResponseWriter, r *http.Request) {
 		Msg("updated ticket")
 }
 
+// UpdateOwnFields lets a ticket owner change their own owner-editable custom fields.
+//
+//	@Summary		Update own ticket's custom fields
+//	@Description	Updates the custom fields of a ticket marked as owner editable, until the event's owner edit cutoff (or its start if there is none). Only available to the ticket owner.
+//	@Tags			ticket
+//	@Accept			json
+//	@Produce		json
+//	@Param			id		path		string					true	"Ticket ID"
+//	@Param			fields	body		map[string]interface{}	true	"Custom field values to change"
+//	@Param			If-Match	header	string	false	"ETag of the version last fetched, fails with 412 if it was changed since"
+//	@Success		200		{object}	models.Ticket
+//	@Failure		304
+//	@Failure		400
+//	@Failure		404
+//	@Failure		412
+//	@Failure		500
+//	@Security		ApiKeyAuth
+//	@Router			/tickets/{id}/custom-fields [patch]
+func (ctrl TicketController) UpdateOwnFields(w http.ResponseWriter, r *http.Request) {
+	// Get ID of requested ticket
+	id := chi.URLParam(r, "id")
+	objID, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		log.Error().Err(err).Msg("could not convert url param to object id")
+		render.Render(w, r, util.ErrInvalidRequest(err))
+		return
+	}
+
+	token, err := util.GetUserTokenFromContext(r.Context())
+	if err != nil {
+		log.Error().Err(err).Send()
+		render.Render(w, r, util.ErrServer(err))
+		return
+	}
+
+	// Parse JSON body
+	var updates map[string]interface{}
+	if err := json.NewDecoder(r.Body).Decode(&updates); err != nil {
+		log.Error().Err(err).Msg("could not parse body")
+		render.Render(w, r, util.ErrInvalidRequest(err))
+		return
+	}
+	if len(updates) == 0 {
+		render.Render(w, r, util.ErrInvalidRequest(fmt.Errorf("no custom fields given")))
+		return
+	}
+
+	expectedVersion, err := util.IfMatchVersion(r)
+	if err != nil {
+		render.Render(w, r, util.ErrInvalidRequest(err))
+		return
+	}
+
+	// Try updating, the model makes sure the requester owns the ticket
+	ticket, err := models.UpdateTicketOwnerFields(r.Context(), objID, token.UID, updates, expectedVersion)
+	switch {
+	case err == nil:
+	case err == models.ErrVersionMismatch:
+		render.Render(w, r, util.ErrPreconditionFailed(err))
+		return
+	case errors.Is(err, models.ErrNotFound):
+		render.Render(w, r, util.ErrNotFound)
+		return
+	case errors.Is(err, models.ErrNoDocumentModified):
+		render.Render(w, r, util.ErrUnmodified)
+		return
+	case errors.Is(err, models.ErrEditNotAllowed),
+		errors.Is(err, models.ErrInvalidCustomFields),
+		errors.Is(err, models.ErrEditCutoffPassed):
+		log.Warn().Err(err).Str("uid", token.UID).Str("id", id).Msg("owner ticket update is invalid")
+		render.Render(w, r, util.ErrInvalidRequest(err))
+		return
+	default:
+		log.Error().Err(err).Str("id", id).Msg("could not update owner's ticket fields")
+		render.Render(w, r, util.ErrServer(err))
+		return
+	}
+
+	// Only hand back what the owner is allowed to see
+	customDataSchema, err := util.ConvertRawCustomFieldsSchema(ticket.EventData.RawCustomFieldsSchema)
+	if err != nil {
+		ticket.CustomFields = nil
+	} else {
+		for key, property := range customDataSchema.Properties {
+			if !property.UserVisible {
+				delete(ticket.CustomFields, key)
+			}
+		}
+	}
+
+	w.Header().Set("ETag", util.ETag(ticket.Version))
+	if err := render.Render(w, r, &ticket); err != nil {
+		render.Render(w, r, util.ErrRender(err))
+		return
+	}
+
+	// Write audit info log
+	log.Info().
+		Str("type", "audit").
+		Str("controller", "ticket").
+		Str("requester_uid", token.UID).
+		Str("ticket_id", id).
+		Any("updates", updates).
+		Str("action", "updateOwnTicketFields").
+		Bool("privileged", false).
+		Msg("owner updated ticket fields")
+}
+
+// GetHistory lists every change made to a ticket.
+//
+//	@Summary		Get ticket change history
+//	@Description	Lists every change made to a ticket, newest first, with who made it and what each field changed from and to. Only available to admins.
+//	@Tags			ticket
+//	@Produce		json
+//	@Param			id	path		string	true	"Ticket ID"
+//	@Success		200	{object}	[]models.ChangeRecord
+//	@Failure		400
+//	@Failure		500
+//	@Security		ApiKeyAuth
+//	@Router			/tickets/{id}/history [get]
+func (ctrl TicketController) GetHistory(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	if _, err := primitive.ObjectIDFromHex(id); err != nil {
+		log.Error().Err(err).Msg("could not convert url param to object id")
+		render.Render(w, r, util.ErrInvalidRequest(err))
+		return
+	}
+
+	renderChangeHistory(w, r, "ticket", models.ChangeDocumentTicket, id)
+}
+
 // Delete deletes a ticket.
 //
 //	@Summary		Delete a ticket
-//	@Description	Deletes a ticket. Only available to admins.
+//	@Description	Moves a ticket to the trash, where superadmins can restore it until it is purged. Only available to admins.
 //	@Tags			ticket
 //	@Accept			json
 //	@Param			id	path		string	true	"Ticket ID"
@@ -917,8 +1237,14 @@ func (ctrl TicketController) Delete(w http.ResponseWriter, r *http.Request) {
 	// to access the ticket later. Errors should be handled in the delete ticket
 	ticket, _ := models.GetTicket(r.Context(), objID)
 
-	// Try to delete document
-	err = models.DeleteTicket(r.Context(), objID)
+	token, err := util.GetUserTokenFromContext(r.Context())
+	requesterUID := ""
+	if err == nil {
+		requesterUID = token.UID
+	}
+
+	// Try to trash document
+	err = models.DeleteTicket(r.Context(), objID, requesterUID)
 	if err == models.ErrNoDocumentModified || err == mongo.ErrNoDocuments {
 		log.Error().Err(err).Msg("could not find ticket to delete")
 		render.Render(w, r, util.ErrNotFound)
@@ -932,11 +1258,6 @@ func (ctrl TicketController) Delete(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusOK)
 
 	// Write audit info log
-	token, err := util.GetUserTokenFromContext(r.Context())
-	requesterUID := ""
-	if err == nil {
-		requesterUID = token.UID
-	}
 	log.Info().
 		Str("type", "audit").
 		Str("controller", "ticket").
@@ -945,5 +1266,327 @@ func (ctrl TicketController) Delete(w http.ResponseWriter, r *http.Request) {
 		Any("ticket", ticket).
 		Str("action", "deleteTicket").
 		Bool("privileged", true).
-		Msg("deleted ticket")
+		Msg("moved ticket to trash")
+}
+
+// Bulk creates, updates and deletes many tickets in one request.
+//
+//	@Summary		Bulk create, update and delete tickets
+//	@Description	Applies a list of ticket creations, updates and deletions, returning the result of each one. If atomic is set, all operations are run in a single transaction and nothing is saved if any of them fail. If deletes need approval, a request made up of only deletes is saved as an approval request for another admin instead. Only available to admins.
+//	@Tags			ticket
+//	@Accept			json
+//	@Produce		json
+//	@Param			operations	body		ticketControllerBulkRequestBody	true	"Operations to apply"
+//	@Success		200			{object}	models.BulkTicketResponse
+//	@Success		202			{object}	models.ApprovalRequest
+//	@Failure		400			{object}	models.BulkTicketResponse
+//	@Failure		403
+//	@Failure		409
+//	@Failure		500
+//	@Security		ApiKeyAuth
+//	@Router			/tickets/bulk [post]
+func (ctrl TicketController) Bulk(w http.ResponseWriter, r *http.Request) {
+	var bulkReq ticketControllerBulkRequestBody
+
+	// Parse JSON body
+	bodyDecoder := json.NewDecoder(r.Body)
+	bodyDecoder.DisallowUnknownFields()
+	err := bodyDecoder.Decode(&bulkReq)
+	if err != nil {
+		log.Error().Err(err).Msg("could not parse body")
+		render.Render(w, r, util.ErrInvalidRequest(err))
+		return
+	}
+
+	// Validate JSON body
+	validate := util.NewValidator()
+	err = validate.Struct(bulkReq)
+	if err != nil {
+		log.Error().Err(err).Msg("could not validate body")
+		render.Render(w, r, util.ErrInvalidRequest(err))
+		return
+	}
+
+	opCount := len(bulkReq.Create) + len(bulkReq.Update) + len(bulkReq.Delete)
+	if opCount == 0 {
+		render.Render(w, r, util.ErrInvalidRequest(fmt.Errorf("no operations provided")))
+		return
+	} else if opCount > maxBulkTicketOperations {
+		render.Render(w, r, util.ErrInvalidRequest(fmt.Errorf("more than %d operations provided", maxBulkTicketOperations)))
+		return
+	}
+
+	token, err := util.GetUserTokenFromContext(r.Context())
+	if err != nil {
+		log.Error().Err(err).Msg("could not fetch user token from context")
+		render.Render(w, r, util.ErrServer(err))
+		return
+	}
+
+	// Deletes wait for a second admin if needed, so they can't be mixed with anything that runs now
+	if len(bulkReq.Delete) > 0 && lib.Approvals.Requires(lib.ApprovalActionBulkDeleteTickets) {
+		if len(bulkReq.Create) > 0 || len(bulkReq.Update) > 0 {
+			render.Render(w, r, util.ErrInvalidRequest(fmt.Errorf("bulk deletes need approval, send creates and updates in a separate request")))
+			return
+		}
+		requestApproval(w, r, "ticket", models.ApprovalRequest{
+			Action:      lib.ApprovalActionBulkDeleteTickets,
+			TicketIDs:   bulkReq.Delete,
+			Atomic:      bulkReq.Atomic,
+			RequestedBy: token.UID,
+		})
+		return
+	}
+
+	response, err := runBulkTicketOperations(r.Context(), token, bulkReq)
+	if err != nil {
+		log.Error().Err(err).Msg("could not run bulk ticket transaction")
+		render.Render(w, r, util.ErrServer(err))
+		return
+	}
+
+	// Return as JSON, fallback if it fails
+	if bulkReq.Atomic && !response.Committed {
+		render.Status(r, http.StatusBadRequest)
+	}
+	if err := render.Render(w, r, &response); err != nil {
+		render.Render(w, r, util.ErrRender(err))
+		return
+	}
+
+	// Write audit info log
+	log.Info().
+		Str("type", "audit").
+		Str("controller", "ticket").
+		Str("requester_uid", token.UID).
+		Any("operations", bulkTicketAuditOperations(bulkReq)).
+		Any("results", response.Results).
+		Bool("committed", response.Committed).
+		Str("action", "bulkTickets").
+		Bool("privileged", true).
+		Msg("applied bulk ticket operations")
+}
+
+// bulkTicketAuditOperation is what the audit log keeps of a single bulk operation. Custom fields can
+// hold sensitive values, so only the keys that were given are logged.
+type bulkTicketAuditOperation struct {
+	Operation string   `json:"operation"`
+	Index     int      `json:"index"`
+	TicketID  string   `json:"ticketID,omitempty"`
+	Keys      []string `json:"keys,omitempty"`
+}
+
+// bulkTicketAuditOperations summarizes a bulk request for the audit log, in the order it runs.
+func bulkTicketAuditOperations(bulkReq ticketControllerBulkRequestBody) []bulkTicketAuditOperation {
+	operations := []bulkTicketAuditOperation{}
+	for i, createReq := range bulkReq.Create {
+		keys := []string{"maxScanCount"}
+		for key := range createReq.CustomFields {
+			keys = append(keys, "customFields."+key)
+		}
+		sort.Strings(keys)
+		operations = append(operations, bulkTicketAuditOperation{Operation: "create", Index: i, Keys: keys})
+	}
+	for i, updateReq := range bulkReq.Update {
+		keys := []string{}
+		if updateReq.MaxScanCount != 0 {
+			keys = append(keys, "maxScanCount")
+		}
+		for key := range updateReq.CustomFields {
+			keys = append(keys, "customFields."+key)
+		}
+		sort.Strings(keys)
+		operations = append(operations, bulkTicketAuditOperation{Operation: "update", Index: i, TicketID: updateReq.ID, Keys: keys})
+	}
+	for i, id := range bulkReq.Delete {
+		operations = append(operations, bulkTicketAuditOperation{Operation: "delete", Index: i, TicketID: id})
+	}
+	return operations
+}
+
+// runBulkTicketOperations runs a bulk request, in a single transaction if it's atomic.
+func runBulkTicketOperations(
+	ctx context.Context,
+	token *auth.Token,
+	bulkReq ticketControllerBulkRequestBody,
+) (models.BulkTicketResponse, error) {
+	response := models.BulkTicketResponse{Atomic: bulkReq.Atomic}
+	if bulkReq.Atomic {
+		// Run everything in one transaction, aborting it if any operation fails. Wallet syncs can
+		// only be queued once it commits, or rolled back changes could end up on passes.
+		txnCtx, walletSyncs := models.WithPendingWalletSyncs(ctx)
+		_, err := lib.Datastore.WithTransaction(txnCtx, func(sessCtx mongo.SessionContext) (interface{}, error) {
+			walletSyncs.Reset() // the transaction might be retried
+			var ok bool
+			response.Results, ok = applyBulkTicketOperations(sessCtx, token, bulkReq)
+			if !ok {
+				return nil, errBulkTicketAborted
+			}
+			return nil, nil
+		})
+		if err != nil && err != errBulkTicketAborted {
+			return models.BulkTicketResponse{}, err
+		}
+		response.Committed = err == nil
+		if response.Committed {
+			if err := walletSyncs.Queue(ctx); err != nil {
+				return response, err
+			}
+		}
+	} else {
+		response.Results, _ = applyBulkTicketOperations(ctx, token, bulkReq)
+		for _, result := range response.Results {
+			if result.Success {
+				response.Committed = true
+				break
+			}
+		}
+	}
+
+	return response, nil
+}
+
+// applyBulkTicketOperations runs every operation in a bulk request in order (creates,
+// updates then deletes), returning the per-operation results and whether all succeeded.
+// If the operations are atomic, it stops at the first failure and marks the rest as skipped.
+func applyBulkTicketOperations(
+	ctx context.Context,
+	token *auth.Token,
+	bulkReq ticketControllerBulkRequestBody,
+) ([]models.BulkTicketResult, bool) {
+	results := []models.BulkTicketResult{}
+	failed := false
+
+	// Adds a result to the list, skipping the operation if a previous atomic one already failed
+	run := func(operation string, index int, fn func() (string, error)) {
+		result := models.BulkTicketResult{Operation: operation, Index: index}
+		if failed && bulkReq.Atomic {
+			result.Error = "skipped since an earlier operation failed"
+			results = append(results, result)
+			return
+		}
+
+		ticketID, err := fn()
+		result.TicketID = ticketID
+		if err != nil {
+			failed = true
+			result.Error = err.Error()
+			result.Code, result.Details = bulkTicketErrorCode(err)
+		} else {
+			result.Success = true
+		}
+		results = append(results, result)
+	}
+
+	for i, createReq := range bulkReq.Create {
+		run("create", i, func() (string, error) {
+			return bulkCreateTicket(ctx, token, createReq)
+		})
+	}
+
+	for i, updateReq := range bulkReq.Update {
+		run("update", i, func() (string, error) {
+			return updateReq.ID, bulkUpdateTicket(ctx, token, updateReq)
+		})
+	}
+
+	for i, id := range bulkReq.Delete {
+		run("delete", i, func() (string, error) {
+			objID, err := primitive.ObjectIDFromHex(id)
+			if err != nil {
+				return id, newBulkTicketError(util.AppCodeInvalidRequest, "invalid ticket ID")
+			}
+
+			err = models.DeleteTicket(ctx, objID, token.UID)
+			if err == models.ErrNoDocumentModified {
+				return id, newBulkTicketError(util.AppCodeNotFound, "ticket not found")
+			}
+			return id, err
+		})
+	}
+
+	return results, !failed
+}
+
+func bulkCreateTicket(ctx context.Context, token *auth.Token, createReq ticketControllerCreateRequestBody) (string, error) {
+	eventID, err := primitive.ObjectIDFromHex(createReq.EventID)
+	if err != nil {
+		return "", util.NewValidationError(err, util.AppCodeInvalidBody, "eventID", "mongodb", "not a valid event ID")
+	}
+
+	// Make sure the student number is real before looking for the user
+	if err := models.ValidateStudentNumber(ctx, createReq.StudentNumber); err != nil {
+		return "", err
+	}
+
+	// Try to find the user object associated with student number
+	user, err := models.GetUserByKey(ctx, "student_number", createReq.StudentNumber)
+	if err == mongo.ErrNoDocuments {
+		return "", newBulkTicketError(util.AppCodeNotFound, "no user exists with student number %s", createReq.StudentNumber)
+	} else if err != nil {
+		return "", err
+	}
+
+	// Only superadmins can make tickets for themselves
+	if token.UID == user.ID {
+		if isSuperAdmin, ok := token.Claims["superadmin"]; !ok || !(isSuperAdmin.(bool)) {
+			return "", newBulkTicketError(util.AppCodeForbidden, "cannot create a ticket for yourself")
+		}
+	}
+
+	id, err := models.CreateNewTicket(ctx, models.Ticket{
+		Owner:        user.ID,
+		Event:        eventID,
+		Timestamp:    time.Now(),
+		MaxScanCount: createReq.MaxScanCount,
+		CustomFields: createReq.CustomFields,
+	})
+	switch err {
+	case nil:
+		return id.Hex(), nil
+	case models.ErrAlreadyExists:
+		return "", newBulkTicketError(util.AppCodeConflict, "ticket with given event and owner ID already exists")
+	case models.ErrNotFound:
+		return "", newBulkTicketError(util.AppCodeNotFound, "event or user given was not found")
+	default:
+		return "", err
+	}
+}
+
+func bulkUpdateTicket(ctx context.Context, token *auth.Token, updateReq ticketControllerBulkUpdateItem) error {
+	objID, err := primitive.ObjectIDFromHex(updateReq.ID)
+	if err != nil {
+		return newBulkTicketError(util.AppCodeInvalidRequest, "invalid ticket ID")
+	}
+
+	// Same semantics as a regular update, where -1 means unlimited scans
+	updateBody := make(map[string]interface{})
+	if updateReq.MaxScanCount != 0 {
+		if updateReq.MaxScanCount == -1 {
+			updateBody["maxScanCount"] = 0
+		} else {
+			updateBody["maxScanCount"] = updateReq.MaxScanCount
+		}
+	}
+	for key, val := range updateReq.CustomFields {
+		if key != "maxScanCount" {
+			updateBody[key] = val
+		}
+	}
+
+	_, err = models.UpdateExistingTicketByKeys(ctx, objID, updateBody, models.UpdateMeta{
+		ChangedBy:       token.UID,
+		ExpectedVersion: updateReq.Version,
+	})
+	switch err {
+	case nil, models.ErrNoDocumentModified:
+		// Nothing changing isn't worth failing the whole operation over
+		return nil
+	case mongo.ErrNoDocuments:
+		return newBulkTicketError(util.AppCodeNotFound, "ticket not found")
+	case models.ErrVersionMismatch:
+		return newBulkTicketError(util.AppCodeVersionConflict, "ticket was changed since version %d", *updateReq.Version)
+	default:
+		return err
+	}
 }
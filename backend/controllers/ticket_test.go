@@ -0,0 +1,154 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"firebase.google.com/go/auth"
+	"github.com/aritrosaha10/frasertickets/models"
+	"github.com/aritrosaha10/frasertickets/util"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestBulkTicketAuditOperationsLeaveOutValues(t *testing.T) {
+	operations := bulkTicketAuditOperations(ticketControllerBulkRequestBody{
+		Create: []ticketControllerCreateRequestBody{
+			{StudentNumber: "111", CustomFields: map[string]interface{}{"allergies": "peanuts"}},
+		},
+		Update: []ticketControllerBulkUpdateItem{
+			{ID: "ticket", CustomFields: map[string]interface{}{"medicalNotes": "asthma", "meal": "fish"}},
+		},
+		Delete: []string{"trashed"},
+	})
+
+	raw, err := json.Marshal(operations)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, value := range []string{"peanuts", "asthma", "fish", "111"} {
+		if strings.Contains(string(raw), value) {
+			t.Errorf("expected %q to be left out of the audit log, got %s", value, raw)
+		}
+	}
+
+	if len(operations) != 3 {
+		t.Fatalf("expected one entry per operation, got %+v", operations)
+	}
+	update := operations[1]
+	if update.Operation != "update" || update.TicketID != "ticket" ||
+		strings.Join(update.Keys, ",") != "customFields.meal,customFields.medicalNotes" {
+		t.Errorf("expected the update's ticket and changed keys, got %+v", update)
+	}
+	if operations[2].Operation != "delete" || operations[2].TicketID != "trashed" {
+		t.Errorf("expected the deleted ticket, got %+v", operations[2])
+	}
+}
+
+// createBulkTestTickets makes an event with a ticket for each of the given owners.
+func createBulkTestTickets(t *testing.T, owners ...string) []primitive.ObjectID {
+	t.Helper()
+	ctx := context.Background()
+
+	eventID, err := models.CreateNewEvent(ctx, models.Event{Name: "Dance", StartTimestamp: time.Now().Add(time.Hour)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids := []primitive.ObjectID{}
+	for _, owner := range owners {
+		if _, err := models.CreateNewUser(ctx, models.User{ID: owner, FullName: owner}); err != nil {
+			t.Fatal(err)
+		}
+		id, err := models.CreateNewTicket(ctx, models.Ticket{Owner: owner, Event: eventID, MaxScanCount: 1})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+func TestBulkTicketUpdatesRollBackWhenAtomic(t *testing.T) {
+	setupTestDatastore(t)
+	ctx := context.Background()
+	ids := createBulkTestTickets(t, "first")
+
+	response, err := runBulkTicketOperations(ctx, &auth.Token{UID: "admin"}, ticketControllerBulkRequestBody{
+		Update: []ticketControllerBulkUpdateItem{
+			{ID: ids[0].Hex(), MaxScanCount: 5},
+			{ID: primitive.NewObjectID().Hex(), MaxScanCount: 5},
+		},
+		Atomic: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.Committed {
+		t.Error("expected the atomic request not to be committed")
+	}
+	if len(response.Results) != 2 || !response.Results[0].Success || response.Results[1].Success {
+		t.Fatalf("expected only the second update to fail, got %+v", response.Results)
+	}
+	if response.Results[1].Code != util.AppCodeNotFound {
+		t.Errorf("expected the missing ticket to be reported as not found, got %+v", response.Results[1])
+	}
+
+	ticket, err := models.GetTicket(ctx, ids[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ticket.MaxScanCount != 1 {
+		t.Errorf("expected the first update to be rolled back, got a max scan count of %d", ticket.MaxScanCount)
+	}
+}
+
+func TestBulkTicketUpdatesReportEachFailure(t *testing.T) {
+	setupTestDatastore(t)
+	ctx := context.Background()
+	ids := createBulkTestTickets(t, "first", "second")
+	staleVersion := 7
+
+	response, err := runBulkTicketOperations(ctx, &auth.Token{UID: "admin"}, ticketControllerBulkRequestBody{
+		Update: []ticketControllerBulkUpdateItem{
+			{ID: ids[0].Hex(), MaxScanCount: 5},
+			{ID: ids[1].Hex(), MaxScanCount: 5, Version: &staleVersion},
+			{ID: "not-an-id", MaxScanCount: 5},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !response.Committed {
+		t.Error("expected the successful update to be committed")
+	}
+
+	expected := []struct {
+		success bool
+		code    int64
+	}{
+		{success: true},
+		{code: util.AppCodeVersionConflict},
+		{code: util.AppCodeInvalidRequest},
+	}
+	if len(response.Results) != len(expected) {
+		t.Fatalf("expected %d results, got %+v", len(expected), response.Results)
+	}
+	for i, result := range response.Results {
+		if result.Operation != "update" || result.Index != i {
+			t.Errorf("result %d is for the wrong operation: %+v", i, result)
+		}
+		if result.Success != expected[i].success || result.Code != expected[i].code {
+			t.Errorf("expected result %d to be %+v, got %+v", i, expected[i], result)
+		}
+	}
+
+	ticket, err := models.GetTicket(ctx, ids[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ticket.MaxScanCount != 5 {
+		t.Errorf("expected the first update to be saved, got a max scan count of %d", ticket.MaxScanCount)
+	}
+}
@@ -0,0 +1,183 @@
+package controllers
+
+import (
+	"net/http"
+
+	"github.com/aritrosaha10/frasertickets/middleware"
+	"github.com/aritrosaha10/frasertickets/models"
+	"github.com/aritrosaha10/frasertickets/util"
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/render"
+	"github.com/rs/zerolog/log"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+type TrashController struct{}
+
+func (ctrl TrashController) Routes() chi.Router {
+	r := chi.NewRouter()
+	r.Use(middleware.AuthenticatorMiddleware) // User must be authenticated before using any of these endpoints
+
+	// Superadmin-only routes
+	r.Group(func(r chi.Router) {
+		r.Use(middleware.AdminAuthorizerMiddleware)
+		r.Use(middleware.SuperAdminAuthorizerMiddleware)
+		r.Get("/", ctrl.List)                               // GET /trash - returns trashed events and tickets, only available to superadmins
+		r.Post("/events/{id}/restore", ctrl.RestoreEvent)   // POST /trash/events/{id}/restore - restores an event with its tickets, only available to superadmins
+		r.Post("/tickets/{id}/restore", ctrl.RestoreTicket) // POST /trash/tickets/{id}/restore - restores a single ticket, only available to superadmins
+	})
+
+	return r
+}
+
+// List returns everything in the trash.
+//
+//	@Summary		List trash
+//	@Description	Lists trashed events (with how many tickets and queued tickets went with them) and tickets trashed on their own, most recently trashed first. Only available to superadmins.
+//	@Tags			trash
+//	@Produce		json
+//	@Success		200	{object}	models.Trash
+//	@Failure		403
+//	@Failure		500
+//	@Security		ApiKeyAuth
+//	@Router			/trash [get]
+func (ctrl TrashController) List(w http.ResponseWriter, r *http.Request) {
+	trash, err := models.GetTrash(r.Context())
+	if err != nil {
+		log.Error().Err(err).Msg("could not fetch trash")
+		render.Render(w, r, util.ErrServer(err))
+		return
+	}
+
+	if err := render.Render(w, r, &trash); err != nil {
+		render.Render(w, r, util.ErrRender(err))
+		return
+	}
+
+	// Write audit info log
+	token, err := util.GetUserTokenFromContext(r.Context())
+	requesterUID := ""
+	if err == nil {
+		requesterUID = token.UID
+	}
+	log.Info().
+		Str("type", "audit").
+		Str("controller", "trash").
+		Str("requester_uid", requesterUID).
+		Str("action", "listTrash").
+		Bool("privileged", true).
+		Msg("fetched trash")
+}
+
+// RestoreEvent takes an event out of the trash.
+//
+//	@Summary		Restore an event
+//	@Description	Takes an event out of the trash, along with the tickets and queued tickets that were trashed with it. Only available to superadmins.
+//	@Tags			trash
+//	@Produce		json
+//	@Param			id	path		string	true	"Event ID"
+//	@Success		200	{object}	models.RestoreResult
+//	@Failure		400
+//	@Failure		403
+//	@Failure		404
+//	@Failure		500
+//	@Security		ApiKeyAuth
+//	@Router			/trash/events/{id}/restore [post]
+func (ctrl TrashController) RestoreEvent(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	objID, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		log.Error().Err(err).Msg("could not convert id to objectid")
+		render.Render(w, r, util.ErrInvalidRequest(err))
+		return
+	}
+
+	result, err := models.RestoreEvent(r.Context(), objID)
+	if err == models.ErrNotFound {
+		render.Render(w, r, util.ErrNotFound)
+		return
+	} else if err != nil {
+		log.Error().Err(err).Msg("could not restore event")
+		render.Render(w, r, util.ErrServer(err))
+		return
+	}
+
+	if err := render.Render(w, r, &result); err != nil {
+		render.Render(w, r, util.ErrRender(err))
+		return
+	}
+
+	// Write audit info log
+	token, err := util.GetUserTokenFromContext(r.Context())
+	requesterUID := ""
+	if err == nil {
+		requesterUID = token.UID
+	}
+	log.Info().
+		Str("type", "audit").
+		Str("controller", "trash").
+		Str("requester_uid", requesterUID).
+		Str("eventId", id).
+		Any("result", result).
+		Str("action", "restoreEvent").
+		Bool("privileged", true).
+		Msg("restored event from trash")
+}
+
+// RestoreTicket takes a ticket out of the trash.
+//
+//	@Summary		Restore a ticket
+//	@Description	Takes a ticket that was trashed on its own out of the trash. Fails if its event is in the trash, or if the owner has been given a new ticket since. Only available to superadmins.
+//	@Tags			trash
+//	@Produce		json
+//	@Param			id	path		string	true	"Ticket ID"
+//	@Success		200	{object}	models.RestoreResult
+//	@Failure		400
+//	@Failure		403
+//	@Failure		404
+//	@Failure		409
+//	@Failure		500
+//	@Security		ApiKeyAuth
+//	@Router			/trash/tickets/{id}/restore [post]
+func (ctrl TrashController) RestoreTicket(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	objID, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		log.Error().Err(err).Msg("could not convert id to objectid")
+		render.Render(w, r, util.ErrInvalidRequest(err))
+		return
+	}
+
+	result, err := models.RestoreTicket(r.Context(), objID)
+	if err == models.ErrNotFound {
+		render.Render(w, r, util.ErrNotFound)
+		return
+	} else if err == models.ErrEventTrashed || err == models.ErrAlreadyExists {
+		render.Render(w, r, util.ErrConflict(err))
+		return
+	} else if err != nil {
+		log.Error().Err(err).Msg("could not restore ticket")
+		render.Render(w, r, util.ErrServer(err))
+		return
+	}
+
+	if err := render.Render(w, r, &result); err != nil {
+		render.Render(w, r, util.ErrRender(err))
+		return
+	}
+
+	// Write audit info log
+	token, err := util.GetUserTokenFromContext(r.Context())
+	requesterUID := ""
+	if err == nil {
+		requesterUID = token.UID
+	}
+	log.Info().
+		Str("type", "audit").
+		Str("controller", "trash").
+		Str("requester_uid", requesterUID).
+		Str("ticket_id", id).
+		Str("action", "restoreTicket").
+		Bool("privileged", true).
+		Msg("restored ticket from trash")
+}
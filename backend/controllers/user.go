@@ -1,9 +1,14 @@
 package controllers
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"net/http"
-	"strings"
+	"strconv"
+
+	"firebase.google.com/go/auth"
 
 	"github.com/aritrosaha10/frasertickets/lib"
 	"github.com/aritrosaha10/frasertickets/middleware"
@@ -15,6 +20,11 @@ import (
 	"go.mongodb.org/mongo-driver/mongo"
 )
 
+type userControllerSetAdminRequestBody struct {
+	Admin      bool `json:"admin"`
+	SuperAdmin bool `json:"superadmin"` // needs admin to be set too
+}
+
 type UserController struct{}
 
 func (ctrl UserController) Routes() chi.Router {
@@ -26,7 +36,16 @@ func (ctrl UserController) Routes() chi.Router {
 	// Admin-only route(s)
 	r.Group(func(r chi.Router) {
 		r.Use(middleware.AdminAuthorizerMiddleware)
-		r.Get("/", ctrl.List) // GET /users - returns list of users, only available to admins
+		r.Get("/", ctrl.List)                       // GET /users - returns list of users, only available to admins
+		r.Get("/search", ctrl.Search)               // GET /users/search - searches users one page at a time, only available to admins
+		r.Get("/pending", ctrl.ListPendingApproval) // GET /users/pending - returns users held for approval, only available to admins
+		r.Post("/{id}/approve", ctrl.Approve)       // POST /users/{id}/approve - approves a held user, only available to admins
+		r.Post("/{id}/reject", ctrl.Reject)         // POST /users/{id}/reject - rejects and deletes a held user, only available to admins
+		r.Get("/{id}/history", ctrl.GetHistory)     // GET /users/{id}/history - lists every change made to a user, only available to admins
+
+		// Superadmin-only route(s)
+		r.With(middleware.SuperAdminAuthorizerMiddleware).
+			Put("/{id}/admin", ctrl.SetAdmin) // PUT /users/{id}/admin - grants or revokes admin access, only available to superadmins
 	})
 
 	r.Route("/{id}", func(r chi.Router) {
@@ -69,16 +88,33 @@ func (ctrl UserController) Routes() chi.Router {
 // List returns all users.
 //
 //	@Summary		List all users
-//	@Description	Lists all user data in the database. Only available to admins.
+//	@Description	Lists all user data in the database, optionally filtered by any field in UserListSpec (ex. admin=true). Only available to admins.
 //	@Tags			user
 //	@Produce		json
+//	@Param			limit	query	int		false	"Page size, results are only paginated if this or cursor is given (max 200)"
+//	@Param			cursor	query	string	false	"Cursor from the X-Next-Cursor header of the previous page"
+//	@Param			sort	query	string	false	"Comma separated fields to sort by, prefixed with - for descending"
 //	@Success		200	{object}	[]models.User
+//	@Header			200	{string}	X-Next-Cursor	"Cursor for the next page, if there is one"
+//	@Header			200	{boolean}	X-Has-More		"Whether there are more results"
+//	@Failure		400
 //	@Failure		500
 //	@Security		ApiKeyAuth
 //	@Router			/users [get]
 func (ctrl UserController) List(w http.ResponseWriter, r *http.Request) {
-	users, err := models.GetAllUsers(r.Context())
+	filter, page, err := parseListOptions(r, models.UserListSpec)
+	if err != nil {
+		render.Render(w, r, util.ErrInvalidRequest(err))
+		return
+	}
+
+	users, pageInfo, err := models.GetUsersPage(r.Context(), filter, page)
 	if err != nil {
+		if errors.Is(err, models.ErrInvalidCursor) {
+			render.Render(w, r, util.ErrInvalidRequest(err))
+			return
+		}
+
 		render.Render(w, r, util.ErrServer(err))
 		return
 	}
@@ -91,6 +127,7 @@ func (ctrl UserController) List(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Return as JSON array, fallback if it fails
+	setPageHeaders(w, pageInfo)
 	if err := render.RenderList(w, r, list); err != nil {
 		render.Render(w, r, util.ErrRender(err))
 		return
@@ -111,13 +148,110 @@ func (ctrl UserController) List(w http.ResponseWriter, r *http.Request) {
 		Msg("fetched all users")
 }
 
+// Search returns a page of users matching the given filters.
+//
+//	@Summary		Search users
+//	@Description	Search users by name, student number, admin status and grade, sorted by full name. Results are paginated, with the cursor for the next page given in the X-Next-Cursor header. Only available to admins.
+//	@Tags			user
+//	@Produce		json
+//	@Param			name			query		string	false	"Partial, case-insensitive match on full name"
+//	@Param			q				query		string	false	"Full text search over name, email and student number"
+//	@Param			studentNumber	query		string	false	"Student number prefix"
+//	@Param			admin			query		bool	false	"Whether to only show admins or non-admins"
+//	@Param			grade			query		int		false	"Grade to filter by"
+//	@Param			limit			query		int		false	"Maximum number of users to return (default 50, max 200)"
+//	@Param			cursor			query		string	false	"Cursor from the previous page"
+//	@Success		200				{object}	[]models.User
+//	@Header			200				{string}	X-Next-Cursor	"Cursor for the next page, if there is one"
+//	@Header			200				{boolean}	X-Has-More		"Whether there are more results"
+//	@Failure		400
+//	@Failure		500
+//	@Security		ApiKeyAuth
+//	@Router			/users/search [get]
+func (ctrl UserController) Search(w http.ResponseWriter, r *http.Request) {
+	page, err := parsePageOptions(r)
+	if err != nil {
+		render.Render(w, r, util.ErrInvalidRequest(err))
+		return
+	}
+	page.Sort, err = models.UserListSpec.ParseSort(r.URL.Query().Get("sort"))
+	if err != nil {
+		render.Render(w, r, util.ErrInvalidRequest(err))
+		return
+	}
+
+	filter := models.UserSearchFilter{
+		Name:                r.URL.Query().Get("name"),
+		Query:               r.URL.Query().Get("q"),
+		StudentNumberPrefix: r.URL.Query().Get("studentNumber"),
+	}
+	if adminRaw := r.URL.Query().Get("admin"); adminRaw != "" {
+		admin, err := strconv.ParseBool(adminRaw)
+		if err != nil {
+			render.Render(w, r, util.ErrInvalidRequest(fmt.Errorf("admin must be true or false")))
+			return
+		}
+		filter.Admin = &admin
+	}
+	if gradeRaw := r.URL.Query().Get("grade"); gradeRaw != "" {
+		grade, err := strconv.Atoi(gradeRaw)
+		if err != nil {
+			render.Render(w, r, util.ErrInvalidRequest(fmt.Errorf("grade must be a number")))
+			return
+		}
+		filter.Grade = grade
+	}
+
+	users, pageInfo, err := models.SearchUsers(r.Context(), filter, page)
+	if err != nil {
+		if errors.Is(err, models.ErrInvalidCursor) {
+			render.Render(w, r, util.ErrInvalidRequest(err))
+			return
+		}
+
+		log.Error().Err(err).Msg("could not search users")
+		render.Render(w, r, util.ErrServer(err))
+		return
+	}
+
+	// Convert into list of renderers to turn into JSON
+	list := []render.Renderer{}
+	for _, user := range users {
+		u := user // Duplicate it before passing by reference to avoid only passing the last user obj
+		list = append(list, &u)
+	}
+
+	// Return as JSON array, fallback if it fails
+	setPageHeaders(w, pageInfo)
+	if err := render.RenderList(w, r, list); err != nil {
+		render.Render(w, r, util.ErrRender(err))
+		return
+	}
+
+	// Write audit info log
+	token, err := util.GetUserTokenFromContext(r.Context())
+	requesterUID := ""
+	if err == nil {
+		requesterUID = token.UID
+	}
+	log.Info().
+		Str("type", "audit").
+		Str("controller", "user").
+		Str("requester_uid", requesterUID).
+		Any("filter", filter).
+		Str("action", "searchUsers").
+		Bool("privileged", true).
+		Msg("searched users")
+}
+
 // Create creates a database entry for a user on account creation.
 //
 //	@Summary		Create a user in DB on account creation
-//	@Description	Creates a user in the database when they first make their account. Only available to new users.
+//	@Description	Creates a user in the database when they first make their account, if the identity policy allows it. Only available to new users.
 //	@Tags			user
 //	@Produce		json
 //	@Success		200	{object}	models.User
+//	@Success		202	{object}	models.User	"Account held for admin approval by the identity policy"
 //	@Failure		401
 //	@Failure		403
 //	@Failure		500
@@ -140,9 +274,10 @@ func (ctrl UserController) Create(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Check if they are using a school account or not
-	if !strings.Contains(userRecord.Email, "@pdsb.net") {
-		log.Warn().Str("uid", userToken.UID).Str("email", userRecord.Email).Msg("user attempting to sign in with personal account")
+	// Check whether the identity policy lets them sign up
+	decision := lib.Identity.Evaluate(userRecord.Email)
+	if decision.Outcome == lib.IdentityOutcomeRejected {
+		log.Warn().Str("uid", userToken.UID).Str("email", userRecord.Email).Msg("user attempting to sign in with account not allowed by identity policy")
 		render.Render(w, r, util.ErrUnauthorized)
 
 		// Also delete the user for good measure
@@ -164,15 +299,27 @@ func (ctrl UserController) Create(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Extract student number from email
-	studentNumber := strings.Replace(userRecord.Email, "@pdsb.net", "", -1)
-
 	tmpUser := models.User{
-		ID:            userRecord.UID,
-		Admin:         false,
-		StudentNumber: studentNumber,
-		FullName:      userRecord.DisplayName,
-		ProfilePicURL: userRecord.PhotoURL,
+		ID:              userRecord.UID,
+		Admin:           false,
+		StudentNumber:   decision.StudentNumber,
+		Email:           models.NormalizeEmail(userRecord.Email),
+		ExternalID:      decision.ExternalID,
+		FullName:        userRecord.DisplayName,
+		ProfilePicURL:   userRecord.PhotoURL,
+		Kind:            decision.Kind,
+		PendingApproval: decision.Outcome == lib.IdentityOutcomeHeld,
+	}
+
+	// Fill in their grade and homeroom if they're on the roster
+	if tmpUser.StudentNumber != "" {
+		rosterEntry, err := models.GetRosterEntry(ctx, tmpUser.StudentNumber)
+		if err == nil {
+			tmpUser.Grade = rosterEntry.Grade
+			tmpUser.Homeroom = rosterEntry.Homeroom
+		} else if err != mongo.ErrNoDocuments {
+			log.Error().Err(err).Str("uid", userRecord.UID).Msg("could not fetch roster entry for new user")
+		}
 	}
 
 	// Create the user doc in MongoDB
@@ -183,26 +330,20 @@ func (ctrl UserController) Create(w http.ResponseWriter, r *http.Request) {
 	}
 	tmpUser.ID = id
 
+	// Held accounts are kept, but don't get anything until an admin approves them
+	if tmpUser.PendingApproval {
+		log.Info().Str("uid", id).Str("email", userRecord.Email).Msg("user held for approval by identity policy")
+		render.Status(r, http.StatusAccepted)
+	}
+
 	// Return as JSON, fallback if it fails
 	if err := render.Render(w, r, &tmpUser); err != nil {
 		render.Render(w, r, util.ErrRender(err))
 		return
 	}
 
-	// Look through queued tickets and create any that may belong to them
-	queuedTickets, err := models.GetQueuedTicketsForStudentNumber(r.Context(), studentNumber)
-	if err != nil {
-		log.Error().Err(err).Str("uid", id).Msg("could not get queued tickets")
-	} else {
-		// TODO: Consider using goroutines? Not bothering right now since too complex to just register 1-2 tickets
-		for i, queuedTicket := range queuedTickets {
-			// No point in updating name multiple times
-			ticket, err := models.ConvertQueuedTicketToTicket(r.Context(), queuedTicket, i == 0)
-			log.Info().Any("ticket", ticket).Str("uid", id).Msg("converted queued ticket to ticket")
-			if err != nil {
-				log.Error().Err(err).Any("queuedTicket", queuedTicket).Str("uid", id).Msg("could not convert queued ticket to ticket")
-			}
-		}
+	if !tmpUser.PendingApproval {
+		convertQueuedTicketsForUser(r.Context(), tmpUser)
 	}
 
 	// Write audit info log
@@ -253,6 +394,7 @@ func (ctrl UserController) Get(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Return as JSON, fallback if it fails
+	w.Header().Set("ETag", util.ETag(user.Version))
 	if err := render.Render(w, r, &user); err != nil {
 		render.Render(w, r, util.ErrRender(err))
 		return
@@ -281,12 +423,14 @@ func (ctrl UserController) Get(w http.ResponseWriter, r *http.Request) {
 //	@Tags			user
 //	@Produce		json
 //	@Param			id	path		string	true	"User ID"
-//	@Param			updates	body	models.User	true	"Updates to make (can only change full name for now)"
+//	@Param			updates	body	models.User	true	"Updates to make (can only change full name, and grade / homeroom for admins)"
+//	@Param			If-Match	header	string	false	"ETag of the version last fetched, fails with 412 if it was changed since"
 //	@Success		200
 //	@Failure		304
 //	@Failure		400
 //	@Failure		403
 //	@Failure		404
+//	@Failure		412
 //	@Failure		500
 //	@Security		ApiKeyAuth
 //	@Router			/users/{id} [patch]
@@ -295,6 +439,11 @@ func (ctrl UserController) Update(w http.ResponseWriter, r *http.Request) {
 	ALLOWED_KEYS := map[string]bool{
 		"full_name": true,
 	}
+	ADMIN_ONLY_KEYS := map[string]bool{
+		"grade":    true,
+		"homeroom": true,
+	}
+	isAdmin, _ := util.CheckIfAdmin(r.Context()) // error doesn't matter, bool defaults to false anyways
 
 	// Get ID of requested user
 	id := chi.URLParam(r, "id")
@@ -321,7 +470,7 @@ func (ctrl UserController) Update(w http.ResponseWriter, r *http.Request) {
 
 	// Check if non-admin user is attempting to change prohibited traits
 	for key, val := range requestedUpdates {
-		if _, ok := ALLOWED_KEYS[key]; !ok {
+		if !ALLOWED_KEYS[key] && !(isAdmin && ADMIN_ONLY_KEYS[key]) {
 			log.
 				Warn().
 				Str("uid", id).
@@ -333,14 +482,34 @@ func (ctrl UserController) Update(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	// Only overwrite the version the requester last saw, if they told us which one that was
+	expectedVersion, err := util.IfMatchVersion(r)
+	if err != nil {
+		render.Render(w, r, util.ErrInvalidRequest(err))
+		return
+	}
+	token, err := util.GetUserTokenFromContext(r.Context())
+	requesterUID := ""
+	if err == nil {
+		requesterUID = token.UID
+	}
+
 	// Try updating the appropriate document
-	err = models.UpdateExistingUserByKeys(r.Context(), id, requestedUpdates)
+	version, err := models.UpdateExistingUserByKeys(r.Context(), id, requestedUpdates, models.UpdateMeta{
+		ChangedBy:       requesterUID,
+		ByOwner:         requesterUID == id,
+		ExpectedVersion: expectedVersion,
+	})
 	if err != nil {
+		var validationErr *util.ValidationError
 		if err == models.ErrNoDocumentModified {
 			log.Error().Stack().Err(err).Send()
 			render.Render(w, r, util.ErrUnmodified)
 			return
-		} else if err == models.ErrEditNotAllowed {
+		} else if err == models.ErrVersionMismatch {
+			render.Render(w, r, util.ErrPreconditionFailed(err))
+			return
+		} else if errors.As(err, &validationErr) {
 			render.Render(w, r, util.ErrInvalidRequest(err))
 			return
 		}
@@ -350,21 +519,389 @@ func (ctrl UserController) Update(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	w.Header().Set("ETag", util.ETag(version))
 	w.WriteHeader(http.StatusOK)
 
+	// Write audit info log
+	log.Info().
+		Str("type", "audit").
+		Str("controller", "user").
+		Str("requester_uid", requesterUID).
+		Str("given_uid", id).
+		Any("requested_updates", requestedUpdates).
+		Str("action", "updateUser").
+		Bool("privileged", true).
+		Msg("updated a user's data")
+}
+
+// GetHistory lists every change made to a user's data.
+//
+//	@Summary		Get user change history
+//	@Description	Lists every change made to a user's data, newest first, with who made it and what each field changed from and to. Only available to admins.
+//	@Tags			user
+//	@Produce		json
+//	@Param			id	path		string	true	"User ID"
+//	@Success		200	{object}	[]models.ChangeRecord
+//	@Failure		500
+//	@Security		ApiKeyAuth
+//	@Router			/users/{id}/history [get]
+func (ctrl UserController) GetHistory(w http.ResponseWriter, r *http.Request) {
+	renderChangeHistory(w, r, "user", models.ChangeDocumentUser, chi.URLParam(r, "id"))
+}
+
+// ListPendingApproval returns all users held for approval by the identity policy.
+//
+//	@Summary		List users pending approval
+//	@Description	Lists all users whose accounts were held for approval by the identity policy. Only available to admins.
+//	@Tags			user
+//	@Produce		json
+//	@Success		200	{object}	[]models.User
+//	@Failure		500
+//	@Security		ApiKeyAuth
+//	@Router			/users/pending [get]
+func (ctrl UserController) ListPendingApproval(w http.ResponseWriter, r *http.Request) {
+	users, err := models.GetUsersPendingApproval(r.Context())
+	if err != nil {
+		render.Render(w, r, util.ErrServer(err))
+		return
+	}
+
+	// Convert into list of renderers to turn into JSON
+	list := []render.Renderer{}
+	for _, user := range users {
+		u := user // Duplicate it before passing by reference to avoid only passing the last user obj
+		list = append(list, &u)
+	}
+
+	// Return as JSON array, fallback if it fails
+	if err := render.RenderList(w, r, list); err != nil {
+		render.Render(w, r, util.ErrRender(err))
+		return
+	}
+
 	// Write audit info log
 	token, err := util.GetUserTokenFromContext(r.Context())
 	requesterUID := ""
 	if err == nil {
 		requesterUID = token.UID
 	}
+	log.Info().
+		Str("type", "audit").
+		Str("controller", "user").
+		Str("requester_uid", requesterUID).
+		Str("action", "listPendingUsers").
+		Bool("privileged", true).
+		Msg("fetched all users pending approval")
+}
+
+type userControllerApproveRequestBody struct {
+	Kind          string `json:"kind"          validate:"omitempty,oneof=student staff guest"`
+	StudentNumber string `json:"studentNumber"`
+}
+
+// Approve approves a user held for approval by the identity policy.
+//
+//	@Summary		Approve a held user
+//	@Description	Approve a user that was held for approval by the identity policy, optionally setting their kind and student number. Any queued tickets for them are converted. Only available to admins.
+//	@Tags			user
+//	@Accept			json
+//	@Produce		json
+//	@Param			id		path		string								true	"User ID"
+//	@Param			body	body		userControllerApproveRequestBody	false	"Identity to give the user"
+//	@Success		200		{object}	models.User
+//	@Failure		400
+//	@Failure		404
+//	@Failure		500
+//	@Security		ApiKeyAuth
+//	@Router			/users/{id}/approve [post]
+func (ctrl UserController) Approve(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+
+	// Body is optional
+	var requestBody userControllerApproveRequestBody
+	if r.ContentLength != 0 {
+		decoder := json.NewDecoder(r.Body)
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&requestBody); err != nil {
+			render.Render(w, r, util.ErrInvalidRequest(err))
+			return
+		}
+		if err := util.NewValidator().Struct(requestBody); err != nil {
+			render.Render(w, r, util.ErrInvalidRequest(err))
+			return
+		}
+	}
+
+	token, err := util.GetUserTokenFromContext(r.Context())
+	requesterUID := ""
+	if err == nil {
+		requesterUID = token.UID
+	}
+
+	user, err := models.ApproveUser(r.Context(), id, requestBody.Kind, requestBody.StudentNumber, requesterUID)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			render.Render(w, r, util.ErrNotFound)
+			return
+		}
+
+		log.Error().Err(err).Str("uid", id).Msg("could not approve user")
+		render.Render(w, r, util.ErrServer(err))
+		return
+	}
+
+	// Return as JSON, fallback if it fails
+	if err := render.Render(w, r, &user); err != nil {
+		render.Render(w, r, util.ErrRender(err))
+		return
+	}
+
+	// Now that they're approved, give them anything that was waiting for them
+	convertQueuedTicketsForUser(r.Context(), user)
+
+	// Write audit info log
 	log.Info().
 		Str("type", "audit").
 		Str("controller", "user").
 		Str("requester_uid", requesterUID).
 		Str("given_uid", id).
-		Any("requested_updates", requestedUpdates).
-		Str("action", "updateUser").
+		Str("kind", user.Kind).
+		Str("action", "approveUser").
 		Bool("privileged", true).
-		Msg("updated a user's data")
+		Msg("approved a held user")
+}
+
+// Reject rejects a user held for approval by the identity policy.
+//
+//	@Summary		Reject a held user
+//	@Description	Reject a user that was held for approval by the identity policy, deleting their account. Only available to admins.
+//	@Tags			user
+//	@Param			id	path	string	true	"User ID"
+//	@Success		200
+//	@Failure		400
+//	@Failure		404
+//	@Failure		500
+//	@Security		ApiKeyAuth
+//	@Router			/users/{id}/reject [post]
+func (ctrl UserController) Reject(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+
+	// Only held users can be rejected, everyone else has to be removed by other means
+	user, err := models.GetUserByKey(r.Context(), "_id", id)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			render.Render(w, r, util.ErrNotFound)
+			return
+		}
+
+		log.Error().Err(err).Str("uid", id).Msg("could not fetch user")
+		render.Render(w, r, util.ErrServer(err))
+		return
+	}
+	if !user.PendingApproval {
+		render.Render(w, r, util.ErrInvalidRequest(fmt.Errorf("user is not pending approval")))
+		return
+	}
+
+	// Delete the account itself first so they can't keep using it
+	if err := lib.Auth.Client.DeleteUser(r.Context(), id); err != nil && !auth.IsUserNotFound(err) {
+		log.Error().Err(err).Str("uid", id).Msg("could not delete user from auth")
+		render.Render(w, r, util.ErrServer(err))
+		return
+	}
+	if err := models.DeleteUser(r.Context(), id); err != nil && err != mongo.ErrNoDocuments {
+		log.Error().Err(err).Str("uid", id).Msg("could not delete user from db")
+		render.Render(w, r, util.ErrServer(err))
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+
+	// Write audit info log
+	token, err := util.GetUserTokenFromContext(r.Context())
+	requesterUID := ""
+	if err == nil {
+		requesterUID = token.UID
+	}
+	log.Info().
+		Str("type", "audit").
+		Str("controller", "user").
+		Str("requester_uid", requesterUID).
+		Str("given_uid", id).
+		Str("email", user.Email).
+		Str("action", "rejectUser").
+		Bool("privileged", true).
+		Msg("rejected a held user")
+}
+
+// convertQueuedTicketsForUser looks through queued tickets and creates any that may belong to the user.
+func convertQueuedTicketsForUser(ctx context.Context, user models.User) {
+	queuedTickets, err := models.GetQueuedTicketsForMatcher(ctx, models.MatcherForUser(user))
+	if err != nil {
+		log.Error().Err(err).Str("uid", user.ID).Msg("could not get queued tickets")
+		return
+	}
+
+	// TODO: Consider using goroutines? Not bothering right now since too complex to just register 1-2 tickets
+	for i, queuedTicket := range queuedTickets {
+		// No point in updating name multiple times
+		ticket, err := models.ConvertQueuedTicketForUser(ctx, queuedTicket, user, i == 0)
+		if err != nil {
+			log.Error().Err(err).Any("queuedTicket", queuedTicket).Str("uid", user.ID).Msg("could not convert queued ticket to ticket")
+			continue
+		}
+		log.Info().Any("ticket", ticket).Str("uid", user.ID).Msg("converted queued ticket to ticket")
+	}
+}
+
+// SetAdmin grants or revokes a user's admin access.
+//
+//	@Summary		Set admin access
+//	@Description	Grants or revokes a user's admin and superadmin access. If admin grants need approval, giving a user more access than they have saves an approval request for another superadmin instead, while taking any access away always happens right away and signs them out. Only available to superadmins.
+//	@Tags			user
+//	@Accept			json
+//	@Produce		json
+//	@Param			id		path		string								true	"User ID"
+//	@Param			access	body		userControllerSetAdminRequestBody	true	"New access"
+//	@Success		200
+//	@Success		202		{object}	models.ApprovalRequest
+//	@Failure		400
+//	@Failure		403
+//	@Failure		404
+//	@Failure		409
+//	@Failure		500
+//	@Security		ApiKeyAuth
+//	@Router			/users/{id}/admin [put]
+func (ctrl UserController) SetAdmin(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+
+	var body userControllerSetAdminRequestBody
+	bodyDecoder := json.NewDecoder(r.Body)
+	bodyDecoder.DisallowUnknownFields()
+	if err := bodyDecoder.Decode(&body); err != nil {
+		log.Error().Err(err).Msg("could not parse body")
+		render.Render(w, r, util.ErrInvalidRequest(err))
+		return
+	}
+	if body.SuperAdmin && !body.Admin {
+		render.Render(w, r, util.ErrInvalidRequest(
+			util.NewValidationError(nil, util.AppCodeInvalidBody, "superadmin", "admin", "superadmins must also be admins"),
+		))
+		return
+	}
+
+	if exists, err := models.CheckIfUserExists(r.Context(), id); err != nil {
+		log.Error().Err(err).Str("uid", id).Msg("could not check if user exists")
+		render.Render(w, r, util.ErrServer(err))
+		return
+	} else if !exists {
+		render.Render(w, r, util.ErrNotFound)
+		return
+	}
+
+	token, err := util.GetUserTokenFromContext(r.Context())
+	requesterUID := ""
+	if err == nil {
+		requesterUID = token.UID
+	}
+
+	target, err := lib.Auth.Client.GetUser(r.Context(), id)
+	if auth.IsUserNotFound(err) {
+		render.Render(w, r, util.ErrNotFound)
+		return
+	} else if err != nil {
+		log.Error().Err(err).Str("uid", id).Msg("could not get user's current access")
+		render.Render(w, r, util.ErrServer(err))
+		return
+	}
+
+	// Taking access away is never held up, since that's what you want when an account is compromised
+	if adminAccessNeedsApproval(lib.Approvals, target.CustomClaims, body.Admin, body.SuperAdmin) {
+		requestApproval(w, r, "user", models.ApprovalRequest{
+			Action:      lib.ApprovalActionGrantAdmin,
+			UserID:      id,
+			Admin:       body.Admin,
+			SuperAdmin:  body.SuperAdmin,
+			RequestedBy: requesterUID,
+		})
+		return
+	}
+
+	if err := setAdminAccess(r.Context(), id, body.Admin, body.SuperAdmin, requesterUID); err != nil {
+		log.Error().Err(err).Str("uid", id).Msg("could not set admin access")
+		render.Render(w, r, util.ErrServer(err))
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+
+	// Write audit info log
+	log.Info().
+		Str("type", "audit").
+		Str("controller", "user").
+		Str("requester_uid", requesterUID).
+		Str("given_uid", id).
+		Bool("admin", body.Admin).
+		Bool("superadmin", body.SuperAdmin).
+		Str("action", "setAdmin").
+		Bool("privileged", true).
+		Msg("set a user's admin access")
+}
+
+// adminAccessLevel ranks admin access, so that a change to it can be told apart as a grant or a
+// reduction. Superadmins are always admins too.
+func adminAccessLevel(admin bool, superAdmin bool) int {
+	switch {
+	case admin && superAdmin:
+		return 2
+	case admin:
+		return 1
+	default:
+		return 0
+	}
+}
+
+// claimsAdminAccessLevel is the admin access level a user's current custom claims give them.
+func claimsAdminAccessLevel(claims map[string]interface{}) int {
+	admin, _ := claims["admin"].(bool)
+	superAdmin, _ := claims["superadmin"].(bool)
+	return adminAccessLevel(admin, superAdmin)
+}
+
+// adminAccessNeedsApproval checks whether a change to a user's admin access has to wait for approval,
+// which is only ever the case when it gives them more access than their current claims do.
+func adminAccessNeedsApproval(policy *lib.ApprovalPolicy, claims map[string]interface{}, admin bool, superAdmin bool) bool {
+	return adminAccessLevel(admin, superAdmin) > claimsAdminAccessLevel(claims) &&
+		policy.Requires(lib.ApprovalActionGrantAdmin)
+}
+
+// adminAccessReduced checks whether a change to a user's admin access takes any of it away.
+func adminAccessReduced(claims map[string]interface{}, admin bool, superAdmin bool) bool {
+	return adminAccessLevel(admin, superAdmin) < claimsAdminAccessLevel(claims)
+}
+
+// setAdminAccess updates a user's admin claims and their saved profile to match. Sessions are
+// revoked whenever access is taken away, even from a superadmin who stays an admin, so the routes
+// they lost stop accepting their current token.
+func setAdminAccess(ctx context.Context, uid string, admin bool, superAdmin bool, changedBy string) error {
+	user, err := lib.Auth.Client.GetUser(ctx, uid)
+	if err != nil {
+		return err
+	}
+
+	claims := map[string]interface{}{"admin": admin, "superadmin": admin && superAdmin}
+	if err := lib.Auth.Client.SetCustomUserClaims(ctx, uid, claims); err != nil {
+		return err
+	}
+	if adminAccessReduced(user.CustomClaims, admin, superAdmin) {
+		if err := lib.Auth.Client.RevokeRefreshTokens(ctx, uid); err != nil {
+			return err
+		}
+	}
+
+	_, err = models.UpdateExistingUserByKeys(ctx, uid, claims, models.UpdateMeta{ChangedBy: changedBy})
+	if err != nil && err != models.ErrNoDocumentModified {
+		return err
+	}
+	return nil
 }
@@ -0,0 +1,47 @@
+package controllers
+
+import (
+	"testing"
+
+	"github.com/aritrosaha10/frasertickets/lib"
+)
+
+func TestAdminAccessChanges(t *testing.T) {
+	policy := &lib.ApprovalPolicy{RequiredActions: map[string]bool{lib.ApprovalActionGrantAdmin: true}}
+	none := map[string]interface{}{}
+	admin := map[string]interface{}{"admin": true, "superadmin": false}
+	superAdmin := map[string]interface{}{"admin": true, "superadmin": true}
+
+	tests := []struct {
+		name          string
+		current       map[string]interface{}
+		admin         bool
+		superAdmin    bool
+		needsApproval bool
+		reduced       bool
+	}{
+		{name: "grant admin is held", current: none, admin: true, needsApproval: true},
+		{name: "grant superadmin is held", current: admin, admin: true, superAdmin: true, needsApproval: true},
+		{name: "demote superadmin is immediate", current: superAdmin, admin: true, reduced: true},
+		{name: "revoke superadmin is immediate", current: superAdmin, reduced: true},
+		{name: "revoke admin is immediate", current: admin, reduced: true},
+		{name: "keeping access is immediate", current: admin, admin: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			needsApproval := adminAccessNeedsApproval(policy, test.current, test.admin, test.superAdmin)
+			if needsApproval != test.needsApproval {
+				t.Errorf("expected needing approval to be %v, got %v", test.needsApproval, needsApproval)
+			}
+			reduced := adminAccessReduced(test.current, test.admin, test.superAdmin)
+			if reduced != test.reduced {
+				t.Errorf("expected sessions to be revoked to be %v, got %v", test.reduced, reduced)
+			}
+		})
+	}
+
+	// Nothing waits when grants don't need approval
+	if adminAccessNeedsApproval(&lib.ApprovalPolicy{}, none, true, true) {
+		t.Error("expected grants to go through right away when approval isn't required")
+	}
+}
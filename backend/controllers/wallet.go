@@ -0,0 +1,124 @@
+package controllers
+
+import (
+	"net/http"
+
+	"github.com/aritrosaha10/frasertickets/middleware"
+	"github.com/aritrosaha10/frasertickets/models"
+	"github.com/aritrosaha10/frasertickets/util"
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/render"
+	"github.com/rs/zerolog/log"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+type WalletController struct{}
+
+func (ctrl WalletController) Routes() chi.Router {
+	r := chi.NewRouter()
+	r.Use(middleware.AuthenticatorMiddleware) // User must be authenticated before using any of these endpoints
+
+	// Admin-only routes
+	r.Group(func(r chi.Router) {
+		r.Use(middleware.AdminAuthorizerMiddleware)
+		r.Get("/sync-jobs", ctrl.ListSyncJobs)             // GET /wallet/sync-jobs - returns queued and failed google wallet syncs, only available to admins
+		r.Post("/sync-jobs/{id}/retry", ctrl.RetrySyncJob) // POST /wallet/sync-jobs/{id}/retry - retries a failed google wallet sync, only available to admins
+	})
+
+	return r
+}
+
+// ListSyncJobs returns changes waiting to be synced to Google Wallet.
+//
+//	@Summary		List wallet sync jobs
+//	@Description	Lists event and ticket changes that still have to reach Google Wallet passes, most recently changed first. Failed jobs have run out of retries and need to be retried by an admin. Only available to admins.
+//	@Tags			wallet
+//	@Produce		json
+//	@Param			status	query		string	false	"pending, failed or all (default)"
+//	@Success		200		{object}	[]models.WalletSyncJob
+//	@Failure		400
+//	@Failure		500
+//	@Security		ApiKeyAuth
+//	@Router			/wallet/sync-jobs [get]
+func (ctrl WalletController) ListSyncJobs(w http.ResponseWriter, r *http.Request) {
+	filter, err := models.WalletSyncStatusFilter(r.URL.Query().Get("status"))
+	if err != nil {
+		render.Render(w, r, util.ErrInvalidRequest(err))
+		return
+	}
+
+	jobs, err := models.GetWalletSyncJobs(r.Context(), filter)
+	if err != nil {
+		log.Error().Err(err).Msg("could not fetch wallet sync jobs")
+		render.Render(w, r, util.ErrServer(err))
+		return
+	}
+
+	// Convert into list of renderers to turn into JSON
+	list := []render.Renderer{}
+	for _, job := range jobs {
+		jb := job // Duplicate it before passing by reference to avoid only passing the last job
+		list = append(list, &jb)
+	}
+
+	// Return as JSON array, fallback if it fails
+	if err := render.RenderList(w, r, list); err != nil {
+		render.Render(w, r, util.ErrRender(err))
+		return
+	}
+}
+
+// RetrySyncJob puts a failed wallet sync back in line.
+//
+//	@Summary		Retry a wallet sync job
+//	@Description	Puts a wallet sync job that ran out of retries back in line with its attempts reset. It runs on the next sync. Only available to admins.
+//	@Tags			wallet
+//	@Produce		json
+//	@Param			id	path		string	true	"Wallet sync job ID"
+//	@Success		200	{object}	models.WalletSyncJob
+//	@Failure		400
+//	@Failure		404
+//	@Failure		500
+//	@Security		ApiKeyAuth
+//	@Router			/wallet/sync-jobs/{id}/retry [post]
+func (ctrl WalletController) RetrySyncJob(w http.ResponseWriter, r *http.Request) {
+	id, err := primitive.ObjectIDFromHex(chi.URLParam(r, "id"))
+	if err != nil {
+		log.Error().Err(err).Msg("could not convert id to objectid")
+		render.Render(w, r, util.ErrInvalidRequest(err))
+		return
+	}
+
+	job, err := models.RetryWalletSyncJob(r.Context(), id)
+	if err == models.ErrNotFound {
+		render.Render(w, r, util.ErrNotFound)
+		return
+	} else if err != nil {
+		log.Error().Err(err).Msg("could not retry wallet sync job")
+		render.Render(w, r, util.ErrServer(err))
+		return
+	}
+
+	// Return as JSON, fallback if it fails
+	if err := render.Render(w, r, &job); err != nil {
+		render.Render(w, r, util.ErrRender(err))
+		return
+	}
+
+	// Write audit info log
+	token, err := util.GetUserTokenFromContext(r.Context())
+	requesterUID := ""
+	if err == nil {
+		requesterUID = token.UID
+	}
+	log.Info().
+		Str("type", "audit").
+		Str("controller", "wallet").
+		Str("requester_uid", requesterUID).
+		Str("job_id", id.Hex()).
+		Str("kind", job.Kind).
+		Str("target_id", job.TargetID.Hex()).
+		Str("action", "retryWalletSyncJob").
+		Bool("privileged", true).
+		Msg("retried wallet sync job")
+}
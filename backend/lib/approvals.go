@@ -0,0 +1,74 @@
+package lib
+
+import (
+	"os"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	ApprovalActionDeleteEvent       = "deleteEvent"
+	ApprovalActionBulkDeleteTickets = "bulkDeleteTickets"
+	ApprovalActionGrantAdmin        = "grantAdmin"
+)
+
+const defaultApprovalTTL = 24 * time.Hour
+
+var (
+	Approvals *ApprovalPolicy
+)
+
+// ApprovalPolicy decides which destructive admin actions need a second admin to sign off before
+// they run, and for how long a request can wait for approval. It's configured per deployment
+// through APPROVAL_REQUIRED_ACTIONS (comma separated, or "none") and APPROVAL_TTL.
+type ApprovalPolicy struct {
+	RequiredActions map[string]bool
+	TTL             time.Duration
+}
+
+func CreateNewApprovalPolicy() *ApprovalPolicy {
+	// Everything needs approval unless turned off
+	policy := &ApprovalPolicy{
+		RequiredActions: map[string]bool{
+			ApprovalActionDeleteEvent:       true,
+			ApprovalActionBulkDeleteTickets: true,
+			ApprovalActionGrantAdmin:        true,
+		},
+		TTL: defaultApprovalTTL,
+	}
+
+	if actionsRaw, ok := os.LookupEnv("APPROVAL_REQUIRED_ACTIONS"); ok {
+		knownActions := policy.RequiredActions
+		policy.RequiredActions = map[string]bool{}
+		for _, action := range strings.Split(actionsRaw, ",") {
+			action = strings.TrimSpace(action)
+			if action == "" || action == "none" {
+				continue
+			}
+			if !knownActions[action] {
+				log.Fatal().Str("action", action).Msg("unknown action in APPROVAL_REQUIRED_ACTIONS")
+			}
+			policy.RequiredActions[action] = true
+		}
+	}
+
+	if ttlRaw := os.Getenv("APPROVAL_TTL"); ttlRaw != "" {
+		ttl, err := time.ParseDuration(ttlRaw)
+		if err != nil || ttl <= 0 {
+			log.Fatal().Err(err).Str("ttl", ttlRaw).Msg("could not parse APPROVAL_TTL")
+		}
+		policy.TTL = ttl
+	}
+
+	return policy
+}
+
+// Requires checks whether an action has to be approved by a second admin before it runs.
+func (policy *ApprovalPolicy) Requires(action string) bool {
+	if policy == nil {
+		return false
+	}
+	return policy.RequiredActions[action]
+}
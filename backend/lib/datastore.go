@@ -47,3 +47,26 @@ func (ds *MongoDatastore) Disconnect() {
 		panic(err)
 	}
 }
+
+// WithTransaction runs fn inside of a MongoDB transaction, committing if it returns
+// no error and aborting otherwise. If ctx already belongs to a session, fn simply runs
+// as part of that session's transaction so that model functions can be nested freely.
+//
+// Transient transaction & commit errors are retried by the driver.
+func (ds *MongoDatastore) WithTransaction(
+	ctx context.Context,
+	fn func(sessCtx mongo.SessionContext) (interface{}, error),
+) (interface{}, error) {
+	// Reuse the existing session if we're already inside of one
+	if session := mongo.SessionFromContext(ctx); session != nil {
+		return fn(mongo.NewSessionContext(ctx, session))
+	}
+
+	session, err := ds.client.StartSession()
+	if err != nil {
+		return nil, err
+	}
+	defer session.EndSession(ctx)
+
+	return session.WithTransaction(ctx, fn)
+}
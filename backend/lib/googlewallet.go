@@ -1,250 +1,287 @@
 package lib
 
 import (
+	"bytes"
 	"context"
+	"crypto/rsa"
 	"encoding/json"
 	"fmt"
+	"io"
 	"net/http"
+	"net/url"
 	"os"
+	"strings"
+	"time"
 
 	"github.com/aritrosaha10/frasertickets/util"
 	"github.com/golang-jwt/jwt"
-	"github.com/joho/godotenv"
 	"github.com/rs/zerolog/log"
-	oauthJwt "golang.org/x/oauth2/jwt"
 )
 
 const (
-	batchUrl  = "https://walletobjects.googleapis.com/batch"
-	classUrl  = "https://walletobjects.googleapis.com/walletobjects/v1/eventTicketClass"
-	objectUrl = "https://walletobjects.googleapis.com/walletobjects/v1/eventTicketObject"
+	defaultGoogleWalletAPIURL     = "https://walletobjects.googleapis.com/walletobjects/v1"
+	defaultGoogleWalletIssuerName = "FraserTickets // John Fraser SAC"
+	defaultGoogleWalletSiteURL    = "https://tickets.johnfrasersac.com"
+	googleWalletSaveURL           = "https://pay.google.com/gp/v/save/"
+	googleWalletScope             = "https://www.googleapis.com/auth/wallet_object.issuer"
 )
 
 var (
-	httpClient  *http.Client
-	credentials *oauthJwt.Config
-	issuerId    string
-	issuerName  string
+	GoogleWallet *GoogleWalletClient
 )
 
-type WalletEventClass struct {
-	id           string
-	suffix       string
-	name         string
-	heroImageUri string
-	longitude    float32
-	latitude     float32
-	// expiryDate   time.Time
+// GoogleWalletClient upserts event ticket classes and objects through the Google Wallet REST API, and
+// signs the links owners use to save their tickets. The API URL can be pointed at a local stand-in
+// server through GOOGLE_WALLET_API_URL, in which case requests aren't authenticated.
+type GoogleWalletClient struct {
+	APIURL     string
+	IssuerID   string
+	IssuerName string
+	SiteURL    string   // Frontend the passes link back to, ex. https://tickets.johnfrasersac.com
+	Origins    []string // Sites allowed to show the save button
+
+	HTTPClient   *http.Client
+	SigningEmail string          // Service account the save links are issued by
+	SigningKey   *rsa.PrivateKey // Private key of the service account
+}
+
+// WalletLocalizedString is a piece of text shown on a pass.
+type WalletLocalizedString struct {
+	DefaultValue WalletTranslatedString `json:"defaultValue"`
+}
+
+type WalletTranslatedString struct {
+	Language string `json:"language"`
+	Value    string `json:"value"`
+}
+
+// WalletText makes English text for a pass.
+func WalletText(value string) *WalletLocalizedString {
+	return &WalletLocalizedString{DefaultValue: WalletTranslatedString{Language: "en-US", Value: value}}
+}
+
+type WalletImage struct {
+	SourceURI          WalletImageURI         `json:"sourceUri"`
+	ContentDescription *WalletLocalizedString `json:"contentDescription,omitempty"`
+}
+
+type WalletImageURI struct {
+	URI string `json:"uri"`
+}
+
+type WalletEventVenue struct {
+	Name    *WalletLocalizedString `json:"name,omitempty"`
+	Address *WalletLocalizedString `json:"address,omitempty"`
+}
+
+type WalletEventDateTime struct {
+	Start string `json:"start,omitempty"` // ISO 8601
+	End   string `json:"end,omitempty"`   // ISO 8601
+}
+
+// WalletEventTicketClass holds everything shared between tickets for the same event.
+type WalletEventTicketClass struct {
+	ID                 string                 `json:"id"` // issuer ID + "." + suffix
+	IssuerName         string                 `json:"issuerName"`
+	EventID            string                 `json:"eventId,omitempty"`
+	EventName          *WalletLocalizedString `json:"eventName"`
+	ReviewStatus       string                 `json:"reviewStatus"`
+	Venue              *WalletEventVenue      `json:"venue,omitempty"`
+	DateTime           *WalletEventDateTime   `json:"dateTime,omitempty"`
+	Logo               *WalletImage           `json:"logo,omitempty"`
+	HeroImage          *WalletImage           `json:"heroImage,omitempty"`
+	HexBackgroundColor string                 `json:"hexBackgroundColor,omitempty"`
 }
 
-type WalletTicketClass struct {
-	ownerName     string
-	studentNumber string
-	qrCodeValue   string
-	id            string
-	event         *WalletEventClass
-	jwt           string
+type WalletBarcode struct {
+	Type          string `json:"type"` // ex. QR_CODE
+	Value         string `json:"value"`
+	AlternateText string `json:"alternateText,omitempty"`
 }
 
-func InitializeGoogleWallet(ctx context.Context) {
-	var err error
-	credentials, err = util.PrepareJWTConfigFromEnv("https://www.googleapis.com/auth/wallet_object.issuer")
-	if err != nil && err.Error() != "could not find FIREBASE_PROJECT_ID in env" {
-		log.Fatal().Err(err).Msg("could not marshal firebase creds from env")
-	} else if err != nil {
-		log.Fatal().Err(err).Msg("could not generate creds")
+type WalletTextModule struct {
+	ID     string `json:"id"`
+	Header string `json:"header"`
+	Body   string `json:"body"`
+}
+
+type WalletLinksModule struct {
+	URIs []WalletURI `json:"uris"`
+}
+
+type WalletURI struct {
+	ID          string `json:"id,omitempty"`
+	URI         string `json:"uri"`
+	Description string `json:"description,omitempty"`
+}
+
+// WalletEventTicketObject is a single person's ticket, shown using its class.
+type WalletEventTicketObject struct {
+	ID               string             `json:"id"` // issuer ID + "." + suffix
+	ClassID          string             `json:"classId"`
+	State            string             `json:"state"` // ACTIVE, COMPLETED, EXPIRED or INACTIVE
+	TicketHolderName string             `json:"ticketHolderName,omitempty"`
+	TicketNumber     string             `json:"ticketNumber,omitempty"`
+	Barcode          *WalletBarcode     `json:"barcode,omitempty"`
+	TextModulesData  []WalletTextModule `json:"textModulesData,omitempty"`
+	LinksModuleData  *WalletLinksModule `json:"linksModuleData,omitempty"`
+}
+
+// WalletAPIError is returned when the Wallet API responds with an error status.
+type WalletAPIError struct {
+	StatusCode int
+	Body       string
+}
+
+func (err *WalletAPIError) Error() string {
+	return fmt.Sprintf("google wallet api responded with %d: %s", err.StatusCode, err.Body)
+}
+
+// Temporary reports whether the same request might work if tried again later.
+func (err *WalletAPIError) Temporary() bool {
+	return err.StatusCode == http.StatusTooManyRequests || err.StatusCode >= 500
+}
+
+// CreateNewGoogleWallet sets up the Wallet API client from the environment. Wallet passes are
+// optional, so nil is returned if GOOGLE_WALLET_ISSUER_ID isn't set.
+func CreateNewGoogleWallet(ctx context.Context) *GoogleWalletClient {
+	issuerID := os.Getenv("GOOGLE_WALLET_ISSUER_ID")
+	if issuerID == "" {
+		log.Warn().Msg("GOOGLE_WALLET_ISSUER_ID not found in env, wallet passes are disabled")
+		return nil
+	}
+
+	wallet := &GoogleWalletClient{
+		APIURL:     defaultGoogleWalletAPIURL,
+		IssuerID:   issuerID,
+		IssuerName: defaultGoogleWalletIssuerName,
+		SiteURL:    defaultGoogleWalletSiteURL,
+	}
+	if issuerName := os.Getenv("GOOGLE_WALLET_ISSUER_NAME"); issuerName != "" {
+		wallet.IssuerName = issuerName
+	}
+	if siteURL := os.Getenv("GOOGLE_WALLET_SITE_URL"); siteURL != "" {
+		wallet.SiteURL = strings.TrimSuffix(siteURL, "/")
+	}
+	wallet.Origins = []string{wallet.SiteURL}
+	if originsRaw := os.Getenv("GOOGLE_WALLET_ORIGINS"); originsRaw != "" {
+		wallet.Origins = strings.Split(originsRaw, ",")
 	}
 
-	issuerName = "FraserTickets // John Fraser SAC"
+	// Save links are signed with the same service account as everything else
+	credentials, err := util.PrepareJWTConfigFromEnv(googleWalletScope)
+	if err != nil {
+		log.Fatal().Err(err).Msg("could not prepare google wallet credentials from env")
+	}
+	wallet.SigningEmail = credentials.Email
+	wallet.SigningKey, err = jwt.ParseRSAPrivateKeyFromPEM(credentials.PrivateKey)
+	if err != nil {
+		log.Fatal().Err(err).Msg("could not parse google wallet signing key")
+	}
 
-	httpClient = credentials.Client(ctx)
-	issuerId = os.Getenv("GOOGLE_WALLET_ISSUER_ID")
-	if issuerId == "" {
-		log.Fatal().Msg("GOOGLE_WALLET_ISSUER_ID not found in env")
+	// Stand-in servers don't need to be authenticated with
+	if apiURL := os.Getenv("GOOGLE_WALLET_API_URL"); apiURL != "" {
+		wallet.APIURL = strings.TrimSuffix(apiURL, "/")
+		wallet.HTTPClient = &http.Client{Timeout: 10 * time.Second}
+	} else {
+		wallet.HTTPClient = credentials.Client(ctx)
+		wallet.HTTPClient.Timeout = 10 * time.Second
 	}
+
+	return wallet
 }
 
-func CreateNewWalletEventClass(id string, suffix string, name string, heroImageUri string, longitude float32, latitude float32) (*WalletEventClass, error) {
-	e := &WalletEventClass{}
-	e.id = id
-	e.suffix = suffix
-	e.name = name
-	e.heroImageUri = heroImageUri
-	e.longitude = longitude
-	e.latitude = latitude
+// ResourceID prefixes an ID suffix with the issuer ID, as the Wallet API expects for classes and
+// objects. Characters the API doesn't allow are replaced with underscores.
+func (wallet *GoogleWalletClient) ResourceID(suffix string) string {
+	safeSuffix := strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') || r == '.' || r == '_' || r == '-' {
+			return r
+		}
+		return '_'
+	}, suffix)
+	return wallet.IssuerID + "." + safeSuffix
+}
 
-	// res, err := httpClient.Post(classUrl, "application/json", bytes.NewBuffer([]byte(e.generateString())))
+// UpsertEventTicketClass creates an event ticket class, or updates it if it already exists.
+func (wallet *GoogleWalletClient) UpsertEventTicketClass(ctx context.Context, class WalletEventTicketClass) error {
+	return wallet.upsert(ctx, "eventTicketClass", class.ID, class)
+}
 
-	// if err != nil {
-	// 	return &WalletEventClass{}, err
-	// }
-	// b, _ := io.ReadAll(res.Body)
-	// log.Debug().Int("status-code", res.StatusCode).Str("api-response", string(b[:]))
+// UpsertEventTicketObject creates an event ticket object, or updates it if it already exists. Its
+// class has to exist first.
+func (wallet *GoogleWalletClient) UpsertEventTicketObject(ctx context.Context, object WalletEventTicketObject) error {
+	return wallet.upsert(ctx, "eventTicketObject", object.ID, object)
+}
 
-	return e, nil
+// PatchEventTicketClass changes only the given fields of an existing event ticket class. A
+// WalletAPIError with a 404 status is returned if the class was never created.
+func (wallet *GoogleWalletClient) PatchEventTicketClass(ctx context.Context, id string, patch interface{}) error {
+	return wallet.send(ctx, http.MethodPatch, wallet.APIURL+"/eventTicketClass/"+url.PathEscape(id), patch)
 }
 
-func (event WalletEventClass) generateString() string {
-	return fmt.Sprintf(`
-	{
-		"eventId": "%s",
-		"eventName": {
-			"defaultValue": {
-				"value": "%s",
-				"language": "en-US"
-			}
-		},
-		"issuerName": "%s",
-		"id": "%s.%s",
-		"reviewStatus": "UNDER_REVIEW",
-		"classTemplateInfo": {
-			"cardTemplateOverride": {
-			  "cardRowTemplateInfos": [
-				{
-				  "oneItem": {
-					"item": {
-					  "firstValue": {
-						"fields": [
-						  {
-							"fieldPath": "object.textModulesData['student_number']",
-						  },
-						],
-					  },
-					},
-				  },
-				},
-			  ],
-			},
-		  }
-	}
-	`, event.id, event.name, issuerName, issuerId, event.suffix)
-}
-
-func CreateNewWalletTicketClass(ownerName string, studentNumber string, qrCodeValue string, id string, event *WalletEventClass) (*WalletTicketClass, error) {
-	t := &WalletTicketClass{}
-	t.id = id
-	t.ownerName = ownerName
-	t.qrCodeValue = qrCodeValue
-	t.studentNumber = studentNumber
-	t.event = event
-
-	var payload map[string]interface{}
-	json.Unmarshal([]byte(fmt.Sprintf(`
-	{
-		"genericClasses": [%s],
-		"genericObjects": [%s]
-	}
-	`, event.generateString(), t.generateString())), &payload)
-
-	fmt.Println(event.generateString())
-	fmt.Println(t.generateString())
+// PatchEventTicketObject changes only the given fields of an existing event ticket object. A
+// WalletAPIError with a 404 status is returned if the object was never created.
+func (wallet *GoogleWalletClient) PatchEventTicketObject(ctx context.Context, id string, patch interface{}) error {
+	return wallet.send(ctx, http.MethodPatch, wallet.APIURL+"/eventTicketObject/"+url.PathEscape(id), patch)
+}
 
-	claims := jwt.MapClaims{
-		"iss":     credentials.Email,
-		"aud":     "google",
-		"origins": []string{"https://tickets.johnfrasersac.com"},
-		"typ":     "savetowallet",
-		"payload": payload,
+// upsert tries inserting a resource, and replaces it instead if the API says it already exists.
+func (wallet *GoogleWalletClient) upsert(ctx context.Context, resource string, id string, body interface{}) error {
+	err := wallet.send(ctx, http.MethodPost, wallet.APIURL+"/"+resource, body)
+	if apiErr, ok := err.(*WalletAPIError); ok && apiErr.StatusCode == http.StatusConflict {
+		return wallet.send(ctx, http.MethodPut, wallet.APIURL+"/"+resource+"/"+url.PathEscape(id), body)
 	}
+	return err
+}
 
-	// The service account credentials are used to sign the JWT
-	key, _ := jwt.ParseRSAPrivateKeyFromPEM(credentials.PrivateKey)
-	token, _ := jwt.NewWithClaims(jwt.SigningMethodRS256, claims).SignedString(key)
-
-	t.jwt = token
-
-	// res, err := httpClient.Post(classUrl, "application/json", bytes.NewBuffer([]byte(t.generateString())))
-
-	// if err != nil {
-	// 	return &WalletTicketClass{}, err
-	// }
-	// b, _ := io.ReadAll(res.Body)
-	// log.Debug().Int("status-code", res.StatusCode).Str("api-response", string(b[:]))
-
-	return t, nil
-}
-
-func (ticket WalletTicketClass) generateString() string {
-	return fmt.Sprintf(`
-	{
-		"classId": "%s.%s",
-		"ticketHolderName": "%s",
-		"logo": {
-			"sourceUri": {
-			  "uri": "https://tickets.johnfrasersac.com/logo.png"
-			},
-			"contentDescription": {
-			  	"defaultValue": {
-					"language": "en-US",
-					"value": "FraserTickets Logo"
-				},
-			},
-		},
-		"barcode": {
-			"type": "QR_CODE",
-			"value": "%s"
-		},
-		"locations": [
-			{
-				"latitude": %f,
-				"longitude": %f
-			}
-		],
-		"cardTitle": {
-			"defaultValue": {
-			  "language": "en-US",
-			  "value": "%s",
-			},
-		  },
-		  "subheader": {
-			"defaultValue": {
-			  "language": "en-US",
-			  "value": "Attendee",
-			},
-		  },
-		  "header": {
-			"defaultValue": {
-			  "language": "en-US",
-			  "value": "%s",
-			},
-		  },
-		  "textModulesData": [
-			{
-			  "id": "student_number",
-			  "header": "Student Number",
-			  "body": "%s",
-			},
-		  ],
-		"state": "ACTIVE",
-		"linksModuleData": {
-			"uris": [
-				{
-					"id": "LINK_MODULE_URI_ID",
-					"uri": "https://tickets.johnfrasersac.com/tickets/%s",
-					"description": "Original Ticket"
-				}
-			]
-		},
-		"ticketNumber": "%s",
-		"id": "%s.%s.%s",
-		"hexBackgroundColor": "#4285f4"
+func (wallet *GoogleWalletClient) send(ctx context.Context, method string, endpoint string, body interface{}) error {
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return err
 	}
-	`, issuerId, ticket.event.suffix, ticket.ownerName, ticket.event.heroImageUri, ticket.qrCodeValue, ticket.event.latitude, ticket.event.longitude, ticket.id, ticket.id, ticket.studentNumber, issuerId, ticket.event.suffix, ticket.id)
-}
 
-func main() {
-	// Load in environment file according to environment
-	env := os.Getenv("FRASERTICKETS_ENV")
-	if env == "" {
-		env = "development"
+	req, err := http.NewRequestWithContext(ctx, method, endpoint, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	res, err := wallet.HTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		resBody, _ := io.ReadAll(io.LimitReader(res.Body, 4096))
+		return &WalletAPIError{StatusCode: res.StatusCode, Body: string(resBody)}
 	}
-	godotenv.Load(".env." + env)
+	return nil
+}
 
-	InitializeGoogleWallet(context.Background())
+// SaveURL signs a link that adds existing event ticket objects to someone's Google Wallet.
+func (wallet *GoogleWalletClient) SaveURL(objectIDs ...string) (string, error) {
+	objects := make([]map[string]string, len(objectIDs))
+	for i, id := range objectIDs {
+		objects[i] = map[string]string{"id": id}
+	}
 
-	event, _ := CreateNewWalletEventClass("aaskldljkasd", "frasertickets", "semi-formal", "https://storage.googleapis.com/frasertickets-event-images/semi-formal-2023/semi-formal-2023-pic-1-v2.jpg", 0, 0)
-	ticket, _ := CreateNewWalletTicketClass("Aritro Saha", "123456", "tickets.johnfrasersac.com/admin/scan/asdjadsjkldsa", "jsdj231809asdkj", event)
+	claims := jwt.MapClaims{
+		"iss":     wallet.SigningEmail,
+		"aud":     "google",
+		"typ":     "savetowallet",
+		"iat":     time.Now().Unix(),
+		"origins": wallet.Origins,
+		"payload": map[string]interface{}{
+			"eventTicketObjects": objects,
+		},
+	}
 
-	fmt.Println("Add to Google Wallet link")
-	fmt.Println("https://pay.google.com/gp/v/save/" + ticket.jwt)
+	// The service account credentials are used to sign the JWT
+	token, err := jwt.NewWithClaims(jwt.SigningMethodRS256, claims).SignedString(wallet.SigningKey)
+	if err != nil {
+		return "", err
+	}
+	return googleWalletSaveURL + token, nil
 }
@@ -0,0 +1,196 @@
+package lib
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/golang-jwt/jwt"
+)
+
+type walletTestRequest struct {
+	Method string
+	Path   string
+	Body   map[string]interface{}
+}
+
+// newWalletTestServer starts a stand-in Wallet API that records every request and answers them with
+// the given handler, along with a client pointed at it.
+func newWalletTestServer(t *testing.T, respond func(w http.ResponseWriter, r *http.Request)) (*GoogleWalletClient, func() []walletTestRequest) {
+	t.Helper()
+
+	var (
+		mu       sync.Mutex
+		requests []walletTestRequest
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		raw, _ := io.ReadAll(r.Body)
+		var body map[string]interface{}
+		json.Unmarshal(raw, &body)
+
+		mu.Lock()
+		requests = append(requests, walletTestRequest{Method: r.Method, Path: r.URL.EscapedPath(), Body: body})
+		mu.Unlock()
+
+		if contentType := r.Header.Get("Content-Type"); contentType != "application/json" {
+			t.Errorf("expected a JSON request, got content type %q", contentType)
+		}
+		respond(w, r)
+	}))
+	t.Cleanup(server.Close)
+
+	wallet := &GoogleWalletClient{
+		APIURL:     server.URL,
+		IssuerID:   "3388000000012345678",
+		IssuerName: "Test Issuer",
+		HTTPClient: server.Client(),
+	}
+	return wallet, func() []walletTestRequest {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]walletTestRequest{}, requests...)
+	}
+}
+
+func TestWalletUpsertCreates(t *testing.T) {
+	wallet, requests := newWalletTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	object := WalletEventTicketObject{ID: wallet.ResourceID("ticket"), ClassID: wallet.ResourceID("event"), State: "ACTIVE"}
+	if err := wallet.UpsertEventTicketObject(context.Background(), object); err != nil {
+		t.Fatal(err)
+	}
+
+	got := requests()
+	if len(got) != 1 || got[0].Method != http.MethodPost || got[0].Path != "/eventTicketObject" {
+		t.Fatalf("expected a single insert, got %+v", got)
+	}
+	if got[0].Body["id"] != object.ID || got[0].Body["state"] != "ACTIVE" {
+		t.Errorf("expected the object to be sent, got %v", got[0].Body)
+	}
+}
+
+func TestWalletUpsertReplacesExisting(t *testing.T) {
+	wallet, requests := newWalletTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			w.WriteHeader(http.StatusConflict)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	})
+
+	class := WalletEventTicketClass{ID: wallet.ResourceID("event/1"), IssuerName: wallet.IssuerName, ReviewStatus: "UNDER_REVIEW"}
+	if err := wallet.UpsertEventTicketClass(context.Background(), class); err != nil {
+		t.Fatal(err)
+	}
+
+	got := requests()
+	if len(got) != 2 {
+		t.Fatalf("expected an insert then a replace, got %+v", got)
+	}
+	if got[1].Method != http.MethodPut || got[1].Path != "/eventTicketClass/3388000000012345678.event_1" {
+		t.Errorf("expected the class to be replaced by ID, got %s %s", got[1].Method, got[1].Path)
+	}
+}
+
+func TestWalletAPIErrors(t *testing.T) {
+	tests := []struct {
+		status    int
+		temporary bool
+	}{
+		{status: http.StatusBadRequest, temporary: false},
+		{status: http.StatusNotFound, temporary: false},
+		{status: http.StatusTooManyRequests, temporary: true},
+		{status: http.StatusServiceUnavailable, temporary: true},
+	}
+
+	for _, test := range tests {
+		wallet, _ := newWalletTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(test.status)
+			io.WriteString(w, `{"error": {"message": "nope"}}`)
+		})
+
+		err := wallet.PatchEventTicketObject(context.Background(), wallet.ResourceID("ticket"), map[string]string{"state": "EXPIRED"})
+		var apiErr *WalletAPIError
+		if !errors.As(err, &apiErr) {
+			t.Fatalf("expected a WalletAPIError for status %d, got %v", test.status, err)
+		}
+		if apiErr.StatusCode != test.status || !strings.Contains(apiErr.Body, "nope") {
+			t.Errorf("expected status %d with the response body, got %+v", test.status, apiErr)
+		}
+		if apiErr.Temporary() != test.temporary {
+			t.Errorf("expected Temporary() to be %v for status %d", test.temporary, test.status)
+		}
+	}
+}
+
+func TestWalletPatchSendsOnlyPatch(t *testing.T) {
+	wallet, requests := newWalletTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	id := wallet.ResourceID("ticket")
+	if err := wallet.PatchEventTicketObject(context.Background(), id, map[string]string{"state": "COMPLETED"}); err != nil {
+		t.Fatal(err)
+	}
+
+	got := requests()
+	if len(got) != 1 || got[0].Method != http.MethodPatch || got[0].Path != "/eventTicketObject/"+id {
+		t.Fatalf("expected a single patch of the object, got %+v", got)
+	}
+	if len(got[0].Body) != 1 || got[0].Body["state"] != "COMPLETED" {
+		t.Errorf("expected only the state to be sent, got %v", got[0].Body)
+	}
+}
+
+func TestWalletResourceID(t *testing.T) {
+	wallet := &GoogleWalletClient{IssuerID: "123"}
+	if id := wallet.ResourceID("event 1/ticket-2.a_b"); id != "123.event_1_ticket-2.a_b" {
+		t.Errorf("expected unsupported characters to be replaced, got %s", id)
+	}
+}
+
+func TestWalletSaveURL(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wallet := &GoogleWalletClient{
+		IssuerID:     "123",
+		Origins:      []string{"https://tickets.example.com"},
+		SigningEmail: "wallet@example.iam.gserviceaccount.com",
+		SigningKey:   key,
+	}
+
+	saveURL, err := wallet.SaveURL("123.a", "123.b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(saveURL, googleWalletSaveURL) {
+		t.Fatalf("expected a save link, got %s", saveURL)
+	}
+
+	claims := jwt.MapClaims{}
+	_, err = jwt.ParseWithClaims(strings.TrimPrefix(saveURL, googleWalletSaveURL), claims, func(token *jwt.Token) (interface{}, error) {
+		return &key.PublicKey, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims["iss"] != wallet.SigningEmail || claims["typ"] != "savetowallet" || claims["aud"] != "google" {
+		t.Errorf("unexpected claims %v", claims)
+	}
+	objects := claims["payload"].(map[string]interface{})["eventTicketObjects"].([]interface{})
+	if len(objects) != 2 || objects[1].(map[string]interface{})["id"] != "123.b" {
+		t.Errorf("expected both objects in the payload, got %v", objects)
+	}
+}
@@ -0,0 +1,204 @@
+package lib
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	IdentityKindStudent = "student"
+	IdentityKindStaff   = "staff"
+	IdentityKindGuest   = "guest"
+
+	IdentityOutcomeAllowed  = "allowed"  // can sign up right away
+	IdentityOutcomeHeld     = "held"     // account is kept, but needs admin approval
+	IdentityOutcomeRejected = "rejected" // account should be deleted
+)
+
+var (
+	Identity *IdentityPolicy
+)
+
+// IdentityAllowlistEntry lets a specific email sign up, even if it isn't from an allowed domain.
+type IdentityAllowlistEntry struct {
+	Email         string `json:"email"`
+	Kind          string `json:"kind"` // staff or guest, defaults to guest
+	StudentNumber string `json:"student_number"`
+	ExternalID    string `json:"external_id"`
+}
+
+// IdentityPolicy decides who can sign up and how their identity (ex. student number) is derived
+// from their account. It's configured per deployment, either through a JSON file given by
+// IDENTITY_POLICY_FILE or through individual environment variables.
+type IdentityPolicy struct {
+	AllowedDomains       []string                 `json:"allowed_domains"`
+	StudentNumberPattern string                   `json:"student_number_pattern"` // Regex run on the email, first capture group is the student #. Defaults to everything before the @ of an allowed domain
+	StudentNumberMapping map[string]string        `json:"student_number_mapping"` // Email -> student # overrides
+	Allowlist            []IdentityAllowlistEntry `json:"allowlist"`
+	HoldUnmatched        bool                     `json:"hold_unmatched"` // Hold accounts that don't match for approval instead of deleting them
+
+	studentNumberRegex *regexp.Regexp
+	allowlist          map[string]IdentityAllowlistEntry
+}
+
+// IdentityDecision is the result of running an email through the identity policy.
+type IdentityDecision struct {
+	Outcome       string
+	Kind          string
+	StudentNumber string
+	ExternalID    string
+}
+
+func CreateNewIdentityPolicy() *IdentityPolicy {
+	// Defaults match the original behaviour of only allowing PDSB accounts
+	policy := &IdentityPolicy{
+		AllowedDomains: []string{"pdsb.net"},
+	}
+
+	if policyFilename := os.Getenv("IDENTITY_POLICY_FILE"); policyFilename != "" {
+		policyFile, err := os.ReadFile(policyFilename)
+		if err != nil {
+			log.Fatal().Err(err).Str("filename", policyFilename).Msg("could not read identity policy file")
+		}
+		if err := json.Unmarshal(policyFile, policy); err != nil {
+			log.Fatal().Err(err).Str("filename", policyFilename).Msg("could not parse identity policy file")
+		}
+	} else {
+		if domainsRaw := os.Getenv("IDENTITY_ALLOWED_DOMAINS"); domainsRaw != "" {
+			policy.AllowedDomains = strings.Split(domainsRaw, ",")
+		}
+		if pattern := os.Getenv("IDENTITY_STUDENT_NUMBER_PATTERN"); pattern != "" {
+			policy.StudentNumberPattern = pattern
+		}
+		// Formatted as email:kind pairs separated by commas
+		if allowlistRaw := os.Getenv("IDENTITY_ALLOWLIST"); allowlistRaw != "" {
+			for _, entryRaw := range strings.Split(allowlistRaw, ",") {
+				email, kind, _ := strings.Cut(entryRaw, ":")
+				policy.Allowlist = append(policy.Allowlist, IdentityAllowlistEntry{Email: email, Kind: kind})
+			}
+		}
+		if holdRaw := os.Getenv("IDENTITY_HOLD_UNMATCHED"); holdRaw != "" {
+			hold, err := strconv.ParseBool(holdRaw)
+			if err != nil {
+				log.Fatal().Err(err).Msg("could not parse IDENTITY_HOLD_UNMATCHED as bool")
+			}
+			policy.HoldUnmatched = hold
+		}
+	}
+
+	if err := policy.prepare(); err != nil {
+		log.Fatal().Err(err).Msg("identity policy is invalid")
+	}
+
+	return policy
+}
+
+// prepare validates the policy and builds the lookup structures used during evaluation.
+func (policy *IdentityPolicy) prepare() error {
+	for i, domain := range policy.AllowedDomains {
+		policy.AllowedDomains[i] = strings.ToLower(strings.TrimPrefix(strings.TrimSpace(domain), "@"))
+	}
+
+	if policy.StudentNumberPattern == "" {
+		policy.StudentNumberPattern = defaultStudentNumberPattern(policy.AllowedDomains)
+	}
+	regex, err := regexp.Compile(policy.StudentNumberPattern)
+	if err != nil {
+		return fmt.Errorf("could not compile student number pattern: %w", err)
+	}
+	if regex.NumSubexp() != 1 {
+		return fmt.Errorf("student number pattern must have exactly one capture group")
+	}
+	policy.studentNumberRegex = regex
+
+	mapping := map[string]string{}
+	for email, studentNumber := range policy.StudentNumberMapping {
+		mapping[normalizeIdentityEmail(email)] = studentNumber
+	}
+	policy.StudentNumberMapping = mapping
+
+	policy.allowlist = map[string]IdentityAllowlistEntry{}
+	for _, entry := range policy.Allowlist {
+		entry.Email = normalizeIdentityEmail(entry.Email)
+		if entry.Kind == "" {
+			entry.Kind = IdentityKindGuest
+		}
+		if entry.Kind != IdentityKindStaff && entry.Kind != IdentityKindGuest && entry.Kind != IdentityKindStudent {
+			return fmt.Errorf("allowlist entry for '%s' has unknown kind '%s'", entry.Email, entry.Kind)
+		}
+		policy.allowlist[entry.Email] = entry
+	}
+
+	return nil
+}
+
+// Evaluate decides whether an account with the given email can sign up, and derives its identity.
+func (policy *IdentityPolicy) Evaluate(email string) IdentityDecision {
+	email = normalizeIdentityEmail(email)
+
+	// Individually allowlisted emails take priority over everything else
+	if entry, ok := policy.allowlist[email]; ok {
+		decision := IdentityDecision{
+			Outcome:       IdentityOutcomeAllowed,
+			Kind:          entry.Kind,
+			StudentNumber: entry.StudentNumber,
+			ExternalID:    entry.ExternalID,
+		}
+		if mapped, ok := policy.StudentNumberMapping[email]; ok {
+			decision.StudentNumber = mapped
+		}
+		return decision
+	}
+
+	if policy.isAllowedDomain(email) {
+		decision := IdentityDecision{Outcome: IdentityOutcomeAllowed}
+
+		if mapped, ok := policy.StudentNumberMapping[email]; ok {
+			decision.StudentNumber = mapped
+		} else if match := policy.studentNumberRegex.FindStringSubmatch(email); match != nil {
+			decision.StudentNumber = match[1]
+		}
+
+		// School accounts without a student number are staff accounts
+		if decision.StudentNumber != "" {
+			decision.Kind = IdentityKindStudent
+		} else {
+			decision.Kind = IdentityKindStaff
+		}
+		return decision
+	}
+
+	if policy.HoldUnmatched {
+		return IdentityDecision{Outcome: IdentityOutcomeHeld, Kind: IdentityKindGuest}
+	}
+	return IdentityDecision{Outcome: IdentityOutcomeRejected}
+}
+
+// defaultStudentNumberPattern takes everything before the @ as the student number, for any of the
+// allowed domains.
+func defaultStudentNumberPattern(domains []string) string {
+	quoted := make([]string, len(domains))
+	for i, domain := range domains {
+		quoted[i] = regexp.QuoteMeta(domain)
+	}
+	return `^(.+)@(?:` + strings.Join(quoted, "|") + `)$`
+}
+
+func (policy *IdentityPolicy) isAllowedDomain(email string) bool {
+	for _, domain := range policy.AllowedDomains {
+		if strings.HasSuffix(email, "@"+domain) {
+			return true
+		}
+	}
+	return false
+}
+
+func normalizeIdentityEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
@@ -0,0 +1,34 @@
+package middleware
+
+import (
+	"net/http"
+
+	"github.com/aritrosaha10/frasertickets/util"
+	"github.com/go-chi/render"
+	"github.com/rs/zerolog/log"
+)
+
+// SuperAdminAuthorizerMiddleware only lets superadmins through. It should be mounted after
+// AdminAuthorizerMiddleware, which takes care of checking for revoked tokens.
+func SuperAdminAuthorizerMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		isSuperAdmin, err := util.CheckIfSuperAdmin(r.Context())
+		if err != nil {
+			log.Error().Err(err).Msg("could not check authorization status")
+			render.Render(w, r, util.ErrServer(err))
+			return
+		}
+
+		if !isSuperAdmin {
+			uid := ""
+			if idToken, err := util.GetUserTokenFromContext(r.Context()); err == nil {
+				uid = idToken.UID
+			}
+			log.Warn().Str("uid", uid).Msg("unauthorized user attempting to access superadmin-only route")
+			render.Render(w, r, util.ErrForbidden)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,276 @@
+package models
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/aritrosaha10/frasertickets/lib"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	ApprovalStatusPending  = "pending"
+	ApprovalStatusApproved = "approved" // approved and currently running
+	ApprovalStatusExecuted = "executed"
+	ApprovalStatusFailed   = "failed" // approved, but the action itself failed
+	ApprovalStatusRejected = "rejected"
+	ApprovalStatusExpired  = "expired" // nobody approved it in time
+)
+
+// ApprovalRequest is a destructive admin action waiting on (or decided by) a second admin. Only the
+// target fields for the request's action are set. Decided requests are kept as an audit trail.
+type ApprovalRequest struct {
+	ID     primitive.ObjectID `json:"id"     bson:"_id,omitempty"`
+	Action string             `json:"action" bson:"action"` // deleteEvent, bulkDeleteTickets or grantAdmin
+
+	// What the action applies to
+	EventID    primitive.ObjectID `json:"eventID"              bson:"event_id,omitempty"`   // deleteEvent
+	TicketIDs  []string           `json:"ticketIDs,omitempty"  bson:"ticket_ids,omitempty"` // bulkDeleteTickets
+	Atomic     bool               `json:"atomic,omitempty"     bson:"atomic,omitempty"`     // bulkDeleteTickets
+	UserID     string             `json:"userID,omitempty"     bson:"user_id,omitempty"`    // grantAdmin
+	Admin      bool               `json:"admin,omitempty"      bson:"admin,omitempty"`      // grantAdmin
+	SuperAdmin bool               `json:"superadmin,omitempty" bson:"superadmin,omitempty"` // grantAdmin
+
+	Status      string    `json:"status"      bson:"status"`
+	RequestedBy string    `json:"requestedBy" bson:"requested_by"`
+	RequestedAt time.Time `json:"requestedAt" bson:"requested_at"`
+	ExpiresAt   time.Time `json:"expiresAt"   bson:"expires_at"`
+
+	// Filled in once someone approves or rejects it
+	DecidedBy      string             `json:"decidedBy,omitempty"      bson:"decided_by,omitempty"`
+	DecidedAt      *time.Time         `json:"decidedAt,omitempty"      bson:"decided_at,omitempty"`
+	Reason         string             `json:"reason,omitempty"         bson:"reason,omitempty"` // optional note from whoever decided
+	ExecutedAt     *time.Time         `json:"executedAt,omitempty"     bson:"executed_at,omitempty"`
+	ExecutionError string             `json:"executionError,omitempty" bson:"execution_error,omitempty"`
+	TicketResults  []BulkTicketResult `json:"ticketResults,omitempty"  bson:"ticket_results,omitempty"` // bulkDeleteTickets
+}
+
+func (request *ApprovalRequest) Render(w http.ResponseWriter, r *http.Request) error {
+	return nil
+}
+
+func CreateApprovalIndices(ctx context.Context) error {
+	// Requests are listed by status, newest first
+	statusIdxModel := mongo.IndexModel{
+		Keys: bson.D{
+			{Key: "status", Value: 1},
+			{Key: "requested_at", Value: -1},
+		},
+	}
+
+	// Try creating the index
+	opts := options.CreateIndexes().SetMaxTime(10 * time.Second)
+	_, err := lib.Datastore.Db.Collection(approvalsColName).
+		Indexes().
+		CreateOne(ctx, statusIdxModel, opts)
+	return err
+}
+
+// settle marks pending requests past their expiry time as expired. Expired requests are never
+// written back as such, since nothing can be done with them anyways.
+func (request *ApprovalRequest) settle() {
+	if request.Status == ApprovalStatusPending && !time.Now().Before(request.ExpiresAt) {
+		request.Status = ApprovalStatusExpired
+	}
+}
+
+// openApprovalRequestsFilter restricts a filter to requests that can still be approved.
+func openApprovalRequestsFilter(filter bson.M) bson.M {
+	filter["status"] = ApprovalStatusPending
+	filter["expires_at"] = bson.M{"$gt": time.Now()}
+	return filter
+}
+
+// ApprovalStatusFilter returns a filter matching approval requests with the given status. Pending
+// requests past their expiry time are treated as expired.
+func ApprovalStatusFilter(status string) (bson.M, error) {
+	switch status {
+	case ApprovalStatusPending:
+		return openApprovalRequestsFilter(bson.M{}), nil
+	case ApprovalStatusExpired:
+		return bson.M{"status": ApprovalStatusPending, "expires_at": bson.M{"$lte": time.Now()}}, nil
+	case ApprovalStatusApproved, ApprovalStatusExecuted, ApprovalStatusFailed, ApprovalStatusRejected:
+		return bson.M{"status": status}, nil
+	case "", "all":
+		return bson.M{}, nil
+	default:
+		return nil, fmt.Errorf("unknown approval status '%s'", status)
+	}
+}
+
+// GetApprovalRequests lists approval requests matching a filter, newest first.
+func GetApprovalRequests(ctx context.Context, filter bson.M) ([]ApprovalRequest, error) {
+	opts := options.Find().SetSort(bson.D{{Key: "requested_at", Value: -1}})
+	cursor, err := lib.Datastore.Db.Collection(approvalsColName).Find(ctx, filter, opts)
+	if err != nil {
+		return []ApprovalRequest{}, err
+	}
+
+	requests := []ApprovalRequest{}
+	if err := cursor.All(ctx, &requests); err != nil {
+		return []ApprovalRequest{}, err
+	}
+	for i := range requests {
+		requests[i].settle()
+	}
+	return requests, nil
+}
+
+func GetApprovalRequest(ctx context.Context, id primitive.ObjectID) (ApprovalRequest, error) {
+	var request ApprovalRequest
+	err := lib.Datastore.Db.Collection(approvalsColName).FindOne(ctx, bson.M{"_id": id}).Decode(&request)
+	if err == mongo.ErrNoDocuments {
+		return ApprovalRequest{}, ErrNotFound
+	} else if err != nil {
+		return ApprovalRequest{}, err
+	}
+
+	request.settle()
+	return request, nil
+}
+
+// CreateApprovalRequest saves a request for an action to be approved by another admin, expiring
+// after the approval policy's time limit. Only one request can be open for the same event or user.
+func CreateApprovalRequest(ctx context.Context, request ApprovalRequest) (ApprovalRequest, error) {
+	request.ID = primitive.NilObjectID
+	request.Status = ApprovalStatusPending
+	request.RequestedAt = time.Now()
+	request.ExpiresAt = request.RequestedAt.Add(lib.Approvals.TTL)
+
+	// Catch the same thing being asked for twice
+	duplicateFilter := bson.M{}
+	switch request.Action {
+	case lib.ApprovalActionDeleteEvent:
+		duplicateFilter["event_id"] = request.EventID
+	case lib.ApprovalActionGrantAdmin:
+		duplicateFilter["user_id"] = request.UserID
+	}
+	if len(duplicateFilter) > 0 {
+		duplicateFilter["action"] = request.Action
+		count, err := lib.Datastore.Db.Collection(approvalsColName).CountDocuments(ctx, openApprovalRequestsFilter(duplicateFilter))
+		if err != nil {
+			return ApprovalRequest{}, err
+		}
+		if count > 0 {
+			return ApprovalRequest{}, ErrAlreadyExists
+		}
+	}
+
+	res, err := lib.Datastore.Db.Collection(approvalsColName).InsertOne(ctx, request)
+	if err != nil {
+		return ApprovalRequest{}, err
+	}
+	request.ID = res.InsertedID.(primitive.ObjectID)
+	return request, nil
+}
+
+// checkApprover makes sure someone is allowed to approve a request. Nobody can approve their own
+// request, and admin grants can only be approved by superadmins.
+func checkApprover(request ApprovalRequest, approverUID string, approverIsSuperAdmin bool) error {
+	if request.RequestedBy == approverUID {
+		return ErrApproverNotAllowed
+	}
+	if request.Action == lib.ApprovalActionGrantAdmin && !approverIsSuperAdmin {
+		return ErrApproverNotAllowed
+	}
+	return nil
+}
+
+// ClaimApprovalRequest approves a pending request, returning it so the action can be run. The
+// request is moved out of pending in a single update, so it can only ever be approved once.
+func ClaimApprovalRequest(
+	ctx context.Context,
+	id primitive.ObjectID,
+	approverUID string,
+	approverIsSuperAdmin bool,
+	reason string,
+) (ApprovalRequest, error) {
+	request, err := GetApprovalRequest(ctx, id)
+	if err != nil {
+		return ApprovalRequest{}, err
+	}
+	if err := checkApprover(request, approverUID, approverIsSuperAdmin); err != nil {
+		return ApprovalRequest{}, err
+	}
+
+	return decideApprovalRequest(ctx, id, ApprovalStatusApproved, approverUID, reason)
+}
+
+// RejectApprovalRequest turns down a pending request so that it never runs. Any admin can reject a
+// request, including the one who made it.
+func RejectApprovalRequest(ctx context.Context, id primitive.ObjectID, rejecterUID string, reason string) (ApprovalRequest, error) {
+	return decideApprovalRequest(ctx, id, ApprovalStatusRejected, rejecterUID, reason)
+}
+
+func decideApprovalRequest(
+	ctx context.Context,
+	id primitive.ObjectID,
+	status string,
+	deciderUID string,
+	reason string,
+) (ApprovalRequest, error) {
+	updates := bson.D{
+		{Key: "status", Value: status},
+		{Key: "decided_by", Value: deciderUID},
+		{Key: "decided_at", Value: time.Now()},
+	}
+	if reason != "" {
+		updates = append(updates, bson.E{Key: "reason", Value: reason})
+	}
+
+	var request ApprovalRequest
+	err := lib.Datastore.Db.Collection(approvalsColName).FindOneAndUpdate(
+		ctx,
+		openApprovalRequestsFilter(bson.M{"_id": id}),
+		bson.D{{Key: "$set", Value: updates}},
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(&request)
+	if err == mongo.ErrNoDocuments {
+		// Either it doesn't exist, or someone else got to it first
+		if _, err := GetApprovalRequest(ctx, id); err != nil {
+			return ApprovalRequest{}, err
+		}
+		return ApprovalRequest{}, ErrApprovalClosed
+	} else if err != nil {
+		return ApprovalRequest{}, err
+	}
+
+	return request, nil
+}
+
+// FinishApprovalRequest saves the outcome of running an approved request's action.
+func FinishApprovalRequest(
+	ctx context.Context,
+	id primitive.ObjectID,
+	ticketResults []BulkTicketResult,
+	executionErr error,
+) (ApprovalRequest, error) {
+	updates := bson.D{
+		{Key: "status", Value: ApprovalStatusExecuted},
+		{Key: "executed_at", Value: time.Now()},
+	}
+	if executionErr != nil {
+		updates[0].Value = ApprovalStatusFailed
+		updates = append(updates, bson.E{Key: "execution_error", Value: executionErr.Error()})
+	}
+	if len(ticketResults) > 0 {
+		updates = append(updates, bson.E{Key: "ticket_results", Value: ticketResults})
+	}
+
+	var request ApprovalRequest
+	err := lib.Datastore.Db.Collection(approvalsColName).FindOneAndUpdate(
+		ctx,
+		bson.M{"_id": id, "status": ApprovalStatusApproved},
+		bson.D{{Key: "$set", Value: updates}},
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(&request)
+	if err == mongo.ErrNoDocuments {
+		return ApprovalRequest{}, ErrNotFound
+	}
+	return request, err
+}
@@ -0,0 +1,442 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/aritrosaha10/frasertickets/lib"
+	"github.com/aritrosaha10/frasertickets/util"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	CoatCheckStatusCheckedIn  = "checked_in"
+	CoatCheckStatusCheckedOut = "checked_out"
+)
+
+// How many times allocating a number is retried when another check in grabs it first
+const coatCheckAllocationAttempts = 5
+
+// CoatRack is a pool of coat check numbers for an event, ex. rack "A" with numbers 1 to 200.
+type CoatRack struct {
+	ID          primitive.ObjectID `json:"id"          bson:"_id,omitempty"`
+	EventID     primitive.ObjectID `json:"eventID"     bson:"event_id"`
+	Name        string             `json:"name"        bson:"name"`
+	StartNumber int                `json:"startNumber" bson:"start_number"`
+	EndNumber   int                `json:"endNumber"   bson:"end_number"` // inclusive
+	// Optional ticket custom field holding numbers pre-assigned from this rack (ex. jacketID). Racks
+	// with one are only used for pre-assigned numbers, never for automatic allocation.
+	PreassignedField string    `json:"preassignedField,omitempty" bson:"preassigned_field,omitempty"`
+	Timestamp        time.Time `json:"timestamp"   bson:"timestamp"`
+	InUse            int64     `json:"inUse"       bson:"-"` // coats currently on the rack
+}
+
+func (rack *CoatRack) Render(w http.ResponseWriter, r *http.Request) error {
+	return nil
+}
+
+// CoatCheck is a single coat checked in for a ticket. Checking the coat back out keeps the record
+// around but frees up its number.
+type CoatCheck struct {
+	ID                primitive.ObjectID `json:"id"                bson:"_id,omitempty"`
+	EventID           primitive.ObjectID `json:"eventID"           bson:"event_id"`
+	TicketID          primitive.ObjectID `json:"ticketID"          bson:"ticket_id"`
+	OwnerID           string             `json:"ownerID"           bson:"owner_id"`
+	OwnerData         *User              `json:"ownerData,omitempty" bson:"ownerData,omitempty"`
+	RackID            primitive.ObjectID `json:"rackID"            bson:"rack_id"`
+	RackName          string             `json:"rackName"          bson:"rack_name"`
+	Number            int                `json:"number"            bson:"number"`
+	Status            string             `json:"status"            bson:"status"`
+	CheckInTimestamp  time.Time          `json:"checkInTimestamp"  bson:"check_in_timestamp"`
+	CheckedInBy       string             `json:"checkedInBy"       bson:"checked_in_by"`
+	CheckOutTimestamp *time.Time         `json:"checkOutTimestamp,omitempty" bson:"check_out_timestamp,omitempty"`
+	CheckedOutBy      string             `json:"checkedOutBy"      bson:"checked_out_by,omitempty"`
+}
+
+func (coatCheck *CoatCheck) Render(w http.ResponseWriter, r *http.Request) error {
+	return nil
+}
+
+func CreateCoatCheckIndices(ctx context.Context) error {
+	// Rack names are unique within an event
+	rackNameIdxModel := mongo.IndexModel{
+		Keys: bson.D{
+			{Key: "event_id", Value: 1},
+			{Key: "name", Value: 1},
+		},
+		Options: options.Index().SetUnique(true),
+	}
+
+	// A number can only be handed out once at a time, and a ticket can only have one coat in at a time
+	checkedInFilter := bson.M{"status": CoatCheckStatusCheckedIn}
+	numberIdxModel := mongo.IndexModel{
+		Keys: bson.D{
+			{Key: "rack_id", Value: 1},
+			{Key: "number", Value: 1},
+		},
+		Options: options.Index().SetUnique(true).SetPartialFilterExpression(checkedInFilter),
+	}
+	ticketIdxModel := mongo.IndexModel{
+		Keys: bson.D{
+			{Key: "ticket_id", Value: 1},
+		},
+		Options: options.Index().SetUnique(true).SetPartialFilterExpression(checkedInFilter),
+	}
+	eventStatusIdxModel := mongo.IndexModel{
+		Keys: bson.D{
+			{Key: "event_id", Value: 1},
+			{Key: "status", Value: 1},
+		},
+	}
+
+	// Try creating the indices
+	opts := options.CreateIndexes().SetMaxTime(10 * time.Second)
+	_, err := lib.Datastore.Db.Collection(coatRacksColName).
+		Indexes().
+		CreateOne(ctx, rackNameIdxModel, opts)
+	if err != nil {
+		return err
+	}
+
+	_, err = lib.Datastore.Db.Collection(coatChecksColName).
+		Indexes().
+		CreateMany(
+			ctx,
+			[]mongo.IndexModel{
+				numberIdxModel,
+				ticketIdxModel,
+				eventStatusIdxModel,
+			},
+			opts,
+		)
+
+	return err
+}
+
+// GetCoatRacks fetches an event's racks in order of name, along with how many coats are on each.
+func GetCoatRacks(ctx context.Context, eventID primitive.ObjectID) ([]CoatRack, error) {
+	opts := options.Find().SetSort(bson.D{{Key: "name", Value: 1}})
+	cursor, err := lib.Datastore.Db.Collection(coatRacksColName).Find(ctx, bson.M{"event_id": eventID}, opts)
+	if err != nil {
+		return []CoatRack{}, err
+	}
+	racks := []CoatRack{}
+	if err := cursor.All(ctx, &racks); err != nil {
+		return []CoatRack{}, err
+	}
+
+	// Count the coats on each rack
+	countCursor, err := lib.Datastore.Db.Collection(coatChecksColName).Aggregate(ctx, mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{"event_id": eventID, "status": CoatCheckStatusCheckedIn}}},
+		{{Key: "$group", Value: bson.D{
+			{Key: "_id", Value: "$rack_id"},
+			{Key: "count", Value: bson.D{{Key: "$sum", Value: 1}}},
+		}}},
+	})
+	if err != nil {
+		return []CoatRack{}, err
+	}
+	var counts []struct {
+		RackID primitive.ObjectID `bson:"_id"`
+		Count  int64              `bson:"count"`
+	}
+	if err := countCursor.All(ctx, &counts); err != nil {
+		return []CoatRack{}, err
+	}
+	inUse := map[primitive.ObjectID]int64{}
+	for _, count := range counts {
+		inUse[count.RackID] = count.Count
+	}
+	for i := range racks {
+		racks[i].InUse = inUse[racks[i].ID]
+	}
+
+	return racks, nil
+}
+
+func GetCoatRack(ctx context.Context, eventID primitive.ObjectID, rackID primitive.ObjectID) (CoatRack, error) {
+	var rack CoatRack
+	err := lib.Datastore.Db.Collection(coatRacksColName).
+		FindOne(ctx, bson.M{"_id": rackID, "event_id": eventID}).
+		Decode(&rack)
+	return rack, err
+}
+
+func CreateCoatRack(ctx context.Context, rack CoatRack) (primitive.ObjectID, error) {
+	if rack.StartNumber < 0 || rack.EndNumber < rack.StartNumber {
+		return primitive.NilObjectID, fmt.Errorf("rack numbers must be non-negative and start at or before where they end")
+	}
+	rack.Timestamp = time.Now()
+
+	res, err := lib.Datastore.Db.Collection(coatRacksColName).InsertOne(ctx, rack)
+	if mongo.IsDuplicateKeyError(err) {
+		return primitive.NilObjectID, ErrAlreadyExists
+	} else if err != nil {
+		return primitive.NilObjectID, err
+	}
+
+	return res.InsertedID.(primitive.ObjectID), nil
+}
+
+// DeleteCoatRack deletes a rack, as long as it has no coats on it.
+func DeleteCoatRack(ctx context.Context, eventID primitive.ObjectID, rackID primitive.ObjectID) error {
+	_, err := lib.Datastore.WithTransaction(ctx, func(sessCtx mongo.SessionContext) (interface{}, error) {
+		count, err := lib.Datastore.Db.Collection(coatChecksColName).CountDocuments(
+			sessCtx,
+			bson.M{"rack_id": rackID, "status": CoatCheckStatusCheckedIn},
+			options.Count().SetLimit(1),
+		)
+		if err != nil {
+			return nil, err
+		}
+		if count > 0 {
+			return nil, ErrCoatRackInUse
+		}
+
+		res, err := lib.Datastore.Db.Collection(coatRacksColName).
+			DeleteOne(sessCtx, bson.M{"_id": rackID, "event_id": eventID})
+		if err != nil {
+			return nil, err
+		}
+		if res.DeletedCount == 0 {
+			return nil, ErrNotFound
+		}
+		return nil, nil
+	})
+
+	return err
+}
+
+// coatCheckLookupStages joins the owner data onto coat checks.
+func coatCheckLookupStages() mongo.Pipeline {
+	return mongo.Pipeline{
+		{
+			{Key: "$lookup", Value: bson.D{
+				{Key: "from", Value: usersColName},
+				{Key: "localField", Value: "owner_id"},
+				{Key: "foreignField", Value: "_id"},
+				{Key: "as", Value: "ownerData"},
+			}},
+		},
+		{
+			{Key: "$unwind", Value: bson.D{
+				{Key: "path", Value: "$ownerData"},
+				{Key: "preserveNullAndEmptyArrays", Value: true},
+			}},
+		},
+	}
+}
+
+// GetCoatChecks fetches coat checks with owner data, ordered by rack and number.
+func GetCoatChecks(ctx context.Context, filter bson.M) ([]CoatCheck, error) {
+	pipeline := append(mongo.Pipeline{
+		{{Key: "$match", Value: filter}},
+		{{Key: "$sort", Value: bson.D{
+			{Key: "rack_name", Value: 1},
+			{Key: "number", Value: 1},
+			{Key: "check_in_timestamp", Value: 1},
+		}}},
+	}, coatCheckLookupStages()...)
+
+	cursor, err := lib.Datastore.Db.Collection(coatChecksColName).Aggregate(ctx, pipeline)
+	if err != nil {
+		return []CoatCheck{}, err
+	}
+	coatChecks := []CoatCheck{}
+	if err := cursor.All(ctx, &coatChecks); err != nil {
+		return []CoatCheck{}, err
+	}
+
+	return coatChecks, nil
+}
+
+// GetUnclaimedCoats fetches the coats for an event that were checked in but never picked up.
+func GetUnclaimedCoats(ctx context.Context, eventID primitive.ObjectID) ([]CoatCheck, error) {
+	return GetCoatChecks(ctx, bson.M{"event_id": eventID, "status": CoatCheckStatusCheckedIn})
+}
+
+// ScanCoatCheck checks a ticket's coat in if it doesn't have one checked in, or checks it back out
+// if it does. On check in, the ticket's pre-assigned number is used if it has one, and otherwise the
+// lowest free number is taken from the given rack, or the first rack with room if none is given.
+func ScanCoatCheck(
+	ctx context.Context,
+	eventID primitive.ObjectID,
+	ticketID primitive.ObjectID,
+	rackID primitive.ObjectID,
+	staffUID string,
+) (CoatCheck, error) {
+	// Check the coat out if there's one in
+	var coatCheck CoatCheck
+	now := time.Now()
+	err := lib.Datastore.Db.Collection(coatChecksColName).FindOneAndUpdate(
+		ctx,
+		bson.M{"event_id": eventID, "ticket_id": ticketID, "status": CoatCheckStatusCheckedIn},
+		bson.M{"$set": bson.M{
+			"status":              CoatCheckStatusCheckedOut,
+			"check_out_timestamp": now,
+			"checked_out_by":      staffUID,
+		}},
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(&coatCheck)
+	if err == nil {
+		return coatCheck, nil
+	} else if err != mongo.ErrNoDocuments {
+		return CoatCheck{}, err
+	}
+
+	// Otherwise, check it in
+	ticket, err := GetTicket(ctx, ticketID)
+	if err == mongo.ErrNoDocuments {
+		return CoatCheck{}, ErrNotFound
+	} else if err != nil {
+		return CoatCheck{}, err
+	}
+	if ticket.Event != eventID {
+		return CoatCheck{}, ErrNotFound
+	}
+
+	racks, err := GetCoatRacks(ctx, eventID)
+	if err != nil {
+		return CoatCheck{}, err
+	}
+
+	coatCheck = CoatCheck{
+		EventID:          eventID,
+		TicketID:         ticketID,
+		OwnerID:          ticket.Owner,
+		Status:           CoatCheckStatusCheckedIn,
+		CheckInTimestamp: now,
+		CheckedInBy:      staffUID,
+	}
+
+	// Pre-assigned numbers are used as-is, and conflict if someone else already has them
+	if rack, number, ok := preassignedCoatNumber(racks, ticket); ok {
+		coatCheck.RackID = rack.ID
+		coatCheck.RackName = rack.Name
+		coatCheck.Number = number
+		return coatCheck, insertCoatCheck(ctx, &coatCheck)
+	}
+
+	for attempt := 0; attempt < coatCheckAllocationAttempts; attempt++ {
+		rack, number, err := nextFreeCoatNumber(ctx, racks, rackID)
+		if err != nil {
+			return CoatCheck{}, err
+		}
+		coatCheck.RackID = rack.ID
+		coatCheck.RackName = rack.Name
+		coatCheck.Number = number
+
+		err = insertCoatCheck(ctx, &coatCheck)
+		if err != ErrAlreadyExists {
+			return coatCheck, err
+		}
+
+		// The ticket itself may have been checked in concurrently, in which case retrying won't help
+		count, err := lib.Datastore.Db.Collection(coatChecksColName).CountDocuments(
+			ctx,
+			bson.M{"ticket_id": ticketID, "status": CoatCheckStatusCheckedIn},
+		)
+		if err != nil {
+			return CoatCheck{}, err
+		}
+		if count > 0 {
+			return CoatCheck{}, ErrAlreadyExists
+		}
+	}
+
+	return CoatCheck{}, errors.New("could not allocate a coat check number, too many concurrent check ins")
+}
+
+func insertCoatCheck(ctx context.Context, coatCheck *CoatCheck) error {
+	res, err := lib.Datastore.Db.Collection(coatChecksColName).InsertOne(ctx, coatCheck)
+	if mongo.IsDuplicateKeyError(err) {
+		return ErrAlreadyExists
+	} else if err != nil {
+		return err
+	}
+
+	coatCheck.ID = res.InsertedID.(primitive.ObjectID)
+	return nil
+}
+
+// preassignedCoatNumber finds the rack and number pre-assigned to a ticket through a custom field.
+func preassignedCoatNumber(racks []CoatRack, ticket Ticket) (CoatRack, int, bool) {
+	for _, rack := range racks {
+		if rack.PreassignedField == "" {
+			continue
+		}
+
+		// Numbers from the DB may come back as any numeric type
+		number, ok := util.CustomFieldInt(ticket.CustomFields[rack.PreassignedField])
+		if !ok {
+			continue
+		}
+
+		if number >= rack.StartNumber && number <= rack.EndNumber {
+			return rack, number, true
+		}
+	}
+
+	return CoatRack{}, 0, false
+}
+
+// nextFreeCoatNumber finds the lowest number not currently in use on the given rack, or on the
+// first rack with room if no rack is given. Racks for pre-assigned numbers are never used.
+func nextFreeCoatNumber(ctx context.Context, racks []CoatRack, rackID primitive.ObjectID) (CoatRack, int, error) {
+	found := false
+	for _, rack := range racks {
+		if !rackID.IsZero() && rack.ID != rackID {
+			continue
+		}
+		found = true
+		if rack.PreassignedField != "" {
+			if !rackID.IsZero() {
+				return CoatRack{}, 0, ErrNoFreeCoatNumber
+			}
+			continue
+		}
+
+		// Walk the numbers in use from lowest to highest, stopping at the first gap
+		opts := options.Find().
+			SetSort(bson.D{{Key: "number", Value: 1}}).
+			SetProjection(bson.M{"number": 1})
+		cursor, err := lib.Datastore.Db.Collection(coatChecksColName).Find(
+			ctx,
+			bson.M{"rack_id": rack.ID, "status": CoatCheckStatusCheckedIn},
+			opts,
+		)
+		if err != nil {
+			return CoatRack{}, 0, err
+		}
+		var used []struct {
+			Number int `bson:"number"`
+		}
+		if err := cursor.All(ctx, &used); err != nil {
+			return CoatRack{}, 0, err
+		}
+
+		next := rack.StartNumber
+		for _, u := range used {
+			if u.Number > next {
+				break
+			}
+			if u.Number == next {
+				next++
+			}
+		}
+		if next <= rack.EndNumber {
+			return rack, next, nil
+		}
+	}
+
+	if !found && !rackID.IsZero() {
+		return CoatRack{}, 0, ErrNotFound
+	}
+	return CoatRack{}, 0, ErrNoFreeCoatNumber
+}
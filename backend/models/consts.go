@@ -1,8 +1,16 @@
 package models
 
 const (
-	usersColName         = "users"
-	eventsColName        = "events"
-	ticketsColName       = "tickets"
-	queuedTicketsColName = "queued-tickets"
+	usersColName          = "users"
+	eventsColName         = "events"
+	ticketsColName        = "tickets"
+	queuedTicketsColName  = "queued-tickets"
+	rosterColName         = "roster"
+	coatRacksColName      = "coat-racks"
+	coatChecksColName     = "coat-checks"
+	countersColName       = "counters"
+	changeHistoryColName  = "change-history"
+	approvalsColName      = "approvals"
+	eventTemplatesColName = "event-templates"
+	walletSyncJobsColName = "wallet-sync-jobs"
 )
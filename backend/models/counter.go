@@ -0,0 +1,152 @@
+package models
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/aritrosaha10/frasertickets/lib"
+	"github.com/aritrosaha10/frasertickets/util"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Counter hands out sequential numbers for an auto-numbered custom field of an event.
+type Counter struct {
+	ID      string             `json:"id"      bson:"_id"` // <event id>:<custom field key>
+	EventID primitive.ObjectID `json:"eventID" bson:"event_id"`
+	Field   string             `json:"field"   bson:"field"`
+	Count   int                `json:"count"   bson:"count"` // how many numbers have been handed out
+}
+
+// ensureCounters creates the counters for every auto-numbered field of an event's schema that
+// doesn't have one yet, and must be called whenever a schema is saved. Inside of a transaction, it
+// has to come after the event itself is written. Concurrent upserts of the same counter fail on the
+// duplicate key instead of being retried, but transactions saving the same event conflict on the
+// event first, and the retried one then finds the counter already there.
+func ensureCounters(ctx context.Context, eventID primitive.ObjectID, rawSchema map[string]interface{}) error {
+	if len(rawSchema) == 0 {
+		return nil
+	}
+	schema, err := util.ConvertRawCustomFieldsSchema(rawSchema)
+	if err != nil {
+		return err
+	}
+
+	for key, property := range schema.Properties {
+		if !property.AutoNumber {
+			continue
+		}
+		_, err := lib.Datastore.Db.Collection(countersColName).UpdateOne(
+			ctx,
+			bson.M{"_id": fmt.Sprintf("%s:%s", eventID.Hex(), key)},
+			bson.M{"$setOnInsert": bson.M{"event_id": eventID, "field": key, "count": 0}},
+			options.Update().SetUpsert(true),
+		)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// nextCounterValue takes the next number for an event's custom field. This must be called inside
+// of a transaction so that the number is given back if whatever it was for isn't saved, which keeps
+// the numbers free of gaps. Concurrent callers conflict on the counter document, and the driver
+// retries the losing transaction. The counter must already exist, see ensureCounters.
+func nextCounterValue(sessCtx mongo.SessionContext, eventID primitive.ObjectID, field string, start int) (int, error) {
+	var counter Counter
+	err := lib.Datastore.Db.Collection(countersColName).FindOneAndUpdate(
+		sessCtx,
+		bson.M{"_id": fmt.Sprintf("%s:%s", eventID.Hex(), field)},
+		bson.M{"$inc": bson.M{"count": 1}},
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(&counter)
+	if err == mongo.ErrNoDocuments {
+		return 0, fmt.Errorf("no counter for auto-numbered custom field '%s' of event %s", field, eventID.Hex())
+	} else if err != nil {
+		return 0, err
+	}
+
+	return start + counter.Count - 1, nil
+}
+
+// renameCounter moves an event's counter over to a renamed custom field.
+func renameCounter(sessCtx mongo.SessionContext, eventID primitive.ObjectID, oldField string, newField string) error {
+	var counter Counter
+	err := lib.Datastore.Db.Collection(countersColName).FindOneAndDelete(
+		sessCtx,
+		bson.M{"_id": fmt.Sprintf("%s:%s", eventID.Hex(), oldField)},
+	).Decode(&counter)
+	if err == mongo.ErrNoDocuments {
+		return nil // Nothing has been numbered yet
+	} else if err != nil {
+		return err
+	}
+
+	counter.ID = fmt.Sprintf("%s:%s", eventID.Hex(), newField)
+	counter.Field = newField
+	_, err = lib.Datastore.Db.Collection(countersColName).InsertOne(sessCtx, counter)
+	return err
+}
+
+// assignAutoNumbers fills in every auto-numbered custom field of a ticket. Values can't be given
+// for these fields by hand, since they could collide with ones handed out later.
+func assignAutoNumbers(sessCtx mongo.SessionContext, event Event, customFields map[string]interface{}) (map[string]interface{}, error) {
+	if len(event.RawCustomFieldsSchema) == 0 {
+		return customFields, nil
+	}
+	schema, err := util.ConvertRawCustomFieldsSchema(event.RawCustomFieldsSchema)
+	if err != nil {
+		return customFields, err
+	}
+	if err := checkNoManualAutoNumbers(schema, customFields); err != nil {
+		return customFields, err
+	}
+
+	for key, property := range schema.Properties {
+		if !property.AutoNumber {
+			continue
+		}
+
+		number, err := nextCounterValue(sessCtx, event.ID, key, property.AutoNumberStart)
+		if err != nil {
+			return customFields, err
+		}
+		if customFields == nil {
+			customFields = map[string]interface{}{}
+		}
+		customFields[key] = number
+	}
+
+	return customFields, nil
+}
+
+// checkEventAutoNumbers makes sure none of an event's auto-numbered custom fields have been given a
+// value, ex. on a queued ticket that will become a ticket later.
+func checkEventAutoNumbers(event Event, customFields map[string]interface{}) error {
+	if len(event.RawCustomFieldsSchema) == 0 || len(customFields) == 0 {
+		return nil
+	}
+	schema, err := util.ConvertRawCustomFieldsSchema(event.RawCustomFieldsSchema)
+	if err != nil {
+		return err
+	}
+	return checkNoManualAutoNumbers(schema, customFields)
+}
+
+func checkNoManualAutoNumbers(schema util.CustomFieldsSchema, customFields map[string]interface{}) error {
+	for key, property := range schema.Properties {
+		if _, given := customFields[key]; given && property.AutoNumber {
+			return util.NewValidationError(
+				ErrEditNotAllowed,
+				util.AppCodeEditNotAllowed,
+				"customFields."+key,
+				"autoNumber",
+				"custom field is numbered automatically",
+			)
+		}
+	}
+	return nil
+}
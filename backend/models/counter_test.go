@@ -0,0 +1,89 @@
+package models
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"testing"
+
+	"github.com/aritrosaha10/frasertickets/lib"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+func autoNumberTestSchema() map[string]interface{} {
+	return map[string]interface{}{
+		"type": "object",
+		"properties": map[string]interface{}{
+			"seat": map[string]interface{}{"type": "integer", "autoNumber": true, "autoNumberStart": 100},
+		},
+	}
+}
+
+func TestNextCounterValueConcurrentFirstUse(t *testing.T) {
+	setupTestDatastore(t)
+	ctx := context.Background()
+
+	eventID, err := CreateNewEvent(ctx, Event{Name: "Counted", RawCustomFieldsSchema: autoNumberTestSchema()})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const callers = 8
+	var (
+		wg      sync.WaitGroup
+		mu      sync.Mutex
+		numbers []int
+	)
+	for i := 0; i < callers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := lib.Datastore.WithTransaction(ctx, func(sessCtx mongo.SessionContext) (interface{}, error) {
+				number, err := nextCounterValue(sessCtx, eventID, "seat", 100)
+				if err != nil {
+					return nil, err
+				}
+				mu.Lock()
+				defer mu.Unlock()
+				numbers = append(numbers, number)
+				return nil, nil
+			})
+			if err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	// Retried transactions are given the same number again, so only the distinct numbers are checked
+	sort.Ints(numbers)
+	seen := map[int]bool{}
+	for _, number := range numbers {
+		seen[number] = true
+	}
+	for number := 100; number < 100+callers; number++ {
+		if !seen[number] {
+			t.Errorf("expected %d to be handed out, got %v", number, numbers)
+		}
+	}
+	if len(seen) != callers {
+		t.Errorf("expected %d distinct numbers, got %v", callers, numbers)
+	}
+}
+
+func TestNextCounterValueWithoutCounter(t *testing.T) {
+	setupTestDatastore(t)
+	ctx := context.Background()
+
+	event := Event{Name: "Counted", RawCustomFieldsSchema: autoNumberTestSchema()}
+	eventID, err := CreateNewEvent(ctx, event)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = lib.Datastore.WithTransaction(ctx, func(sessCtx mongo.SessionContext) (interface{}, error) {
+		return nextCounterValue(sessCtx, eventID, "missing", 1)
+	})
+	if err == nil {
+		t.Error("expected an error for a field without a counter")
+	}
+}
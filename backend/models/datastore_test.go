@@ -0,0 +1,34 @@
+package models
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	"github.com/aritrosaha10/frasertickets/lib"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// setupTestDatastore points the models at a throwaway database on the MongoDB server given by
+// MONGODB_TEST_CONNECTION_STR, and drops it once the test is done. Tests that need a database are
+// skipped if it isn't set. The server has to be a replica set for transactions to work.
+func setupTestDatastore(t *testing.T) {
+	t.Helper()
+
+	connectionStr := os.Getenv("MONGODB_TEST_CONNECTION_STR")
+	if connectionStr == "" {
+		t.Skip("MONGODB_TEST_CONNECTION_STR not set")
+	}
+	t.Setenv("MONGODB_CONNECTION_STR", connectionStr)
+
+	previous := lib.Datastore
+	lib.Datastore = lib.CreateNewDB()
+	lib.Datastore.Connect()
+	lib.Datastore.Db = lib.Datastore.Db.Client().Database("test_" + primitive.NewObjectID().Hex())
+
+	t.Cleanup(func() {
+		lib.Datastore.Db.Drop(context.Background())
+		lib.Datastore.Disconnect()
+		lib.Datastore = previous
+	})
+}
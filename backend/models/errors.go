@@ -5,10 +5,27 @@ import (
 )
 
 var (
-	ErrNoDocumentModified error
-	ErrEditNotAllowed     error
-	ErrAlreadyExists      error
-	ErrNotFound           error
+	ErrNoDocumentModified      error
+	ErrEditNotAllowed          error
+	ErrAlreadyExists           error
+	ErrNotFound                error
+	ErrNotOnRoster             error
+	ErrNotEligible             error
+	ErrInvalidCursor           error
+	ErrInvalidReport           error
+	ErrNoFreeCoatNumber        error
+	ErrCoatRackInUse           error
+	ErrInvalidSchemaUpdate     error
+	ErrSchemaUpdateRejected    error
+	ErrInvalidCustomFields     error
+	ErrEditCutoffPassed        error
+	ErrVersionMismatch         error
+	ErrEventTrashed            error
+	ErrApproverNotAllowed      error
+	ErrApprovalClosed          error
+	ErrInvalidEventTemplate    error
+	ErrWalletDisabled          error
+	ErrWalletSyncInTransaction error
 )
 
 func init() {
@@ -16,4 +33,21 @@ func init() {
 	ErrEditNotAllowed = errors.New("models: cannot update forbidden / unknown attr")
 	ErrAlreadyExists = errors.New("models: document already exists when it should be unique")
 	ErrNotFound = errors.New("models: document could not be found")
+	ErrNotOnRoster = errors.New("models: student number is not on the roster")
+	ErrNotEligible = errors.New("models: user is not eligible for this event")
+	ErrInvalidCursor = errors.New("models: pagination cursor is invalid")
+	ErrInvalidReport = errors.New("models: report options are invalid")
+	ErrNoFreeCoatNumber = errors.New("models: no free coat check numbers left")
+	ErrCoatRackInUse = errors.New("models: coat rack still has coats on it")
+	ErrInvalidSchemaUpdate = errors.New("models: custom fields schema update is invalid")
+	ErrSchemaUpdateRejected = errors.New("models: custom fields schema update would break existing tickets")
+	ErrInvalidCustomFields = errors.New("models: custom fields don't match the event's schema")
+	ErrEditCutoffPassed = errors.New("models: owners can no longer edit tickets for this event")
+	ErrVersionMismatch = errors.New("models: document was changed since the given version")
+	ErrEventTrashed = errors.New("models: the event for this document is in the trash")
+	ErrApproverNotAllowed = errors.New("models: approver isn't allowed to decide on this request")
+	ErrApprovalClosed = errors.New("models: approval request has already been decided or has expired")
+	ErrInvalidEventTemplate = errors.New("models: event template settings are invalid")
+	ErrWalletDisabled = errors.New("models: google wallet passes aren't set up")
+	ErrWalletSyncInTransaction = errors.New("models: wallet syncs can't be queued inside of a transaction without collecting them")
 }
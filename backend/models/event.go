@@ -1,17 +1,23 @@
 package models
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/aritrosaha10/frasertickets/lib"
+	"github.com/aritrosaha10/frasertickets/util"
 	"github.com/rs/zerolog/log"
 	"github.com/xeipuuv/gojsonschema"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
 )
 
 type Event struct {
@@ -23,16 +29,43 @@ type Event struct {
 	Address               string                 `json:"address"         bson:"address"`
 	StartTimestamp        time.Time              `json:"start_timestamp" bson:"start_timestamp"`
 	EndTimestamp          time.Time              `json:"end_timestamp"   bson:"end_timestamp"`
-	RawCustomFieldsSchema map[string]interface{} `json:"custom_fields_schema" bson:"custom_fields_schema"` // Schema for extra data in JSON Schema format
+	RawCustomFieldsSchema map[string]interface{} `json:"custom_fields_schema" bson:"custom_fields_schema"`               // Schema for extra data in JSON Schema format
+	Audience              *EventAudience         `json:"audience,omitempty"   bson:"audience,omitempty"`                 // Who can get tickets, open to everyone if missing
+	OwnerEditCutoff       *time.Time             `json:"owner_edit_cutoff,omitempty" bson:"owner_edit_cutoff,omitempty"` // When owners stop being able to edit their tickets, defaults to the start
+	Version               int                    `json:"version"              bson:"version"`                            // Bumped on every update, sent as the ETag
+	Draft                 bool                   `json:"draft"                bson:"draft,omitempty"`                    // Hidden from everyone but admins until published
+	DeletedAt             *time.Time             `json:"deleted_at,omitempty" bson:"deleted_at,omitempty"`               // Set while the event is in the trash
+	DeletedBy             string                 `json:"deleted_by,omitempty" bson:"deleted_by,omitempty"`               // UID of whoever trashed it
+}
+
+// EventAudience restricts who can get a ticket for an event. Grades and roles must both match if
+// given, but anyone on the allowlist is always let in.
+type EventAudience struct {
+	Grades    []int    `json:"grades,omitempty"    bson:"grades,omitempty"`
+	Roles     []string `json:"roles,omitempty"     bson:"roles,omitempty"`     // student, staff, guest or admin
+	Allowlist []string `json:"allowlist,omitempty" bson:"allowlist,omitempty"` // Student numbers, emails or external IDs
+}
+
+// OwnerEditDeadline is when ticket owners can no longer change their own custom fields.
+func (event Event) OwnerEditDeadline() time.Time {
+	if event.OwnerEditCutoff == nil || event.OwnerEditCutoff.IsZero() {
+		return event.StartTimestamp
+	}
+	return *event.OwnerEditCutoff
 }
 
 func (event *Event) Render(w http.ResponseWriter, r *http.Request) error {
 	return nil
 }
 
-func GetAllEvents(ctx context.Context) ([]Event, error) {
+func GetAllEvents(ctx context.Context, includeDrafts bool) ([]Event, error) {
+	filter := bson.M{}
+	if !includeDrafts {
+		filter["draft"] = bson.M{"$ne": true}
+	}
+
 	// Try to get data from MongoDB
-	cursor, err := lib.Datastore.Db.Collection(eventsColName).Find(ctx, bson.D{})
+	cursor, err := lib.Datastore.Db.Collection(eventsColName).Find(ctx, excludeTrashed(filter))
 	if err != nil {
 		return []Event{}, err
 	}
@@ -50,7 +83,7 @@ func GetEvent(ctx context.Context, filter bson.M) (Event, error) {
 	// Try to fetch data from DB
 	var event Event
 	err := lib.Datastore.Db.Collection(eventsColName).
-		FindOne(ctx, filter).
+		FindOne(ctx, excludeTrashed(filter)).
 		Decode(&event)
 
 	// No error handling needed (user & err will default to empty struct / nil)
@@ -59,23 +92,87 @@ func GetEvent(ctx context.Context, filter bson.M) (Event, error) {
 
 func CheckIfEventExists(ctx context.Context, id primitive.ObjectID) (bool, error) {
 	// Directly return results from DB
-	count, err := lib.Datastore.Db.Collection(eventsColName).CountDocuments(ctx, bson.M{"_id": id})
+	count, err := lib.Datastore.Db.Collection(eventsColName).CountDocuments(ctx, excludeTrashed(bson.M{"_id": id}))
 	return count == 1, err
 }
 
 func CreateNewEvent(ctx context.Context, event Event) (primitive.ObjectID, error) {
-	// Validate custom fields schema
-	schemaLoader := gojsonschema.NewGoLoader(event.RawCustomFieldsSchema)
-	_, err := gojsonschema.NewSchema(schemaLoader)
-	if err != nil {
+	if err := validateEventSettings(event.RawCustomFieldsSchema, event.Audience); err != nil {
 		return primitive.NilObjectID, err
 	}
 
 	// Try to add document
 	res, err := lib.Datastore.Db.Collection(eventsColName).InsertOne(ctx, event)
+	if err != nil {
+		return primitive.NilObjectID, err
+	}
+	id := res.InsertedID.(primitive.ObjectID)
 
 	// Return object ID
-	return res.InsertedID.(primitive.ObjectID), err
+	return id, ensureCounters(ctx, id, event.RawCustomFieldsSchema)
+}
+
+// validateEventSettings checks a custom fields schema and audience before they're saved on an event
+// or event template.
+func validateEventSettings(rawCustomFieldsSchema map[string]interface{}, audience *EventAudience) error {
+	if err := audience.validate(); err != nil {
+		return err
+	}
+
+	// Validate custom fields schema
+	schemaLoader := gojsonschema.NewGoLoader(rawCustomFieldsSchema)
+	if _, err := gojsonschema.NewSchema(schemaLoader); err != nil {
+		return err
+	}
+
+	// Catch bad options of our own, like auto-numbering a text field
+	if len(rawCustomFieldsSchema) != 0 {
+		if _, err := util.ConvertRawCustomFieldsSchema(rawCustomFieldsSchema); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func init() {
+	// Let custom field schemas use our phone format hint, email is already built in
+	gojsonschema.FormatCheckers.Add(util.CustomFieldFormatPhone, phoneFormatChecker{})
+}
+
+type phoneFormatChecker struct{}
+
+func (checker phoneFormatChecker) IsFormat(input interface{}) bool {
+	str, ok := input.(string)
+	if !ok {
+		return true // Only strings have formats
+	}
+	return util.CheckCustomFieldFormat(util.CustomFieldFormatPhone, str)
+}
+
+// applyCustomFieldDefaults fills in the default value of every custom field that wasn't given.
+func applyCustomFieldDefaults(event Event, customFields map[string]interface{}) (map[string]interface{}, error) {
+	if len(event.RawCustomFieldsSchema) == 0 {
+		return customFields, nil
+	}
+	schema, err := util.ConvertRawCustomFieldsSchema(event.RawCustomFieldsSchema)
+	if err != nil {
+		return customFields, err
+	}
+
+	for key, property := range schema.Properties {
+		if property.Default == nil {
+			continue
+		}
+		if _, given := customFields[key]; given {
+			continue
+		}
+		if customFields == nil {
+			customFields = map[string]interface{}{}
+		}
+		customFields[key] = property.Default
+	}
+
+	return customFields, nil
 }
 
 func ValidateCustomEventFields(ctx context.Context, event Event, customFields map[string]interface{}) (bool, []gojsonschema.ResultError, error) {
@@ -94,7 +191,26 @@ func ValidateCustomEventFields(ctx context.Context, event Event, customFields ma
 	}
 }
 
-func UpdateExistingEvent(ctx context.Context, id string, updates map[string]interface{}) error {
+// customFieldsErrDetails converts JSON schema validation errors into field details for clients.
+func customFieldsErrDetails(schemaErrs []gojsonschema.ResultError) []util.ErrDetail {
+	details := []util.ErrDetail{}
+	for _, schemaErr := range schemaErrs {
+		field := schemaErr.Field()
+		if property, ok := schemaErr.Details()["property"].(string); ok && schemaErr.Type() == "required" {
+			field = property // Missing fields are reported against the root object
+		}
+
+		path := "customFields"
+		if field != gojsonschema.STRING_CONTEXT_ROOT && field != "" {
+			path += "." + field
+		}
+		details = append(details, util.ErrDetail{Field: path, Rule: schemaErr.Type(), Message: schemaErr.Description()})
+	}
+	return details
+}
+
+// UpdateExistingEvent updates an event's details, and returns its new version.
+func UpdateExistingEvent(ctx context.Context, id string, updates map[string]interface{}, meta UpdateMeta) (int, error) {
 	UPDATABLE_KEYS := map[string]bool{
 		"name":                 true,
 		"description":          true,
@@ -103,13 +219,16 @@ func UpdateExistingEvent(ctx context.Context, id string, updates map[string]inte
 		"address":              true,
 		"start_timestamp":      true,
 		"end_timestamp":        true,
-		"custom_fields_schema": false, // Not allowed because since a ticket might exist with only old attributes
+		"custom_fields_schema": false, // Not allowed since tickets might only match the old schema, use UpdateEventCustomFieldsSchema instead
+		"audience":             true,
+		"owner_edit_cutoff":    true,
+		"draft":                true,
 	}
 
 	// Get event to get the custom field schema
 	objectID, err := primitive.ObjectIDFromHex(id)
 	if err != nil {
-		return err
+		return 0, err
 	}
 
 	// Convert the string/interface map to BSON updates
@@ -117,11 +236,15 @@ func UpdateExistingEvent(ctx context.Context, id string, updates map[string]inte
 	for key, val := range updates {
 		// Don't allow other keys to be updated
 		if !UPDATABLE_KEYS[key] {
-			return ErrEditNotAllowed
+			return 0, util.NewValidationError(ErrEditNotAllowed, util.AppCodeEditNotAllowed, key, "editable", "field can't be updated")
 		}
 
 		// Convert timestamps to time.Time objects
-		if key == "start_timestamp" || key == "end_timestamp" {
+		if key == "owner_edit_cutoff" && (val == nil || val == "") {
+			// Clearing the cutoff goes back to closing edits at the start of the event. It's stored as
+			// null rather than a zero time, which would read back as a cutoff that has long passed.
+			bsonUpdates = append(bsonUpdates, bson.E{Key: key, Value: nil})
+		} else if key == "start_timestamp" || key == "end_timestamp" || key == "owner_edit_cutoff" {
 			// TODO: Validate if the start_timestamp is before end_timestamp, probably not necessary but may be helpful
 			if timestampStr, ok := val.(string); ok {
 				timestamp, err := time.Parse(time.RFC3339, timestampStr)
@@ -129,12 +252,24 @@ func UpdateExistingEvent(ctx context.Context, id string, updates map[string]inte
 					bsonUpdates = append(bsonUpdates, bson.E{Key: key, Value: timestamp})
 				} else {
 					log.Warn().Err(err).Str("key", key).Msg("could not parse timestamp as RFC3339")
-					return errors.Join(fmt.Errorf("could not parse timestamp as RFC3339"), err)
+					return 0, errors.Join(fmt.Errorf("could not parse timestamp as RFC3339"), err)
 				}
 			} else {
 				log.Warn().Err(err).Str("key", key).Msg("could not parse timestamp as string")
-				return errors.Join(fmt.Errorf("could not parse timestamp as string"), err)
+				return 0, errors.Join(fmt.Errorf("could not parse timestamp as string"), err)
+			}
+		} else if key == "draft" {
+			draft, ok := val.(bool)
+			if !ok {
+				return 0, fmt.Errorf("draft must be a boolean")
+			}
+			bsonUpdates = append(bsonUpdates, bson.E{Key: key, Value: draft})
+		} else if key == "audience" {
+			audience, err := ParseEventAudience(val)
+			if err != nil {
+				return 0, err
 			}
+			bsonUpdates = append(bsonUpdates, bson.E{Key: key, Value: audience})
 		} else {
 			// Add the key/val pair in BSON
 			bsonUpdates = append(bsonUpdates, bson.E{Key: key, Value: val})
@@ -142,41 +277,177 @@ func UpdateExistingEvent(ctx context.Context, id string, updates map[string]inte
 	}
 
 	// Try to update document in DB
-	res, err := lib.Datastore.Db.Collection(eventsColName).
-		UpdateByID(ctx, objectID, bson.D{{Key: "$set", Value: bsonUpdates}})
+	version, err := updateVersionedDocument(ctx, eventsColName, ChangeDocumentEvent, objectID, id, bsonUpdates, meta)
 	if err != nil {
-		return err
+		return 0, err
 	}
-	if res.ModifiedCount == 0 {
-		return ErrNoDocumentModified
+
+	// Passes show the name, venue, times and first image
+	for key := range updates {
+		if key == "name" || key == "img_urls" || key == "location" || key == "address" ||
+			key == "start_timestamp" || key == "end_timestamp" {
+			if err := queueWalletSync(ctx, WalletSyncKindEvent, objectID); err != nil {
+				return 0, err
+			}
+			break
+		}
 	}
-	return nil
+	return version, nil
 }
 
-func DeleteEvent(ctx context.Context, id primitive.ObjectID) error {
-	// Check if event exists
-	exists, err := CheckIfEventExists(ctx, id)
+// DeleteEvent moves an event to the trash along with all of its tickets and queued tickets, so
+// that restoring the event brings them all back.
+func DeleteEvent(ctx context.Context, id primitive.ObjectID, deletedBy string) error {
+	_, err := lib.Datastore.WithTransaction(ctx, func(sessCtx mongo.SessionContext) (interface{}, error) {
+		trashed := bson.D{
+			{Key: "deleted_at", Value: time.Now()},
+			{Key: "deleted_by", Value: deletedBy},
+		}
+
+		// Trash event
+		res, err := lib.Datastore.Db.Collection(eventsColName).UpdateOne(
+			sessCtx,
+			excludeTrashed(bson.M{"_id": id}),
+			bson.D{{Key: "$set", Value: trashed}},
+		)
+		if err != nil {
+			return nil, err
+		}
+		if res.MatchedCount == 0 {
+			return nil, ErrNotFound
+		}
+
+		// Trash all tickets to event, leaving ones that were already trashed on their own alone
+		trashedWithEvent := append(trashed, bson.E{Key: "trashed_with_event", Value: true})
+		_, err = lib.Datastore.Db.Collection(ticketsColName).UpdateMany(
+			sessCtx,
+			excludeTrashed(bson.M{"event": id}),
+			bson.D{{Key: "$set", Value: trashedWithEvent}},
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		_, err = lib.Datastore.Db.Collection(queuedTicketsColName).UpdateMany(
+			sessCtx,
+			excludeTrashed(bson.M{"event_id": id}),
+			bson.D{{Key: "$set", Value: trashedWithEvent}},
+		)
+		return nil, err
+	})
 	if err != nil {
 		return err
 	}
-	if !exists {
-		return ErrNotFound
+
+	return queueWalletSync(ctx, WalletSyncKindEvent, id)
+}
+
+// ParseEventAudience converts a raw JSON audience (ex. from a PATCH body) into an EventAudience.
+// A nil value or an audience without any restrictions results in nil, opening the event up to everyone.
+func ParseEventAudience(raw interface{}) (*EventAudience, error) {
+	if raw == nil {
+		return nil, nil
 	}
 
-	// Delete all tickets to event
-	err = DeleteAllTicketsForEvent(ctx, id)
+	// Easiest way to get from a generic map to the struct is to go through JSON again
+	rawJSON, err := json.Marshal(raw)
 	if err != nil {
-		return err
+		return nil, err
 	}
+	decoder := json.NewDecoder(bytes.NewReader(rawJSON))
+	decoder.DisallowUnknownFields()
 
-	// Delete event
-	res, err := lib.Datastore.Db.Collection(eventsColName).DeleteOne(ctx, bson.M{"_id": id})
+	var audience EventAudience
+	if err := decoder.Decode(&audience); err != nil {
+		return nil, errors.Join(fmt.Errorf("could not parse audience"), err)
+	}
+	if err := audience.validate(); err != nil {
+		return nil, err
+	}
+	if audience.isEmpty() {
+		return nil, nil
+	}
 
-	// Handle no document found
-	if err == nil {
-		if res.DeletedCount == 0 {
-			err = ErrNotFound
+	return &audience, nil
+}
+
+func (audience *EventAudience) isEmpty() bool {
+	return audience == nil || (len(audience.Grades) == 0 && len(audience.Roles) == 0 && len(audience.Allowlist) == 0)
+}
+
+func (audience *EventAudience) validate() error {
+	if audience == nil {
+		return nil
+	}
+
+	for _, role := range audience.Roles {
+		switch role {
+		case lib.IdentityKindStudent, lib.IdentityKindStaff, lib.IdentityKindGuest, "admin":
+		default:
+			return fmt.Errorf("unknown audience role '%s'", role)
 		}
 	}
-	return err
+	for _, grade := range audience.Grades {
+		if grade <= 0 {
+			return fmt.Errorf("audience grades must be positive")
+		}
+	}
+
+	return nil
+}
+
+// CheckEligibility returns a ValidationError wrapping ErrNotEligible explaining why the user can't
+// get a ticket, or nil if they can.
+func (audience *EventAudience) CheckEligibility(user User) error {
+	if audience.isEmpty() {
+		return nil
+	}
+
+	// Allowlisted users skip every other check
+	for _, allowed := range audience.Allowlist {
+		if allowed == "" {
+			continue
+		}
+		if allowed == user.StudentNumber || allowed == user.ExternalID || NormalizeEmail(allowed) == user.Email {
+			return nil
+		}
+	}
+
+	// Only an allowlist means the event is invite-only
+	if len(audience.Grades) == 0 && len(audience.Roles) == 0 {
+		return notEligible("audience", "event is invite-only")
+	}
+
+	if len(audience.Grades) != 0 {
+		gradeAllowed := false
+		gradesStr := make([]string, len(audience.Grades))
+		for i, grade := range audience.Grades {
+			gradeAllowed = gradeAllowed || grade == user.Grade
+			gradesStr[i] = strconv.Itoa(grade)
+		}
+		if !gradeAllowed {
+			if user.Grade == 0 {
+				return notEligible("audience", fmt.Sprintf("event is only open to grade(s) %s, and user has no grade", strings.Join(gradesStr, ", ")))
+			}
+			return notEligible("audience", fmt.Sprintf("event is only open to grade(s) %s, but user is in grade %d", strings.Join(gradesStr, ", "), user.Grade))
+		}
+	}
+
+	if len(audience.Roles) != 0 {
+		kind := user.EffectiveKind()
+		roleAllowed := false
+		for _, role := range audience.Roles {
+			roleAllowed = roleAllowed || role == kind || (role == "admin" && user.Admin)
+		}
+		if !roleAllowed {
+			return notEligible("audience", fmt.Sprintf("event is only open to %s", strings.Join(audience.Roles, ", ")))
+		}
+	}
+
+	return nil
+}
+
+// notEligible explains why a ticket can't be made for a user.
+func notEligible(rule string, message string) error {
+	return util.NewValidationError(ErrNotEligible, util.AppCodeNotEligible, "owner", rule, message)
 }
@@ -0,0 +1,66 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestClearingOwnerEditCutoff(t *testing.T) {
+	setupTestDatastore(t)
+	ctx := context.Background()
+
+	eventID, err := CreateNewEvent(ctx, Event{
+		Name:           "Gala",
+		StartTimestamp: time.Now().Add(time.Hour),
+		EndTimestamp:   time.Now().Add(2 * time.Hour),
+		RawCustomFieldsSchema: map[string]interface{}{
+			"type": "object",
+			"properties": map[string]interface{}{
+				"meal": map[string]interface{}{"type": "string", "ownerEditable": true},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := CreateNewUser(ctx, User{ID: "holder", FullName: "Holder"}); err != nil {
+		t.Fatal(err)
+	}
+	ticketID, err := CreateNewTicket(ctx, Ticket{Owner: "holder", Event: eventID, CustomFields: map[string]interface{}{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Edits close once a cutoff in the past is set
+	cutoff := time.Now().Add(-time.Minute).Format(time.RFC3339)
+	if _, err := UpdateExistingEvent(ctx, eventID.Hex(), map[string]interface{}{"owner_edit_cutoff": cutoff}, UpdateMeta{}); err != nil {
+		t.Fatal(err)
+	}
+	_, err = UpdateTicketOwnerFields(ctx, ticketID, "holder", map[string]interface{}{"meal": "fish"}, nil)
+	if !errors.Is(err, ErrEditCutoffPassed) {
+		t.Fatalf("expected ErrEditCutoffPassed, got %v", err)
+	}
+
+	// Clearing it falls back to the start of the event
+	if _, err := UpdateExistingEvent(ctx, eventID.Hex(), map[string]interface{}{"owner_edit_cutoff": nil}, UpdateMeta{}); err != nil {
+		t.Fatal(err)
+	}
+	event, err := GetEvent(ctx, bson.M{"_id": eventID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if event.OwnerEditCutoff != nil {
+		t.Errorf("expected the cleared cutoff to read back as unset, got %v", event.OwnerEditCutoff)
+	}
+	ticket, err := UpdateTicketOwnerFields(ctx, ticketID, "holder", map[string]interface{}{"meal": "fish"}, nil)
+	if err != nil {
+		t.Fatalf("expected owners to edit before the start once the cutoff is cleared, got %v", err)
+	}
+	if ticket.CustomFields["meal"] != "fish" {
+		t.Errorf("expected the edit to be saved, got %v", ticket.CustomFields)
+	}
+}
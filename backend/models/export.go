@@ -0,0 +1,158 @@
+package models
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/aritrosaha10/frasertickets/lib"
+	"github.com/aritrosaha10/frasertickets/util"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// TicketExportColumn is a single column in an attendee export.
+type TicketExportColumn struct {
+	ID        string                   `json:"id"`
+	Header    string                   `json:"header"`
+	Value     func(Ticket) interface{} `json:"-"`
+	Sensitive bool                     `json:"sensitive"` // only exported when asked for by ID
+}
+
+// TicketExportColumns returns every column that can be exported for an event's tickets. Custom
+// fields get one column each, labelled by their display name and in display order.
+func TicketExportColumns(event Event) ([]TicketExportColumn, error) {
+	columns := []TicketExportColumn{
+		{ID: "ticketId", Header: "Ticket ID", Value: func(t Ticket) interface{} { return t.ID.Hex() }},
+		{ID: "ownerId", Header: "Owner ID", Value: func(t Ticket) interface{} { return t.Owner }},
+		{ID: "fullName", Header: "Full Name", Value: func(t Ticket) interface{} { return t.OwnerData.FullName }},
+		{ID: "studentNumber", Header: "Student Number", Value: func(t Ticket) interface{} { return t.OwnerData.StudentNumber }},
+		{ID: "email", Header: "Email", Value: func(t Ticket) interface{} { return t.OwnerData.Email }},
+		{ID: "grade", Header: "Grade", Value: func(t Ticket) interface{} {
+			if t.OwnerData.Grade == 0 {
+				return nil
+			}
+			return t.OwnerData.Grade
+		}},
+		{ID: "homeroom", Header: "Homeroom", Value: func(t Ticket) interface{} { return t.OwnerData.Homeroom }},
+		{ID: "timestamp", Header: "Created At", Value: func(t Ticket) interface{} { return t.Timestamp }},
+		{ID: "scanned", Header: "Scanned", Value: func(t Ticket) interface{} { return t.Scanned() }},
+		{ID: "scanCount", Header: "Scan Count", Value: func(t Ticket) interface{} { return t.ScanCount }},
+		{ID: "maxScanCount", Header: "Max Scan Count", Value: func(t Ticket) interface{} { return t.MaxScanCount }},
+		{ID: "firstScanTime", Header: "First Scan Time", Value: func(t Ticket) interface{} { return optionalTime(t.FirstScanTimestamp) }},
+		{ID: "lastScanTime", Header: "Last Scan Time", Value: func(t Ticket) interface{} { return t.LastScanTimestamp }},
+	}
+
+	if len(event.RawCustomFieldsSchema) == 0 {
+		return columns, nil
+	}
+	schema, err := util.ConvertRawCustomFieldsSchema(event.RawCustomFieldsSchema)
+	if err != nil {
+		return []TicketExportColumn{}, err
+	}
+
+	for _, key := range schema.OrderedKeys() {
+		customKey := key // Copy so each closure gets its own key
+		columns = append(columns, TicketExportColumn{
+			ID:        "customFields." + customKey,
+			Header:    customFieldHeader(schema, key),
+			Value:     func(t Ticket) interface{} { return t.CustomFields[customKey] },
+			Sensitive: schema.Properties[key].Sensitive,
+		})
+	}
+
+	return columns, nil
+}
+
+// optionalTime unwraps an optional timestamp for an export, leaving the cell empty if it isn't set.
+func optionalTime(t *time.Time) interface{} {
+	if t == nil {
+		return nil
+	}
+	return *t
+}
+
+// customFieldHeader is how a custom field is labelled in exports and reports, falling back to its
+// key if it has no display name.
+func customFieldHeader(schema util.CustomFieldsSchema, key string) string {
+	if displayName := schema.Properties[key].DisplayName; displayName != "" {
+		return displayName
+	}
+	return key
+}
+
+// TabularColumns converts export columns into the columns a tabular writer expects.
+func TabularColumns(columns []TicketExportColumn) []util.TabularColumn {
+	tabularColumns := make([]util.TabularColumn, len(columns))
+	for i, column := range columns {
+		tabularColumns[i] = util.TabularColumn{Key: column.ID, Header: column.Header}
+	}
+	return tabularColumns
+}
+
+// TabularRow pulls a ticket's value for each of the columns.
+func TabularRow(columns []TicketExportColumn, ticket Ticket) []interface{} {
+	row := make([]interface{}, len(columns))
+	for i, column := range columns {
+		row[i] = column.Value(ticket)
+	}
+	return row
+}
+
+// SelectTicketExportColumns picks out the columns with the given IDs, in the order given. All
+// columns other than sensitive ones are returned if no IDs are given.
+func SelectTicketExportColumns(columns []TicketExportColumn, ids []string) ([]TicketExportColumn, error) {
+	if len(ids) == 0 {
+		selected := []TicketExportColumn{}
+		for _, column := range columns {
+			if !column.Sensitive {
+				selected = append(selected, column)
+			}
+		}
+		return selected, nil
+	}
+
+	byID := map[string]TicketExportColumn{}
+	for _, column := range columns {
+		byID[column.ID] = column
+	}
+
+	selected := []TicketExportColumn{}
+	for _, id := range ids {
+		column, ok := byID[strings.TrimSpace(id)]
+		if !ok {
+			return []TicketExportColumn{}, fmt.Errorf("unknown export column '%s'", id)
+		}
+		selected = append(selected, column)
+	}
+	return selected, nil
+}
+
+// StreamEventTickets calls fn on each of an event's tickets (with owner data) one at a time, straight
+// from a database cursor. Iteration stops at the first error returned by fn.
+func StreamEventTickets(ctx context.Context, eventID primitive.ObjectID, fn func(Ticket) error) error {
+	pipeline := append(mongo.Pipeline{
+		{{Key: "$match", Value: excludeTrashed(bson.M{"event": eventID})}},
+		{{Key: "$sort", Value: bson.D{{Key: "_id", Value: 1}}}},
+	}, ticketOwnerLookupStages()...)
+
+	cursor, err := lib.Datastore.Db.Collection(ticketsColName).Aggregate(ctx, pipeline)
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(ctx)
+
+	for cursor.Next(ctx) {
+		var ticket Ticket
+		if err := cursor.Decode(&ticket); err != nil {
+			return err
+		}
+		if err := fn(ticket); err != nil {
+			return err
+		}
+	}
+
+	return cursor.Err()
+}
@@ -0,0 +1,220 @@
+package models
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/aritrosaha10/frasertickets/lib"
+	"github.com/aritrosaha10/frasertickets/util"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	ChangeDocumentTicket = "ticket"
+	ChangeDocumentEvent  = "event"
+	ChangeDocumentUser   = "user"
+)
+
+// UpdateMeta describes who is making an edit, and which version of the document they last saw.
+type UpdateMeta struct {
+	ChangedBy       string // UID of the requester, empty for edits made by the system
+	ByOwner         bool   // the requester owns the document instead of being an admin
+	ExpectedVersion *int   // fails with ErrVersionMismatch if the document has moved on, nil skips the check
+}
+
+// ChangeRecord is a single saved edit to a document, listing what each changed field used to be.
+type ChangeRecord struct {
+	ID           primitive.ObjectID `json:"id"           bson:"_id,omitempty"`
+	DocumentKind string             `json:"documentKind" bson:"document_kind"` // ticket, event or user
+	DocumentID   string             `json:"documentID"   bson:"document_id"`   // hex for object IDs, UID for users
+	ChangedBy    string             `json:"changedBy"    bson:"changed_by"`    // UID of whoever made the edit, empty for the system
+	ByOwner      bool               `json:"byOwner"      bson:"by_owner"`      // made by the document's owner instead of an admin
+	Version      int                `json:"version"      bson:"version"`       // version of the document after the edit
+	Changes      []FieldChange      `json:"changes"      bson:"changes"`
+	Timestamp    time.Time          `json:"timestamp"    bson:"timestamp"`
+}
+
+func (record *ChangeRecord) Render(w http.ResponseWriter, r *http.Request) error {
+	return nil
+}
+
+// FieldChange is one field's value before and after an edit.
+type FieldChange struct {
+	Field string      `json:"field" bson:"field"` // ex. maxScanCount or customFields.mealChoice
+	From  interface{} `json:"from"  bson:"from"`
+	To    interface{} `json:"to"    bson:"to"`
+}
+
+func CreateChangeHistoryIndices(ctx context.Context) error {
+	// History is always looked up for one document at a time, newest first
+	documentIdxModel := mongo.IndexModel{
+		Keys: bson.D{
+			{Key: "document_kind", Value: 1},
+			{Key: "document_id", Value: 1},
+			{Key: "timestamp", Value: -1},
+		},
+	}
+
+	// Try creating the index
+	opts := options.CreateIndexes().SetMaxTime(10 * time.Second)
+	_, err := lib.Datastore.Db.Collection(changeHistoryColName).
+		Indexes().
+		CreateOne(ctx, documentIdxModel, opts)
+	return err
+}
+
+// recordChange saves an edit to the change history. Nothing is saved if no fields changed.
+func recordChange(ctx context.Context, record ChangeRecord) error {
+	return recordChanges(ctx, []ChangeRecord{record})
+}
+
+// recordChanges saves several edits to the change history at once, skipping ones where no fields
+// changed.
+func recordChanges(ctx context.Context, records []ChangeRecord) error {
+	now := time.Now()
+	documents := []interface{}{}
+	for _, record := range records {
+		if len(record.Changes) == 0 {
+			continue
+		}
+		record.ID = primitive.NilObjectID
+		if record.Timestamp.IsZero() {
+			record.Timestamp = now
+		}
+		documents = append(documents, record)
+	}
+	if len(documents) == 0 {
+		return nil
+	}
+
+	_, err := lib.Datastore.Db.Collection(changeHistoryColName).InsertMany(ctx, documents)
+	return err
+}
+
+// GetChangeHistory lists every saved edit to a document, newest first.
+func GetChangeHistory(ctx context.Context, documentKind string, documentID string) ([]ChangeRecord, error) {
+	opts := options.Find().SetSort(bson.D{{Key: "timestamp", Value: -1}, {Key: "_id", Value: -1}})
+	cursor, err := lib.Datastore.Db.Collection(changeHistoryColName).Find(
+		ctx,
+		bson.M{"document_kind": documentKind, "document_id": documentID},
+		opts,
+	)
+	if err != nil {
+		return []ChangeRecord{}, err
+	}
+
+	records := []ChangeRecord{}
+	if err := cursor.All(ctx, &records); err != nil {
+		return []ChangeRecord{}, err
+	}
+	return records, nil
+}
+
+// updateVersionedDocument applies $set updates to a document, bumping its version and saving what
+// changed to the change history, all in one transaction. Fields set to what they already are don't
+// count as changes, and ErrNoDocumentModified is returned if nothing would change. Trashed documents
+// count as not found. The document's new version is returned.
+func updateVersionedDocument(
+	ctx context.Context,
+	colName string,
+	documentKind string,
+	id interface{},
+	documentID string,
+	bsonUpdates bson.D,
+	meta UpdateMeta,
+) (int, error) {
+	res, err := lib.Datastore.WithTransaction(ctx, func(sessCtx mongo.SessionContext) (interface{}, error) {
+		var current bson.M
+		err := lib.Datastore.Db.Collection(colName).FindOne(sessCtx, excludeTrashed(bson.M{"_id": id})).Decode(&current)
+		if err == mongo.ErrNoDocuments {
+			return nil, ErrNotFound
+		} else if err != nil {
+			return nil, err
+		}
+
+		version, _ := util.CustomFieldInt(current["version"]) // Missing on documents from before versioning
+		if meta.ExpectedVersion != nil && *meta.ExpectedVersion != version {
+			return nil, ErrVersionMismatch
+		}
+
+		changes := []FieldChange{}
+		for _, update := range bsonUpdates {
+			from := documentValue(current, update.Key)
+			if !sameValue(from, update.Value) {
+				changes = append(changes, FieldChange{Field: update.Key, From: from, To: update.Value})
+			}
+		}
+		if len(changes) == 0 {
+			return nil, ErrNoDocumentModified
+		}
+
+		_, err = lib.Datastore.Db.Collection(colName).UpdateByID(sessCtx, id, bson.D{
+			{Key: "$set", Value: bsonUpdates},
+			{Key: "$inc", Value: bson.D{{Key: "version", Value: 1}}},
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		err = recordChange(sessCtx, ChangeRecord{
+			DocumentKind: documentKind,
+			DocumentID:   documentID,
+			ChangedBy:    meta.ChangedBy,
+			ByOwner:      meta.ByOwner,
+			Version:      version + 1,
+			Changes:      changes,
+		})
+		if err != nil {
+			return nil, err
+		}
+		return version + 1, nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return res.(int), nil
+}
+
+// documentValue looks up a dotted key (ex. customFields.mealChoice) in a raw document.
+func documentValue(document bson.M, key string) interface{} {
+	var value interface{} = document
+	for _, part := range strings.Split(key, ".") {
+		subDocument, ok := value.(bson.M)
+		if !ok {
+			return nil
+		}
+		value = subDocument[part]
+	}
+	return value
+}
+
+// sameValue compares a stored value with a new one. Stored numbers and dates come back from Mongo
+// as different types than the ones they're written with, so values are compared as JSON.
+func sameValue(stored interface{}, updated interface{}) bool {
+	if reflect.DeepEqual(stored, updated) {
+		return true
+	}
+	if storedTime, ok := stored.(primitive.DateTime); ok {
+		if updatedTime, ok := updated.(time.Time); ok {
+			return storedTime.Time().Equal(updatedTime)
+		}
+	}
+
+	storedJSON, err := json.Marshal(stored)
+	if err != nil {
+		return false
+	}
+	updatedJSON, err := json.Marshal(updated)
+	if err != nil {
+		return false
+	}
+	return string(storedJSON) == string(updatedJSON)
+}
@@ -0,0 +1,131 @@
+package models
+
+import (
+	"context"
+	"testing"
+
+	"github.com/aritrosaha10/frasertickets/lib"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestUpdateVersionedDocument(t *testing.T) {
+	setupTestDatastore(t)
+	ctx := context.Background()
+
+	if _, err := CreateNewUser(ctx, User{ID: "user1", FullName: "Old Name"}); err != nil {
+		t.Fatal(err)
+	}
+	updates := bson.D{{Key: "full_name", Value: "New Name"}}
+
+	version, err := updateVersionedDocument(ctx, usersColName, ChangeDocumentUser, "user1", "user1", updates, UpdateMeta{ChangedBy: "admin"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != 1 {
+		t.Errorf("expected version 1, got %d", version)
+	}
+
+	// Setting the same value again isn't a change
+	_, err = updateVersionedDocument(ctx, usersColName, ChangeDocumentUser, "user1", "user1", updates, UpdateMeta{})
+	if err != ErrNoDocumentModified {
+		t.Errorf("expected ErrNoDocumentModified, got %v", err)
+	}
+
+	stale := 0
+	_, err = updateVersionedDocument(ctx, usersColName, ChangeDocumentUser, "user1", "user1", bson.D{
+		{Key: "full_name", Value: "Stale Name"},
+	}, UpdateMeta{ExpectedVersion: &stale})
+	if err != ErrVersionMismatch {
+		t.Errorf("expected ErrVersionMismatch, got %v", err)
+	}
+
+	_, err = updateVersionedDocument(ctx, usersColName, ChangeDocumentUser, "missing", "missing", updates, UpdateMeta{})
+	if err != ErrNotFound {
+		t.Errorf("expected ErrNotFound, got %v", err)
+	}
+
+	history, err := GetChangeHistory(ctx, ChangeDocumentUser, "user1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(history) != 1 {
+		t.Fatalf("expected one change record, got %d", len(history))
+	}
+	record := history[0]
+	if record.Version != 1 || record.ChangedBy != "admin" || len(record.Changes) != 1 {
+		t.Fatalf("unexpected change record %+v", record)
+	}
+	if change := record.Changes[0]; change.Field != "full_name" || change.From != "Old Name" || change.To != "New Name" {
+		t.Errorf("unexpected field change %+v", change)
+	}
+}
+
+func TestApproveUserIsVersioned(t *testing.T) {
+	setupTestDatastore(t)
+	ctx := context.Background()
+
+	if _, err := CreateNewUser(ctx, User{ID: "held", PendingApproval: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	user, err := ApproveUser(ctx, "held", "staff", "", "admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.PendingApproval || user.Kind != "staff" || user.Version != 1 {
+		t.Errorf("expected an approved staff user at version 1, got %+v", user)
+	}
+
+	// Approving twice finds nothing waiting
+	if _, err := ApproveUser(ctx, "held", "", "", "admin"); err == nil {
+		t.Error("expected a second approval to fail")
+	}
+
+	history, err := GetChangeHistory(ctx, ChangeDocumentUser, "held")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(history) != 1 || history[0].ChangedBy != "admin" {
+		t.Errorf("expected one change by the approver, got %+v", history)
+	}
+}
+
+func TestImportRosterVersionsUserChanges(t *testing.T) {
+	setupTestDatastore(t)
+	ctx := context.Background()
+
+	for _, user := range []User{
+		{ID: "moved", StudentNumber: "111", Grade: 9, Homeroom: "101"},
+		{ID: "unchanged", StudentNumber: "222", Grade: 10, Homeroom: "202"},
+	} {
+		if _, err := CreateNewUser(ctx, user); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	result, err := ImportRoster(ctx, []RosterEntry{
+		{StudentNumber: "111", Grade: 10, Homeroom: "102", Active: true},
+		{StudentNumber: "222", Grade: 10, Homeroom: "202", Active: true},
+	}, RosterColumns{Grade: true, Homeroom: true}, false, "admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.UsersUpdated != 1 {
+		t.Errorf("expected one user to be updated, got %d", result.UsersUpdated)
+	}
+
+	var moved User
+	if err := lib.Datastore.Db.Collection(usersColName).FindOne(ctx, bson.M{"_id": "moved"}).Decode(&moved); err != nil {
+		t.Fatal(err)
+	}
+	if moved.Grade != 10 || moved.Homeroom != "102" || moved.Version != 1 {
+		t.Errorf("expected the moved user to be updated to version 1, got %+v", moved)
+	}
+	history, err := GetChangeHistory(ctx, ChangeDocumentUser, "unchanged")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(history) != 0 {
+		t.Errorf("expected no changes to the unchanged user, got %+v", history)
+	}
+}
@@ -0,0 +1,434 @@
+package models
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	DefaultPageLimit = 50
+	MaxPageLimit     = 200
+)
+
+// SortKey is a single field that results are ordered by.
+type SortKey struct {
+	Field      string
+	Descending bool
+}
+
+// PageOptions describes which page of results to fetch. Cursor is the opaque token returned as
+// PageInfo.NextCursor by the previous page, or empty for the first page.
+type PageOptions struct {
+	Limit     int
+	Cursor    string
+	Sort      []SortKey
+	Unlimited bool // Return everything in one page, for clients that don't paginate yet
+}
+
+// PageInfo describes where a page of results ends, so the next one can be fetched.
+type PageInfo struct {
+	NextCursor string `json:"next_cursor,omitempty"`
+	HasMore    bool   `json:"has_more"`
+}
+
+// pageCursor is what gets encoded into cursor tokens. The sort fields are kept along with the
+// values so a cursor can't accidentally be reused with a different sort order.
+type pageCursor struct {
+	Fields []string `bson:"f"`
+	Values bson.A   `bson:"v"`
+}
+
+// normalize fills in defaults and always adds _id as the final sort key, so every document has a
+// unique position and no results are skipped or repeated between pages.
+func (page PageOptions) normalize() PageOptions {
+	if page.Limit <= 0 {
+		page.Limit = DefaultPageLimit
+	}
+	if page.Limit > MaxPageLimit {
+		page.Limit = MaxPageLimit
+	}
+
+	sort := []SortKey{}
+	for _, key := range page.Sort {
+		if key.Field != "_id" {
+			sort = append(sort, key)
+		}
+	}
+	descending := false
+	for _, key := range page.Sort {
+		if key.Field == "_id" {
+			descending = key.Descending
+		}
+	}
+	page.Sort = append(sort, SortKey{Field: "_id", Descending: descending})
+
+	return page
+}
+
+func (page PageOptions) sortDocument() bson.D {
+	sort := bson.D{}
+	for _, key := range page.Sort {
+		direction := 1
+		if key.Descending {
+			direction = -1
+		}
+		sort = append(sort, bson.E{Key: key.Field, Value: direction})
+	}
+	return sort
+}
+
+func (page PageOptions) sortFields() []string {
+	fields := make([]string, len(page.Sort))
+	for i, key := range page.Sort {
+		fields[i] = key.Field
+	}
+	return fields
+}
+
+// cursorFilter converts the cursor into a filter only matching documents after it in the sort order.
+func (page PageOptions) cursorFilter() (bson.M, error) {
+	if page.Cursor == "" {
+		return bson.M{}, nil
+	}
+
+	rawCursor, err := base64.RawURLEncoding.DecodeString(page.Cursor)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+	var cursor pageCursor
+	if err := bson.Unmarshal(rawCursor, &cursor); err != nil {
+		return nil, ErrInvalidCursor
+	}
+	if strings.Join(cursor.Fields, ",") != strings.Join(page.sortFields(), ",") || len(cursor.Values) != len(page.Sort) {
+		return nil, fmt.Errorf("%w: cursor does not match the requested sort order", ErrInvalidCursor)
+	}
+
+	// (a > x) OR (a == x AND b > y) OR ...
+	conditions := bson.A{}
+	for i, key := range page.Sort {
+		after, ok := afterCondition(key, cursor.Values[i])
+		if !ok {
+			continue
+		}
+		condition := bson.A{}
+		for j := 0; j < i; j++ {
+			// Matches both null and missing fields, same as how they sort
+			condition = append(condition, bson.M{page.Sort[j].Field: cursor.Values[j]})
+		}
+		conditions = append(conditions, bson.M{"$and": append(condition, after)})
+	}
+	if len(conditions) == 0 {
+		// Every key was already at the end of its order, so nothing can come after the cursor
+		return bson.M{"_id": bson.M{"$exists": false}}, nil
+	}
+
+	return bson.M{"$or": conditions}, nil
+}
+
+// afterCondition matches documents that come after the value in a single key's sort order. Missing
+// and null fields sort before everything else, which comparisons like $gt never match on their own.
+// ok is false if nothing can come after the value.
+func afterCondition(key SortKey, value interface{}) (bson.M, bool) {
+	null := isNullCursorValue(value)
+	switch {
+	case !key.Descending && null:
+		return bson.M{key.Field: bson.M{"$ne": nil}}, true
+	case !key.Descending:
+		return bson.M{key.Field: bson.M{"$gt": value}}, true
+	case null:
+		return nil, false
+	default:
+		return bson.M{"$or": bson.A{
+			bson.M{key.Field: bson.M{"$lt": value}},
+			bson.M{key.Field: nil},
+		}}, true
+	}
+}
+
+func isNullCursorValue(value interface{}) bool {
+	switch value.(type) {
+	case nil, primitive.Null, primitive.Undefined:
+		return true
+	default:
+		return false
+	}
+}
+
+// encodeCursor creates a cursor token pointing right after the given document.
+func (page PageOptions) encodeCursor(doc bson.Raw) (string, error) {
+	cursor := pageCursor{Fields: page.sortFields()}
+	for _, field := range cursor.Fields {
+		value, err := doc.LookupErr(strings.Split(field, ".")...)
+		if err != nil {
+			// Missing fields sort as null
+			cursor.Values = append(cursor.Values, nil)
+			continue
+		}
+		cursor.Values = append(cursor.Values, value)
+	}
+
+	rawCursor, err := bson.Marshal(cursor)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(rawCursor), nil
+}
+
+// mergeFilters combines filters with $and, skipping any that are empty.
+func mergeFilters(filters ...bson.M) bson.M {
+	nonEmpty := bson.A{}
+	for _, filter := range filters {
+		if len(filter) != 0 {
+			nonEmpty = append(nonEmpty, filter)
+		}
+	}
+
+	switch len(nonEmpty) {
+	case 0:
+		return bson.M{}
+	case 1:
+		return nonEmpty[0].(bson.M)
+	default:
+		return bson.M{"$and": nonEmpty}
+	}
+}
+
+// findPage runs a find query one page at a time, decoding results into T.
+func findPage[T any](ctx context.Context, col *mongo.Collection, filter bson.M, page PageOptions) ([]T, PageInfo, error) {
+	page = page.normalize()
+
+	cursorFilter, err := page.cursorFilter()
+	if err != nil {
+		return []T{}, PageInfo{}, err
+	}
+
+	opts := options.Find().SetSort(page.sortDocument())
+	if !page.Unlimited {
+		// Fetch one more than needed to know if there's another page
+		opts.SetLimit(int64(page.Limit + 1))
+	}
+	cursor, err := col.Find(ctx, mergeFilters(filter, cursorFilter), opts)
+	if err != nil {
+		return []T{}, PageInfo{}, err
+	}
+	defer cursor.Close(ctx)
+
+	return decodePage[T](ctx, cursor, page)
+}
+
+// decodePage reads up to a page of results from a cursor fetched with a limit of page.Limit + 1
+// (or without a limit if the page is unlimited).
+func decodePage[T any](ctx context.Context, cursor *mongo.Cursor, page PageOptions) ([]T, PageInfo, error) {
+	results := []T{}
+	info := PageInfo{}
+	var lastDoc bson.Raw
+	for cursor.Next(ctx) {
+		if !page.Unlimited && len(results) == page.Limit {
+			info.HasMore = true
+			break
+		}
+
+		var result T
+		if err := cursor.Decode(&result); err != nil {
+			return []T{}, PageInfo{}, err
+		}
+		results = append(results, result)
+		lastDoc = append(bson.Raw(nil), cursor.Current...) // Current gets reused by the driver
+	}
+	if err := cursor.Err(); err != nil {
+		return []T{}, PageInfo{}, err
+	}
+
+	if info.HasMore {
+		nextCursor, err := page.encodeCursor(lastDoc)
+		if err != nil {
+			return []T{}, PageInfo{}, err
+		}
+		info.NextCursor = nextCursor
+	}
+
+	return results, info, nil
+}
+
+// FilterType is how a filter value from a query string gets converted before querying.
+type FilterType int
+
+const (
+	FilterTypeString FilterType = iota
+	FilterTypeInt
+	FilterTypeBool
+	FilterTypeObjectID
+	FilterTypeTime // RFC3339
+)
+
+// FilterField is a field that a list can be filtered on.
+type FilterField struct {
+	Field string // Field name in the document
+	Type  FilterType
+}
+
+// ListSpec describes what a list endpoint can be sorted and filtered by. Query names are what
+// clients use, which are mapped to document fields so internal names don't leak into the API.
+type ListSpec struct {
+	SortFields         map[string]string
+	FilterFields       map[string]FilterField
+	CustomFieldsPrefix string // Document field holding custom fields, empty if they can't be filtered on
+}
+
+var (
+	filterOperatorRegex = regexp.MustCompile(`^([A-Za-z0-9_.]+)\[(eq|ne|gt|gte|lt|lte)\]$`)
+	customFieldKeyRegex = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+)
+
+// ParseSort reads a comma separated list of sort keys (ex. "timestamp,-scanCount", where a leading
+// dash sorts descending) into sort keys.
+func (spec ListSpec) ParseSort(raw string) ([]SortKey, error) {
+	sort := []SortKey{}
+	if raw == "" {
+		return sort, nil
+	}
+
+	for _, name := range strings.Split(raw, ",") {
+		key := SortKey{}
+		if strings.HasPrefix(name, "-") {
+			key.Descending = true
+			name = name[1:]
+		}
+
+		field, ok := spec.SortFields[name]
+		if !ok {
+			return []SortKey{}, fmt.Errorf("cannot sort by '%s'", name)
+		}
+		key.Field = field
+		sort = append(sort, key)
+	}
+
+	return sort, nil
+}
+
+// ParseFilters converts query params into a filter. Params are either "name=value" for equality or
+// "name[op]=value" where op is one of eq, ne, gt, gte, lt or lte. Custom fields are filtered on with
+// "customFields.key=value". Params that aren't filters (ex. limit) are ignored.
+func (spec ListSpec) ParseFilters(query url.Values) (bson.M, error) {
+	conditions := []bson.M{}
+	for param, values := range query {
+		name, operator := param, "eq"
+		if match := filterOperatorRegex.FindStringSubmatch(param); match != nil {
+			name, operator = match[1], match[2]
+		}
+
+		var (
+			field     string
+			converter func(string) (interface{}, error)
+		)
+		if filterField, ok := spec.FilterFields[name]; ok {
+			field = filterField.Field
+			filterType := filterField.Type
+			converter = func(raw string) (interface{}, error) { return convertFilterValue(raw, filterType) }
+		} else if customKey, ok := strings.CutPrefix(name, "customFields."); ok && spec.CustomFieldsPrefix != "" {
+			if !customFieldKeyRegex.MatchString(customKey) {
+				return nil, fmt.Errorf("custom field '%s' cannot be filtered on", customKey)
+			}
+			field = spec.CustomFieldsPrefix + "." + customKey
+			converter = convertCustomFieldFilterValue
+		} else {
+			continue
+		}
+
+		for _, raw := range values {
+			value, err := converter(raw)
+			if err != nil {
+				return nil, fmt.Errorf("could not parse filter '%s': %w", param, err)
+			}
+
+			// Custom fields can hold any type, so equality checks try all of them
+			if candidates, ok := value.(bson.A); ok && (operator == "eq" || operator == "ne") {
+				if operator == "eq" {
+					conditions = append(conditions, bson.M{field: bson.M{"$in": candidates}})
+				} else {
+					conditions = append(conditions, bson.M{field: bson.M{"$nin": candidates}})
+				}
+				continue
+			} else if ok {
+				// Comparisons only make sense for numbers, otherwise compare as strings
+				value = raw
+				if number, err := strconv.ParseFloat(raw, 64); err == nil {
+					value = number
+				}
+			}
+
+			conditions = append(conditions, bson.M{field: bson.M{"$" + operator: value}})
+		}
+	}
+
+	return mergeFilters(conditions...), nil
+}
+
+func convertFilterValue(raw string, filterType FilterType) (interface{}, error) {
+	switch filterType {
+	case FilterTypeInt:
+		return strconv.Atoi(raw)
+	case FilterTypeBool:
+		return strconv.ParseBool(raw)
+	case FilterTypeObjectID:
+		return primitive.ObjectIDFromHex(raw)
+	case FilterTypeTime:
+		return time.Parse(time.RFC3339, raw)
+	default:
+		return raw, nil
+	}
+}
+
+// convertCustomFieldFilterValue returns every type the raw value could be, since custom fields aren't typed.
+func convertCustomFieldFilterValue(raw string) (interface{}, error) {
+	candidates := bson.A{raw}
+	if number, err := strconv.ParseFloat(raw, 64); err == nil {
+		candidates = append(candidates, number)
+	}
+	if boolean, err := strconv.ParseBool(raw); err == nil {
+		candidates = append(candidates, boolean)
+	}
+	return candidates, nil
+}
+
+// aggregatePage runs an aggregation one page at a time, decoding results into T. The filter and sort
+// are applied before the given stages, and the limit after them, since stages like $unwind can drop
+// documents. Pipelines only pull as many documents as the limit needs, so stages like $lookup still
+// only run for about a page of documents.
+func aggregatePage[T any](ctx context.Context, col *mongo.Collection, filter bson.M, page PageOptions, stages mongo.Pipeline) ([]T, PageInfo, error) {
+	page = page.normalize()
+
+	cursorFilter, err := page.cursorFilter()
+	if err != nil {
+		return []T{}, PageInfo{}, err
+	}
+
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: mergeFilters(filter, cursorFilter)}},
+		{{Key: "$sort", Value: page.sortDocument()}},
+	}
+	pipeline = append(pipeline, stages...)
+	if !page.Unlimited {
+		// Fetch one more than needed to know if there's another page
+		pipeline = append(pipeline, bson.D{{Key: "$limit", Value: page.Limit + 1}})
+	}
+
+	cursor, err := col.Aggregate(ctx, pipeline)
+	if err != nil {
+		return []T{}, PageInfo{}, err
+	}
+	defer cursor.Close(ctx)
+
+	return decodePage[T](ctx, cursor, page)
+}
@@ -0,0 +1,265 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"reflect"
+	"testing"
+
+	"github.com/aritrosaha10/frasertickets/lib"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+func TestPageOptionsNormalize(t *testing.T) {
+	page := PageOptions{}.normalize()
+	if page.Limit != DefaultPageLimit {
+		t.Errorf("expected default limit %d, got %d", DefaultPageLimit, page.Limit)
+	}
+	if !reflect.DeepEqual(page.Sort, []SortKey{{Field: "_id"}}) {
+		t.Errorf("expected only _id sort, got %v", page.Sort)
+	}
+
+	page = PageOptions{
+		Limit: MaxPageLimit + 1,
+		Sort:  []SortKey{{Field: "_id", Descending: true}, {Field: "timestamp"}},
+	}.normalize()
+	if page.Limit != MaxPageLimit {
+		t.Errorf("expected limit to be capped at %d, got %d", MaxPageLimit, page.Limit)
+	}
+	expectedSort := []SortKey{{Field: "timestamp"}, {Field: "_id", Descending: true}}
+	if !reflect.DeepEqual(page.Sort, expectedSort) {
+		t.Errorf("expected _id to be moved last keeping its direction, got %v", page.Sort)
+	}
+}
+
+func cursorAfter(t *testing.T, page PageOptions, doc bson.D) string {
+	t.Helper()
+
+	raw, err := bson.Marshal(doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cursor, err := page.encodeCursor(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cursor
+}
+
+func TestCursorFilter(t *testing.T) {
+	id := primitive.NewObjectID()
+
+	tests := []struct {
+		name     string
+		sort     []SortKey
+		doc      bson.D
+		expected bson.M
+	}{
+		{
+			name: "ascending value",
+			sort: []SortKey{{Field: "scanCount"}},
+			doc:  bson.D{{Key: "_id", Value: id}, {Key: "scanCount", Value: int32(2)}},
+			expected: bson.M{"$or": bson.A{
+				bson.M{"$and": bson.A{bson.M{"scanCount": bson.M{"$gt": int32(2)}}}},
+				bson.M{"$and": bson.A{bson.M{"scanCount": int32(2)}, bson.M{"_id": bson.M{"$gt": id}}}},
+			}},
+		},
+		{
+			name: "ascending missing value comes before every value",
+			sort: []SortKey{{Field: "scanCount"}},
+			doc:  bson.D{{Key: "_id", Value: id}},
+			expected: bson.M{"$or": bson.A{
+				bson.M{"$and": bson.A{bson.M{"scanCount": bson.M{"$ne": nil}}}},
+				bson.M{"$and": bson.A{bson.M{"scanCount": nil}, bson.M{"_id": bson.M{"$gt": id}}}},
+			}},
+		},
+		{
+			name: "descending value is followed by missing values",
+			sort: []SortKey{{Field: "scanCount", Descending: true}},
+			doc:  bson.D{{Key: "_id", Value: id}, {Key: "scanCount", Value: int32(2)}},
+			expected: bson.M{"$or": bson.A{
+				bson.M{"$and": bson.A{bson.M{"$or": bson.A{
+					bson.M{"scanCount": bson.M{"$lt": int32(2)}},
+					bson.M{"scanCount": nil},
+				}}}},
+				bson.M{"$and": bson.A{bson.M{"scanCount": int32(2)}, bson.M{"_id": bson.M{"$gt": id}}}},
+			}},
+		},
+		{
+			name: "descending null value only has ties left",
+			sort: []SortKey{{Field: "scanCount", Descending: true}},
+			doc:  bson.D{{Key: "_id", Value: id}, {Key: "scanCount", Value: nil}},
+			expected: bson.M{"$or": bson.A{
+				bson.M{"$and": bson.A{bson.M{"scanCount": nil}, bson.M{"_id": bson.M{"$gt": id}}}},
+			}},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			page := PageOptions{Sort: test.sort}.normalize()
+			page.Cursor = cursorAfter(t, page, test.doc)
+
+			filter, err := page.cursorFilter()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// Compare as extended JSON so decoded cursor values match regardless of their Go types
+			got, _ := bson.MarshalExtJSON(filter, true, false)
+			expected, _ := bson.MarshalExtJSON(test.expected, true, false)
+			if string(got) != string(expected) {
+				t.Errorf("expected filter %s, got %s", expected, got)
+			}
+		})
+	}
+}
+
+func TestCursorFilterRejectsBadCursors(t *testing.T) {
+	page := PageOptions{Sort: []SortKey{{Field: "timestamp"}}}.normalize()
+	otherPage := PageOptions{Sort: []SortKey{{Field: "scanCount"}}}.normalize()
+	otherCursor := cursorAfter(t, otherPage, bson.D{{Key: "_id", Value: primitive.NewObjectID()}})
+
+	for _, cursor := range []string{"not a cursor!", "aGVsbG8", otherCursor} {
+		page.Cursor = cursor
+		if _, err := page.cursorFilter(); !errors.Is(err, ErrInvalidCursor) {
+			t.Errorf("expected ErrInvalidCursor for cursor %q, got %v", cursor, err)
+		}
+	}
+}
+
+func TestListSpecParseSort(t *testing.T) {
+	sort, err := TicketListSpec.ParseSort("-scanCount,timestamp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []SortKey{{Field: "scanCount", Descending: true}, {Field: "timestamp"}}
+	if !reflect.DeepEqual(sort, expected) {
+		t.Errorf("expected %v, got %v", expected, sort)
+	}
+
+	if _, err := TicketListSpec.ParseSort("owner.passwordHash"); err == nil {
+		t.Error("expected unknown sort field to be rejected")
+	}
+}
+
+func TestListSpecParseFilters(t *testing.T) {
+	filter, err := TicketListSpec.ParseFilters(url.Values{
+		"scanCount[gte]": {"2"},
+		"limit":          {"10"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := bson.M{"scanCount": bson.M{"$gte": 2}}
+	if !reflect.DeepEqual(filter, expected) {
+		t.Errorf("expected %v, got %v", expected, filter)
+	}
+
+	if _, err := TicketListSpec.ParseFilters(url.Values{"customFields.$where": {"1"}}); err == nil {
+		t.Error("expected invalid custom field key to be rejected")
+	}
+}
+
+type pageTestDoc struct {
+	ID    int  `bson:"_id"`
+	Score *int `bson:"score,omitempty"`
+}
+
+// collectPages fetches every page one at a time, returning the IDs in the order they were returned.
+func collectPages(t *testing.T, fetch func(PageOptions) ([]pageTestDoc, PageInfo, error), page PageOptions) []int {
+	t.Helper()
+
+	ids := []int{}
+	for i := 0; i < 20; i++ {
+		docs, info, err := fetch(page)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, doc := range docs {
+			ids = append(ids, doc.ID)
+		}
+		if !info.HasMore {
+			return ids
+		}
+		if len(docs) != page.Limit {
+			t.Fatalf("expected a full page before the last one, got %d docs", len(docs))
+		}
+		page.Cursor = info.NextCursor
+	}
+	t.Fatal("pagination never finished")
+	return nil
+}
+
+func insertPageTestDocs(t *testing.T, col *mongo.Collection) {
+	t.Helper()
+
+	score := func(score int) *int { return &score }
+	docs := []interface{}{
+		pageTestDoc{ID: 1, Score: score(20)},
+		pageTestDoc{ID: 2},
+		bson.D{{Key: "_id", Value: 3}, {Key: "score", Value: nil}},
+		pageTestDoc{ID: 4, Score: score(10)},
+		pageTestDoc{ID: 5, Score: score(20)},
+		pageTestDoc{ID: 6},
+		pageTestDoc{ID: 7, Score: score(30)},
+	}
+	if _, err := col.InsertMany(context.Background(), docs); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFindPageWithMissingSortValues(t *testing.T) {
+	setupTestDatastore(t)
+	col := lib.Datastore.Db.Collection("pages")
+	insertPageTestDocs(t, col)
+
+	fetch := func(page PageOptions) ([]pageTestDoc, PageInfo, error) {
+		return findPage[pageTestDoc](context.Background(), col, bson.M{}, page)
+	}
+
+	// Missing and null scores sort before everything else, ties are broken by ID
+	ascending := collectPages(t, fetch, PageOptions{Limit: 2, Sort: []SortKey{{Field: "score"}}})
+	if expected := []int{2, 3, 6, 4, 1, 5, 7}; !reflect.DeepEqual(ascending, expected) {
+		t.Errorf("expected ascending order %v, got %v", expected, ascending)
+	}
+
+	descending := collectPages(t, fetch, PageOptions{Limit: 2, Sort: []SortKey{{Field: "score", Descending: true}}})
+	if expected := []int{7, 1, 5, 4, 2, 3, 6}; !reflect.DeepEqual(descending, expected) {
+		t.Errorf("expected descending order %v, got %v", expected, descending)
+	}
+}
+
+func TestAggregatePageLimitsAfterJoins(t *testing.T) {
+	setupTestDatastore(t)
+	ctx := context.Background()
+	col := lib.Datastore.Db.Collection("pages")
+	insertPageTestDocs(t, col)
+
+	// Only odd documents have something to join with, the rest get dropped by $unwind
+	for _, id := range []int{1, 3, 5, 7} {
+		if _, err := lib.Datastore.Db.Collection("joined").InsertOne(ctx, bson.M{"_id": id}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	stages := mongo.Pipeline{
+		{{Key: "$lookup", Value: bson.D{
+			{Key: "from", Value: "joined"},
+			{Key: "localField", Value: "_id"},
+			{Key: "foreignField", Value: "_id"},
+			{Key: "as", Value: "joined"},
+		}}},
+		{{Key: "$unwind", Value: "$joined"}},
+	}
+
+	fetch := func(page PageOptions) ([]pageTestDoc, PageInfo, error) {
+		return aggregatePage[pageTestDoc](ctx, col, bson.M{}, page, stages)
+	}
+	ids := collectPages(t, fetch, PageOptions{Limit: 2})
+	if expected := []int{1, 3, 5, 7}; !reflect.DeepEqual(ids, expected) {
+		t.Errorf("expected %v, got %v", expected, ids)
+	}
+}
@@ -2,25 +2,50 @@ package models
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"net/http"
+	"strings"
 	"time"
 
 	"github.com/aritrosaha10/frasertickets/lib"
+	"github.com/aritrosaha10/frasertickets/util"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
+const (
+	QueuedTicketStatusPending   = "pending"   // waiting for the owner to sign up
+	QueuedTicketStatusConverted = "converted" // turned into a real ticket
+	QueuedTicketStatusExpired   = "expired"   // owner didn't sign up before the expiry time
+)
+
 type QueuedTicket struct {
 	ID             primitive.ObjectID     `json:"id"             bson:"_id,omitempty"`
 	StudentNumber  string                 `json:"studentNumber" bson:"student_number"`
+	Email          string                 `json:"email"          bson:"email,omitempty"`       // Alternative to student #, ex. for staff & guests
+	ExternalID     string                 `json:"externalID"     bson:"external_id,omitempty"` // Alternative to student #, ex. an ID from another system
 	EventID        primitive.ObjectID     `json:"eventID"       bson:"event_id"`
 	EventData      Event                  `json:"eventData"      bson:"event_data"`
 	Timestamp      time.Time              `json:"timestamp"      bson:"timestamp"`
 	MaxScanCount   int                    `json:"max_scan_count" bson:"max_scan_count"`
 	FullNameUpdate string                 `json:"full_name_update" bson:"full_name_update"`
 	CustomFields   map[string]interface{} `json:"customFields" bson:"customFields"`
+	ExpiresAt      *time.Time             `json:"expires_at,omitempty" bson:"expires_at,omitempty"` // Optional, won't be converted after this
+
+	// Conversion outcome, queued tickets are kept around after conversion for record-keeping
+	Status              string             `json:"status"                bson:"status"` // Empty for older queued tickets, treated as pending
+	ConvertedTicketID   primitive.ObjectID `json:"converted_ticket_id"   bson:"converted_ticket_id,omitempty"`
+	ConvertedTimestamp  *time.Time         `json:"converted_timestamp,omitempty" bson:"converted_timestamp,omitempty"`
+	ConversionAttempts  int                `json:"conversion_attempts"   bson:"conversion_attempts"`
+	LastConversionError string             `json:"last_conversion_error" bson:"last_conversion_error,omitempty"`
+
+	// Queued tickets go to the trash along with their event
+	DeletedAt        *time.Time `json:"deleted_at,omitempty"         bson:"deleted_at,omitempty"`
+	DeletedBy        string     `json:"deleted_by,omitempty"         bson:"deleted_by,omitempty"`
+	TrashedWithEvent bool       `json:"trashed_with_event,omitempty" bson:"trashed_with_event,omitempty"`
 }
 
 func (queuedTicket *QueuedTicket) Render(w http.ResponseWriter, r *http.Request) error {
@@ -34,6 +59,21 @@ func CreateQueuedTicketIndices(ctx context.Context) error {
 			{Key: "student_number", Value: 1},
 		},
 	}
+	queuedTicketEmailModel := mongo.IndexModel{
+		Keys: bson.D{
+			{Key: "email", Value: 1},
+		},
+	}
+	queuedTicketExternalIDModel := mongo.IndexModel{
+		Keys: bson.D{
+			{Key: "external_id", Value: 1},
+		},
+	}
+	queuedTicketStatusModel := mongo.IndexModel{
+		Keys: bson.D{
+			{Key: "status", Value: 1},
+		},
+	}
 
 	// Try creating indices
 	opts := options.CreateIndexes().SetMaxTime(10 * time.Second)
@@ -43,6 +83,9 @@ func CreateQueuedTicketIndices(ctx context.Context) error {
 			ctx,
 			[]mongo.IndexModel{
 				queuedTicketStudentNumberModel,
+				queuedTicketEmailModel,
+				queuedTicketExternalIDModel,
+				queuedTicketStatusModel,
 			},
 			opts,
 		)
@@ -50,8 +93,90 @@ func CreateQueuedTicketIndices(ctx context.Context) error {
 	return err
 }
 
+// pendingQueuedTicketsFilter restricts a filter to queued tickets that haven't been converted,
+// haven't expired yet and aren't in the trash.
+func pendingQueuedTicketsFilter(filter bson.M) bson.M {
+	return bson.M{"$and": bson.A{
+		bson.M{"status": bson.M{"$nin": bson.A{QueuedTicketStatusConverted, QueuedTicketStatusExpired}}},
+		bson.M{"deleted_at": bson.M{"$exists": false}},
+		bson.M{"$or": bson.A{
+			bson.M{"expires_at": bson.M{"$exists": false}},
+			bson.M{"expires_at": bson.M{"$gt": time.Now()}},
+		}},
+		filter,
+	}}
+}
+
+// QueuedTicketStatusFilter returns a filter matching queued tickets with the given status.
+// Older queued tickets without a status are treated as pending, and pending tickets past their
+// expiry time are treated as expired even if the worker hasn't marked them as such yet.
+func QueuedTicketStatusFilter(status string) (bson.M, error) {
+	switch status {
+	case QueuedTicketStatusPending:
+		return pendingQueuedTicketsFilter(bson.M{}), nil
+	case QueuedTicketStatusConverted:
+		return bson.M{"status": QueuedTicketStatusConverted}, nil
+	case QueuedTicketStatusExpired:
+		return bson.M{"$or": bson.A{
+			bson.M{"status": QueuedTicketStatusExpired},
+			bson.M{
+				"status":     bson.M{"$ne": QueuedTicketStatusConverted},
+				"expires_at": bson.M{"$lte": time.Now()},
+			},
+		}}, nil
+	case "all":
+		return bson.M{}, nil
+	default:
+		return nil, fmt.Errorf("unknown queued ticket status '%s'", status)
+	}
+}
+
+// convertibleQueuedTicketsFilter restricts a filter to pending queued tickets whose events have
+// been published. Queued tickets for drafts wait until the event is published.
+func convertibleQueuedTicketsFilter(ctx context.Context, filter bson.M) (bson.M, error) {
+	draftEventIDs, err := lib.Datastore.Db.Collection(eventsColName).Distinct(ctx, "_id", bson.M{"draft": true})
+	if err != nil {
+		return nil, err
+	}
+	return pendingQueuedTicketsFilter(bson.M{"$and": bson.A{
+		bson.M{"event_id": bson.M{"$nin": draftEventIDs}},
+		filter,
+	}}), nil
+}
+
+// GetAllQueuedTickets fetches every queued ticket that is still waiting to be converted, leaving out
+// ones for draft events.
 func GetAllQueuedTickets(ctx context.Context) ([]QueuedTicket, error) {
-	pipeline := mongo.Pipeline{
+	filter, err := convertibleQueuedTicketsFilter(ctx, bson.M{})
+	if err != nil {
+		return []QueuedTicket{}, err
+	}
+	return GetQueuedTickets(ctx, filter)
+}
+
+// QueuedTicketListSpec is what lists of queued tickets can be sorted and filtered by.
+var QueuedTicketListSpec = ListSpec{
+	SortFields: map[string]string{
+		"id":            "_id",
+		"timestamp":     "timestamp",
+		"studentNumber": "student_number",
+		"expiresAt":     "expires_at",
+	},
+	FilterFields: map[string]FilterField{
+		"eventId":       {Field: "event_id", Type: FilterTypeObjectID},
+		"studentNumber": {Field: "student_number", Type: FilterTypeString},
+		"email":         {Field: "email", Type: FilterTypeString},
+		"externalID":    {Field: "external_id", Type: FilterTypeString},
+		"timestamp":     {Field: "timestamp", Type: FilterTypeTime},
+		"expiresAt":     {Field: "expires_at", Type: FilterTypeTime},
+		"maxScanCount":  {Field: "max_scan_count", Type: FilterTypeInt},
+	},
+	CustomFieldsPrefix: "customFields",
+}
+
+// queuedTicketLookupStages joins the event data onto queued tickets.
+func queuedTicketLookupStages() mongo.Pipeline {
+	return mongo.Pipeline{
 		{
 			{Key: "$lookup", Value: bson.D{
 				{Key: "from", Value: "events"},
@@ -65,6 +190,14 @@ func GetAllQueuedTickets(ctx context.Context) ([]QueuedTicket, error) {
 			{Key: "$unwind", Value: "$event_data"},
 		},
 	}
+}
+
+func GetQueuedTickets(ctx context.Context, filter bson.M) ([]QueuedTicket, error) {
+	pipeline := append(mongo.Pipeline{
+		{
+			{Key: "$match", Value: excludeTrashed(filter)},
+		},
+	}, queuedTicketLookupStages()...)
 
 	// Try to get data from MongoDB
 	cursor, err := lib.Datastore.Db.Collection(queuedTicketsColName).Aggregate(ctx, pipeline)
@@ -82,15 +215,20 @@ func GetAllQueuedTickets(ctx context.Context) ([]QueuedTicket, error) {
 	return queuedTickets, nil
 }
 
+// GetQueuedTicketsPage returns a single page of queued tickets, with event data only looked up for that page.
+func GetQueuedTicketsPage(ctx context.Context, filter bson.M, page PageOptions) ([]QueuedTicket, PageInfo, error) {
+	return aggregatePage[QueuedTicket](ctx, lib.Datastore.Db.Collection(queuedTicketsColName), excludeTrashed(filter), page, queuedTicketLookupStages())
+}
+
 func GetQueuedTicket(ctx context.Context, queuedTicketID primitive.ObjectID) (QueuedTicket, error) {
 	pipeline := mongo.Pipeline{
 		{
-			{Key: "$match", Value: bson.M{"_id": queuedTicketID}},
+			{Key: "$match", Value: excludeTrashed(bson.M{"_id": queuedTicketID})},
 		},
 		{
 			{Key: "$lookup", Value: bson.D{
 				{Key: "from", Value: "events"},
-				{Key: "localField", Value: "eventId"},
+				{Key: "localField", Value: "event_id"},
 				{Key: "foreignField", Value: "_id"},
 				{Key: "as", Value: "event_data"},
 			},
@@ -121,8 +259,70 @@ func GetQueuedTicket(ctx context.Context, queuedTicketID primitive.ObjectID) (Qu
 	return queuedTicket, nil
 }
 
-func GetQueuedTicketsForStudentNumber(ctx context.Context, studentNumber string) ([]QueuedTicket, error) {
-	cursor, err := lib.Datastore.Db.Collection(queuedTicketsColName).Find(ctx, bson.M{"student_number": studentNumber})
+// QueuedTicketMatcher holds the identifiers used to match queued tickets to users. Only the
+// non-empty identifiers are used, and matching any one of them is enough.
+type QueuedTicketMatcher struct {
+	StudentNumber string
+	Email         string
+	ExternalID    string
+}
+
+// Matcher returns the identifiers a queued ticket should be matched on.
+func (queuedTicket QueuedTicket) Matcher() QueuedTicketMatcher {
+	return QueuedTicketMatcher{
+		StudentNumber: queuedTicket.StudentNumber,
+		Email:         queuedTicket.Email,
+		ExternalID:    queuedTicket.ExternalID,
+	}
+}
+
+// MatcherForUser returns the identifiers of a user that queued tickets can be matched on.
+func MatcherForUser(user User) QueuedTicketMatcher {
+	return QueuedTicketMatcher{
+		StudentNumber: user.StudentNumber,
+		Email:         user.Email,
+		ExternalID:    user.ExternalID,
+	}
+}
+
+// NormalizeEmail makes emails comparable, since providers don't always keep the same casing.
+func NormalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+func (matcher QueuedTicketMatcher) IsEmpty() bool {
+	return matcher.StudentNumber == "" && matcher.Email == "" && matcher.ExternalID == ""
+}
+
+// filter returns a filter matching documents where any of the non-empty identifiers match.
+// The keys are the same for both users and queued tickets.
+func (matcher QueuedTicketMatcher) filter() bson.M {
+	conditions := bson.A{}
+	if matcher.StudentNumber != "" {
+		conditions = append(conditions, bson.M{"student_number": matcher.StudentNumber})
+	}
+	if matcher.Email != "" {
+		conditions = append(conditions, bson.M{"email": NormalizeEmail(matcher.Email)})
+	}
+	if matcher.ExternalID != "" {
+		conditions = append(conditions, bson.M{"external_id": matcher.ExternalID})
+	}
+
+	// Make sure an empty matcher never matches everything
+	if len(conditions) == 0 {
+		return bson.M{"_id": bson.M{"$exists": false}}
+	}
+	return bson.M{"$or": conditions}
+}
+
+// GetQueuedTicketsForMatcher fetches every pending queued ticket matching any of the given identifiers,
+// leaving out ones for draft events.
+func GetQueuedTicketsForMatcher(ctx context.Context, matcher QueuedTicketMatcher) ([]QueuedTicket, error) {
+	filter, err := convertibleQueuedTicketsFilter(ctx, matcher.filter())
+	if err != nil {
+		return []QueuedTicket{}, err
+	}
+	cursor, err := lib.Datastore.Db.Collection(queuedTicketsColName).Find(ctx, filter)
 	if err != nil {
 		return []QueuedTicket{}, err
 	}
@@ -137,14 +337,83 @@ func GetQueuedTicketsForStudentNumber(ctx context.Context, studentNumber string)
 	return queuedTickets, nil
 }
 
+// FindUserForMatcher finds the user that a queued ticket belongs to. Identifiers are tried from most
+// to least specific (external ID, email then student number) in case they point to different users.
+// Users pending approval are skipped. Returns mongo.ErrNoDocuments if no user matches.
+func FindUserForMatcher(ctx context.Context, matcher QueuedTicketMatcher) (User, error) {
+	lookups := []struct {
+		key   string
+		value string
+	}{
+		{"external_id", matcher.ExternalID},
+		{"email", NormalizeEmail(matcher.Email)},
+		{"student_number", matcher.StudentNumber},
+	}
+
+	for _, lookup := range lookups {
+		if lookup.value == "" {
+			continue
+		}
+
+		user, err := GetUserByKey(ctx, lookup.key, lookup.value)
+		if err == mongo.ErrNoDocuments || (err == nil && user.PendingApproval) {
+			// Users waiting for approval shouldn't receive tickets yet
+			continue
+		}
+		return user, err
+	}
+
+	return User{}, mongo.ErrNoDocuments
+}
+
+// userForQueuedTicketMatcher builds a stand-in user for someone who hasn't signed up yet, filling in
+// their grade and homeroom from the roster if they're on it.
+func userForQueuedTicketMatcher(ctx context.Context, matcher QueuedTicketMatcher) (User, error) {
+	user := User{
+		StudentNumber: matcher.StudentNumber,
+		Email:         NormalizeEmail(matcher.Email),
+		ExternalID:    matcher.ExternalID,
+	}
+	if matcher.StudentNumber == "" {
+		return user, nil
+	}
+
+	entry, err := GetRosterEntry(ctx, matcher.StudentNumber)
+	if err == mongo.ErrNoDocuments {
+		return user, nil
+	} else if err != nil {
+		return User{}, err
+	}
+	user.Grade = entry.Grade
+	user.Homeroom = entry.Homeroom
+	user.Kind = lib.IdentityKindStudent
+
+	return user, nil
+}
+
 func CreateQueuedTicket(ctx context.Context, queuedTicket QueuedTicket) (primitive.ObjectID, error) {
 	queuedTicket.Timestamp = time.Now()
+	queuedTicket.Status = QueuedTicketStatusPending
+	queuedTicket.Email = NormalizeEmail(queuedTicket.Email)
+
+	// There needs to be some way of matching it to a user
+	matcher := queuedTicket.Matcher()
+	if matcher.IsEmpty() {
+		return primitive.NilObjectID, fmt.Errorf("queued ticket needs a student number, email or external id")
+	}
+
+	// Catch typos in student numbers before they turn into tickets that never convert
+	if queuedTicket.StudentNumber != "" {
+		if err := ValidateStudentNumber(ctx, queuedTicket.StudentNumber); err != nil {
+			return primitive.NilObjectID, err
+		}
+	}
 
 	// Check if queued ticket already exists
-	queuedExists, err := CheckIfQueuedTicketExists(ctx, bson.M{
-		"student_number": queuedTicket.StudentNumber,
-		"event_id":       queuedTicket.EventID,
-	})
+	queuedExists, err := CheckIfQueuedTicketExists(ctx, pendingQueuedTicketsFilter(bson.M{
+		"event_id": queuedTicket.EventID,
+		"$or":      matcher.filter()["$or"],
+	}))
 	if err != nil {
 		return primitive.NilObjectID, err
 	}
@@ -153,27 +422,47 @@ func CreateQueuedTicket(ctx context.Context, queuedTicket QueuedTicket) (primiti
 	}
 
 	// Check if an actual ticket already exists
-	actualExists, err := CheckIfTicketExists(ctx, bson.M{
-		"ownerData.student_number": queuedTicket.StudentNumber,
-		"eventID":                  queuedTicket.EventID,
-	})
-	if err != nil {
+	user, err := FindUserForMatcher(ctx, matcher)
+	userFound := err == nil
+	if err == nil {
+		actualExists, err := CheckIfTicketExists(ctx, bson.M{
+			"owner": user.ID,
+			"event": queuedTicket.EventID,
+		})
+		if err != nil {
+			return primitive.NilObjectID, err
+		}
+		if actualExists {
+			return primitive.NilObjectID, ErrAlreadyExists
+		}
+	} else if err != mongo.ErrNoDocuments {
 		return primitive.NilObjectID, err
 	}
-	if actualExists {
-		return primitive.NilObjectID, ErrAlreadyExists
-	}
 
 	// Check if event exists
-	eventExists, err := CheckIfEventExists(ctx, queuedTicket.EventID)
-	if err != nil {
+	event, err := GetEvent(ctx, bson.M{"_id": queuedTicket.EventID})
+	if err == mongo.ErrNoDocuments {
+		return primitive.NilObjectID, ErrNotFound
+	} else if err != nil {
 		return primitive.NilObjectID, err
 	}
-	if !eventExists {
-		return primitive.NilObjectID, ErrNotFound
+
+	// Check if whoever it's for is part of the event's audience, using the roster if they haven't signed up yet
+	if !userFound {
+		user, err = userForQueuedTicketMatcher(ctx, matcher)
+		if err != nil {
+			return primitive.NilObjectID, err
+		}
+	}
+	if err := event.Audience.CheckEligibility(user); err != nil {
+		return primitive.NilObjectID, err
 	}
 
-	// TODO: Check if any custom fields match the event's schema
+	// Custom fields are checked now rather than when the ticket is made, where it'd be too late to fix them
+	queuedTicket.CustomFields, err = validateQueuedTicketCustomFields(ctx, event, queuedTicket.CustomFields)
+	if err != nil {
+		return primitive.NilObjectID, err
+	}
 
 	// Try to add ticket
 	res, err := lib.Datastore.Db.Collection(queuedTicketsColName).InsertOne(ctx, queuedTicket)
@@ -185,8 +474,50 @@ func CreateQueuedTicket(ctx context.Context, queuedTicket QueuedTicket) (primiti
 	return res.InsertedID.(primitive.ObjectID), err
 }
 
+// validateQueuedTicketCustomFields fills in defaults and checks custom fields against the event's
+// schema, the same way they will be once the queued ticket is converted. Auto-numbered fields only get
+// their values on conversion, so they can't be given and aren't checked.
+func validateQueuedTicketCustomFields(ctx context.Context, event Event, customFields map[string]interface{}) (map[string]interface{}, error) {
+	if len(event.RawCustomFieldsSchema) == 0 {
+		return customFields, nil
+	}
+	if err := checkEventAutoNumbers(event, customFields); err != nil {
+		return nil, err
+	}
+	customFields, err := applyCustomFieldDefaults(event, customFields)
+	if err != nil {
+		return nil, err
+	}
+
+	valid, schemaErrs, err := ValidateCustomEventFields(ctx, event, customFields)
+	if err != nil {
+		return nil, err
+	}
+	if valid {
+		return customFields, nil
+	}
+
+	schema, err := util.ConvertRawCustomFieldsSchema(event.RawCustomFieldsSchema)
+	if err != nil {
+		return nil, err
+	}
+	validationErr := &util.ValidationError{Err: ErrInvalidCustomFields, AppCode: util.AppCodeInvalidCustomFields}
+	for _, detail := range customFieldsErrDetails(schemaErrs) {
+		if property, ok := schema.Properties[strings.TrimPrefix(detail.Field, "customFields.")]; ok && property.AutoNumber {
+			continue
+		}
+		validationErr.Details = append(validationErr.Details, detail)
+	}
+	if len(validationErr.Details) == 0 {
+		return customFields, nil
+	}
+	return nil, validationErr
+}
+
+// ConvertQueuedTicketToTicket turns a queued ticket into a real ticket for the user matching its
+// student number, email or external ID. ErrNotFound is returned if the user doesn't exist yet.
 func ConvertQueuedTicketToTicket(ctx context.Context, queuedTicket QueuedTicket, applyFullNameUpdate bool) (Ticket, error) {
-	user, err := GetUserByKey(ctx, "student_number", queuedTicket.StudentNumber)
+	user, err := FindUserForMatcher(ctx, queuedTicket.Matcher())
 	if err != nil {
 		if err == mongo.ErrNoDocuments {
 			return Ticket{}, ErrNotFound
@@ -194,50 +525,284 @@ func ConvertQueuedTicketToTicket(ctx context.Context, queuedTicket QueuedTicket,
 		return Ticket{}, err
 	}
 
-	if _, err := CheckIfEventExists(ctx, queuedTicket.EventID); err != nil {
+	return ConvertQueuedTicketForUser(ctx, queuedTicket, user, applyFullNameUpdate)
+}
+
+// ConvertQueuedTicketForUser turns a queued ticket into a real ticket for a user that's already known
+// to match it. The ticket creation, name update and queued ticket update all happen in one
+// transaction, which the driver retries on transient errors. Failed conversions are recorded on
+// the queued ticket.
+func ConvertQueuedTicketForUser(ctx context.Context, queuedTicket QueuedTicket, user User, applyFullNameUpdate bool) (Ticket, error) {
+	res, err := lib.Datastore.WithTransaction(ctx, func(sessCtx mongo.SessionContext) (interface{}, error) {
+		ticket := Ticket{
+			Owner:        user.ID,
+			Event:        queuedTicket.EventID,
+			Timestamp:    time.Now(),
+			ScanCount:    0,
+			MaxScanCount: queuedTicket.MaxScanCount,
+			CustomFields: queuedTicket.CustomFields,
+		}
+
+		ticketID, err := CreateNewTicket(sessCtx, ticket)
+		if err != nil {
+			return nil, err
+		}
+		ticket.ID = ticketID
+
+		// Try updating full name if requested, nothing changing is fine
+		if applyFullNameUpdate && queuedTicket.FullNameUpdate != "" {
+			_, err := UpdateExistingUserByKeys(sessCtx, user.ID, map[string]interface{}{
+				"full_name": queuedTicket.FullNameUpdate,
+			}, UpdateMeta{})
+			if err != nil && err != ErrNoDocumentModified {
+				return nil, err
+			}
+		}
+
+		// Record the conversion, only if nobody else converted it in the meantime
+		err = MarkQueuedTicketConverted(sessCtx, queuedTicket.ID, ticketID)
+		if err != nil {
+			return nil, err
+		}
+
+		return ticket, nil
+	})
+	if err != nil {
+		// Keep track of the failure outside of the (aborted) transaction so admins can see it
+		if recordErr := recordQueuedTicketConversionFailure(ctx, queuedTicket.ID, err); recordErr != nil {
+			return Ticket{}, errors.Join(err, recordErr)
+		}
 		return Ticket{}, err
 	}
 
-	ticket := Ticket{
-		Owner:        user.ID,
-		Event:        queuedTicket.EventID,
-		Timestamp:    time.Now(),
-		ScanCount:    0,
-		MaxScanCount: queuedTicket.MaxScanCount,
-		CustomFields: queuedTicket.CustomFields,
+	return res.(Ticket), nil
+}
+
+// MarkQueuedTicketConverted records that a queued ticket has been fulfilled by the given ticket.
+func MarkQueuedTicketConverted(ctx context.Context, id primitive.ObjectID, ticketID primitive.ObjectID) error {
+	res, err := lib.Datastore.Db.Collection(queuedTicketsColName).UpdateOne(
+		ctx,
+		pendingQueuedTicketsFilter(bson.M{"_id": id}),
+		bson.D{
+			{Key: "$set", Value: bson.D{
+				{Key: "status", Value: QueuedTicketStatusConverted},
+				{Key: "converted_ticket_id", Value: ticketID},
+				{Key: "converted_timestamp", Value: time.Now()},
+			}},
+			{Key: "$unset", Value: bson.D{
+				{Key: "last_conversion_error", Value: ""},
+			}},
+			{Key: "$inc", Value: bson.D{
+				{Key: "conversion_attempts", Value: 1},
+			}},
+		},
+	)
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		// Either deleted or already converted by someone else
+		return ErrNoDocumentModified
+	}
+	return nil
+}
+
+func recordQueuedTicketConversionFailure(ctx context.Context, id primitive.ObjectID, conversionErr error) error {
+	_, err := lib.Datastore.Db.Collection(queuedTicketsColName).UpdateByID(
+		ctx,
+		id,
+		bson.D{
+			{Key: "$set", Value: bson.D{
+				{Key: "last_conversion_error", Value: conversionErr.Error()},
+			}},
+			{Key: "$inc", Value: bson.D{
+				{Key: "conversion_attempts", Value: 1},
+			}},
+		},
+	)
+	return err
+}
+
+// UpdateExistingQueuedTicketByKeys applies updates to a queued ticket that hasn't been converted yet.
+// It reports whether the update could let the queued ticket be converted now, which is the case when
+// its identifiers changed or it was brought back from being expired. Bad updates are returned as
+// ValidationErrors.
+func UpdateExistingQueuedTicketByKeys(
+	ctx context.Context,
+	id primitive.ObjectID,
+	updates map[string]interface{},
+) (bool, error) {
+	UPDATABLE_KEYS := map[string]bool{
+		"student_number":   true,
+		"email":            true,
+		"external_id":      true,
+		"max_scan_count":   true,
+		"full_name_update": true,
+		"customFields":     true,
+		"expires_at":       true,
 	}
 
-	ticketId, err := CreateNewTicket(ctx, ticket)
+	queuedTicket, err := GetQueuedTicket(ctx, id)
 	if err != nil {
-		return Ticket{}, err
+		return false, err
 	}
 
-	ticket.ID = ticketId
+	// Converted tickets should be edited as actual tickets instead
+	if queuedTicket.Status == QueuedTicketStatusConverted {
+		return false, util.NewValidationError(ErrEditNotAllowed, util.AppCodeEditNotAllowed, "status", "converted", "converted queued tickets can't be edited")
+	}
+	revived := false
+
+	// Convert the string/interface map to BSON updates
+	bsonSets := bson.D{}
+	bsonUnsets := bson.D{}
+	matcher := queuedTicket.Matcher()
+	for key, val := range updates {
+		// Don't allow other keys to be updated
+		if !UPDATABLE_KEYS[key] {
+			return false, util.NewValidationError(ErrEditNotAllowed, util.AppCodeEditNotAllowed, key, "editable", "field can't be updated")
+		}
 
-	// Try updating full name if requested
-	if applyFullNameUpdate && queuedTicket.FullNameUpdate != "" {
-		UpdateExistingUserByKeys(ctx, user.ID, map[string]interface{}{
-			"full_name": queuedTicket.FullNameUpdate,
-		})
+		switch key {
+		case "student_number", "email", "external_id":
+			identifier, ok := val.(string)
+			if !ok {
+				return false, util.NewValidationError(nil, util.AppCodeInvalidBody, key, "type", "must be a string")
+			}
+
+			switch key {
+			case "student_number":
+				if identifier != "" {
+					if err := ValidateStudentNumber(ctx, identifier); err != nil {
+						return false, err
+					}
+				}
+				matcher.StudentNumber = identifier
+			case "email":
+				identifier = NormalizeEmail(identifier)
+				matcher.Email = identifier
+			case "external_id":
+				matcher.ExternalID = identifier
+			}
+
+			// Empty identifiers are removed instead of being stored
+			if identifier == "" && key != "student_number" {
+				bsonUnsets = append(bsonUnsets, bson.E{Key: key, Value: ""})
+				continue
+			}
+			val = identifier
+		case "max_scan_count":
+			maxScanCount, ok := val.(float64) // JSON numbers always decode as float64
+			if !ok || maxScanCount < 0 || maxScanCount != float64(int(maxScanCount)) {
+				return false, util.NewValidationError(nil, util.AppCodeInvalidBody, key, "gte", "max scan count must be an integer greater than or equal to 0")
+			}
+			val = int(maxScanCount)
+		case "customFields":
+			customFields, ok := val.(map[string]interface{})
+			if !ok {
+				return false, util.NewValidationError(nil, util.AppCodeInvalidBody, key, "type", "custom fields must be an object")
+			}
+			event, err := GetEvent(ctx, bson.M{"_id": queuedTicket.EventID})
+			if err != nil {
+				return false, err
+			}
+			val, err = validateQueuedTicketCustomFields(ctx, event, customFields)
+			if err != nil {
+				return false, err
+			}
+		case "expires_at":
+			// null removes the expiry
+			if val == nil {
+				bsonUnsets = append(bsonUnsets, bson.E{Key: key, Value: ""})
+				bsonSets = append(bsonSets, bson.E{Key: "status", Value: QueuedTicketStatusPending})
+				revived = queuedTicket.Status == QueuedTicketStatusExpired
+				continue
+			}
+
+			timestampStr, ok := val.(string)
+			if !ok {
+				return false, util.NewValidationError(nil, util.AppCodeInvalidBody, key, "type", "expiry timestamp must be a string")
+			}
+			timestamp, err := time.Parse(time.RFC3339, timestampStr)
+			if err != nil {
+				return false, util.NewValidationError(err, util.AppCodeInvalidBody, key, "rfc3339", "expiry timestamp must be RFC3339")
+			}
+			val = timestamp
+
+			// Pushing the expiry back revives expired queued tickets
+			if timestamp.After(time.Now()) {
+				bsonSets = append(bsonSets, bson.E{Key: "status", Value: QueuedTicketStatusPending})
+				revived = queuedTicket.Status == QueuedTicketStatusExpired
+			}
+		}
+
+		// Add the key/val pair in BSON
+		bsonSets = append(bsonSets, bson.E{Key: key, Value: val})
 	}
 
-	// Delete queued ticket since it has already been converted
-	// No point in doing much with the error from this,
-	// if it doesn't succeed, should still return new ticket
-	DeleteQueuedTicket(ctx, queuedTicket.ID)
+	// Make sure the new identifiers still match someone, and don't collide with another queued ticket
+	if matcher.IsEmpty() {
+		return false, util.NewValidationError(nil, util.AppCodeInvalidBody, "student_number", "required", "queued ticket needs a student number, email or external id")
+	}
+	if matcher != queuedTicket.Matcher() {
+		exists, err := CheckIfQueuedTicketExists(ctx, pendingQueuedTicketsFilter(bson.M{
+			"_id":      bson.M{"$ne": id},
+			"event_id": queuedTicket.EventID,
+			"$or":      matcher.filter()["$or"],
+		}))
+		if err != nil {
+			return false, err
+		}
+		if exists {
+			return false, ErrAlreadyExists
+		}
+	}
 
-	return ticket, nil
+	// Any previous conversion error is likely stale now
+	bsonUnsets = append(bsonUnsets, bson.E{Key: "last_conversion_error", Value: ""})
+
+	// Try to update document in DB
+	bsonUpdates := bson.D{{Key: "$unset", Value: bsonUnsets}}
+	if len(bsonSets) > 0 {
+		bsonUpdates = append(bsonUpdates, bson.E{Key: "$set", Value: bsonSets})
+	}
+	res, err := lib.Datastore.Db.Collection(queuedTicketsColName).
+		UpdateByID(ctx, id, bsonUpdates)
+	if err != nil {
+		return false, err
+	}
+	if res.ModifiedCount == 0 {
+		return false, ErrNoDocumentModified
+	}
+	return matcher != queuedTicket.Matcher() || revived, nil
+}
+
+// ExpireQueuedTickets marks every pending queued ticket past its expiry time as expired,
+// returning how many were expired.
+func ExpireQueuedTickets(ctx context.Context) (int64, error) {
+	res, err := lib.Datastore.Db.Collection(queuedTicketsColName).UpdateMany(
+		ctx,
+		excludeTrashed(bson.M{
+			"status":     bson.M{"$nin": bson.A{QueuedTicketStatusConverted, QueuedTicketStatusExpired}},
+			"expires_at": bson.M{"$lte": time.Now()},
+		}),
+		bson.D{{Key: "$set", Value: bson.D{{Key: "status", Value: QueuedTicketStatusExpired}}}},
+	)
+	if err != nil {
+		return 0, err
+	}
+	return res.ModifiedCount, nil
 }
 
 func CheckIfQueuedTicketExists(ctx context.Context, filter bson.M) (bool, error) {
 	// Directly return DB results
-	count, err := lib.Datastore.Db.Collection(queuedTicketsColName).CountDocuments(ctx, filter)
+	count, err := lib.Datastore.Db.Collection(queuedTicketsColName).CountDocuments(ctx, excludeTrashed(filter))
 	return count > 0, err
 }
 
 func DeleteQueuedTicket(ctx context.Context, id primitive.ObjectID) error {
 	// Delete queued ticket
-	res, err := lib.Datastore.Db.Collection(queuedTicketsColName).DeleteOne(ctx, bson.M{"_id": id})
+	res, err := lib.Datastore.Db.Collection(queuedTicketsColName).DeleteOne(ctx, excludeTrashed(bson.M{"_id": id}))
 
 	// Handle no document found
 	if err == nil {
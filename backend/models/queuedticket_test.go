@@ -0,0 +1,75 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/aritrosaha10/frasertickets/util"
+)
+
+func TestQueuedTicketCustomFieldsAreValidated(t *testing.T) {
+	setupTestDatastore(t)
+	ctx := context.Background()
+
+	eventID, err := CreateNewEvent(ctx, Event{
+		Name: "Banquet",
+		RawCustomFieldsSchema: map[string]interface{}{
+			"type": "object",
+			"properties": map[string]interface{}{
+				"meal":  map[string]interface{}{"type": "string", "enum": []interface{}{"fish", "pasta"}},
+				"table": map[string]interface{}{"type": "integer", "default": 1},
+				"seat":  map[string]interface{}{"type": "integer", "autoNumber": true},
+			},
+			"required": []interface{}{"meal", "seat"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Values outside of the schema are caught before anything is saved
+	_, err = CreateQueuedTicket(ctx, QueuedTicket{
+		EventID:      eventID,
+		Email:        "guest@example.com",
+		CustomFields: map[string]interface{}{"meal": "steak"},
+	})
+	var validationErr *util.ValidationError
+	if !errors.As(err, &validationErr) || !errors.Is(err, ErrInvalidCustomFields) {
+		t.Fatalf("expected a custom fields validation error, got %v", err)
+	}
+	if len(validationErr.Details) != 1 || validationErr.Details[0].Field != "customFields.meal" {
+		t.Errorf("expected only the meal to be reported, got %+v", validationErr.Details)
+	}
+
+	// Required auto-numbered fields are only filled in on conversion, and defaults are applied
+	id, err := CreateQueuedTicket(ctx, QueuedTicket{
+		EventID:      eventID,
+		Email:        "guest@example.com",
+		CustomFields: map[string]interface{}{"meal": "fish"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	queuedTicket, err := GetQueuedTicket(ctx, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if table, _ := util.CustomFieldInt(queuedTicket.CustomFields["table"]); table != 1 {
+		t.Errorf("expected the default table to be saved, got %v", queuedTicket.CustomFields)
+	}
+
+	// Updates are held to the same rules
+	_, err = UpdateExistingQueuedTicketByKeys(ctx, id, map[string]interface{}{
+		"customFields": map[string]interface{}{"meal": "steak"},
+	})
+	if !errors.Is(err, ErrInvalidCustomFields) {
+		t.Errorf("expected updating to invalid custom fields to fail, got %v", err)
+	}
+	_, err = UpdateExistingQueuedTicketByKeys(ctx, id, map[string]interface{}{
+		"customFields": map[string]interface{}{"meal": "pasta", "seat": 3},
+	})
+	if !errors.Is(err, ErrEditNotAllowed) {
+		t.Errorf("expected setting an auto-numbered field to fail, got %v", err)
+	}
+}
@@ -0,0 +1,274 @@
+package models
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"github.com/aritrosaha10/frasertickets/lib"
+	"github.com/aritrosaha10/frasertickets/util"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// CustomFieldReport groups an event's tickets by the values of one or more custom fields, ex. meal
+// choices for catering or jacket numbers for coat check.
+type CustomFieldReport struct {
+	EventID primitive.ObjectID       `json:"eventID"`
+	Fields  []CustomFieldReportField `json:"fields"`
+	Total   int64                    `json:"total"`
+	Groups  []CustomFieldReportGroup `json:"groups"`
+}
+
+func (report *CustomFieldReport) Render(w http.ResponseWriter, r *http.Request) error {
+	return nil
+}
+
+// CustomFieldReportField is a custom field that a report is grouped by.
+type CustomFieldReportField struct {
+	Key         string `json:"key"`
+	DisplayName string `json:"displayName"`
+}
+
+// CustomFieldReportGroup is every ticket sharing the same combination of custom field values.
+type CustomFieldReportGroup struct {
+	Values  map[string]interface{}    `json:"values"` // keyed by custom field key, missing values are null
+	Count   int64                     `json:"count"`
+	Scanned int64                     `json:"scanned"`
+	Holders []CustomFieldReportHolder `json:"holders,omitempty"`
+
+	tickets []Ticket // the holders' tickets with owner data, for writing them out like an export
+}
+
+// CustomFieldReportHolder is a ticket holder listed under a report group.
+type CustomFieldReportHolder struct {
+	TicketID      primitive.ObjectID `json:"ticketID"`
+	OwnerID       string             `json:"ownerID"`
+	FullName      string             `json:"fullName"`
+	StudentNumber string             `json:"studentNumber"`
+	Email         string             `json:"email"`
+	Grade         int                `json:"grade"`
+	Homeroom      string             `json:"homeroom"`
+	Scanned       bool               `json:"scanned"`
+}
+
+// customFieldReportHolderColumns are the export columns listed for each holder in report files.
+var customFieldReportHolderColumns = []string{"fullName", "studentNumber", "email", "grade", "homeroom", "scanned"}
+
+// customFieldReportGroupRaw is a group as it comes out of the report pipeline, with the values
+// keyed by the field's index since custom field keys can't safely be used as document keys.
+type customFieldReportGroupRaw struct {
+	ID      bson.Raw `bson:"_id"`
+	Count   int64    `bson:"count"`
+	Scanned int64    `bson:"scanned"`
+}
+
+// customFieldReportHolderRaw is a holder's ticket, tagged with the _id of the group it belongs to.
+type customFieldReportHolderRaw struct {
+	Group  bson.Raw `bson:"reportGroup"`
+	Ticket `bson:",inline"`
+}
+
+type customFieldReportFacets struct {
+	Groups  []customFieldReportGroupRaw  `bson:"groups"`
+	Holders []customFieldReportHolderRaw `bson:"holders"`
+}
+
+// GetCustomFieldReport groups an event's tickets by the given custom fields, which must all be in
+// the event's schema. Groups are ordered from largest to smallest. Holders are only listed, in order
+// of name, when includeHolders is set. They're looked up separately from the counts, so tickets with
+// missing owners are still counted.
+func GetCustomFieldReport(
+	ctx context.Context,
+	event Event,
+	fields []string,
+	includeHolders bool,
+) (CustomFieldReport, error) {
+	if len(fields) == 0 {
+		return CustomFieldReport{}, fmt.Errorf("%w: at least one custom field must be given", ErrInvalidReport)
+	}
+
+	schema := util.CustomFieldsSchema{}
+	if len(event.RawCustomFieldsSchema) != 0 {
+		var err error
+		schema, err = util.ConvertRawCustomFieldsSchema(event.RawCustomFieldsSchema)
+		if err != nil {
+			return CustomFieldReport{}, err
+		}
+	}
+
+	report := CustomFieldReport{
+		EventID: event.ID,
+		Fields:  []CustomFieldReportField{},
+		Groups:  []CustomFieldReportGroup{},
+	}
+	groupID := bson.D{}
+	for i, field := range fields {
+		if _, ok := schema.Properties[field]; !ok {
+			return CustomFieldReport{}, fmt.Errorf("%w: '%s' is not a custom field of this event", ErrInvalidReport, field)
+		}
+		report.Fields = append(report.Fields, CustomFieldReportField{Key: field, DisplayName: customFieldHeader(schema, field)})
+
+		// Missing fields are turned into nulls so both facets key groups the same way
+		groupID = append(groupID, bson.E{
+			Key:   fmt.Sprintf("f%d", i),
+			Value: bson.D{{Key: "$ifNull", Value: bson.A{"$customFields." + field, nil}}},
+		})
+	}
+
+	facets := bson.D{
+		{Key: "groups", Value: bson.A{
+			bson.D{{Key: "$group", Value: bson.D{
+				{Key: "_id", Value: groupID},
+				{Key: "count", Value: bson.D{{Key: "$sum", Value: 1}}},
+				{Key: "scanned", Value: bson.D{{Key: "$sum", Value: ticketScannedCountExpr()}}},
+			}}},
+			bson.D{{Key: "$sort", Value: bson.D{{Key: "count", Value: -1}, {Key: "_id", Value: 1}}}},
+		}},
+	}
+	if includeHolders {
+		holders := bson.A{
+			bson.D{{Key: "$lookup", Value: bson.D{
+				{Key: "from", Value: usersColName},
+				{Key: "localField", Value: "owner"},
+				{Key: "foreignField", Value: "_id"},
+				{Key: "as", Value: "ownerData"},
+			}}},
+			bson.D{{Key: "$unwind", Value: bson.D{
+				{Key: "path", Value: "$ownerData"},
+				{Key: "preserveNullAndEmptyArrays", Value: true},
+			}}},
+			bson.D{{Key: "$sort", Value: bson.D{
+				{Key: "ownerData.full_name", Value: 1},
+				{Key: "_id", Value: 1},
+			}}},
+			bson.D{{Key: "$project", Value: bson.D{
+				{Key: "owner", Value: 1},
+				{Key: "scanCount", Value: 1},
+				{Key: "ownerData", Value: 1},
+				{Key: "reportGroup", Value: groupID},
+			}}},
+		}
+		facets = append(facets, bson.E{Key: "holders", Value: holders})
+	}
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: excludeTrashed(bson.M{"event": event.ID})}},
+		{{Key: "$facet", Value: facets}},
+	}
+
+	cursor, err := lib.Datastore.Db.Collection(ticketsColName).Aggregate(ctx, pipeline)
+	if err != nil {
+		return CustomFieldReport{}, err
+	}
+	defer cursor.Close(ctx)
+
+	var result customFieldReportFacets
+	if cursor.Next(ctx) {
+		if err := cursor.Decode(&result); err != nil {
+			return CustomFieldReport{}, err
+		}
+	}
+	if err := cursor.Err(); err != nil {
+		return CustomFieldReport{}, err
+	}
+
+	// Both facets build the group _id from the same expression, so they're byte for byte the same
+	ticketsByGroup := map[string][]Ticket{}
+	for _, holder := range result.Holders {
+		ticketsByGroup[string(holder.Group)] = append(ticketsByGroup[string(holder.Group)], holder.Ticket)
+	}
+
+	for _, raw := range result.Groups {
+		reportGroup := CustomFieldReportGroup{
+			Values:  map[string]interface{}{},
+			Count:   raw.Count,
+			Scanned: raw.Scanned,
+		}
+		for i, field := range fields {
+			reportGroup.Values[field] = nil
+			value, err := raw.ID.LookupErr(fmt.Sprintf("f%d", i))
+			if err != nil {
+				continue // Tickets without the field are grouped under null
+			}
+			var decoded interface{}
+			if err := value.Unmarshal(&decoded); err != nil {
+				return CustomFieldReport{}, err
+			}
+			reportGroup.Values[field] = decoded
+		}
+		if includeHolders {
+			reportGroup.tickets = ticketsByGroup[string(raw.ID)]
+			reportGroup.Holders = []CustomFieldReportHolder{}
+			for _, ticket := range reportGroup.tickets {
+				reportGroup.Holders = append(reportGroup.Holders, CustomFieldReportHolder{
+					TicketID:      ticket.ID,
+					OwnerID:       ticket.Owner,
+					FullName:      ticket.OwnerData.FullName,
+					StudentNumber: ticket.OwnerData.StudentNumber,
+					Email:         ticket.OwnerData.Email,
+					Grade:         ticket.OwnerData.Grade,
+					Homeroom:      ticket.OwnerData.Homeroom,
+					Scanned:       ticket.Scanned(),
+				})
+			}
+		}
+
+		report.Total += raw.Count
+		report.Groups = append(report.Groups, reportGroup)
+	}
+
+	return report, nil
+}
+
+// WriteCustomFieldReport writes a report as a table, with one row per group or, if holders were
+// included, one row per holder. Holders are written with the same columns as attendee exports.
+func WriteCustomFieldReport(tabularWriter util.TabularWriter, report CustomFieldReport, includeHolders bool) error {
+	header := []util.TabularColumn{}
+	for _, field := range report.Fields {
+		header = append(header, util.TabularColumn{Key: "customFields." + field.Key, Header: field.DisplayName})
+	}
+
+	var holderColumns []TicketExportColumn
+	if includeHolders {
+		baseColumns, err := TicketExportColumns(Event{})
+		if err != nil {
+			return err
+		}
+		holderColumns, err = SelectTicketExportColumns(baseColumns, customFieldReportHolderColumns)
+		if err != nil {
+			return err
+		}
+		header = append(header, TabularColumns(holderColumns)...)
+	} else {
+		header = append(header,
+			util.TabularColumn{Key: "count", Header: "Count"},
+			util.TabularColumn{Key: "scanned", Header: "Scanned"},
+		)
+	}
+	if err := tabularWriter.WriteHeader(header); err != nil {
+		return err
+	}
+
+	for _, group := range report.Groups {
+		values := []interface{}{}
+		for _, field := range report.Fields {
+			values = append(values, group.Values[field.Key])
+		}
+
+		if !includeHolders {
+			if err := tabularWriter.WriteRow(append(values, group.Count, group.Scanned)); err != nil {
+				return err
+			}
+			continue
+		}
+		for _, ticket := range group.tickets {
+			row := append(append([]interface{}{}, values...), TabularRow(holderColumns, ticket)...)
+			if err := tabularWriter.WriteRow(row); err != nil {
+				return err
+			}
+		}
+	}
+
+	return tabularWriter.Close()
+}
@@ -0,0 +1,459 @@
+package models
+
+import (
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aritrosaha10/frasertickets/lib"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	maxRosterSuggestions        = 5
+	maxRosterSuggestionDistance = 2
+)
+
+// RosterEntry is a single enrolled student, as given by the school.
+type RosterEntry struct {
+	StudentNumber    string    `json:"student_number"    bson:"student_number"`
+	LegalName        string    `json:"legal_name"        bson:"legal_name"`
+	Grade            int       `json:"grade"             bson:"grade"`
+	Homeroom         string    `json:"homeroom"          bson:"homeroom"`
+	Active           bool      `json:"active"            bson:"active"`
+	UpdatedTimestamp time.Time `json:"updated_timestamp" bson:"updated_timestamp"`
+}
+
+func (entry *RosterEntry) Render(w http.ResponseWriter, r *http.Request) error {
+	return nil
+}
+
+// RosterColumns records which of the optional columns a roster CSV had, so that importing it only
+// changes what it actually gives.
+type RosterColumns struct {
+	Grade    bool
+	Homeroom bool
+}
+
+// RosterImportResult summarizes what changed during a roster import.
+type RosterImportResult struct {
+	Received    int   `json:"received"`
+	Inserted    int64 `json:"inserted"`
+	Updated     int64 `json:"updated"`
+	Deactivated int64 `json:"deactivated"`
+
+	UsersUpdated int64 `json:"users_updated"` // Users whose grade or homeroom changed
+}
+
+func (result *RosterImportResult) Render(w http.ResponseWriter, r *http.Request) error {
+	return nil
+}
+
+// RosterFilter narrows down roster entries when browsing the student directory.
+type RosterFilter struct {
+	Query    string // Partial legal name or student number prefix
+	Grade    int    // 0 for any
+	Homeroom string
+	Active   *bool
+}
+
+// RosterMismatchError is returned when a student number isn't on the roster. It includes active
+// student numbers that are close enough that they may have been what was meant.
+type RosterMismatchError struct {
+	StudentNumber string
+	Suggestions   []string
+}
+
+func (e *RosterMismatchError) Error() string {
+	if len(e.Suggestions) == 0 {
+		return fmt.Sprintf("student number %s is not on the roster", e.StudentNumber)
+	}
+	return fmt.Sprintf("student number %s is not on the roster, did you mean %s?", e.StudentNumber, strings.Join(e.Suggestions, ", "))
+}
+
+func (e *RosterMismatchError) Unwrap() error {
+	return ErrNotOnRoster
+}
+
+func CreateRosterIndices(ctx context.Context) error {
+	// Create appropriate indices
+	studentNumberIdxModel := mongo.IndexModel{
+		Keys: bson.D{
+			{Key: "student_number", Value: 1},
+		},
+		Options: options.Index().SetUnique(true),
+	}
+
+	legalNameIdxModel := mongo.IndexModel{
+		Keys: bson.D{
+			{Key: "legal_name", Value: 1},
+		},
+	}
+
+	// Try creating the indices
+	opts := options.CreateIndexes().SetMaxTime(10 * time.Second)
+	_, err := lib.Datastore.Db.Collection(rosterColName).
+		Indexes().
+		CreateMany(
+			ctx,
+			[]mongo.IndexModel{
+				studentNumberIdxModel,
+				legalNameIdxModel,
+			},
+			opts,
+		)
+
+	return err
+}
+
+// ParseRosterCSV reads roster entries from a CSV with a header row. Columns are matched by name
+// (student_number, legal_name and optionally grade, homeroom and active), in any order. Which of the
+// grade and homeroom columns were there is returned along with the entries.
+func ParseRosterCSV(reader io.Reader) ([]RosterEntry, RosterColumns, error) {
+	csvReader := csv.NewReader(reader)
+	csvReader.TrimLeadingSpace = true
+
+	header, err := csvReader.Read()
+	if err != nil {
+		if err == io.EOF {
+			return []RosterEntry{}, RosterColumns{}, fmt.Errorf("roster csv is empty")
+		}
+		return []RosterEntry{}, RosterColumns{}, err
+	}
+
+	// Figure out which column is which
+	cols := map[string]int{}
+	for i, name := range header {
+		name = strings.ToLower(strings.TrimSpace(name))
+		name = strings.ReplaceAll(name, " ", "_")
+		cols[name] = i
+	}
+	for _, required := range []string{"student_number", "legal_name"} {
+		if _, ok := cols[required]; !ok {
+			return []RosterEntry{}, RosterColumns{}, fmt.Errorf("roster csv is missing the %s column", required)
+		}
+	}
+
+	_, hasGrade := cols["grade"]
+	_, hasHomeroom := cols["homeroom"]
+	columns := RosterColumns{Grade: hasGrade, Homeroom: hasHomeroom}
+
+	entries := []RosterEntry{}
+	seen := map[string]bool{}
+	for line := 2; ; line++ {
+		rec, err := csvReader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return []RosterEntry{}, RosterColumns{}, err
+		}
+
+		entry := RosterEntry{
+			StudentNumber: strings.TrimSpace(rec[cols["student_number"]]),
+			LegalName:     strings.TrimSpace(rec[cols["legal_name"]]),
+			Active:        true,
+		}
+		if entry.StudentNumber == "" {
+			return []RosterEntry{}, RosterColumns{}, fmt.Errorf("line %d: student number is empty", line)
+		}
+		if seen[entry.StudentNumber] {
+			return []RosterEntry{}, RosterColumns{}, fmt.Errorf("line %d: student number %s appears more than once", line, entry.StudentNumber)
+		}
+		seen[entry.StudentNumber] = true
+
+		if col, ok := cols["grade"]; ok && strings.TrimSpace(rec[col]) != "" {
+			grade, err := strconv.Atoi(strings.TrimSpace(rec[col]))
+			if err != nil {
+				return []RosterEntry{}, RosterColumns{}, fmt.Errorf("line %d: could not parse grade: %w", line, err)
+			}
+			entry.Grade = grade
+		}
+		if col, ok := cols["homeroom"]; ok {
+			entry.Homeroom = strings.TrimSpace(rec[col])
+		}
+		if col, ok := cols["active"]; ok && strings.TrimSpace(rec[col]) != "" {
+			active, err := strconv.ParseBool(strings.TrimSpace(rec[col]))
+			if err != nil {
+				return []RosterEntry{}, RosterColumns{}, fmt.Errorf("line %d: could not parse active flag: %w", line, err)
+			}
+			entry.Active = active
+		}
+
+		entries = append(entries, entry)
+	}
+
+	return entries, columns, nil
+}
+
+// ImportRoster upserts the given entries by student number. Grades and homerooms are only changed if
+// their columns were in the import. If deactivateMissing is set, anyone currently on the roster who
+// isn't in the import is marked as inactive. Changes to users who already signed up are recorded as
+// made by importedBy.
+func ImportRoster(
+	ctx context.Context,
+	entries []RosterEntry,
+	columns RosterColumns,
+	deactivateMissing bool,
+	importedBy string,
+) (RosterImportResult, error) {
+	result := RosterImportResult{Received: len(entries)}
+	now := time.Now()
+
+	writes := []mongo.WriteModel{}
+	studentNumbers := []string{}
+	for _, entry := range entries {
+		set := bson.M{
+			"student_number":    entry.StudentNumber,
+			"legal_name":        entry.LegalName,
+			"active":            entry.Active,
+			"updated_timestamp": now,
+		}
+		if columns.Grade {
+			set["grade"] = entry.Grade
+		}
+		if columns.Homeroom {
+			set["homeroom"] = entry.Homeroom
+		}
+		writes = append(writes, mongo.NewUpdateOneModel().
+			SetFilter(bson.M{"student_number": entry.StudentNumber}).
+			SetUpdate(bson.M{"$set": set}).
+			SetUpsert(true))
+		studentNumbers = append(studentNumbers, entry.StudentNumber)
+	}
+
+	if len(writes) > 0 {
+		res, err := lib.Datastore.Db.Collection(rosterColName).BulkWrite(ctx, writes, options.BulkWrite().SetOrdered(false))
+		if err != nil {
+			return result, err
+		}
+		result.Inserted = res.UpsertedCount
+		result.Updated = res.ModifiedCount
+
+		// Keep grades and homerooms of students who already signed up in sync
+		result.UsersUpdated, err = syncRosterToUsers(ctx, entries, columns, studentNumbers, importedBy)
+		if err != nil {
+			return result, err
+		}
+	}
+
+	if deactivateMissing {
+		res, err := lib.Datastore.Db.Collection(rosterColName).UpdateMany(
+			ctx,
+			bson.M{"student_number": bson.M{"$nin": studentNumbers}, "active": true},
+			bson.M{"$set": bson.M{"active": false, "updated_timestamp": now}},
+		)
+		if err != nil {
+			return result, err
+		}
+		result.Deactivated = res.ModifiedCount
+	}
+
+	return result, nil
+}
+
+// syncRosterToUsers copies the grades and homerooms of roster entries over to the users with the
+// same student numbers, returning how many users were changed. Columns missing from the import are
+// left alone, and only users that actually differ are updated, each as its own versioned change.
+func syncRosterToUsers(
+	ctx context.Context,
+	entries []RosterEntry,
+	columns RosterColumns,
+	studentNumbers []string,
+	changedBy string,
+) (int64, error) {
+	if !columns.Grade && !columns.Homeroom {
+		return 0, nil
+	}
+
+	entriesByNumber := map[string]RosterEntry{}
+	for _, entry := range entries {
+		entriesByNumber[entry.StudentNumber] = entry
+	}
+
+	users, err := GetUsersByStudentNumbers(ctx, studentNumbers)
+	if err != nil {
+		return 0, err
+	}
+
+	var updated int64
+	for _, user := range users {
+		entry := entriesByNumber[user.StudentNumber]
+		updates := bson.D{}
+		if columns.Grade && user.Grade != entry.Grade {
+			updates = append(updates, bson.E{Key: "grade", Value: entry.Grade})
+		}
+		if columns.Homeroom && user.Homeroom != entry.Homeroom {
+			updates = append(updates, bson.E{Key: "homeroom", Value: entry.Homeroom})
+		}
+		if len(updates) == 0 {
+			continue
+		}
+
+		_, err := updateVersionedDocument(ctx, usersColName, ChangeDocumentUser, user.ID, user.ID, updates, UpdateMeta{ChangedBy: changedBy})
+		if err == ErrNoDocumentModified || err == ErrNotFound {
+			continue // Changed or deleted since they were fetched
+		} else if err != nil {
+			return updated, err
+		}
+		updated++
+	}
+	return updated, nil
+}
+
+func GetRosterEntry(ctx context.Context, studentNumber string) (RosterEntry, error) {
+	var entry RosterEntry
+	err := lib.Datastore.Db.Collection(rosterColName).
+		FindOne(ctx, bson.M{"student_number": studentNumber}).
+		Decode(&entry)
+
+	// No error handling needed (entry & err will default to empty struct / nil)
+	return entry, err
+}
+
+func GetRosterEntries(ctx context.Context, rosterFilter RosterFilter) ([]RosterEntry, error) {
+	filter := bson.M{}
+	if rosterFilter.Query != "" {
+		query := regexp.QuoteMeta(rosterFilter.Query)
+		filter["$or"] = bson.A{
+			bson.M{"legal_name": bson.M{"$regex": query, "$options": "i"}},
+			bson.M{"student_number": bson.M{"$regex": "^" + query}},
+		}
+	}
+	if rosterFilter.Grade != 0 {
+		filter["grade"] = rosterFilter.Grade
+	}
+	if rosterFilter.Homeroom != "" {
+		filter["homeroom"] = rosterFilter.Homeroom
+	}
+	if rosterFilter.Active != nil {
+		filter["active"] = *rosterFilter.Active
+	}
+
+	opts := options.Find().SetSort(bson.D{{Key: "legal_name", Value: 1}})
+	cursor, err := lib.Datastore.Db.Collection(rosterColName).Find(ctx, filter, opts)
+	if err != nil {
+		return []RosterEntry{}, err
+	}
+
+	entries := []RosterEntry{}
+	if err := cursor.All(ctx, &entries); err != nil {
+		return []RosterEntry{}, err
+	}
+
+	return entries, nil
+}
+
+// ValidateStudentNumber checks that a student number belongs to an active student on the roster.
+// If it doesn't, a *RosterMismatchError with suggestions is returned. Validation is skipped while
+// the roster is empty so deployments that don't use one keep working.
+func ValidateStudentNumber(ctx context.Context, studentNumber string) error {
+	col := lib.Datastore.Db.Collection(rosterColName)
+
+	// CountDocuments (unlike EstimatedDocumentCount) also works inside transactions
+	count, err := col.CountDocuments(ctx, bson.M{}, options.Count().SetLimit(1))
+	if err != nil {
+		return err
+	}
+	if count == 0 {
+		return nil
+	}
+
+	// Most lookups are exact matches, so only look for suggestions once that fails
+	entry, err := GetRosterEntry(ctx, studentNumber)
+	if err == nil && entry.Active {
+		return nil
+	} else if err != nil && !errors.Is(err, mongo.ErrNoDocuments) {
+		return err
+	}
+
+	suggestions, err := suggestStudentNumbers(ctx, studentNumber)
+	if err != nil {
+		return err
+	}
+	return &RosterMismatchError{StudentNumber: studentNumber, Suggestions: suggestions}
+}
+
+// suggestStudentNumbers finds active student numbers within a small edit distance of the given one.
+func suggestStudentNumbers(ctx context.Context, studentNumber string) ([]string, error) {
+	opts := options.Find().SetProjection(bson.M{"student_number": 1})
+	cursor, err := lib.Datastore.Db.Collection(rosterColName).Find(ctx, bson.M{"active": true}, opts)
+	if err != nil {
+		return []string{}, err
+	}
+
+	var entries []RosterEntry
+	if err := cursor.All(ctx, &entries); err != nil {
+		return []string{}, err
+	}
+
+	type candidate struct {
+		studentNumber string
+		distance      int
+	}
+	candidates := []candidate{}
+	for _, entry := range entries {
+		if entry.StudentNumber == studentNumber {
+			continue
+		}
+		distance := levenshteinDistance(studentNumber, entry.StudentNumber)
+		if distance <= maxRosterSuggestionDistance {
+			candidates = append(candidates, candidate{entry.StudentNumber, distance})
+		}
+	}
+
+	// Closest first, ties broken alphabetically so results are stable
+	sort.Slice(candidates, func(i, j int) bool {
+		if candidates[i].distance != candidates[j].distance {
+			return candidates[i].distance < candidates[j].distance
+		}
+		return candidates[i].studentNumber < candidates[j].studentNumber
+	})
+
+	suggestions := []string{}
+	for i := 0; i < len(candidates) && i < maxRosterSuggestions; i++ {
+		suggestions = append(suggestions, candidates[i].studentNumber)
+	}
+	return suggestions, nil
+}
+
+// levenshteinDistance returns the minimum number of single character edits to turn a into b.
+func levenshteinDistance(a string, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	prev := make([]int, len(rb)+1)
+	curr := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+
+	for i := 1; i <= len(ra); i++ {
+		curr[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			// Cheapest of deleting, inserting or substituting
+			curr[j] = prev[j] + 1
+			if curr[j-1]+1 < curr[j] {
+				curr[j] = curr[j-1] + 1
+			}
+			if prev[j-1]+cost < curr[j] {
+				curr[j] = prev[j-1] + cost
+			}
+		}
+		prev, curr = curr, prev
+	}
+
+	return prev[len(rb)]
+}
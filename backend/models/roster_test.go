@@ -0,0 +1,82 @@
+package models
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/aritrosaha10/frasertickets/lib"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestParseRosterCSVColumns(t *testing.T) {
+	entries, columns, err := ParseRosterCSV(strings.NewReader("legal_name,student_number,homeroom\nAda Lovelace,111,101\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if columns.Grade || !columns.Homeroom {
+		t.Errorf("expected only the homeroom column to be found, got %+v", columns)
+	}
+	if len(entries) != 1 || entries[0].StudentNumber != "111" || entries[0].Homeroom != "101" || !entries[0].Active {
+		t.Errorf("unexpected entries %+v", entries)
+	}
+}
+
+func TestImportPartialRosterKeepsMissingColumns(t *testing.T) {
+	setupTestDatastore(t)
+	ctx := context.Background()
+
+	entries, columns, err := ParseRosterCSV(strings.NewReader("student_number,legal_name,grade,homeroom\n111,Ada Lovelace,10,101\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ImportRoster(ctx, entries, columns, false, "admin"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := CreateNewUser(ctx, User{ID: "ada", StudentNumber: "111", Grade: 10, Homeroom: "101"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// A later roster with only names shouldn't wipe out grades and homerooms
+	entries, columns, err = ParseRosterCSV(strings.NewReader("student_number,legal_name\n111,Ada King\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := ImportRoster(ctx, entries, columns, false, "admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.UsersUpdated != 0 {
+		t.Errorf("expected no users to be updated, got %d", result.UsersUpdated)
+	}
+
+	entry, err := GetRosterEntry(ctx, "111")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry.LegalName != "Ada King" || entry.Grade != 10 || entry.Homeroom != "101" {
+		t.Errorf("expected only the name to change on the roster, got %+v", entry)
+	}
+	var user User
+	if err := lib.Datastore.Db.Collection(usersColName).FindOne(ctx, bson.M{"_id": "ada"}).Decode(&user); err != nil {
+		t.Fatal(err)
+	}
+	if user.Grade != 10 || user.Homeroom != "101" {
+		t.Errorf("expected the user's grade and homeroom to be kept, got %+v", user)
+	}
+
+	// Only the columns that are there get synced
+	entries, columns, err = ParseRosterCSV(strings.NewReader("student_number,legal_name,grade\n111,Ada King,11\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ImportRoster(ctx, entries, columns, false, "admin"); err != nil {
+		t.Fatal(err)
+	}
+	if err := lib.Datastore.Db.Collection(usersColName).FindOne(ctx, bson.M{"_id": "ada"}).Decode(&user); err != nil {
+		t.Fatal(err)
+	}
+	if user.Grade != 11 || user.Homeroom != "101" {
+		t.Errorf("expected only the grade to be synced, got %+v", user)
+	}
+}
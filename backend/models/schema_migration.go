@@ -0,0 +1,585 @@
+package models
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"sort"
+
+	"github.com/aritrosaha10/frasertickets/lib"
+	"github.com/aritrosaha10/frasertickets/util"
+	"github.com/xeipuuv/gojsonschema"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+const (
+	SchemaChangeAdded               = "added"
+	SchemaChangeRemoved             = "removed"
+	SchemaChangeDropped             = "dropped"
+	SchemaChangeRenamed             = "renamed"
+	SchemaChangeTypeChanged         = "type_changed"
+	SchemaChangeRequired            = "required"
+	SchemaChangeOptional            = "optional"
+	SchemaChangeConstraintRelaxed   = "constraint_relaxed"
+	SchemaChangeConstraintTightened = "constraint_tightened"
+	SchemaChangePresentation        = "presentation_changed"
+	SchemaChangeNumbering           = "numbering_changed"
+)
+
+// Only this many invalid tickets are listed in a schema update result, the rest are just counted
+const maxListedInvalidTickets = 50
+
+// Keys of a custom field that only change how it's shown or handled by us, never what's valid
+var customFieldPresentationKeys = map[string]bool{
+	"displayName":   true,
+	"description":   true,
+	"userVisible":   true,
+	"editable":      true,
+	"enumLabels":    true,
+	"default":       true,
+	"displayOrder":  true,
+	"sensitive":     true,
+	"ownerEditable": true,
+}
+
+// Keys of a custom field that change how it's numbered. Existing numbers aren't redone when these
+// change, so new ones could collide with them.
+var customFieldNumberingKeys = map[string]bool{
+	"autoNumber":      true,
+	"autoNumberStart": true,
+}
+
+// Constraints that are relaxed when their value goes down or up respectively
+var (
+	lowerBoundConstraints = map[string]bool{"minimum": true, "exclusiveMinimum": true, "minLength": true, "minItems": true}
+	upperBoundConstraints = map[string]bool{"maximum": true, "exclusiveMaximum": true, "maxLength": true, "maxItems": true}
+)
+
+// CustomFieldsSchemaMigration moves existing custom field data over to a new schema.
+type CustomFieldsSchemaMigration struct {
+	Renames  map[string]string      `json:"renames,omitempty"`  // old key -> new key
+	Defaults map[string]interface{} `json:"defaults,omitempty"` // new key -> value for tickets that don't have one
+	Drop     []string               `json:"drop,omitempty"`     // old keys whose data should be removed
+}
+
+// apply returns the custom fields with the migration applied, leaving the original untouched.
+func (migration CustomFieldsSchemaMigration) apply(customFields map[string]interface{}) map[string]interface{} {
+	migrated := map[string]interface{}{}
+	for key, val := range customFields {
+		migrated[key] = val
+	}
+	for _, key := range migration.Drop {
+		delete(migrated, key)
+	}
+	for oldKey, newKey := range migration.Renames {
+		if val, found := migrated[oldKey]; found {
+			delete(migrated, oldKey)
+			migrated[newKey] = val
+		}
+	}
+	for key, val := range migration.Defaults {
+		if _, found := migrated[key]; !found {
+			migrated[key] = val
+		}
+	}
+	return migrated
+}
+
+// CustomFieldsSchemaChange is a single difference between an event's old and new schema.
+type CustomFieldsSchemaChange struct {
+	Field    string `json:"field"`
+	Change   string `json:"change"`
+	Breaking bool   `json:"breaking"`
+	Detail   string `json:"detail"`
+}
+
+// CustomFieldsValidationFailure is an existing ticket that wouldn't match the new schema.
+type CustomFieldsValidationFailure struct {
+	TicketID primitive.ObjectID `json:"ticketID"`
+	OwnerID  string             `json:"ownerID"`
+	Errors   []util.ErrDetail   `json:"errors"`
+}
+
+// CustomFieldsSchemaUpdateResult describes what a schema update changes, and whether it was saved.
+type CustomFieldsSchemaUpdateResult struct {
+	Changes               []CustomFieldsSchemaChange      `json:"changes"`
+	Breaking              bool                            `json:"breaking"`
+	TicketsChecked        int                             `json:"ticketsChecked"`
+	TicketsMigrated       int                             `json:"ticketsMigrated"`
+	QueuedTicketsMigrated int                             `json:"queuedTicketsMigrated"`
+	InvalidTicketCount    int                             `json:"invalidTicketCount"`
+	InvalidTickets        []CustomFieldsValidationFailure `json:"invalidTickets"` // only the first few are listed
+	Applied               bool                            `json:"applied"`
+}
+
+func (result *CustomFieldsSchemaUpdateResult) Render(w http.ResponseWriter, r *http.Request) error {
+	return nil
+}
+
+// Returned from the schema update transaction to abort it on dry runs
+var errSchemaUpdateDryRun = errors.New("dry run, aborting schema update")
+
+// normalizeRawSchema round trips a raw schema through JSON, so schemas read from Mongo (with
+// primitive.A lists) and schemas read from requests can be compared directly.
+func normalizeRawSchema(raw map[string]interface{}) (map[string]interface{}, error) {
+	encoded, err := json.Marshal(raw)
+	if err != nil {
+		return nil, err
+	}
+	normalized := map[string]interface{}{}
+	if err := json.Unmarshal(encoded, &normalized); err != nil {
+		return nil, err
+	}
+	return normalized, nil
+}
+
+// rawSchemaProperties pulls the raw property objects and required keys out of a normalized schema.
+func rawSchemaProperties(raw map[string]interface{}) (map[string]map[string]interface{}, map[string]bool) {
+	properties := map[string]map[string]interface{}{}
+	if rawProperties, ok := raw["properties"].(map[string]interface{}); ok {
+		for key, rawProperty := range rawProperties {
+			if property, ok := rawProperty.(map[string]interface{}); ok {
+				properties[key] = property
+			}
+		}
+	}
+
+	required := map[string]bool{}
+	if rawRequired, ok := raw["required"].([]interface{}); ok {
+		for _, key := range rawRequired {
+			if keyStr, ok := key.(string); ok {
+				required[keyStr] = true
+			}
+		}
+	}
+
+	return properties, required
+}
+
+// isConstraintRelaxed checks whether changing a JSON schema keyword from oldVal to newVal can only
+// let more values through. Unknown keywords are assumed to be tightened unless they were removed.
+func isConstraintRelaxed(keyword string, oldVal interface{}, newVal interface{}) bool {
+	if newVal == nil {
+		return true
+	}
+	if oldVal == nil {
+		return false
+	}
+
+	oldNum, oldIsNum := oldVal.(float64)
+	newNum, newIsNum := newVal.(float64)
+	switch {
+	case lowerBoundConstraints[keyword] && oldIsNum && newIsNum:
+		return newNum <= oldNum
+	case upperBoundConstraints[keyword] && oldIsNum && newIsNum:
+		return newNum >= oldNum
+	case keyword == "enum":
+		oldEnum, oldOk := oldVal.([]interface{})
+		newEnum, newOk := newVal.([]interface{})
+		if !oldOk || !newOk {
+			return false
+		}
+		for _, oldChoice := range oldEnum {
+			found := false
+			for _, newChoice := range newEnum {
+				if reflect.DeepEqual(oldChoice, newChoice) {
+					found = true
+					break
+				}
+			}
+			if !found {
+				return false
+			}
+		}
+		return true
+	case keyword == "additionalProperties":
+		return newVal == true
+	default:
+		return false
+	}
+}
+
+// DiffCustomFieldsSchemas lists the differences between two custom field schemas, taking renames,
+// defaults and dropped fields from the migration into account. Breaking changes are ones that
+// existing tickets might not satisfy.
+func DiffCustomFieldsSchemas(
+	oldRaw map[string]interface{},
+	newRaw map[string]interface{},
+	migration CustomFieldsSchemaMigration,
+) ([]CustomFieldsSchemaChange, error) {
+	oldSchema, err := normalizeRawSchema(oldRaw)
+	if err != nil {
+		return nil, err
+	}
+	newSchema, err := normalizeRawSchema(newRaw)
+	if err != nil {
+		return nil, err
+	}
+	oldProperties, oldRequired := rawSchemaProperties(oldSchema)
+	newProperties, newRequired := rawSchemaProperties(newSchema)
+
+	// Make sure the migration makes sense for these schemas
+	renamedFrom := map[string]string{}
+	for oldKey, newKey := range migration.Renames {
+		if _, found := oldProperties[oldKey]; !found {
+			return nil, fmt.Errorf("%w: can't rename '%s' since it isn't in the current schema", ErrInvalidSchemaUpdate, oldKey)
+		}
+		if _, found := newProperties[newKey]; !found {
+			return nil, fmt.Errorf("%w: can't rename '%s' to '%s' since it isn't in the new schema", ErrInvalidSchemaUpdate, oldKey, newKey)
+		}
+		if _, found := oldProperties[newKey]; found {
+			return nil, fmt.Errorf("%w: can't rename '%s' to '%s' since it already exists", ErrInvalidSchemaUpdate, oldKey, newKey)
+		}
+		if _, found := renamedFrom[newKey]; found {
+			return nil, fmt.Errorf("%w: more than one field is renamed to '%s'", ErrInvalidSchemaUpdate, newKey)
+		}
+		renamedFrom[newKey] = oldKey
+	}
+	for key := range migration.Defaults {
+		if _, found := newProperties[key]; !found {
+			return nil, fmt.Errorf("%w: can't set a default for '%s' since it isn't in the new schema", ErrInvalidSchemaUpdate, key)
+		}
+	}
+	dropped := map[string]bool{}
+	for _, key := range migration.Drop {
+		if _, found := oldProperties[key]; !found {
+			return nil, fmt.Errorf("%w: can't drop '%s' since it isn't in the current schema", ErrInvalidSchemaUpdate, key)
+		}
+		if _, found := newProperties[key]; found {
+			return nil, fmt.Errorf("%w: can't drop '%s' since it's still in the new schema", ErrInvalidSchemaUpdate, key)
+		}
+		dropped[key] = true
+	}
+
+	changes := []CustomFieldsSchemaChange{}
+	for key, newProperty := range newProperties {
+		_, hasDefault := migration.Defaults[key]
+
+		sourceKey := key
+		if oldKey, renamed := renamedFrom[key]; renamed {
+			sourceKey = oldKey
+			changes = append(changes, CustomFieldsSchemaChange{
+				Field:  key,
+				Change: SchemaChangeRenamed,
+				Detail: fmt.Sprintf("renamed from '%s'", oldKey),
+			})
+		}
+
+		oldProperty, existed := oldProperties[sourceKey]
+		if !existed {
+			breaking := newRequired[key] && !hasDefault
+			detail := "new optional field"
+			if newRequired[key] {
+				detail = "new required field"
+				if hasDefault {
+					detail += ", filled in with the default"
+				}
+			}
+			changes = append(changes, CustomFieldsSchemaChange{Field: key, Change: SchemaChangeAdded, Breaking: breaking, Detail: detail})
+			continue
+		}
+
+		// Required-ness
+		if newRequired[key] && !oldRequired[sourceKey] {
+			detail := "field is now required"
+			if hasDefault {
+				detail += ", missing values are filled in with the default"
+			}
+			changes = append(changes, CustomFieldsSchemaChange{Field: key, Change: SchemaChangeRequired, Breaking: !hasDefault, Detail: detail})
+		} else if !newRequired[key] && oldRequired[sourceKey] {
+			changes = append(changes, CustomFieldsSchemaChange{Field: key, Change: SchemaChangeOptional, Detail: "field is no longer required"})
+		}
+
+		// Everything else in the property, keyword by keyword
+		keywords := map[string]bool{}
+		for keyword := range oldProperty {
+			keywords[keyword] = true
+		}
+		for keyword := range newProperty {
+			keywords[keyword] = true
+		}
+		presentationChanged := false
+		for keyword := range keywords {
+			oldVal, newVal := oldProperty[keyword], newProperty[keyword]
+			if reflect.DeepEqual(oldVal, newVal) {
+				continue
+			}
+
+			switch {
+			case customFieldPresentationKeys[keyword]:
+				presentationChanged = true
+			case customFieldNumberingKeys[keyword]:
+				changes = append(changes, CustomFieldsSchemaChange{
+					Field:    key,
+					Change:   SchemaChangeNumbering,
+					Breaking: true,
+					Detail:   fmt.Sprintf("'%s' changed from %v to %v, existing numbers are kept", keyword, oldVal, newVal),
+				})
+			case keyword == "type":
+				changes = append(changes, CustomFieldsSchemaChange{
+					Field:    key,
+					Change:   SchemaChangeTypeChanged,
+					Breaking: true,
+					Detail:   fmt.Sprintf("type changed from %v to %v", oldVal, newVal),
+				})
+			case isConstraintRelaxed(keyword, oldVal, newVal):
+				changes = append(changes, CustomFieldsSchemaChange{
+					Field:  key,
+					Change: SchemaChangeConstraintRelaxed,
+					Detail: fmt.Sprintf("'%s' relaxed", keyword),
+				})
+			default:
+				changes = append(changes, CustomFieldsSchemaChange{
+					Field:    key,
+					Change:   SchemaChangeConstraintTightened,
+					Breaking: true,
+					Detail:   fmt.Sprintf("'%s' changed", keyword),
+				})
+			}
+		}
+		if presentationChanged {
+			changes = append(changes, CustomFieldsSchemaChange{Field: key, Change: SchemaChangePresentation, Detail: "display settings changed"})
+		}
+	}
+
+	for key := range oldProperties {
+		if _, stillExists := newProperties[key]; stillExists {
+			continue
+		}
+		if _, renamed := migration.Renames[key]; renamed {
+			continue
+		}
+		if dropped[key] {
+			changes = append(changes, CustomFieldsSchemaChange{Field: key, Change: SchemaChangeDropped, Detail: "field and its data are removed"})
+		} else {
+			changes = append(changes, CustomFieldsSchemaChange{
+				Field:    key,
+				Change:   SchemaChangeRemoved,
+				Breaking: true,
+				Detail:   "field is removed but existing data is kept, drop it to remove the data too",
+			})
+		}
+	}
+
+	// Schema-wide keywords, ex. additionalProperties
+	for keyword := range newSchema {
+		if keyword == "properties" || keyword == "required" {
+			continue
+		}
+		if !reflect.DeepEqual(oldSchema[keyword], newSchema[keyword]) && !isConstraintRelaxed(keyword, oldSchema[keyword], newSchema[keyword]) {
+			changes = append(changes, CustomFieldsSchemaChange{Change: SchemaChangeConstraintTightened, Breaking: true, Detail: fmt.Sprintf("'%s' changed", keyword)})
+		}
+	}
+	for keyword := range oldSchema {
+		if _, found := newSchema[keyword]; !found && keyword != "properties" && keyword != "required" {
+			changes = append(changes, CustomFieldsSchemaChange{Change: SchemaChangeConstraintRelaxed, Detail: fmt.Sprintf("'%s' removed", keyword)})
+		}
+	}
+
+	sort.SliceStable(changes, func(i, j int) bool {
+		return changes[i].Field < changes[j].Field
+	})
+	return changes, nil
+}
+
+// UpdateEventCustomFieldsSchema replaces an event's custom fields schema. Every existing ticket is
+// migrated and checked against the new schema, and the update is only saved if they all pass and,
+// unless acceptBreaking is set, no breaking changes are found. Pending queued tickets are migrated
+// too. Everything is saved in one transaction, along with each migrated ticket's change history and
+// counters for new auto-numbered fields, but tickets made while the update runs are only checked
+// against the schema they were made with.
+// The result is returned with ErrSchemaUpdateRejected if the update wasn't saved.
+func UpdateEventCustomFieldsSchema(
+	ctx context.Context,
+	eventID primitive.ObjectID,
+	newRaw map[string]interface{},
+	migration CustomFieldsSchemaMigration,
+	dryRun bool,
+	acceptBreaking bool,
+	meta UpdateMeta,
+) (CustomFieldsSchemaUpdateResult, error) {
+	// Make sure the new schema is valid before looking at any tickets
+	newSchemaNormalized, err := normalizeRawSchema(newRaw)
+	if err != nil {
+		return CustomFieldsSchemaUpdateResult{}, fmt.Errorf("%w: %s", ErrInvalidSchemaUpdate, err)
+	}
+	compiledSchema, err := gojsonschema.NewSchema(gojsonschema.NewGoLoader(newSchemaNormalized))
+	if err != nil {
+		return CustomFieldsSchemaUpdateResult{}, fmt.Errorf("%w: %s", ErrInvalidSchemaUpdate, err)
+	}
+	newSchema, err := util.ConvertRawCustomFieldsSchema(newSchemaNormalized)
+	if err != nil {
+		return CustomFieldsSchemaUpdateResult{}, fmt.Errorf("%w: %s", ErrInvalidSchemaUpdate, err)
+	}
+
+	var result CustomFieldsSchemaUpdateResult
+	_, err = lib.Datastore.WithTransaction(ctx, func(sessCtx mongo.SessionContext) (interface{}, error) {
+		result = CustomFieldsSchemaUpdateResult{InvalidTickets: []CustomFieldsValidationFailure{}}
+
+		event, err := GetEvent(sessCtx, bson.M{"_id": eventID})
+		if err == mongo.ErrNoDocuments {
+			return nil, ErrNotFound
+		} else if err != nil {
+			return nil, err
+		}
+		if meta.ExpectedVersion != nil && *meta.ExpectedVersion != event.Version {
+			return nil, ErrVersionMismatch // Checked up front to skip looking at every ticket
+		}
+
+		result.Changes, err = DiffCustomFieldsSchemas(event.RawCustomFieldsSchema, newSchemaNormalized, migration)
+		if err != nil {
+			return nil, err
+		}
+		for _, change := range result.Changes {
+			result.Breaking = result.Breaking || change.Breaking
+		}
+
+		// Check every ticket against the new schema, keeping track of the ones that need saving
+		ticketWrites := []mongo.WriteModel{}
+		ticketChanges := []ChangeRecord{}
+		cursor, err := lib.Datastore.Db.Collection(ticketsColName).Find(sessCtx, excludeTrashed(bson.M{"event": eventID}))
+		if err != nil {
+			return nil, err
+		}
+		defer cursor.Close(sessCtx)
+		for cursor.Next(sessCtx) {
+			var ticket Ticket
+			if err := cursor.Decode(&ticket); err != nil {
+				return nil, err
+			}
+			result.TicketsChecked++
+
+			migrated := migration.apply(ticket.CustomFields)
+			validation, err := compiledSchema.Validate(gojsonschema.NewGoLoader(migrated))
+			if err != nil {
+				return nil, err
+			}
+			if !validation.Valid() {
+				result.InvalidTicketCount++
+				if len(result.InvalidTickets) < maxListedInvalidTickets {
+					result.InvalidTickets = append(result.InvalidTickets, CustomFieldsValidationFailure{
+						TicketID: ticket.ID,
+						OwnerID:  ticket.Owner,
+						Errors:   customFieldsErrDetails(validation.Errors()),
+					})
+				}
+				continue
+			}
+
+			if !reflect.DeepEqual(migrated, ticket.CustomFields) {
+				ticketWrites = append(ticketWrites, mongo.NewUpdateOneModel().
+					SetFilter(bson.M{"_id": ticket.ID}).
+					SetUpdate(bson.M{"$set": bson.M{"customFields": migrated}, "$inc": bson.M{"version": 1}}))
+				ticketChanges = append(ticketChanges, ChangeRecord{
+					DocumentKind: ChangeDocumentTicket,
+					DocumentID:   ticket.ID.Hex(),
+					ChangedBy:    meta.ChangedBy,
+					Version:      ticket.Version + 1,
+					Changes:      customFieldChanges(ticket.CustomFields, migrated),
+				})
+			}
+		}
+		if err := cursor.Err(); err != nil {
+			return nil, err
+		}
+		result.TicketsMigrated = len(ticketWrites)
+
+		// Queued tickets aren't validated until they're converted, but they still need to be migrated
+		queuedTickets, err := GetQueuedTickets(sessCtx, pendingQueuedTicketsFilter(bson.M{"event_id": eventID}))
+		if err != nil {
+			return nil, err
+		}
+		queuedTicketWrites := []mongo.WriteModel{}
+		for _, queuedTicket := range queuedTickets {
+			migrated := migration.apply(queuedTicket.CustomFields)
+			if !reflect.DeepEqual(migrated, queuedTicket.CustomFields) {
+				queuedTicketWrites = append(queuedTicketWrites, mongo.NewUpdateOneModel().
+					SetFilter(bson.M{"_id": queuedTicket.ID}).
+					SetUpdate(bson.M{"$set": bson.M{"customFields": migrated}}))
+			}
+		}
+		result.QueuedTicketsMigrated = len(queuedTicketWrites)
+
+		if dryRun {
+			return nil, errSchemaUpdateDryRun
+		}
+		if result.InvalidTicketCount > 0 || (result.Breaking && !acceptBreaking) {
+			return nil, ErrSchemaUpdateRejected
+		}
+
+		// Save everything
+		_, err = updateVersionedDocument(
+			sessCtx,
+			eventsColName,
+			ChangeDocumentEvent,
+			eventID,
+			eventID.Hex(),
+			bson.D{{Key: "custom_fields_schema", Value: newSchemaNormalized}},
+			meta,
+		)
+		if err != nil && err != ErrNoDocumentModified { // Only migrating tickets is fine
+			return nil, err
+		}
+		if len(ticketWrites) > 0 {
+			if _, err := lib.Datastore.Db.Collection(ticketsColName).BulkWrite(sessCtx, ticketWrites); err != nil {
+				return nil, err
+			}
+			if err := recordChanges(sessCtx, ticketChanges); err != nil {
+				return nil, err
+			}
+		}
+		if len(queuedTicketWrites) > 0 {
+			if _, err := lib.Datastore.Db.Collection(queuedTicketsColName).BulkWrite(sessCtx, queuedTicketWrites); err != nil {
+				return nil, err
+			}
+		}
+
+		// Renamed auto-numbered fields keep counting from where they left off, and new ones need
+		// counters before any tickets can be made with the new schema
+		for oldKey, newKey := range migration.Renames {
+			if newSchema.Properties[newKey].AutoNumber {
+				if err := renameCounter(sessCtx, eventID, oldKey, newKey); err != nil {
+					return nil, err
+				}
+			}
+		}
+		if err := ensureCounters(sessCtx, eventID, newSchemaNormalized); err != nil {
+			return nil, err
+		}
+
+		result.Applied = true
+		return nil, nil
+	})
+	if err == errSchemaUpdateDryRun {
+		return result, nil
+	}
+	return result, err
+}
+
+// customFieldChanges lists every custom field that differs between a ticket's old and new custom
+// fields, for its change history.
+func customFieldChanges(from map[string]interface{}, to map[string]interface{}) []FieldChange {
+	keys := []string{}
+	for key := range from {
+		keys = append(keys, key)
+	}
+	for key := range to {
+		if _, ok := from[key]; !ok {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	changes := []FieldChange{}
+	for _, key := range keys {
+		if !sameValue(from[key], to[key]) {
+			changes = append(changes, FieldChange{Field: "customFields." + key, From: from[key], To: to[key]})
+		}
+	}
+	return changes
+}
@@ -0,0 +1,264 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/aritrosaha10/frasertickets/lib"
+	"github.com/aritrosaha10/frasertickets/util"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func schemaWith(properties map[string]interface{}, required ...string) map[string]interface{} {
+	schema := map[string]interface{}{"type": "object", "properties": properties}
+	if len(required) > 0 {
+		requiredRaw := []interface{}{}
+		for _, key := range required {
+			requiredRaw = append(requiredRaw, key)
+		}
+		schema["required"] = requiredRaw
+	}
+	return schema
+}
+
+func TestDiffCustomFieldsSchemas(t *testing.T) {
+	base := schemaWith(map[string]interface{}{
+		"size":  map[string]interface{}{"type": "string", "enum": []interface{}{"S", "M"}},
+		"notes": map[string]interface{}{"type": "string", "maxLength": 100},
+		"seat":  map[string]interface{}{"type": "integer", "autoNumber": true},
+	}, "size")
+
+	tests := []struct {
+		name      string
+		newSchema map[string]interface{}
+		migration CustomFieldsSchemaMigration
+		expected  []CustomFieldsSchemaChange
+	}{
+		{
+			name: "relaxed constraints and presentation",
+			newSchema: schemaWith(map[string]interface{}{
+				"size":  map[string]interface{}{"type": "string", "enum": []interface{}{"S", "M", "L"}, "displayName": "Size"},
+				"notes": map[string]interface{}{"type": "string", "maxLength": 200},
+				"seat":  map[string]interface{}{"type": "integer", "autoNumber": true},
+			}),
+			expected: []CustomFieldsSchemaChange{
+				{Field: "notes", Change: SchemaChangeConstraintRelaxed, Detail: "'maxLength' relaxed"},
+				{Field: "size", Change: SchemaChangeOptional, Detail: "field is no longer required"},
+				{Field: "size", Change: SchemaChangeConstraintRelaxed, Detail: "'enum' relaxed"},
+				{Field: "size", Change: SchemaChangePresentation, Detail: "display settings changed"},
+			},
+		},
+		{
+			name: "tightened constraint and type change",
+			newSchema: schemaWith(map[string]interface{}{
+				"size":  map[string]interface{}{"type": "string", "enum": []interface{}{"S"}},
+				"notes": map[string]interface{}{"type": "integer"},
+				"seat":  map[string]interface{}{"type": "integer", "autoNumber": true},
+			}, "size"),
+			expected: []CustomFieldsSchemaChange{
+				{Field: "notes", Change: SchemaChangeTypeChanged, Breaking: true, Detail: "type changed from string to integer"},
+				{Field: "notes", Change: SchemaChangeConstraintRelaxed, Detail: "'maxLength' relaxed"},
+				{Field: "size", Change: SchemaChangeConstraintTightened, Breaking: true, Detail: "'enum' changed"},
+			},
+		},
+		{
+			name: "numbering changes are breaking",
+			newSchema: schemaWith(map[string]interface{}{
+				"size":  map[string]interface{}{"type": "string", "enum": []interface{}{"S", "M"}},
+				"notes": map[string]interface{}{"type": "string", "maxLength": 100},
+				"seat":  map[string]interface{}{"type": "integer", "autoNumber": true, "autoNumberStart": 100},
+			}, "size"),
+			expected: []CustomFieldsSchemaChange{
+				{Field: "seat", Change: SchemaChangeNumbering, Breaking: true, Detail: "'autoNumberStart' changed from <nil> to 100, existing numbers are kept"},
+			},
+		},
+		{
+			name: "renames, defaults and drops",
+			newSchema: schemaWith(map[string]interface{}{
+				"shirtSize": map[string]interface{}{"type": "string", "enum": []interface{}{"S", "M"}},
+				"seat":      map[string]interface{}{"type": "integer", "autoNumber": true},
+				"diet":      map[string]interface{}{"type": "string"},
+			}, "shirtSize", "diet"),
+			migration: CustomFieldsSchemaMigration{
+				Renames:  map[string]string{"size": "shirtSize"},
+				Defaults: map[string]interface{}{"diet": "none"},
+				Drop:     []string{"notes"},
+			},
+			expected: []CustomFieldsSchemaChange{
+				{Field: "diet", Change: SchemaChangeAdded, Detail: "new required field, filled in with the default"},
+				{Field: "notes", Change: SchemaChangeDropped, Detail: "field and its data are removed"},
+				{Field: "shirtSize", Change: SchemaChangeRenamed, Detail: "renamed from 'size'"},
+			},
+		},
+		{
+			name: "removed and required fields without data migrations",
+			newSchema: schemaWith(map[string]interface{}{
+				"size": map[string]interface{}{"type": "string", "enum": []interface{}{"S", "M"}},
+				"seat": map[string]interface{}{"type": "integer", "autoNumber": true},
+				"diet": map[string]interface{}{"type": "string"},
+			}, "size", "diet"),
+			expected: []CustomFieldsSchemaChange{
+				{Field: "diet", Change: SchemaChangeAdded, Breaking: true, Detail: "new required field"},
+				{Field: "notes", Change: SchemaChangeRemoved, Breaking: true, Detail: "field is removed but existing data is kept, drop it to remove the data too"},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			changes, err := DiffCustomFieldsSchemas(base, test.newSchema, test.migration)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !sameSchemaChanges(changes, test.expected) {
+				t.Errorf("expected changes %+v, got %+v", test.expected, changes)
+			}
+		})
+	}
+}
+
+// sameSchemaChanges compares changes ignoring the order of changes to the same field, which
+// depends on map iteration.
+func sameSchemaChanges(got []CustomFieldsSchemaChange, expected []CustomFieldsSchemaChange) bool {
+	if len(got) != len(expected) {
+		return false
+	}
+	remaining := append([]CustomFieldsSchemaChange{}, expected...)
+	for _, change := range got {
+		found := false
+		for i, candidate := range remaining {
+			if reflect.DeepEqual(change, candidate) {
+				remaining = append(remaining[:i], remaining[i+1:]...)
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+func TestDiffCustomFieldsSchemasRejectsBadMigrations(t *testing.T) {
+	oldSchema := schemaWith(map[string]interface{}{
+		"size":  map[string]interface{}{"type": "string"},
+		"notes": map[string]interface{}{"type": "string"},
+	})
+	newSchema := schemaWith(map[string]interface{}{
+		"size":      map[string]interface{}{"type": "string"},
+		"shirtSize": map[string]interface{}{"type": "string"},
+	})
+
+	migrations := map[string]CustomFieldsSchemaMigration{
+		"rename of missing field":     {Renames: map[string]string{"diet": "shirtSize"}},
+		"rename to missing field":     {Renames: map[string]string{"notes": "diet"}},
+		"rename onto existing field":  {Renames: map[string]string{"notes": "size"}},
+		"default for missing field":   {Defaults: map[string]interface{}{"notes": "none"}},
+		"drop of missing field":       {Drop: []string{"diet"}},
+		"drop of field still present": {Drop: []string{"size"}},
+	}
+	for name, migration := range migrations {
+		if _, err := DiffCustomFieldsSchemas(oldSchema, newSchema, migration); !errors.Is(err, ErrInvalidSchemaUpdate) {
+			t.Errorf("%s: expected ErrInvalidSchemaUpdate, got %v", name, err)
+		}
+	}
+}
+
+func TestCustomFieldsSchemaMigrationApply(t *testing.T) {
+	migration := CustomFieldsSchemaMigration{
+		Renames:  map[string]string{"size": "shirtSize"},
+		Defaults: map[string]interface{}{"diet": "none", "shirtSize": "M"},
+		Drop:     []string{"notes"},
+	}
+	original := map[string]interface{}{"size": "S", "notes": "hi"}
+
+	migrated := migration.apply(original)
+	expected := map[string]interface{}{"shirtSize": "S", "diet": "none"}
+	if !reflect.DeepEqual(migrated, expected) {
+		t.Errorf("expected %v, got %v", expected, migrated)
+	}
+	if !reflect.DeepEqual(original, map[string]interface{}{"size": "S", "notes": "hi"}) {
+		t.Errorf("expected the original to be left alone, got %v", original)
+	}
+}
+
+func TestUpdateEventCustomFieldsSchemaMigratesTickets(t *testing.T) {
+	setupTestDatastore(t)
+	ctx := context.Background()
+
+	eventID, err := CreateNewEvent(ctx, Event{
+		Name:                  "Gala",
+		RawCustomFieldsSchema: schemaWith(map[string]interface{}{"size": map[string]interface{}{"type": "string"}}),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := CreateNewUser(ctx, User{ID: "holder", FullName: "Holder"}); err != nil {
+		t.Fatal(err)
+	}
+	ticketID, err := CreateNewTicket(ctx, Ticket{Owner: "holder", Event: eventID, CustomFields: map[string]interface{}{"size": "S"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	queuedTicketID, err := CreateQueuedTicket(ctx, QueuedTicket{
+		EventID:      eventID,
+		Email:        "guest@example.com",
+		CustomFields: map[string]interface{}{"size": "M"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	newSchema := schemaWith(map[string]interface{}{
+		"shirtSize": map[string]interface{}{"type": "string"},
+		"seat":      map[string]interface{}{"type": "integer", "autoNumber": true},
+	})
+	migration := CustomFieldsSchemaMigration{Renames: map[string]string{"size": "shirtSize"}}
+	result, err := UpdateEventCustomFieldsSchema(ctx, eventID, newSchema, migration, false, false, UpdateMeta{ChangedBy: "admin"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.Applied || result.TicketsMigrated != 1 || result.QueuedTicketsMigrated != 1 {
+		t.Fatalf("expected the ticket and queued ticket to be migrated, got %+v", result)
+	}
+
+	// Migrated tickets show up in their history like any other edit
+	history, err := GetChangeHistory(ctx, ChangeDocumentTicket, ticketID.Hex())
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []FieldChange{
+		{Field: "customFields.shirtSize", To: "S"},
+		{Field: "customFields.size", From: "S"},
+	}
+	if len(history) != 1 || history[0].ChangedBy != "admin" || history[0].Version != 1 ||
+		!reflect.DeepEqual(history[0].Changes, expected) {
+		t.Errorf("expected the rename to be recorded, got %+v", history)
+	}
+
+	// Queued tickets aren't versioned
+	var queuedTicket bson.M
+	err = lib.Datastore.Db.Collection(queuedTicketsColName).FindOne(ctx, bson.M{"_id": queuedTicketID}).Decode(&queuedTicket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, versioned := queuedTicket["version"]; versioned {
+		t.Errorf("expected the queued ticket to be left unversioned, got %v", queuedTicket)
+	}
+
+	// The new auto-numbered field has a counter as soon as the schema is saved
+	newTicketID, err := CreateNewTicket(ctx, Ticket{Owner: "holder", Event: eventID, CustomFields: map[string]interface{}{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	newTicket, err := GetTicket(ctx, newTicketID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if seat, _ := util.CustomFieldInt(newTicket.CustomFields["seat"]); seat != 1 {
+		t.Errorf("expected the first seat to be numbered 1, got %v", newTicket.CustomFields)
+	}
+}
@@ -0,0 +1,209 @@
+package models
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/aritrosaha10/frasertickets/lib"
+	"github.com/aritrosaha10/frasertickets/util"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+const (
+	DefaultStatsInterval = 15 * time.Minute
+	MaxStatsInterval     = 24 * time.Hour
+)
+
+// EventStats summarizes attendance for an event.
+type EventStats struct {
+	EventID        primitive.ObjectID     `json:"eventID"`
+	Issued         int64                  `json:"issued"`     // tickets that exist for the event
+	Scanned        int64                  `json:"scanned"`    // tickets scanned at least once
+	NoShows        int64                  `json:"noShows"`    // tickets never scanned
+	TotalScans     int64                  `json:"totalScans"` // every scan, including re-entries
+	AttendanceRate float64                `json:"attendanceRate"`
+	Interval       string                 `json:"interval"`
+	Admissions     []AdmissionBucket      `json:"admissions"`
+	CustomFields   []CustomFieldBreakdown `json:"customFields"`
+}
+
+func (stats *EventStats) Render(w http.ResponseWriter, r *http.Request) error {
+	return nil
+}
+
+// AdmissionBucket counts the ticket holders first admitted within a slice of time.
+type AdmissionBucket struct {
+	Start      time.Time `json:"start"      bson:"_id"`
+	Count      int64     `json:"count"      bson:"count"`
+	Cumulative int64     `json:"cumulative" bson:"-"`
+}
+
+// CustomFieldBreakdown counts tickets by each value of a custom field.
+type CustomFieldBreakdown struct {
+	Field       string                  `json:"field"`
+	DisplayName string                  `json:"displayName"`
+	Values      []CustomFieldValueStats `json:"values"`
+}
+
+// CustomFieldValueStats is how many tickets with a custom field value were issued and scanned.
+type CustomFieldValueStats struct {
+	Value   interface{} `json:"value"   bson:"_id"`
+	Issued  int64       `json:"issued"  bson:"issued"`
+	Scanned int64       `json:"scanned" bson:"scanned"`
+}
+
+// eventStatsTotals is the result of the totals facet in the stats pipeline.
+type eventStatsTotals struct {
+	Issued     int64 `bson:"issued"`
+	Scanned    int64 `bson:"scanned"`
+	TotalScans int64 `bson:"totalScans"`
+}
+
+// statsBucketStart builds an expression rounding a date down to the start of its bucket. Buckets are
+// counted from the Unix epoch in UTC, so intervals dividing a day evenly line up with the clock.
+// $dateTrunc would do the same, but needs MongoDB 5.0. Intervals must be a whole number of minutes.
+func statsBucketStart(date interface{}, interval time.Duration) (bson.D, error) {
+	if interval < time.Minute || interval > MaxStatsInterval || interval%time.Minute != 0 {
+		return nil, fmt.Errorf("%w: interval must be a whole number of minutes between 1m and %s", ErrInvalidReport, MaxStatsInterval)
+	}
+
+	millis := bson.D{{Key: "$toLong", Value: date}}
+	return bson.D{{Key: "$toDate", Value: bson.D{{Key: "$subtract", Value: bson.A{
+		millis,
+		bson.D{{Key: "$mod", Value: bson.A{millis, interval.Milliseconds()}}},
+	}}}}}, nil
+}
+
+// GetEventStats computes attendance stats for an event in a single aggregation. Admissions are
+// bucketed by when each ticket was first scanned, falling back to the last scan for tickets scanned
+// before first scans were recorded. Custom fields are broken down for each of the given keys, or
+// every non-sensitive key in the event's schema if none are given.
+func GetEventStats(
+	ctx context.Context,
+	event Event,
+	interval time.Duration,
+	fields []string,
+) (EventStats, error) {
+	admissionBucket, err := statsBucketStart(bson.D{{Key: "$ifNull", Value: bson.A{"$firstScanTime", "$lastScanTime"}}}, interval)
+	if err != nil {
+		return EventStats{}, err
+	}
+
+	// Figure out which custom fields to break down
+	schema := util.CustomFieldsSchema{}
+	if len(event.RawCustomFieldsSchema) != 0 {
+		schema, err = util.ConvertRawCustomFieldsSchema(event.RawCustomFieldsSchema)
+		if err != nil {
+			return EventStats{}, err
+		}
+	}
+	if len(fields) == 0 {
+		for _, key := range schema.OrderedKeys() {
+			if !schema.Properties[key].Sensitive {
+				fields = append(fields, key)
+			}
+		}
+	}
+	for _, field := range fields {
+		if _, ok := schema.Properties[field]; !ok {
+			return EventStats{}, fmt.Errorf("%w: '%s' is not a custom field of this event", ErrInvalidReport, field)
+		}
+	}
+
+	scannedCond := ticketScannedCountExpr()
+
+	facets := bson.D{
+		{Key: "totals", Value: bson.A{
+			bson.D{{Key: "$group", Value: bson.D{
+				{Key: "_id", Value: nil},
+				{Key: "issued", Value: bson.D{{Key: "$sum", Value: 1}}},
+				{Key: "scanned", Value: bson.D{{Key: "$sum", Value: scannedCond}}},
+				{Key: "totalScans", Value: bson.D{{Key: "$sum", Value: "$scanCount"}}},
+			}}},
+		}},
+		{Key: "admissions", Value: bson.A{
+			bson.D{{Key: "$match", Value: bson.M{"scanCount": bson.M{"$gt": 0}}}},
+			bson.D{{Key: "$group", Value: bson.D{
+				{Key: "_id", Value: admissionBucket},
+				{Key: "count", Value: bson.D{{Key: "$sum", Value: 1}}},
+			}}},
+			bson.D{{Key: "$sort", Value: bson.D{{Key: "_id", Value: 1}}}},
+		}},
+	}
+	// Facet names can't contain dots, so custom fields are referred to by index
+	for i, field := range fields {
+		facets = append(facets, bson.E{Key: fmt.Sprintf("customField%d", i), Value: bson.A{
+			bson.D{{Key: "$group", Value: bson.D{
+				{Key: "_id", Value: "$customFields." + field},
+				{Key: "issued", Value: bson.D{{Key: "$sum", Value: 1}}},
+				{Key: "scanned", Value: bson.D{{Key: "$sum", Value: scannedCond}}},
+			}}},
+			bson.D{{Key: "$sort", Value: bson.D{{Key: "issued", Value: -1}, {Key: "_id", Value: 1}}}},
+		}})
+	}
+
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: excludeTrashed(bson.M{"event": event.ID})}},
+		{{Key: "$facet", Value: facets}},
+	}
+
+	cursor, err := lib.Datastore.Db.Collection(ticketsColName).Aggregate(ctx, pipeline)
+	if err != nil {
+		return EventStats{}, err
+	}
+	defer cursor.Close(ctx)
+	if !cursor.Next(ctx) {
+		if err := cursor.Err(); err != nil {
+			return EventStats{}, err
+		}
+		return EventStats{}, fmt.Errorf("stats aggregation returned no results")
+	}
+
+	stats := EventStats{
+		EventID:      event.ID,
+		Interval:     interval.String(),
+		Admissions:   []AdmissionBucket{},
+		CustomFields: []CustomFieldBreakdown{},
+	}
+
+	var totals []eventStatsTotals
+	if err := cursor.Current.Lookup("totals").Unmarshal(&totals); err != nil {
+		return EventStats{}, err
+	}
+	if len(totals) == 1 {
+		stats.Issued = totals[0].Issued
+		stats.Scanned = totals[0].Scanned
+		stats.TotalScans = totals[0].TotalScans
+	}
+	stats.NoShows = stats.Issued - stats.Scanned
+	if stats.Issued > 0 {
+		stats.AttendanceRate = float64(stats.Scanned) / float64(stats.Issued)
+	}
+
+	if err := cursor.Current.Lookup("admissions").Unmarshal(&stats.Admissions); err != nil {
+		return EventStats{}, err
+	}
+	var cumulative int64
+	for i := range stats.Admissions {
+		cumulative += stats.Admissions[i].Count
+		stats.Admissions[i].Cumulative = cumulative
+	}
+
+	for i, field := range fields {
+		breakdown := CustomFieldBreakdown{
+			Field:       field,
+			DisplayName: schema.Properties[field].DisplayName,
+			Values:      []CustomFieldValueStats{},
+		}
+		if err := cursor.Current.Lookup(fmt.Sprintf("customField%d", i)).Unmarshal(&breakdown.Values); err != nil {
+			return EventStats{}, err
+		}
+		stats.CustomFields = append(stats.CustomFields, breakdown)
+	}
+
+	return stats, nil
+}
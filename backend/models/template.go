@@ -0,0 +1,220 @@
+package models
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/aritrosaha10/frasertickets/lib"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// EventTemplate is a named set of event settings (ex. the yearly Semi-Formal) that new draft
+// events can be made from, so the custom fields schema doesn't have to be re-entered every time.
+type EventTemplate struct {
+	ID                    primitive.ObjectID     `json:"id"                   bson:"_id,omitempty"`
+	Name                  string                 `json:"name"                 bson:"name"` // Unique, ex. Semi-Formal
+	Description           string                 `json:"description"          bson:"description"`
+	ImageURLs             []string               `json:"img_urls"             bson:"img_urls"`
+	Location              string                 `json:"location"             bson:"location"`
+	Address               string                 `json:"address"              bson:"address"`
+	DurationMinutes       int                    `json:"duration_minutes"     bson:"duration_minutes"`                                       // Default length of events made from it
+	OwnerEditCutoffBefore int                    `json:"owner_edit_cutoff_minutes_before" bson:"owner_edit_cutoff_minutes_before,omitempty"` // Minutes before the start that owners stop editing tickets, 0 means at the start
+	RawCustomFieldsSchema map[string]interface{} `json:"custom_fields_schema" bson:"custom_fields_schema"`
+	Audience              *EventAudience         `json:"audience,omitempty"   bson:"audience,omitempty"`
+	CreatedBy             string                 `json:"created_by"           bson:"created_by"`
+	Timestamp             time.Time              `json:"timestamp"            bson:"timestamp"`
+}
+
+func (template *EventTemplate) Render(w http.ResponseWriter, r *http.Request) error {
+	return nil
+}
+
+func CreateEventTemplateIndices(ctx context.Context) error {
+	// Templates are picked by name, so they need to be unique
+	nameIdxModel := mongo.IndexModel{
+		Keys:    bson.D{{Key: "name", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	}
+
+	// Try creating the index
+	opts := options.CreateIndexes().SetMaxTime(10 * time.Second)
+	_, err := lib.Datastore.Db.Collection(eventTemplatesColName).
+		Indexes().
+		CreateOne(ctx, nameIdxModel, opts)
+	return err
+}
+
+// EventTemplateFromEvent copies an event's settings into a new template.
+func EventTemplateFromEvent(event Event, name string) EventTemplate {
+	template := EventTemplate{
+		Name:                  name,
+		Description:           event.Description,
+		ImageURLs:             event.ImageURLs,
+		Location:              event.Location,
+		Address:               event.Address,
+		DurationMinutes:       int(event.EndTimestamp.Sub(event.StartTimestamp).Minutes()),
+		RawCustomFieldsSchema: event.RawCustomFieldsSchema,
+		Audience:              event.Audience,
+	}
+	if event.OwnerEditCutoff != nil && event.OwnerEditCutoff.Before(event.StartTimestamp) {
+		template.OwnerEditCutoffBefore = int(event.StartTimestamp.Sub(*event.OwnerEditCutoff).Minutes())
+	}
+	return template
+}
+
+// NewEvent makes a draft event from the template. If end is zero, the template's duration is used.
+func (template EventTemplate) NewEvent(name string, start time.Time, end time.Time) (Event, error) {
+	if end.IsZero() {
+		end = start.Add(time.Duration(template.DurationMinutes) * time.Minute)
+	}
+	if !start.Before(end) {
+		return Event{}, fmt.Errorf("%w: start timestamp is not before end timestamp", ErrInvalidEventTemplate)
+	}
+
+	event := Event{
+		Name:                  name,
+		Description:           template.Description,
+		ImageURLs:             template.ImageURLs,
+		Location:              template.Location,
+		Address:               template.Address,
+		StartTimestamp:        start,
+		EndTimestamp:          end,
+		RawCustomFieldsSchema: template.RawCustomFieldsSchema,
+		Audience:              template.Audience,
+		Draft:                 true,
+	}
+	if template.OwnerEditCutoffBefore > 0 {
+		cutoff := start.Add(-time.Duration(template.OwnerEditCutoffBefore) * time.Minute)
+		event.OwnerEditCutoff = &cutoff
+	}
+	return event, nil
+}
+
+func (template EventTemplate) validate() error {
+	if template.Name == "" {
+		return fmt.Errorf("%w: template name is required", ErrInvalidEventTemplate)
+	}
+	if template.DurationMinutes <= 0 {
+		return fmt.Errorf("%w: template duration must be at least a minute", ErrInvalidEventTemplate)
+	}
+	if template.OwnerEditCutoffBefore < 0 {
+		return fmt.Errorf("%w: owner edit cutoff can't be after the start", ErrInvalidEventTemplate)
+	}
+	if err := validateEventSettings(template.RawCustomFieldsSchema, template.Audience); err != nil {
+		return fmt.Errorf("%w: %s", ErrInvalidEventTemplate, err)
+	}
+	return nil
+}
+
+func GetEventTemplates(ctx context.Context) ([]EventTemplate, error) {
+	opts := options.Find().SetSort(bson.D{{Key: "name", Value: 1}})
+	cursor, err := lib.Datastore.Db.Collection(eventTemplatesColName).Find(ctx, bson.M{}, opts)
+	if err != nil {
+		return []EventTemplate{}, err
+	}
+
+	templates := []EventTemplate{}
+	if err := cursor.All(ctx, &templates); err != nil {
+		return []EventTemplate{}, err
+	}
+	return templates, nil
+}
+
+func GetEventTemplate(ctx context.Context, id primitive.ObjectID) (EventTemplate, error) {
+	var template EventTemplate
+	err := lib.Datastore.Db.Collection(eventTemplatesColName).FindOne(ctx, bson.M{"_id": id}).Decode(&template)
+	if err == mongo.ErrNoDocuments {
+		return EventTemplate{}, ErrNotFound
+	}
+	return template, err
+}
+
+func CreateEventTemplate(ctx context.Context, template EventTemplate) (primitive.ObjectID, error) {
+	if err := template.validate(); err != nil {
+		return primitive.NilObjectID, err
+	}
+	template.ID = primitive.NilObjectID
+	template.Timestamp = time.Now()
+
+	res, err := lib.Datastore.Db.Collection(eventTemplatesColName).InsertOne(ctx, template)
+	if mongo.IsDuplicateKeyError(err) {
+		return primitive.NilObjectID, ErrAlreadyExists
+	} else if err != nil {
+		return primitive.NilObjectID, err
+	}
+	return res.InsertedID.(primitive.ObjectID), nil
+}
+
+// ReplaceEventTemplate overwrites a template's settings, keeping who made it and when.
+func ReplaceEventTemplate(ctx context.Context, id primitive.ObjectID, template EventTemplate) (EventTemplate, error) {
+	if err := template.validate(); err != nil {
+		return EventTemplate{}, err
+	}
+
+	existing, err := GetEventTemplate(ctx, id)
+	if err != nil {
+		return EventTemplate{}, err
+	}
+	template.ID = id
+	template.CreatedBy = existing.CreatedBy
+	template.Timestamp = existing.Timestamp
+
+	res, err := lib.Datastore.Db.Collection(eventTemplatesColName).ReplaceOne(ctx, bson.M{"_id": id}, template)
+	if mongo.IsDuplicateKeyError(err) {
+		return EventTemplate{}, ErrAlreadyExists
+	} else if err != nil {
+		return EventTemplate{}, err
+	}
+	if res.MatchedCount == 0 {
+		return EventTemplate{}, ErrNotFound
+	}
+	return template, nil
+}
+
+func DeleteEventTemplate(ctx context.Context, id primitive.ObjectID) error {
+	res, err := lib.Datastore.Db.Collection(eventTemplatesColName).DeleteOne(ctx, bson.M{"_id": id})
+	if err == nil && res.DeletedCount == 0 {
+		err = ErrNotFound
+	}
+	return err
+}
+
+// CloneEvent copies an event's details, images, audience and custom fields schema into a new draft
+// event, with every date moved so the new event starts at the given time. Tickets aren't copied.
+func CloneEvent(ctx context.Context, id primitive.ObjectID, name string, start time.Time) (Event, error) {
+	original, err := GetEvent(ctx, bson.M{"_id": id})
+	if err == mongo.ErrNoDocuments {
+		return Event{}, ErrNotFound
+	} else if err != nil {
+		return Event{}, err
+	}
+
+	shift := start.Sub(original.StartTimestamp)
+	clone := Event{
+		Name:                  name,
+		Description:           original.Description,
+		ImageURLs:             original.ImageURLs,
+		Location:              original.Location,
+		Address:               original.Address,
+		StartTimestamp:        original.StartTimestamp.Add(shift),
+		EndTimestamp:          original.EndTimestamp.Add(shift),
+		RawCustomFieldsSchema: original.RawCustomFieldsSchema,
+		Audience:              original.Audience,
+		Draft:                 true,
+	}
+	if original.OwnerEditCutoff != nil {
+		cutoff := original.OwnerEditCutoff.Add(shift)
+		clone.OwnerEditCutoff = &cutoff
+	}
+
+	clone.ID, err = CreateNewEvent(ctx, clone)
+	if err != nil {
+		return Event{}, err
+	}
+	return clone, nil
+}
@@ -2,7 +2,6 @@ package models
 
 import (
 	"context"
-	"fmt"
 	"net/http"
 	"time"
 
@@ -15,16 +14,22 @@ import (
 )
 
 type Ticket struct {
-	ID                primitive.ObjectID     `json:"id"        bson:"_id,omitempty"`
-	Owner             string                 `json:"ownerID"   bson:"owner"` // owner ID
-	OwnerData         User                   `json:"ownerData" bson:"ownerData"`
-	Event             primitive.ObjectID     `json:"eventID"   bson:"event"`
-	EventData         Event                  `json:"eventData" bson:"eventData"`
-	Timestamp         time.Time              `json:"timestamp" bson:"timestamp"`
-	ScanCount         int                    `json:"scanCount" bson:"scanCount"`
-	LastScanTimestamp time.Time              `json:"lastScanTime" bson:"lastScanTime"`
-	MaxScanCount      int                    `json:"maxScanCount" bson:"maxScanCount"`
-	CustomFields      map[string]interface{} `json:"customFields" bson:"customFields"`
+	ID                 primitive.ObjectID     `json:"id"        bson:"_id,omitempty"`
+	Owner              string                 `json:"ownerID"   bson:"owner"` // owner ID
+	OwnerData          User                   `json:"ownerData" bson:"ownerData"`
+	Event              primitive.ObjectID     `json:"eventID"   bson:"event"`
+	EventData          Event                  `json:"eventData" bson:"eventData"`
+	Timestamp          time.Time              `json:"timestamp" bson:"timestamp"`
+	ScanCount          int                    `json:"scanCount" bson:"scanCount"`
+	FirstScanTimestamp *time.Time             `json:"firstScanTime,omitempty" bson:"firstScanTime,omitempty"`
+	LastScanTimestamp  time.Time              `json:"lastScanTime" bson:"lastScanTime"`
+	MaxScanCount       int                    `json:"maxScanCount" bson:"maxScanCount"`
+	CustomFields       map[string]interface{} `json:"customFields" bson:"customFields"`
+	Version            int                    `json:"version" bson:"version"`                                         // bumped on every update, sent as the ETag
+	DeletedAt          *time.Time             `json:"deletedAt,omitempty" bson:"deleted_at,omitempty"`                // set while the ticket is in the trash
+	DeletedBy          string                 `json:"deletedBy,omitempty" bson:"deleted_by,omitempty"`                // UID of whoever trashed it
+	TrashedWithEvent   bool                   `json:"trashedWithEvent,omitempty" bson:"trashed_with_event,omitempty"` // comes back when the event is restored
+	WalletIssuedAt     *time.Time             `json:"walletIssuedAt,omitempty" bson:"wallet_issued_at,omitempty"`     // last time a google wallet pass was issued, so changes get synced to it
 }
 
 func (ticket *Ticket) Render(w http.ResponseWriter, r *http.Request) error {
@@ -44,6 +49,29 @@ func (scan *TicketScan) Render(w http.ResponseWriter, r *http.Request) error {
 	return nil
 }
 
+// BulkTicketResult is the outcome of a single operation within a bulk ticket request.
+type BulkTicketResult struct {
+	Operation string `json:"operation"` // create, update or delete
+	Index     int    `json:"index"`     // index of the operation within its list in the request
+	TicketID  string `json:"ticketID,omitempty"`
+	Success   bool   `json:"success"`
+	Error     string `json:"error,omitempty"`
+
+	Code    int64            `json:"code,omitempty"`    // app code of the error, same as in error responses
+	Details []util.ErrDetail `json:"details,omitempty"` // the fields that caused the error, if known
+}
+
+// BulkTicketResponse holds the outcome of every operation in a bulk ticket request.
+type BulkTicketResponse struct {
+	Atomic    bool               `json:"atomic"`
+	Committed bool               `json:"committed"` // whether any changes were actually saved
+	Results   []BulkTicketResult `json:"results"`
+}
+
+func (res *BulkTicketResponse) Render(w http.ResponseWriter, r *http.Request) error {
+	return nil
+}
+
 func CreateTicketIndices(ctx context.Context) error {
 	// Create appropriate indices
 	eventOwnerPairIdxModel := mongo.IndexModel{
@@ -80,11 +108,35 @@ func CreateTicketIndices(ctx context.Context) error {
 	return err
 }
 
-func GetTickets(ctx context.Context, filter bson.M) ([]Ticket, error) {
-	pipeline := mongo.Pipeline{
-		{
-			{Key: "$match", Value: filter},
-		},
+// TicketListSpec is what lists of tickets can be sorted and filtered by.
+var TicketListSpec = ListSpec{
+	SortFields: map[string]string{
+		"id":            "_id",
+		"timestamp":     "timestamp",
+		"scanCount":     "scanCount",
+		"firstScanTime": "firstScanTime",
+		"lastScanTime":  "lastScanTime",
+		"maxScanCount":  "maxScanCount",
+	},
+	FilterFields: map[string]FilterField{
+		"eventId":       {Field: "event", Type: FilterTypeObjectID},
+		"ownerId":       {Field: "owner", Type: FilterTypeString},
+		"timestamp":     {Field: "timestamp", Type: FilterTypeTime},
+		"scanCount":     {Field: "scanCount", Type: FilterTypeInt},
+		"firstScanTime": {Field: "firstScanTime", Type: FilterTypeTime},
+		"lastScanTime":  {Field: "lastScanTime", Type: FilterTypeTime},
+		"maxScanCount":  {Field: "maxScanCount", Type: FilterTypeInt},
+	},
+	CustomFieldsPrefix: "customFields",
+}
+
+// ticketLookupStages joins the event and owner data onto tickets.
+func ticketLookupStages() mongo.Pipeline {
+	return append(ticketEventLookupStages(), ticketOwnerLookupStages()...)
+}
+
+func ticketEventLookupStages() mongo.Pipeline {
+	return mongo.Pipeline{
 		{
 			{Key: "$lookup", Value: bson.D{
 				{Key: "from", Value: "events"},
@@ -97,6 +149,11 @@ func GetTickets(ctx context.Context, filter bson.M) ([]Ticket, error) {
 		{
 			{Key: "$unwind", Value: "$eventData"},
 		},
+	}
+}
+
+func ticketOwnerLookupStages() mongo.Pipeline {
+	return mongo.Pipeline{
 		{
 			{Key: "$lookup", Value: bson.D{
 				{Key: "from", Value: "users"},
@@ -110,6 +167,14 @@ func GetTickets(ctx context.Context, filter bson.M) ([]Ticket, error) {
 			{Key: "$unwind", Value: "$ownerData"},
 		},
 	}
+}
+
+func GetTickets(ctx context.Context, filter bson.M) ([]Ticket, error) {
+	pipeline := append(mongo.Pipeline{
+		{
+			{Key: "$match", Value: excludeTrashed(filter)},
+		},
+	}, ticketLookupStages()...)
 
 	// Try to get data from MongoDB
 	cursor, err := lib.Datastore.Db.Collection(ticketsColName).Aggregate(ctx, pipeline)
@@ -127,9 +192,14 @@ func GetTickets(ctx context.Context, filter bson.M) ([]Ticket, error) {
 	return tickets, nil
 }
 
+// GetTicketsPage returns a single page of tickets, with event and owner data only looked up for that page.
+func GetTicketsPage(ctx context.Context, filter bson.M, page PageOptions) ([]Ticket, PageInfo, error) {
+	return aggregatePage[Ticket](ctx, lib.Datastore.Db.Collection(ticketsColName), excludeTrashed(filter), page, ticketLookupStages())
+}
+
 func GetTicketCount(ctx context.Context, filter bson.M) (int64, error) {
 	// Try to get data from MongoDB
-	count, err := lib.Datastore.Db.Collection(ticketsColName).CountDocuments(ctx, filter)
+	count, err := lib.Datastore.Db.Collection(ticketsColName).CountDocuments(ctx, excludeTrashed(filter))
 	if err != nil {
 		return -1, err
 	}
@@ -137,6 +207,22 @@ func GetTicketCount(ctx context.Context, filter bson.M) (int64, error) {
 	return count, nil
 }
 
+// Scanned reports whether the ticket has been used to get in at least once. Aggregations use
+// ticketScannedExpr for the same check.
+func (ticket Ticket) Scanned() bool {
+	return ticket.ScanCount > 0
+}
+
+// ticketScannedExpr is the aggregation expression version of Ticket.Scanned.
+func ticketScannedExpr() bson.D {
+	return bson.D{{Key: "$gt", Value: bson.A{"$scanCount", 0}}}
+}
+
+// ticketScannedCountExpr is 1 for scanned tickets and 0 otherwise, for adding up with $sum.
+func ticketScannedCountExpr() bson.D {
+	return bson.D{{Key: "$cond", Value: bson.A{ticketScannedExpr(), 1, 0}}}
+}
+
 func SearchForTicket(
 	ctx context.Context,
 	eventID primitive.ObjectID,
@@ -144,7 +230,7 @@ func SearchForTicket(
 ) (Ticket, error) {
 	pipeline := mongo.Pipeline{
 		{
-			{Key: "$match", Value: bson.M{"event": eventID, "owner": userID}},
+			{Key: "$match", Value: excludeTrashed(bson.M{"event": eventID, "owner": userID})},
 		},
 		{
 			{Key: "$lookup", Value: bson.D{
@@ -196,7 +282,7 @@ func SearchForTicket(
 func GetTicket(ctx context.Context, id primitive.ObjectID) (Ticket, error) {
 	pipeline := mongo.Pipeline{
 		{
-			{Key: "$match", Value: bson.M{"_id": id}},
+			{Key: "$match", Value: excludeTrashed(bson.M{"_id": id})},
 		},
 		{
 			{Key: "$lookup", Value: bson.D{
@@ -247,7 +333,7 @@ func GetTicket(ctx context.Context, id primitive.ObjectID) (Ticket, error) {
 
 func CheckIfTicketExists(ctx context.Context, filter bson.M) (bool, error) {
 	// Directly return results from DB
-	count, err := lib.Datastore.Db.Collection(ticketsColName).CountDocuments(ctx, filter)
+	count, err := lib.Datastore.Db.Collection(ticketsColName).CountDocuments(ctx, excludeTrashed(filter))
 	return count == 1, err
 }
 
@@ -270,64 +356,95 @@ func CreateNewTicket(ctx context.Context, ticket Ticket) (primitive.ObjectID, er
 	}
 
 	// Check if user exists
-	userExists, err := CheckIfUserExists(ctx, ticket.Owner)
-	if err != nil {
+	user, err := GetUserByKey(ctx, "_id", ticket.Owner)
+	if err == mongo.ErrNoDocuments {
+		return primitive.NilObjectID, ErrNotFound
+	} else if err != nil {
 		return primitive.NilObjectID, err
 	}
-	if !userExists {
-		return primitive.NilObjectID, ErrNotFound
+
+	// Accounts held by the identity policy don't get anything until they're approved
+	if user.PendingApproval {
+		return primitive.NilObjectID, notEligible("pendingApproval", "user is still waiting to be approved")
 	}
 
-	// Check if ticket's custom data matches schema
-	valid, schemaErrs, err := ValidateCustomEventFields(ctx, event, ticket.CustomFields)
-	if err != nil {
+	// Check if user is part of the event's audience
+	if err := event.Audience.CheckEligibility(user); err != nil {
 		return primitive.NilObjectID, err
 	}
-	if !valid {
-		errStr := ""
-		for _, schemaErr := range schemaErrs {
-			errStr += schemaErr.String() + "\n"
+
+	// Defaults and auto-numbered fields are filled in within the same transaction as the insert so
+	// that numbers only get used up by tickets that are actually saved
+	res, err := lib.Datastore.WithTransaction(ctx, func(sessCtx mongo.SessionContext) (interface{}, error) {
+		customFields, err := applyCustomFieldDefaults(event, ticket.CustomFields)
+		if err != nil {
+			return nil, err
+		}
+		customFields, err = assignAutoNumbers(sessCtx, event, customFields)
+		if err != nil {
+			return nil, err
+		}
+		ticket.CustomFields = customFields
+
+		// Check if ticket's custom data matches schema
+		valid, schemaErrs, err := ValidateCustomEventFields(sessCtx, event, ticket.CustomFields)
+		if err != nil {
+			return nil, err
+		}
+		if !valid {
+			return nil, &util.ValidationError{
+				Err:     ErrInvalidCustomFields,
+				AppCode: util.AppCodeInvalidCustomFields,
+				Details: customFieldsErrDetails(schemaErrs),
+			}
 		}
-		return primitive.NilObjectID, fmt.Errorf(errStr)
-	}
 
-	// Try to add ticket
-	res, err := lib.Datastore.Db.Collection(ticketsColName).InsertOne(ctx, ticket)
+		// Try to add ticket
+		insertRes, err := lib.Datastore.Db.Collection(ticketsColName).InsertOne(sessCtx, ticket)
+		if err != nil {
+			return nil, err
+		}
+		return insertRes.InsertedID, nil
+	})
 	if err != nil {
 		return primitive.NilObjectID, err
 	}
 
 	// Return object ID
-	return res.InsertedID.(primitive.ObjectID), err
+	return res.(primitive.ObjectID), nil
 }
 
+// UpdateExistingTicketByKeys updates a ticket's scan data or admin editable custom fields, and
+// returns its new version.
 func UpdateExistingTicketByKeys(
 	ctx context.Context,
 	id primitive.ObjectID,
 	updates map[string]interface{},
-) error {
+	meta UpdateMeta,
+) (int, error) {
 	// TODO: Somehow enforce schema during these updates
 	UPDATABLE_KEYS := map[string]bool{
-		"scanCount":    true,
-		"lastScanTime": true,
-		"maxScanCount": true,
+		"scanCount":     true,
+		"firstScanTime": true,
+		"lastScanTime":  true,
+		"maxScanCount":  true,
 	}
 	CUSTOM_UPDATABLE_KEYS := map[string]bool{}
 
 	// TODO: Enforce optional data schema
 	ticket, err := GetTicket(ctx, id)
 	if err != nil {
-		return err
+		return 0, err
 	}
 
 	// Convert schema to struct format
 	customFieldSchema, err := util.ConvertRawCustomFieldsSchema(ticket.EventData.RawCustomFieldsSchema)
 	if err != nil {
-		return err
+		return 0, err
 	}
 	// Add all the new properties
 	for key, property := range customFieldSchema.Properties {
-		if property.Editable {
+		if property.Editable && !property.AutoNumber {
 			CUSTOM_UPDATABLE_KEYS[key] = true
 		}
 	}
@@ -339,11 +456,20 @@ func UpdateExistingTicketByKeys(
 		// Don't allow other keys to be updated
 		if !UPDATABLE_KEYS[key] {
 			if CUSTOM_UPDATABLE_KEYS[key] {
-				// TODO: Validate this value against the schema, already done in frontend but best to keep backup
+				// Check the value against the schema too, already done in frontend but best to keep backup
+				if err := util.CheckCustomFieldValue(customFieldSchema.Properties[key], val); err != nil {
+					return 0, util.NewValidationError(
+						ErrInvalidCustomFields,
+						util.AppCodeInvalidCustomFields,
+						"customFields."+key,
+						"schema",
+						err.Error(),
+					)
+				}
 				// Adjust key so that it updates under customFields object
 				tmpKey = "customFields." + key
 			} else {
-				return ErrEditNotAllowed
+				return 0, util.NewValidationError(ErrEditNotAllowed, util.AppCodeEditNotAllowed, key, "editable", "field can't be updated")
 			}
 		}
 
@@ -352,32 +478,194 @@ func UpdateExistingTicketByKeys(
 	}
 
 	// Try to update document in DB
-	res, err := lib.Datastore.Db.Collection(ticketsColName).
-		UpdateByID(ctx, id, bson.D{{Key: "$set", Value: bsonUpdates}})
+	version, err := updateVersionedDocument(ctx, ticketsColName, ChangeDocumentTicket, id, id.Hex(), bsonUpdates, meta)
 	if err != nil {
-		return err
+		return 0, err
 	}
-	if res.ModifiedCount == 0 {
-		return ErrNoDocumentModified
+
+	// Scans can use up a ticket, which shows on its pass
+	_, scanned := updates["scanCount"]
+	_, limitChanged := updates["maxScanCount"]
+	if scanned || limitChanged {
+		if err := queueWalletSync(ctx, WalletSyncKindTicket, id); err != nil {
+			return 0, err
+		}
 	}
-	return nil
+	return version, nil
 }
 
-func DeleteTicket(ctx context.Context, id primitive.ObjectID) error {
-	// Delete ticket
-	res, err := lib.Datastore.Db.Collection(ticketsColName).DeleteOne(ctx, bson.M{"_id": id})
+// Scans are retried this many times if the ticket keeps changing underneath them
+const maxScanAttempts = 3
+
+// ScanTicket records a scan of a ticket, unless it has used up all of its scans. Each scan is only
+// saved if the ticket wasn't changed since it was read, so concurrent scans at different doors each
+// get their own index and can't go over the limit. The returned scan isn't processed if the limit
+// was reached. ErrVersionMismatch is returned if the ticket kept changing.
+func ScanTicket(ctx context.Context, id primitive.ObjectID, scannedBy string) (TicketScan, error) {
+	for attempt := 0; attempt < maxScanAttempts; attempt++ {
+		ticket, err := GetTicket(ctx, id)
+		if err != nil {
+			return TicketScan{}, err
+		}
+		owner, err := GetUserByKey(ctx, "_id", ticket.Owner)
+		if err != nil {
+			return TicketScan{}, err
+		}
+
+		scan := TicketScan{
+			Index:      ticket.ScanCount + 1,
+			Timestamp:  time.Now(),
+			TicketData: ticket,
+			UserData:   owner,
+			Processed:  true,
+		}
+
+		// Max scan count of 0 means unlimited, otherwise show the previous scan
+		if ticket.MaxScanCount != 0 && scan.Index > ticket.MaxScanCount {
+			scan.Index = ticket.ScanCount
+			scan.Timestamp = ticket.LastScanTimestamp
+			scan.Processed = false
+			scan.NoProcessReason = "max scan count exceeded"
+			return scan, nil
+		}
+
+		updates := map[string]interface{}{
+			"lastScanTime": scan.Timestamp,
+			"scanCount":    scan.Index,
+		}
+		// Keep track of when the holder was first admitted for attendance stats
+		if scan.Index == 1 {
+			updates["firstScanTime"] = scan.Timestamp
+		}
+		version, err := UpdateExistingTicketByKeys(ctx, id, updates, UpdateMeta{
+			ChangedBy:       scannedBy,
+			ExpectedVersion: &ticket.Version,
+		})
+		if err == ErrVersionMismatch {
+			continue
+		} else if err != nil {
+			return TicketScan{}, err
+		}
+
+		scan.TicketData.ScanCount = scan.Index
+		scan.TicketData.LastScanTimestamp = scan.Timestamp
+		if scan.Index == 1 {
+			scan.TicketData.FirstScanTimestamp = &scan.Timestamp
+		}
+		scan.TicketData.Version = version
+		return scan, nil
+	}
+
+	return TicketScan{}, ErrVersionMismatch
+}
+
+// UpdateTicketOwnerFields lets a ticket's owner change the custom fields marked as owner editable,
+// up until the event's owner edit deadline. The new values are checked against the whole schema,
+// and what they used to be is saved to the change history.
+func UpdateTicketOwnerFields(
+	ctx context.Context,
+	id primitive.ObjectID,
+	ownerUID string,
+	updates map[string]interface{},
+	expectedVersion *int,
+) (Ticket, error) {
+	res, err := lib.Datastore.WithTransaction(ctx, func(sessCtx mongo.SessionContext) (interface{}, error) {
+		ticket, err := GetTicket(sessCtx, id)
+		if err == mongo.ErrNoDocuments || (err == nil && (ticket.Owner != ownerUID || ticket.EventData.Draft)) {
+			return nil, ErrNotFound // Other people's tickets and tickets for unpublished events are treated as missing
+		} else if err != nil {
+			return nil, err
+		}
+
+		if time.Now().After(ticket.EventData.OwnerEditDeadline()) {
+			return nil, &util.ValidationError{Err: ErrEditCutoffPassed, AppCode: util.AppCodeEditClosed}
+		}
+
+		schema := util.CustomFieldsSchema{}
+		if len(ticket.EventData.RawCustomFieldsSchema) != 0 {
+			schema, err = util.ConvertRawCustomFieldsSchema(ticket.EventData.RawCustomFieldsSchema)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		// Check every field is allowed before looking at any values
+		validationErr := &util.ValidationError{Err: ErrEditNotAllowed, AppCode: util.AppCodeEditNotAllowed}
+		for key := range updates {
+			if property, ok := schema.Properties[key]; !ok || !property.OwnerEditable {
+				validationErr.Details = append(validationErr.Details, util.ErrDetail{
+					Field:   "customFields." + key,
+					Rule:    "ownerEditable",
+					Message: "field can't be changed by the ticket owner",
+				})
+			}
+		}
+		if len(validationErr.Details) > 0 {
+			return nil, validationErr
+		}
+
+		// Validate the ticket as a whole, since ex. required fields can't be cleared
+		customFields := map[string]interface{}{}
+		for key, val := range ticket.CustomFields {
+			customFields[key] = val
+		}
+		bsonUpdates := bson.D{}
+		for key, val := range updates {
+			bsonUpdates = append(bsonUpdates, bson.E{Key: "customFields." + key, Value: val})
+			customFields[key] = val
+		}
+
+		valid, schemaErrs, err := ValidateCustomEventFields(sessCtx, ticket.EventData, customFields)
+		if err != nil {
+			return nil, err
+		}
+		if !valid {
+			return nil, &util.ValidationError{
+				Err:     ErrInvalidCustomFields,
+				AppCode: util.AppCodeInvalidCustomFields,
+				Details: customFieldsErrDetails(schemaErrs),
+			}
+		}
+
+		ticket.Version, err = updateVersionedDocument(sessCtx, ticketsColName, ChangeDocumentTicket, id, id.Hex(), bsonUpdates, UpdateMeta{
+			ChangedBy:       ownerUID,
+			ByOwner:         true,
+			ExpectedVersion: expectedVersion,
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		ticket.CustomFields = customFields
+		return ticket, nil
+	})
+	if err != nil {
+		return Ticket{}, err
+	}
+
+	return res.(Ticket), nil
+}
+
+// DeleteTicket moves a ticket to the trash. It can be restored until the trash retention period
+// is over, at which point it is purged for good.
+func DeleteTicket(ctx context.Context, id primitive.ObjectID, deletedBy string) error {
+	// Trash ticket
+	res, err := lib.Datastore.Db.Collection(ticketsColName).UpdateOne(
+		ctx,
+		excludeTrashed(bson.M{"_id": id}),
+		bson.D{{Key: "$set", Value: bson.D{
+			{Key: "deleted_at", Value: time.Now()},
+			{Key: "deleted_by", Value: deletedBy},
+		}}},
+	)
 
 	// Handle no document found
 	if err == nil {
-		if res.DeletedCount == 0 {
+		if res.MatchedCount == 0 {
 			err = ErrNoDocumentModified
+		} else {
+			err = queueWalletSync(ctx, WalletSyncKindTicket, id)
 		}
 	}
 	return err
 }
-
-func DeleteAllTicketsForEvent(ctx context.Context, eventID primitive.ObjectID) error {
-	// Delete all tickets to event
-	_, err := lib.Datastore.Db.Collection(ticketsColName).DeleteMany(ctx, bson.M{"event": eventID})
-	return err
-}
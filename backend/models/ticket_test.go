@@ -0,0 +1,105 @@
+package models
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+func createScanTestTicket(t *testing.T, maxScanCount int) Ticket {
+	t.Helper()
+	ctx := context.Background()
+
+	eventID, err := CreateNewEvent(ctx, Event{
+		Name:           "Dance",
+		StartTimestamp: time.Now().Add(time.Hour),
+		EndTimestamp:   time.Now().Add(2 * time.Hour),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := CreateNewUser(ctx, User{ID: "holder", FullName: "Holder"}); err != nil {
+		t.Fatal(err)
+	}
+	id, err := CreateNewTicket(ctx, Ticket{Owner: "holder", Event: eventID, Timestamp: time.Now(), MaxScanCount: maxScanCount})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ticket, err := GetTicket(ctx, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ticket
+}
+
+func TestScanTicketStopsAtLimit(t *testing.T) {
+	setupTestDatastore(t)
+	ticket := createScanTestTicket(t, 1)
+
+	scan, err := ScanTicket(context.Background(), ticket.ID, "scanner")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !scan.Processed || scan.Index != 1 || scan.TicketData.ScanCount != 1 {
+		t.Errorf("expected the first scan to be processed, got %+v", scan)
+	}
+
+	scan, err = ScanTicket(context.Background(), ticket.ID, "scanner")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if scan.Processed || scan.Index != 1 {
+		t.Errorf("expected the second scan to be refused, got %+v", scan)
+	}
+}
+
+func TestScanTicketConcurrently(t *testing.T) {
+	setupTestDatastore(t)
+	ctx := context.Background()
+	const scanners = 5
+	ticket := createScanTestTicket(t, 2)
+
+	var (
+		wg        sync.WaitGroup
+		mu        sync.Mutex
+		processed []int
+	)
+	for i := 0; i < scanners; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			scan, err := ScanTicket(ctx, ticket.ID, "scanner")
+			if err == ErrVersionMismatch {
+				return // Gave up after too many conflicts, which is fine as long as nothing was saved
+			} else if err != nil {
+				t.Error(err)
+				return
+			}
+			if scan.Processed {
+				mu.Lock()
+				processed = append(processed, scan.Index)
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	saved, err := GetTicket(ctx, ticket.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if saved.ScanCount > 2 {
+		t.Errorf("expected the scan limit of 2 to hold, got %d scans", saved.ScanCount)
+	}
+	if saved.ScanCount != len(processed) {
+		t.Errorf("expected %d processed scans to match the saved count %d", len(processed), saved.ScanCount)
+	}
+	seen := map[int]bool{}
+	for _, index := range processed {
+		if seen[index] {
+			t.Errorf("scan index %d was handed out twice: %v", index, processed)
+		}
+		seen[index] = true
+	}
+}
@@ -0,0 +1,275 @@
+package models
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/aritrosaha10/frasertickets/lib"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Trash lists everything that has been deleted but not purged yet.
+type Trash struct {
+	Events  []TrashedEvent `json:"events"`
+	Tickets []Ticket       `json:"tickets"` // only tickets trashed on their own, the rest come back with their event
+}
+
+func (trash *Trash) Render(w http.ResponseWriter, r *http.Request) error {
+	return nil
+}
+
+// TrashedEvent is an event in the trash, along with how much would come back if it's restored.
+type TrashedEvent struct {
+	Event
+	TicketCount       int64 `json:"ticket_count"`
+	QueuedTicketCount int64 `json:"queued_ticket_count"`
+}
+
+// RestoreResult counts what came back out of the trash.
+type RestoreResult struct {
+	EventsRestored        int64 `json:"events_restored"`
+	TicketsRestored       int64 `json:"tickets_restored"`
+	QueuedTicketsRestored int64 `json:"queued_tickets_restored"`
+}
+
+func (res *RestoreResult) Render(w http.ResponseWriter, r *http.Request) error {
+	return nil
+}
+
+// PurgeResult counts what was permanently removed from the trash.
+type PurgeResult struct {
+	EventsPurged        int64 `json:"events_purged"`
+	TicketsPurged       int64 `json:"tickets_purged"`
+	QueuedTicketsPurged int64 `json:"queued_tickets_purged"`
+}
+
+// excludeTrashed restricts a filter to documents that aren't in the trash.
+func excludeTrashed(filter bson.M) bson.M {
+	notTrashed := bson.M{"deleted_at": bson.M{"$exists": false}}
+	if len(filter) == 0 {
+		return notTrashed
+	}
+	return bson.M{"$and": bson.A{filter, notTrashed}}
+}
+
+// onlyTrashed restricts a filter to documents that are in the trash.
+func onlyTrashed(filter bson.M) bson.M {
+	trashed := bson.M{"deleted_at": bson.M{"$exists": true}}
+	if len(filter) == 0 {
+		return trashed
+	}
+	return bson.M{"$and": bson.A{filter, trashed}}
+}
+
+var untrashUpdate = bson.D{{Key: "$unset", Value: bson.D{
+	{Key: "deleted_at", Value: ""},
+	{Key: "deleted_by", Value: ""},
+	{Key: "trashed_with_event", Value: ""},
+}}}
+
+// GetTrash lists trashed events and tickets, most recently trashed first.
+func GetTrash(ctx context.Context) (Trash, error) {
+	trash := Trash{Events: []TrashedEvent{}, Tickets: []Ticket{}}
+
+	opts := options.Find().SetSort(bson.D{{Key: "deleted_at", Value: -1}})
+	cursor, err := lib.Datastore.Db.Collection(eventsColName).Find(ctx, onlyTrashed(bson.M{}), opts)
+	if err != nil {
+		return Trash{}, err
+	}
+	events := []Event{}
+	if err := cursor.All(ctx, &events); err != nil {
+		return Trash{}, err
+	}
+	for _, event := range events {
+		trashedEvent := TrashedEvent{Event: event}
+		trashedEvent.TicketCount, err = lib.Datastore.Db.Collection(ticketsColName).
+			CountDocuments(ctx, bson.M{"event": event.ID, "trashed_with_event": true})
+		if err != nil {
+			return Trash{}, err
+		}
+		trashedEvent.QueuedTicketCount, err = lib.Datastore.Db.Collection(queuedTicketsColName).
+			CountDocuments(ctx, bson.M{"event_id": event.ID, "trashed_with_event": true})
+		if err != nil {
+			return Trash{}, err
+		}
+
+		trash.Events = append(trash.Events, trashedEvent)
+	}
+
+	pipeline := append(mongo.Pipeline{
+		{{Key: "$match", Value: onlyTrashed(bson.M{"trashed_with_event": bson.M{"$ne": true}})}},
+		{{Key: "$sort", Value: bson.D{{Key: "deleted_at", Value: -1}}}},
+	}, ticketLookupStages()...)
+	cursor, err = lib.Datastore.Db.Collection(ticketsColName).Aggregate(ctx, pipeline)
+	if err != nil {
+		return Trash{}, err
+	}
+	if err := cursor.All(ctx, &trash.Tickets); err != nil {
+		return Trash{}, err
+	}
+
+	return trash, nil
+}
+
+// RestoreEvent takes an event out of the trash, along with the tickets and queued tickets that were
+// trashed with it. Tickets that were trashed on their own before the event stay in the trash.
+func RestoreEvent(ctx context.Context, id primitive.ObjectID) (RestoreResult, error) {
+	res, err := lib.Datastore.WithTransaction(ctx, func(sessCtx mongo.SessionContext) (interface{}, error) {
+		result := RestoreResult{}
+
+		eventRes, err := lib.Datastore.Db.Collection(eventsColName).UpdateOne(sessCtx, onlyTrashed(bson.M{"_id": id}), untrashUpdate)
+		if err != nil {
+			return nil, err
+		}
+		if eventRes.MatchedCount == 0 {
+			return nil, ErrNotFound
+		}
+		result.EventsRestored = eventRes.ModifiedCount
+
+		ticketsRes, err := lib.Datastore.Db.Collection(ticketsColName).UpdateMany(
+			sessCtx,
+			onlyTrashed(bson.M{"event": id, "trashed_with_event": true}),
+			untrashUpdate,
+		)
+		if err != nil {
+			return nil, err
+		}
+		result.TicketsRestored = ticketsRes.ModifiedCount
+
+		queuedTicketsRes, err := lib.Datastore.Db.Collection(queuedTicketsColName).UpdateMany(
+			sessCtx,
+			onlyTrashed(bson.M{"event_id": id, "trashed_with_event": true}),
+			untrashUpdate,
+		)
+		if err != nil {
+			return nil, err
+		}
+		result.QueuedTicketsRestored = queuedTicketsRes.ModifiedCount
+
+		return result, nil
+	})
+	if err != nil {
+		return RestoreResult{}, err
+	}
+
+	if err := queueWalletSync(ctx, WalletSyncKindEvent, id); err != nil {
+		return RestoreResult{}, err
+	}
+	return res.(RestoreResult), nil
+}
+
+// RestoreTicket takes a ticket out of the trash. Tickets trashed with their event can only come back
+// with the event, and a ticket can't be restored if its owner has since been given a new one.
+func RestoreTicket(ctx context.Context, id primitive.ObjectID) (RestoreResult, error) {
+	res, err := lib.Datastore.WithTransaction(ctx, func(sessCtx mongo.SessionContext) (interface{}, error) {
+		var ticket Ticket
+		err := lib.Datastore.Db.Collection(ticketsColName).FindOne(sessCtx, onlyTrashed(bson.M{"_id": id})).Decode(&ticket)
+		if err == mongo.ErrNoDocuments {
+			return nil, ErrNotFound
+		} else if err != nil {
+			return nil, err
+		}
+
+		eventExists, err := CheckIfEventExists(sessCtx, ticket.Event)
+		if err != nil {
+			return nil, err
+		}
+		if ticket.TrashedWithEvent || !eventExists {
+			return nil, ErrEventTrashed
+		}
+
+		duplicateExists, err := CheckIfTicketExists(sessCtx, bson.M{"event": ticket.Event, "owner": ticket.Owner})
+		if err != nil {
+			return nil, err
+		}
+		if duplicateExists {
+			return nil, ErrAlreadyExists
+		}
+
+		ticketRes, err := lib.Datastore.Db.Collection(ticketsColName).UpdateOne(sessCtx, onlyTrashed(bson.M{"_id": id}), untrashUpdate)
+		if err != nil {
+			return nil, err
+		}
+		return RestoreResult{TicketsRestored: ticketRes.ModifiedCount}, nil
+	})
+	if err != nil {
+		return RestoreResult{}, err
+	}
+
+	if err := queueWalletSync(ctx, WalletSyncKindTicket, id); err != nil {
+		return RestoreResult{}, err
+	}
+	return res.(RestoreResult), nil
+}
+
+// PurgeTrash permanently deletes everything that was trashed before the given time. Purging an event
+// also deletes all of its tickets, queued tickets, coat racks, coat checks and counters.
+func PurgeTrash(ctx context.Context, before time.Time) (PurgeResult, error) {
+	res, err := lib.Datastore.WithTransaction(ctx, func(sessCtx mongo.SessionContext) (interface{}, error) {
+		result := PurgeResult{}
+		expired := bson.M{"deleted_at": bson.M{"$lte": before}}
+
+		// Find expired events first, since everything attached to them goes too
+		cursor, err := lib.Datastore.Db.Collection(eventsColName).Find(
+			sessCtx,
+			expired,
+			options.Find().SetProjection(bson.M{"_id": 1}),
+		)
+		if err != nil {
+			return nil, err
+		}
+		events := []Event{}
+		if err := cursor.All(sessCtx, &events); err != nil {
+			return nil, err
+		}
+		eventIDs := bson.A{}
+		for _, event := range events {
+			eventIDs = append(eventIDs, event.ID)
+		}
+
+		if len(eventIDs) > 0 {
+			for _, colName := range []string{coatChecksColName, coatRacksColName, countersColName} {
+				_, err := lib.Datastore.Db.Collection(colName).DeleteMany(sessCtx, bson.M{"event_id": bson.M{"$in": eventIDs}})
+				if err != nil {
+					return nil, err
+				}
+			}
+
+			ticketsRes, err := lib.Datastore.Db.Collection(ticketsColName).DeleteMany(sessCtx, bson.M{"event": bson.M{"$in": eventIDs}})
+			if err != nil {
+				return nil, err
+			}
+			result.TicketsPurged += ticketsRes.DeletedCount
+
+			queuedTicketsRes, err := lib.Datastore.Db.Collection(queuedTicketsColName).DeleteMany(sessCtx, bson.M{"event_id": bson.M{"$in": eventIDs}})
+			if err != nil {
+				return nil, err
+			}
+			result.QueuedTicketsPurged += queuedTicketsRes.DeletedCount
+
+			eventsRes, err := lib.Datastore.Db.Collection(eventsColName).DeleteMany(sessCtx, bson.M{"_id": bson.M{"$in": eventIDs}})
+			if err != nil {
+				return nil, err
+			}
+			result.EventsPurged = eventsRes.DeletedCount
+		}
+
+		// Tickets trashed on their own, coat checks are kept since the coat might still be on a rack
+		ticketsRes, err := lib.Datastore.Db.Collection(ticketsColName).DeleteMany(sessCtx, expired)
+		if err != nil {
+			return nil, err
+		}
+		result.TicketsPurged += ticketsRes.DeletedCount
+
+		return result, nil
+	})
+	if err != nil {
+		return PurgeResult{}, err
+	}
+
+	return res.(PurgeResult), nil
+}
@@ -0,0 +1,137 @@
+package models
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// createTrashTestEvent makes an event with a ticket for each of the given owners and one queued ticket.
+func createTrashTestEvent(t *testing.T, owners ...string) (primitive.ObjectID, []primitive.ObjectID, primitive.ObjectID) {
+	t.Helper()
+	ctx := context.Background()
+
+	eventID, err := CreateNewEvent(ctx, Event{Name: "Formal", StartTimestamp: time.Now().Add(time.Hour)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ticketIDs := []primitive.ObjectID{}
+	for _, owner := range owners {
+		if _, err := CreateNewUser(ctx, User{ID: owner, FullName: owner}); err != nil {
+			t.Fatal(err)
+		}
+		id, err := CreateNewTicket(ctx, Ticket{Owner: owner, Event: eventID, MaxScanCount: 1})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ticketIDs = append(ticketIDs, id)
+	}
+	queuedTicketID, err := CreateQueuedTicket(ctx, QueuedTicket{EventID: eventID, Email: "guest@example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return eventID, ticketIDs, queuedTicketID
+}
+
+func TestTrashedDocumentsAreHiddenFromReads(t *testing.T) {
+	setupTestDatastore(t)
+	ctx := context.Background()
+	eventID, ticketIDs, queuedTicketID := createTrashTestEvent(t, "first")
+
+	if err := DeleteEvent(ctx, eventID, "admin"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := GetEvent(ctx, bson.M{"_id": eventID}); err == nil {
+		t.Error("expected the trashed event not to be found")
+	}
+	if exists, err := CheckIfEventExists(ctx, eventID); err != nil || exists {
+		t.Errorf("expected the trashed event not to exist, got %v (%v)", exists, err)
+	}
+	events, err := GetAllEvents(ctx, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 0 {
+		t.Errorf("expected the trashed event to be left out of the list, got %+v", events)
+	}
+
+	if _, err := GetTicket(ctx, ticketIDs[0]); err == nil {
+		t.Error("expected the trashed ticket not to be found")
+	}
+	tickets, err := GetTickets(ctx, bson.M{"event": eventID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tickets) != 0 {
+		t.Errorf("expected the trashed ticket to be left out of the list, got %+v", tickets)
+	}
+	tickets, _, err = GetTicketsPage(ctx, bson.M{}, PageOptions{Limit: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tickets) != 0 {
+		t.Errorf("expected the trashed ticket to be left out of the page, got %+v", tickets)
+	}
+
+	if _, err := GetQueuedTicket(ctx, queuedTicketID); err == nil {
+		t.Error("expected the trashed queued ticket not to be found")
+	}
+	queuedTickets, err := GetQueuedTickets(ctx, bson.M{"event_id": eventID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(queuedTickets) != 0 {
+		t.Errorf("expected the trashed queued ticket to be left out of the list, got %+v", queuedTickets)
+	}
+}
+
+func TestRestoringEventBringsBackItsTickets(t *testing.T) {
+	setupTestDatastore(t)
+	ctx := context.Background()
+	eventID, ticketIDs, queuedTicketID := createTrashTestEvent(t, "first", "second")
+
+	// The second ticket is trashed on its own before the event, so it should stay in the trash
+	if err := DeleteTicket(ctx, ticketIDs[1], "admin"); err != nil {
+		t.Fatal(err)
+	}
+	if err := DeleteEvent(ctx, eventID, "admin"); err != nil {
+		t.Fatal(err)
+	}
+
+	trash, err := GetTrash(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(trash.Events) != 1 || trash.Events[0].TicketCount != 1 || trash.Events[0].QueuedTicketCount != 1 {
+		t.Errorf("expected the event to be trashed with one ticket and one queued ticket, got %+v", trash.Events)
+	}
+	if len(trash.Tickets) != 1 || trash.Tickets[0].ID != ticketIDs[1] {
+		t.Errorf("expected only the second ticket to be listed on its own, got %+v", trash.Tickets)
+	}
+
+	result, err := RestoreEvent(ctx, eventID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := RestoreResult{EventsRestored: 1, TicketsRestored: 1, QueuedTicketsRestored: 1}
+	if result != expected {
+		t.Errorf("expected %+v to be restored, got %+v", expected, result)
+	}
+
+	if _, err := GetEvent(ctx, bson.M{"_id": eventID}); err != nil {
+		t.Errorf("expected the event to be restored, got %v", err)
+	}
+	if _, err := GetTicket(ctx, ticketIDs[0]); err != nil {
+		t.Errorf("expected the ticket trashed with the event to be restored, got %v", err)
+	}
+	if _, err := GetQueuedTicket(ctx, queuedTicketID); err != nil {
+		t.Errorf("expected the queued ticket to be restored, got %v", err)
+	}
+	if _, err := GetTicket(ctx, ticketIDs[1]); err == nil {
+		t.Error("expected the ticket trashed on its own to stay in the trash")
+	}
+}
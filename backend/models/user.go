@@ -4,22 +4,36 @@ import (
 	"context"
 	"fmt"
 	"net/http"
-	"reflect"
+	"regexp"
 	"time"
 
 	"github.com/aritrosaha10/frasertickets/lib"
+	"github.com/aritrosaha10/frasertickets/util"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
+// Grades users can be in. 0 means the user has no grade, ex. staff.
+const (
+	MinGrade = 1
+	MaxGrade = 12
+)
+
 type User struct {
-	ID            string `json:"id"             bson:"_id,omitempty"` // This is also the UUID in Firebase Auth
-	Admin         bool   `json:"admin"          bson:"admin"`
-	SuperAdmin    bool   `json:"superadmin"     bson:"superadmin"`
-	StudentNumber string `json:"student_number" bson:"student_number"`
-	FullName      string `json:"full_name"      bson:"full_name"`
-	ProfilePicURL string `json:"pfp_url"        bson:"pfp_url"`
+	ID              string `json:"id"             bson:"_id,omitempty"` // This is also the UUID in Firebase Auth
+	Admin           bool   `json:"admin"          bson:"admin"`
+	SuperAdmin      bool   `json:"superadmin"     bson:"superadmin"`
+	StudentNumber   string `json:"student_number" bson:"student_number"`
+	Email           string `json:"email"          bson:"email"`
+	ExternalID      string `json:"external_id"    bson:"external_id,omitempty"` // Optional ID from another system, used to match queued tickets
+	FullName        string `json:"full_name"      bson:"full_name"`
+	ProfilePicURL   string `json:"pfp_url"        bson:"pfp_url"`
+	Grade           int    `json:"grade"          bson:"grade,omitempty"`
+	Homeroom        string `json:"homeroom"       bson:"homeroom,omitempty"`
+	Kind            string `json:"kind"           bson:"kind,omitempty"`               // student, staff or guest, decided by the identity policy
+	PendingApproval bool   `json:"pending_approval" bson:"pending_approval,omitempty"` // Held by the identity policy until an admin approves them
+	Version         int    `json:"version"        bson:"version"`                      // Bumped on every update, sent as the ETag
 }
 
 func (user *User) Render(w http.ResponseWriter, r *http.Request) error {
@@ -34,6 +48,36 @@ func CreateUserIndices(ctx context.Context) error {
 		},
 	}
 
+	emailIdxModel := mongo.IndexModel{
+		Keys: bson.D{
+			{Key: "email", Value: 1},
+		},
+	}
+	externalIDIdxModel := mongo.IndexModel{
+		Keys: bson.D{
+			{Key: "external_id", Value: 1},
+		},
+	}
+	textIdxModel := mongo.IndexModel{
+		Keys: bson.D{
+			{Key: "full_name", Value: "text"},
+			{Key: "email", Value: "text"},
+			{Key: "student_number", Value: "text"},
+		},
+		Options: options.Index().SetName("user_search_text"),
+	}
+	fullNameIdxModel := mongo.IndexModel{
+		Keys: bson.D{
+			{Key: "full_name", Value: 1},
+			{Key: "_id", Value: 1},
+		},
+	}
+	gradeIdxModel := mongo.IndexModel{
+		Keys: bson.D{
+			{Key: "grade", Value: 1},
+		},
+	}
+
 	// Try creating the indices
 	opts := options.CreateIndexes().SetMaxTime(10 * time.Second)
 	_, err := lib.Datastore.Db.Collection(usersColName).
@@ -42,6 +86,11 @@ func CreateUserIndices(ctx context.Context) error {
 			ctx,
 			[]mongo.IndexModel{
 				studentNumberIdxModel,
+				emailIdxModel,
+				externalIDIdxModel,
+				textIdxModel,
+				fullNameIdxModel,
+				gradeIdxModel,
 			},
 			opts,
 		)
@@ -65,6 +114,114 @@ func GetAllUsers(ctx context.Context) ([]User, error) {
 	return users, nil
 }
 
+// UserSearchFilter narrows down users when searching as an admin. Empty fields aren't filtered on.
+type UserSearchFilter struct {
+	Name                string // Partial, case-insensitive match on full name
+	Query               string // Full text search over name, email and student number
+	StudentNumberPrefix string
+	Admin               *bool
+	Grade               int
+}
+
+func (searchFilter UserSearchFilter) filter() bson.M {
+	filter := bson.M{}
+	if searchFilter.Name != "" {
+		filter["full_name"] = bson.M{"$regex": regexp.QuoteMeta(searchFilter.Name), "$options": "i"}
+	}
+	if searchFilter.Query != "" {
+		filter["$text"] = bson.M{"$search": searchFilter.Query}
+	}
+	if searchFilter.StudentNumberPrefix != "" {
+		// Anchored regexes without options can still use the index
+		filter["student_number"] = bson.M{"$regex": "^" + regexp.QuoteMeta(searchFilter.StudentNumberPrefix)}
+	}
+	if searchFilter.Admin != nil {
+		filter["admin"] = *searchFilter.Admin
+	}
+	if searchFilter.Grade != 0 {
+		filter["grade"] = searchFilter.Grade
+	}
+	return filter
+}
+
+// UserListSpec is what lists of users can be sorted and filtered by.
+var UserListSpec = ListSpec{
+	SortFields: map[string]string{
+		"id":            "_id",
+		"fullName":      "full_name",
+		"studentNumber": "student_number",
+		"grade":         "grade",
+	},
+	FilterFields: map[string]FilterField{
+		"admin":      {Field: "admin", Type: FilterTypeBool},
+		"superadmin": {Field: "superadmin", Type: FilterTypeBool},
+		"grade":      {Field: "grade", Type: FilterTypeInt},
+		"homeroom":   {Field: "homeroom", Type: FilterTypeString},
+		"kind":       {Field: "kind", Type: FilterTypeString},
+	},
+}
+
+// SearchUsers returns a page of users matching the filter, sorted by full name unless another sort is given.
+func SearchUsers(ctx context.Context, searchFilter UserSearchFilter, page PageOptions) ([]User, PageInfo, error) {
+	if len(page.Sort) == 0 {
+		page.Sort = []SortKey{{Field: "full_name"}}
+	}
+	return findPage[User](ctx, lib.Datastore.Db.Collection(usersColName), searchFilter.filter(), page)
+}
+
+// GetUsersPage returns a single page of users matching the filter.
+func GetUsersPage(ctx context.Context, filter bson.M, page PageOptions) ([]User, PageInfo, error) {
+	return findPage[User](ctx, lib.Datastore.Db.Collection(usersColName), filter, page)
+}
+
+// GetUsersPendingApproval returns all users held by the identity policy that haven't been approved yet.
+func GetUsersPendingApproval(ctx context.Context) ([]User, error) {
+	cursor, err := lib.Datastore.Db.Collection(usersColName).Find(ctx, bson.M{"pending_approval": true})
+	if err != nil {
+		return []User{}, err
+	}
+
+	users := []User{}
+	if err := cursor.All(ctx, &users); err != nil {
+		return []User{}, err
+	}
+
+	return users, nil
+}
+
+// GetUsersMissingEmail returns users that signed up before emails were stored on them.
+func GetUsersMissingEmail(ctx context.Context) ([]User, error) {
+	cursor, err := lib.Datastore.Db.Collection(usersColName).Find(ctx, bson.M{"$or": bson.A{
+		bson.M{"email": bson.M{"$exists": false}},
+		bson.M{"email": ""},
+	}})
+	if err != nil {
+		return []User{}, err
+	}
+
+	users := []User{}
+	if err := cursor.All(ctx, &users); err != nil {
+		return []User{}, err
+	}
+
+	return users, nil
+}
+
+// GetUsersByStudentNumbers returns the users with any of the given student numbers.
+func GetUsersByStudentNumbers(ctx context.Context, studentNumbers []string) ([]User, error) {
+	cursor, err := lib.Datastore.Db.Collection(usersColName).Find(ctx, bson.M{"student_number": bson.M{"$in": studentNumbers}})
+	if err != nil {
+		return []User{}, err
+	}
+
+	users := []User{}
+	if err := cursor.All(ctx, &users); err != nil {
+		return []User{}, err
+	}
+
+	return users, nil
+}
+
 func GetUserByKey(ctx context.Context, key string, value string) (User, error) {
 	// Try to fetch data from DB
 	var user User
@@ -86,6 +243,15 @@ func CheckIfUserWithStudentNumberExists(ctx context.Context, studentNumber strin
 	return count == 1, err
 }
 
+// EffectiveKind returns what kind of user this is, treating users from before the identity policy who have a
+// student number as students.
+func (user User) EffectiveKind() string {
+	if user.Kind == "" && user.StudentNumber != "" {
+		return lib.IdentityKindStudent
+	}
+	return user.Kind
+}
+
 func CreateNewUser(ctx context.Context, user User) (string, error) {
 	// Try to add document
 	res, err := lib.Datastore.Db.Collection(usersColName).InsertOne(ctx, user)
@@ -94,7 +260,54 @@ func CreateNewUser(ctx context.Context, user User) (string, error) {
 	return res.InsertedID.(string), err
 }
 
-func UpdateExistingUserByStruct(ctx context.Context, user User, fieldsToUpdate User) (User, error) {
+// ApproveUser clears the pending approval flag on a user held by the identity policy. Any non-empty
+// identifiers given are set on the user at the same time. mongo.ErrNoDocuments is returned if the
+// user doesn't exist or isn't waiting to be approved.
+func ApproveUser(ctx context.Context, id string, kind string, studentNumber string, approvedBy string) (User, error) {
+	updates := bson.D{{Key: "pending_approval", Value: false}}
+	if kind != "" {
+		updates = append(updates, bson.E{Key: "kind", Value: kind})
+	}
+	if studentNumber != "" {
+		updates = append(updates, bson.E{Key: "student_number", Value: studentNumber})
+	}
+
+	res, err := lib.Datastore.WithTransaction(ctx, func(sessCtx mongo.SessionContext) (interface{}, error) {
+		user, err := GetUserByKey(sessCtx, "_id", id)
+		if err != nil {
+			return nil, err
+		}
+		if !user.PendingApproval {
+			return nil, mongo.ErrNoDocuments
+		}
+
+		_, err = updateVersionedDocument(sessCtx, usersColName, ChangeDocumentUser, id, id, updates, UpdateMeta{ChangedBy: approvedBy})
+		if err != nil {
+			return nil, err
+		}
+		return GetUserByKey(sessCtx, "_id", id)
+	})
+	if err != nil {
+		return User{}, err
+	}
+
+	return res.(User), nil
+}
+
+func DeleteUser(ctx context.Context, id string) error {
+	res, err := lib.Datastore.Db.Collection(usersColName).DeleteOne(ctx, bson.M{"_id": id})
+	if err != nil {
+		return err
+	}
+	if res.DeletedCount == 0 {
+		return mongo.ErrNoDocuments
+	}
+	return nil
+}
+
+// UpdateExistingUserByStruct replaces every field of a user other than its ID and version with the
+// ones from fieldsToUpdate, and returns the updated user.
+func UpdateExistingUserByStruct(ctx context.Context, user User, fieldsToUpdate User, meta UpdateMeta) (User, error) {
 	// Confirm that user object exists in database
 	_, err := GetUserByKey(ctx, "_id", user.ID)
 	if err != nil {
@@ -106,39 +319,56 @@ func UpdateExistingUserByStruct(ctx context.Context, user User, fieldsToUpdate U
 		return User{}, fmt.Errorf("cannot update object id of user")
 	}
 
-	// Update user object with new values from fieldsToUpdate using reflection
-	fieldsToUpdateValue := reflect.ValueOf(fieldsToUpdate)
-	userValue := reflect.ValueOf(user)
-	for i := 0; i < fieldsToUpdateValue.NumField(); i++ {
-		userValue.Field(i).Set(fieldsToUpdateValue.Field(i))
-	}
-	newUser := userValue.Interface().(User)
-
-	// Run replace operation
-	_, err = lib.Datastore.Db.Collection(usersColName).
-		ReplaceOne(ctx, bson.D{{Key: "_id", Value: user.ID}}, newUser)
+	// Every field comes from fieldsToUpdate except for the ID
+	newUser := fieldsToUpdate
+	newUser.ID = user.ID
 
-	// Error checking
+	// Set every field so the change is versioned and recorded like any other update
+	raw, err := bson.Marshal(newUser)
 	if err != nil {
 		return User{}, err
 	}
+	var fields bson.D
+	if err := bson.Unmarshal(raw, &fields); err != nil {
+		return User{}, err
+	}
+	bsonUpdates := bson.D{}
+	for _, field := range fields {
+		if field.Key != "_id" && field.Key != "version" {
+			bsonUpdates = append(bsonUpdates, field)
+		}
+	}
+
+	newUser.Version, err = updateVersionedDocument(ctx, usersColName, ChangeDocumentUser, user.ID, user.ID, bsonUpdates, meta)
+	if err == ErrNoDocumentModified {
+		return user, nil
+	} else if err != nil {
+		return User{}, err
+	}
 
 	return newUser, nil
 }
 
+// UpdateExistingUserByKeys updates a user's profile, and returns its new version.
 func UpdateExistingUserByKeys(
 	ctx context.Context,
 	id string,
 	updates map[string]interface{},
-) error {
+	meta UpdateMeta,
+) (int, error) {
 	// TODO: Somehow enforce schema during these updates, especially since users can run this function
 	// to limited extent
 	UPDATABLE_KEYS := map[string]bool{
 		"admin":          true,
 		"superadmin":     true,
 		"student_number": true,
+		"email":          true,
+		"external_id":    true,
 		"full_name":      true,
 		"pfp_url":        true,
+		"kind":           true,
+		"grade":          true,
+		"homeroom":       true,
 	}
 
 	// Convert the string/interface map to BSON updates
@@ -146,7 +376,22 @@ func UpdateExistingUserByKeys(
 	for key, val := range updates {
 		// Don't allow other keys to be updated
 		if !UPDATABLE_KEYS[key] {
-			return ErrEditNotAllowed
+			return 0, util.NewValidationError(ErrEditNotAllowed, util.AppCodeEditNotAllowed, key, "editable", "field can't be updated")
+		}
+
+		// JSON numbers always decode as float64, but grades are stored as ints
+		if key == "grade" {
+			grade, ok := val.(float64)
+			if !ok || grade != float64(int(grade)) || (grade != 0 && (grade < MinGrade || grade > MaxGrade)) {
+				return 0, util.NewValidationError(
+					nil,
+					util.AppCodeInvalidBody,
+					key,
+					"range",
+					fmt.Sprintf("grade must be a whole number from %d to %d, or 0 for none", MinGrade, MaxGrade),
+				)
+			}
+			val = int(grade)
 		}
 
 		// Add the key/val pair in BSON
@@ -154,13 +399,5 @@ func UpdateExistingUserByKeys(
 	}
 
 	// Try to update document in DB
-	res, err := lib.Datastore.Db.Collection(usersColName).
-		UpdateByID(ctx, id, bson.D{{Key: "$set", Value: bsonUpdates}})
-	if err != nil {
-		return err
-	}
-	if res.ModifiedCount == 0 {
-		return ErrNoDocumentModified
-	}
-	return nil
+	return updateVersionedDocument(ctx, usersColName, ChangeDocumentUser, id, id, bsonUpdates, meta)
 }
@@ -0,0 +1,219 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/aritrosaha10/frasertickets/lib"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// WalletPass is a link for a ticket owner to save their ticket to Google Wallet.
+type WalletPass struct {
+	TicketID string `json:"ticketID"`
+	ObjectID string `json:"objectID"`
+	SaveURL  string `json:"saveURL"`
+}
+
+func (pass *WalletPass) Render(w http.ResponseWriter, r *http.Request) error {
+	return nil
+}
+
+// WalletClassID is the Wallet class shared by every ticket for an event.
+func WalletClassID(event Event) string {
+	return lib.GoogleWallet.ResourceID("event_" + event.ID.Hex())
+}
+
+// WalletObjectID is the Wallet object for a single ticket.
+func WalletObjectID(ticket Ticket) string {
+	return lib.GoogleWallet.ResourceID("ticket_" + ticket.ID.Hex())
+}
+
+func walletEventTicketClass(event Event) lib.WalletEventTicketClass {
+	wallet := lib.GoogleWallet
+	class := lib.WalletEventTicketClass{
+		ID:           WalletClassID(event),
+		IssuerName:   wallet.IssuerName,
+		EventID:      event.ID.Hex(),
+		EventName:    lib.WalletText(event.Name),
+		ReviewStatus: "UNDER_REVIEW",
+		Venue: &lib.WalletEventVenue{
+			Name:    lib.WalletText(event.Location),
+			Address: lib.WalletText(event.Address),
+		},
+		DateTime: &lib.WalletEventDateTime{
+			Start: event.StartTimestamp.Format(time.RFC3339),
+			End:   event.EndTimestamp.Format(time.RFC3339),
+		},
+		Logo: &lib.WalletImage{
+			SourceURI:          lib.WalletImageURI{URI: wallet.SiteURL + "/logo.png"},
+			ContentDescription: lib.WalletText("FraserTickets Logo"),
+		},
+		HexBackgroundColor: "#4285f4",
+	}
+	if len(event.ImageURLs) > 0 {
+		class.HeroImage = &lib.WalletImage{SourceURI: lib.WalletImageURI{URI: event.ImageURLs[0]}}
+	}
+	return class
+}
+
+// walletEventTicketObject builds the Wallet object for a ticket, which needs its event and owner data
+// filled in. The QR code holds the ticket ID, same as the one shown on the site.
+func walletEventTicketObject(ticket Ticket) lib.WalletEventTicketObject {
+	wallet := lib.GoogleWallet
+	object := lib.WalletEventTicketObject{
+		ID:               WalletObjectID(ticket),
+		ClassID:          WalletClassID(ticket.EventData),
+		TicketHolderName: ticket.OwnerData.FullName,
+		TicketNumber:     ticket.ID.Hex(),
+		Barcode: &lib.WalletBarcode{
+			Type:  "QR_CODE",
+			Value: ticket.ID.Hex(),
+		},
+		LinksModuleData: &lib.WalletLinksModule{
+			URIs: []lib.WalletURI{{
+				ID:          "original_ticket",
+				URI:         wallet.SiteURL + "/tickets/" + ticket.ID.Hex(),
+				Description: "Original Ticket",
+			}},
+		},
+	}
+	if ticket.OwnerData.StudentNumber != "" {
+		object.TextModulesData = append(object.TextModulesData, lib.WalletTextModule{
+			ID:     "student_number",
+			Header: "Student Number",
+			Body:   ticket.OwnerData.StudentNumber,
+		})
+	}
+
+	object.State = walletTicketState(ticket)
+	return object
+}
+
+// walletTicketState decides how a ticket's pass is shown. Used up tickets shouldn't look like they
+// still get someone in, and passes for events that are over get put away.
+func walletTicketState(ticket Ticket) string {
+	if ticket.MaxScanCount > 0 && ticket.ScanCount >= ticket.MaxScanCount {
+		return "COMPLETED"
+	}
+	if !ticket.EventData.EndTimestamp.IsZero() && time.Now().After(ticket.EventData.EndTimestamp) {
+		return "EXPIRED"
+	}
+	return "ACTIVE"
+}
+
+// IssueWalletPass makes sure a ticket and its event are up to date in Google Wallet, and returns a
+// link for the owner to save it. The ticket needs its event and owner data filled in, as returned by
+// GetTicket.
+func IssueWalletPass(ctx context.Context, ticket Ticket) (WalletPass, error) {
+	if lib.GoogleWallet == nil {
+		return WalletPass{}, ErrWalletDisabled
+	}
+
+	if err := lib.GoogleWallet.UpsertEventTicketClass(ctx, walletEventTicketClass(ticket.EventData)); err != nil {
+		return WalletPass{}, err
+	}
+	object := walletEventTicketObject(ticket)
+	if err := lib.GoogleWallet.UpsertEventTicketObject(ctx, object); err != nil {
+		return WalletPass{}, err
+	}
+
+	saveURL, err := lib.GoogleWallet.SaveURL(object.ID)
+	if err != nil {
+		return WalletPass{}, err
+	}
+
+	// Remember that the ticket has a pass, so later changes get synced to it
+	_, err = lib.Datastore.Db.Collection(ticketsColName).UpdateOne(
+		ctx,
+		bson.M{"_id": ticket.ID},
+		bson.D{{Key: "$set", Value: bson.D{{Key: "wallet_issued_at", Value: time.Now()}}}},
+	)
+	if err != nil {
+		return WalletPass{}, err
+	}
+	return WalletPass{
+		TicketID: ticket.ID.Hex(),
+		ObjectID: object.ID,
+		SaveURL:  saveURL,
+	}, nil
+}
+
+// isWalletNotFound checks whether the Wallet API said a class or object doesn't exist, which happens
+// when a pass was never fully issued. There's nothing to sync in that case.
+func isWalletNotFound(err error) bool {
+	var walletErr *lib.WalletAPIError
+	return errors.As(err, &walletErr) && walletErr.StatusCode == http.StatusNotFound
+}
+
+// SyncWalletJob pushes the current state of a job's event or ticket to Google Wallet. Syncing an
+// event updates its class, then queues a sync for every one of its tickets with a pass.
+func SyncWalletJob(ctx context.Context, job WalletSyncJob) error {
+	if lib.GoogleWallet == nil {
+		return ErrWalletDisabled
+	}
+
+	switch job.Kind {
+	case WalletSyncKindEvent:
+		return syncWalletEvent(ctx, job.TargetID)
+	case WalletSyncKindTicket:
+		return syncWalletTicket(ctx, job.TargetID)
+	default:
+		return fmt.Errorf("unknown wallet sync kind '%s'", job.Kind)
+	}
+}
+
+func syncWalletEvent(ctx context.Context, id primitive.ObjectID) error {
+	// Trashed events still get their class updated, their tickets are expired below
+	var event Event
+	err := lib.Datastore.Db.Collection(eventsColName).FindOne(ctx, bson.M{"_id": id}).Decode(&event)
+	if err != nil && err != mongo.ErrNoDocuments {
+		return err
+	}
+	if err == nil {
+		err = lib.GoogleWallet.PatchEventTicketClass(ctx, WalletClassID(event), walletEventTicketClass(event))
+		if err != nil && !isWalletNotFound(err) {
+			return err
+		}
+	}
+
+	// Times and trashing change every ticket's state, so sync each of them on their own
+	cursor, err := lib.Datastore.Db.Collection(ticketsColName).Find(
+		ctx,
+		bson.M{"event": id, "wallet_issued_at": bson.M{"$exists": true}},
+	)
+	if err != nil {
+		return err
+	}
+	var tickets []Ticket
+	if err := cursor.All(ctx, &tickets); err != nil {
+		return err
+	}
+	for _, ticket := range tickets {
+		if err := enqueueWalletSyncJob(ctx, WalletSyncKindTicket, ticket.ID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func syncWalletTicket(ctx context.Context, id primitive.ObjectID) error {
+	objectID := lib.GoogleWallet.ResourceID("ticket_" + id.Hex())
+
+	// Trashed or purged tickets can't be used anymore
+	ticket, err := GetTicket(ctx, id)
+	if err == mongo.ErrNoDocuments {
+		err = lib.GoogleWallet.PatchEventTicketObject(ctx, objectID, map[string]string{"state": "EXPIRED"})
+	} else if err == nil {
+		err = lib.GoogleWallet.PatchEventTicketObject(ctx, objectID, walletEventTicketObject(ticket))
+	}
+	if err != nil && !isWalletNotFound(err) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,293 @@
+package models
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/aritrosaha10/frasertickets/lib"
+	"github.com/rs/zerolog/log"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	WalletSyncKindEvent  = "event"  // patch the event's class, then sync every ticket with a pass
+	WalletSyncKindTicket = "ticket" // patch the ticket's object
+
+	WalletSyncStatusPending = "pending"
+	WalletSyncStatusFailed  = "failed" // gave up retrying, waiting on an admin
+)
+
+// WalletSyncJob is a change to an event or ticket that still has to reach Google Wallet. There's
+// only ever one job per event or ticket, so changes made while a job waits are synced together.
+type WalletSyncJob struct {
+	ID            primitive.ObjectID `json:"id"                  bson:"_id,omitempty"`
+	Kind          string             `json:"kind"                bson:"kind"` // event or ticket
+	TargetID      primitive.ObjectID `json:"targetID"            bson:"target_id"`
+	Status        string             `json:"status"              bson:"status"`
+	Attempts      int                `json:"attempts"            bson:"attempts"`
+	NextAttemptAt time.Time          `json:"nextAttemptAt"       bson:"next_attempt_at"`
+	LastError     string             `json:"lastError,omitempty" bson:"last_error,omitempty"`
+	EnqueuedAt    time.Time          `json:"enqueuedAt"          bson:"enqueued_at"` // bumped on every new change, so ones made mid-sync aren't lost
+	UpdatedAt     time.Time          `json:"updatedAt"           bson:"updated_at"`
+}
+
+func (job *WalletSyncJob) Render(w http.ResponseWriter, r *http.Request) error {
+	return nil
+}
+
+func CreateWalletSyncJobIndices(ctx context.Context) error {
+	// Only one job per event or ticket
+	targetIdxModel := mongo.IndexModel{
+		Keys: bson.D{
+			{Key: "kind", Value: 1},
+			{Key: "target_id", Value: 1},
+		},
+		Options: options.Index().SetUnique(true),
+	}
+	// Due jobs are picked by status and time
+	dueIdxModel := mongo.IndexModel{
+		Keys: bson.D{
+			{Key: "status", Value: 1},
+			{Key: "next_attempt_at", Value: 1},
+		},
+	}
+
+	// Try creating the indices
+	opts := options.CreateIndexes().SetMaxTime(10 * time.Second)
+	_, err := lib.Datastore.Db.Collection(walletSyncJobsColName).
+		Indexes().
+		CreateMany(ctx, []mongo.IndexModel{targetIdxModel, dueIdxModel}, opts)
+	return err
+}
+
+// pendingWalletSyncsKey is the context key a transaction's PendingWalletSyncs are kept under.
+type pendingWalletSyncsKey struct{}
+
+type pendingWalletSync struct {
+	kind string
+	id   primitive.ObjectID
+}
+
+// PendingWalletSyncs holds the wallet syncs for changes made inside of a transaction, so they can be
+// queued once it commits. Queueing them any earlier would let a rolled back change reach Google Wallet.
+type PendingWalletSyncs struct {
+	syncs []pendingWalletSync
+}
+
+// WithPendingWalletSyncs returns a context that collects wallet syncs instead of queueing them. It
+// should be used for any transaction that changes events or tickets, with Queue called after commit.
+func WithPendingWalletSyncs(ctx context.Context) (context.Context, *PendingWalletSyncs) {
+	pending := &PendingWalletSyncs{}
+	return context.WithValue(ctx, pendingWalletSyncsKey{}, pending), pending
+}
+
+// Reset forgets every collected sync, for when a transaction is retried from the start.
+func (pending *PendingWalletSyncs) Reset() {
+	pending.syncs = nil
+}
+
+// Queue queues every collected sync. The context must not belong to a session.
+func (pending *PendingWalletSyncs) Queue(ctx context.Context) error {
+	for _, sync := range pending.syncs {
+		if err := queueWalletSync(ctx, sync.kind, sync.id); err != nil {
+			return err
+		}
+	}
+	pending.syncs = nil
+	return nil
+}
+
+// queueWalletSync makes sure an event or ticket gets synced to Google Wallet, but only if a pass was
+// ever issued for it. Failing to queue a sync is only logged, and never fails the change itself since
+// it's already committed. Inside of a transaction, the sync is collected to be queued after commit,
+// and ErrWalletSyncInTransaction is returned if nothing is there to collect it.
+func queueWalletSync(ctx context.Context, kind string, id primitive.ObjectID) error {
+	if lib.GoogleWallet == nil {
+		return nil
+	}
+
+	if mongo.SessionFromContext(ctx) != nil {
+		pending, ok := ctx.Value(pendingWalletSyncsKey{}).(*PendingWalletSyncs)
+		if !ok {
+			return ErrWalletSyncInTransaction
+		}
+		pending.syncs = append(pending.syncs, pendingWalletSync{kind: kind, id: id})
+		return nil
+	}
+
+	// Most tickets never get a pass, so don't bother syncing them
+	issuedFilter := bson.M{"wallet_issued_at": bson.M{"$exists": true}}
+	if kind == WalletSyncKindEvent {
+		issuedFilter["event"] = id
+	} else {
+		issuedFilter["_id"] = id
+	}
+	count, err := lib.Datastore.Db.Collection(ticketsColName).CountDocuments(ctx, issuedFilter, options.Count().SetLimit(1))
+	if err != nil {
+		log.Error().Err(err).Str("kind", kind).Str("target_id", id.Hex()).Msg("could not check for wallet passes to sync")
+		return nil
+	}
+	if count == 0 {
+		return nil
+	}
+
+	if err := enqueueWalletSyncJob(ctx, kind, id); err != nil {
+		log.Error().Err(err).Str("kind", kind).Str("target_id", id.Hex()).Msg("could not queue wallet sync")
+	}
+	return nil
+}
+
+// QueueEndedEventWalletSyncs queues a sync for every event that ended after since and no later than
+// until, so that their passes get marked as expired.
+func QueueEndedEventWalletSyncs(ctx context.Context, since time.Time, until time.Time) error {
+	eventIDs, err := lib.Datastore.Db.Collection(eventsColName).Distinct(
+		ctx,
+		"_id",
+		excludeTrashed(bson.M{"end_timestamp": bson.M{"$gt": since, "$lte": until}}),
+	)
+	if err != nil {
+		return err
+	}
+
+	for _, rawID := range eventIDs {
+		id, ok := rawID.(primitive.ObjectID)
+		if !ok {
+			continue
+		}
+		if err := queueWalletSync(ctx, WalletSyncKindEvent, id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// enqueueWalletSyncJob adds a job to sync an event or ticket as soon as possible, or brings back the
+// existing one if there is one.
+func enqueueWalletSyncJob(ctx context.Context, kind string, id primitive.ObjectID) error {
+	now := time.Now()
+	_, err := lib.Datastore.Db.Collection(walletSyncJobsColName).UpdateOne(
+		ctx,
+		bson.M{"kind": kind, "target_id": id},
+		bson.D{{Key: "$set", Value: bson.D{
+			{Key: "status", Value: WalletSyncStatusPending},
+			{Key: "attempts", Value: 0},
+			{Key: "next_attempt_at", Value: now},
+			{Key: "enqueued_at", Value: now},
+			{Key: "updated_at", Value: now},
+		}}},
+		options.Update().SetUpsert(true),
+	)
+	return err
+}
+
+// WalletSyncStatusFilter returns a filter matching wallet sync jobs with the given status.
+func WalletSyncStatusFilter(status string) (bson.M, error) {
+	switch status {
+	case WalletSyncStatusPending, WalletSyncStatusFailed:
+		return bson.M{"status": status}, nil
+	case "", "all":
+		return bson.M{}, nil
+	default:
+		return nil, fmt.Errorf("unknown wallet sync status '%s'", status)
+	}
+}
+
+// GetWalletSyncJobs lists wallet sync jobs matching a filter, most recently changed first.
+func GetWalletSyncJobs(ctx context.Context, filter bson.M) ([]WalletSyncJob, error) {
+	opts := options.Find().SetSort(bson.D{{Key: "updated_at", Value: -1}})
+	cursor, err := lib.Datastore.Db.Collection(walletSyncJobsColName).Find(ctx, filter, opts)
+	if err != nil {
+		return []WalletSyncJob{}, err
+	}
+
+	jobs := []WalletSyncJob{}
+	if err := cursor.All(ctx, &jobs); err != nil {
+		return []WalletSyncJob{}, err
+	}
+	return jobs, nil
+}
+
+// ClaimWalletSyncJob picks the next due job and pushes its next attempt back by the lease, so that
+// nothing else picks it up while it runs. ErrNotFound is returned if nothing is due.
+func ClaimWalletSyncJob(ctx context.Context, lease time.Duration) (WalletSyncJob, error) {
+	now := time.Now()
+
+	var job WalletSyncJob
+	err := lib.Datastore.Db.Collection(walletSyncJobsColName).FindOneAndUpdate(
+		ctx,
+		bson.M{"status": WalletSyncStatusPending, "next_attempt_at": bson.M{"$lte": now}},
+		bson.D{
+			{Key: "$set", Value: bson.D{
+				{Key: "next_attempt_at", Value: now.Add(lease)},
+				{Key: "updated_at", Value: now},
+			}},
+			{Key: "$inc", Value: bson.D{{Key: "attempts", Value: 1}}},
+		},
+		options.FindOneAndUpdate().
+			SetSort(bson.D{{Key: "next_attempt_at", Value: 1}}).
+			SetReturnDocument(options.After),
+	).Decode(&job)
+	if err == mongo.ErrNoDocuments {
+		return WalletSyncJob{}, ErrNotFound
+	}
+	return job, err
+}
+
+// CompleteWalletSyncJob removes a job once it's synced, unless something changed again since it was
+// claimed, in which case it's left to run again.
+func CompleteWalletSyncJob(ctx context.Context, job WalletSyncJob) error {
+	_, err := lib.Datastore.Db.Collection(walletSyncJobsColName).DeleteOne(
+		ctx,
+		bson.M{"_id": job.ID, "enqueued_at": job.EnqueuedAt},
+	)
+	return err
+}
+
+// FailWalletSyncJob records why a job failed, and either schedules it to be tried again or gives up
+// on it if retryAt is zero.
+func FailWalletSyncJob(ctx context.Context, job WalletSyncJob, syncErr error, retryAt time.Time) error {
+	updates := bson.D{
+		{Key: "last_error", Value: syncErr.Error()},
+		{Key: "updated_at", Value: time.Now()},
+	}
+	if retryAt.IsZero() {
+		updates = append(updates, bson.E{Key: "status", Value: WalletSyncStatusFailed})
+	} else {
+		updates = append(updates, bson.E{Key: "next_attempt_at", Value: retryAt})
+	}
+
+	// A newer change would have reset the job already, so leave it alone in that case
+	_, err := lib.Datastore.Db.Collection(walletSyncJobsColName).UpdateOne(
+		ctx,
+		bson.M{"_id": job.ID, "enqueued_at": job.EnqueuedAt},
+		bson.D{{Key: "$set", Value: updates}},
+	)
+	return err
+}
+
+// RetryWalletSyncJob puts a job that was given up on back in line, with its attempts reset.
+func RetryWalletSyncJob(ctx context.Context, id primitive.ObjectID) (WalletSyncJob, error) {
+	now := time.Now()
+
+	var job WalletSyncJob
+	err := lib.Datastore.Db.Collection(walletSyncJobsColName).FindOneAndUpdate(
+		ctx,
+		bson.M{"_id": id, "status": WalletSyncStatusFailed},
+		bson.D{{Key: "$set", Value: bson.D{
+			{Key: "status", Value: WalletSyncStatusPending},
+			{Key: "attempts", Value: 0},
+			{Key: "next_attempt_at", Value: now},
+			{Key: "updated_at", Value: now},
+		}}},
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(&job)
+	if err == mongo.ErrNoDocuments {
+		return WalletSyncJob{}, ErrNotFound
+	}
+	return job, err
+}
@@ -0,0 +1,229 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/aritrosaha10/frasertickets/lib"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// setupTestWallet makes the models think Google Wallet is set up, so that syncs get queued.
+func setupTestWallet(t *testing.T) {
+	t.Helper()
+
+	previous := lib.GoogleWallet
+	lib.GoogleWallet = &lib.GoogleWalletClient{}
+	t.Cleanup(func() {
+		lib.GoogleWallet = previous
+	})
+}
+
+// insertIssuedTicket adds a ticket to an event that already had a wallet pass issued for it.
+func insertIssuedTicket(t *testing.T, ctx context.Context, eventID primitive.ObjectID) primitive.ObjectID {
+	t.Helper()
+
+	issuedAt := time.Now()
+	res, err := lib.Datastore.Db.Collection(ticketsColName).InsertOne(ctx, Ticket{
+		Owner:          primitive.NewObjectID().Hex(),
+		Event:          eventID,
+		Timestamp:      time.Now(),
+		WalletIssuedAt: &issuedAt,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res.InsertedID.(primitive.ObjectID)
+}
+
+func TestWalletSyncJobClaimAndComplete(t *testing.T) {
+	setupTestDatastore(t)
+	ctx := context.Background()
+
+	ticketID := primitive.NewObjectID()
+	if err := enqueueWalletSyncJob(ctx, WalletSyncKindTicket, ticketID); err != nil {
+		t.Fatal(err)
+	}
+
+	job, err := ClaimWalletSyncJob(ctx, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if job.TargetID != ticketID || job.Kind != WalletSyncKindTicket || job.Attempts != 1 {
+		t.Errorf("claimed the wrong job: %+v", job)
+	}
+	if !job.NextAttemptAt.After(time.Now()) {
+		t.Errorf("expected the claim to lease the job, next attempt is at %v", job.NextAttemptAt)
+	}
+
+	// Leased jobs can't be claimed again
+	if _, err := ClaimWalletSyncJob(ctx, time.Minute); err != ErrNotFound {
+		t.Errorf("expected ErrNotFound while the job is leased, got %v", err)
+	}
+
+	if err := CompleteWalletSyncJob(ctx, job); err != nil {
+		t.Fatal(err)
+	}
+	jobs, err := GetWalletSyncJobs(ctx, bson.M{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(jobs) != 0 {
+		t.Errorf("expected the completed job to be removed, got %+v", jobs)
+	}
+}
+
+func TestCompleteWalletSyncJobAfterNewChange(t *testing.T) {
+	setupTestDatastore(t)
+	ctx := context.Background()
+
+	eventID := primitive.NewObjectID()
+	if err := enqueueWalletSyncJob(ctx, WalletSyncKindEvent, eventID); err != nil {
+		t.Fatal(err)
+	}
+	job, err := ClaimWalletSyncJob(ctx, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The event changes again while it's being synced
+	time.Sleep(5 * time.Millisecond)
+	if err := enqueueWalletSyncJob(ctx, WalletSyncKindEvent, eventID); err != nil {
+		t.Fatal(err)
+	}
+	if err := CompleteWalletSyncJob(ctx, job); err != nil {
+		t.Fatal(err)
+	}
+
+	again, err := ClaimWalletSyncJob(ctx, time.Minute)
+	if err != nil {
+		t.Fatalf("expected the newer change to still be queued, got %v", err)
+	}
+	if again.ID != job.ID || again.Attempts != 1 {
+		t.Errorf("expected the same job with its attempts reset, got %+v", again)
+	}
+}
+
+func TestFailWalletSyncJob(t *testing.T) {
+	setupTestDatastore(t)
+	ctx := context.Background()
+
+	if err := enqueueWalletSyncJob(ctx, WalletSyncKindTicket, primitive.NewObjectID()); err != nil {
+		t.Fatal(err)
+	}
+	job, err := ClaimWalletSyncJob(ctx, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Retrying makes it due again at the given time
+	if err := FailWalletSyncJob(ctx, job, errors.New("temporary"), time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	job, err = ClaimWalletSyncJob(ctx, time.Minute)
+	if err != nil {
+		t.Fatalf("expected the retried job to be claimable, got %v", err)
+	}
+	if job.Attempts != 2 || job.LastError != "temporary" {
+		t.Errorf("expected a second attempt after the first error, got %+v", job)
+	}
+
+	// Giving up leaves it for an admin
+	if err := FailWalletSyncJob(ctx, job, errors.New("permanent"), time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ClaimWalletSyncJob(ctx, -time.Minute); err != ErrNotFound {
+		t.Errorf("expected failed jobs to never be claimed, got %v", err)
+	}
+	failed, err := GetWalletSyncJobs(ctx, bson.M{"status": WalletSyncStatusFailed})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(failed) != 1 || failed[0].LastError != "permanent" {
+		t.Errorf("expected the job to be marked as failed, got %+v", failed)
+	}
+}
+
+func TestQueueWalletSyncInTransaction(t *testing.T) {
+	setupTestDatastore(t)
+	setupTestWallet(t)
+	ctx := context.Background()
+
+	eventID, err := CreateNewEvent(ctx, Event{Name: "Synced"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ticketID := insertIssuedTicket(t, ctx, eventID)
+
+	// Nothing is there to collect the sync, so it has to fail instead of being lost
+	_, err = lib.Datastore.WithTransaction(ctx, func(sessCtx mongo.SessionContext) (interface{}, error) {
+		return nil, queueWalletSync(sessCtx, WalletSyncKindTicket, ticketID)
+	})
+	if err != ErrWalletSyncInTransaction {
+		t.Errorf("expected ErrWalletSyncInTransaction, got %v", err)
+	}
+
+	txnCtx, pending := WithPendingWalletSyncs(ctx)
+	_, err = lib.Datastore.WithTransaction(txnCtx, func(sessCtx mongo.SessionContext) (interface{}, error) {
+		return nil, queueWalletSync(sessCtx, WalletSyncKindTicket, ticketID)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	jobs, err := GetWalletSyncJobs(ctx, bson.M{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(jobs) != 0 {
+		t.Fatalf("expected nothing to be queued before the syncs are, got %+v", jobs)
+	}
+
+	if err := pending.Queue(ctx); err != nil {
+		t.Fatal(err)
+	}
+	jobs, err = GetWalletSyncJobs(ctx, bson.M{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(jobs) != 1 || jobs[0].TargetID != ticketID {
+		t.Errorf("expected the ticket to be queued after commit, got %+v", jobs)
+	}
+}
+
+func TestQueueEndedEventWalletSyncs(t *testing.T) {
+	setupTestDatastore(t)
+	setupTestWallet(t)
+	ctx := context.Background()
+
+	now := time.Now()
+	endedID, err := CreateNewEvent(ctx, Event{Name: "Ended", EndTimestamp: now.Add(-time.Hour)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	longAgoID, err := CreateNewEvent(ctx, Event{Name: "Ended long ago", EndTimestamp: now.Add(-48 * time.Hour)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	upcomingID, err := CreateNewEvent(ctx, Event{Name: "Upcoming", EndTimestamp: now.Add(time.Hour)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, eventID := range []primitive.ObjectID{endedID, longAgoID, upcomingID} {
+		insertIssuedTicket(t, ctx, eventID)
+	}
+
+	if err := QueueEndedEventWalletSyncs(ctx, now.Add(-24*time.Hour), now); err != nil {
+		t.Fatal(err)
+	}
+	jobs, err := GetWalletSyncJobs(ctx, bson.M{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(jobs) != 1 || jobs[0].Kind != WalletSyncKindEvent || jobs[0].TargetID != endedID {
+		t.Errorf("expected only the event that ended in the window to be queued, got %+v", jobs)
+	}
+}
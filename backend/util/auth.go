@@ -19,3 +19,19 @@ func CheckIfAdmin(ctx context.Context) (bool, error) {
 
 	return isAdmin, nil
 }
+
+func CheckIfSuperAdmin(ctx context.Context) (bool, error) {
+	idToken, err := GetUserTokenFromContext(ctx)
+	if err != nil {
+		return false, err
+	}
+
+	// Check claims for superadmin data
+	claims := idToken.Claims
+	isSuperAdmin := false
+	if superAdminRaw, ok := claims["superadmin"]; ok {
+		isSuperAdmin, _ = superAdminRaw.(bool)
+	}
+
+	return isSuperAdmin, nil
+}
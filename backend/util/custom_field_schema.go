@@ -2,10 +2,22 @@ package util
 
 import (
 	"fmt"
+	"net/mail"
+	"reflect"
+	"regexp"
+	"sort"
 
 	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
+const (
+	CustomFieldFormatEmail = "email"
+	CustomFieldFormatPhone = "phone"
+)
+
+// Loose enough for extensions and international numbers, ex. "+1 (905) 555-0123 x12"
+var customFieldPhoneRegex = regexp.MustCompile(`^\+?[0-9 ()\-.]{7,20}( ?(x|ext\.?) ?[0-9]{1,6})?$`)
+
 // Note that this doesn't include all the possible attributes that a custom property
 // can have, but only includes the ones that we would need to parse ourselves or were
 // added by us.
@@ -15,6 +27,25 @@ type CustomField struct {
 	Editable    bool   `json:"editable"`
 	DisplayName string `json:"displayName"`
 	Description string `json:"description"`
+
+	// Optional, assigns each new ticket the next number from a per-event counter
+	AutoNumber      bool `json:"autoNumber,omitempty"`
+	AutoNumberStart int  `json:"autoNumberStart,omitempty"` // first number handed out, defaults to 1
+
+	// Optional, lets the ticket owner change the field themselves (editable is only for admins)
+	OwnerEditable bool `json:"ownerEditable,omitempty"`
+
+	// Optional, everything below is standard JSON schema except for enumLabels, displayOrder & sensitive
+	Enum         []interface{} `json:"enum,omitempty"`         // allowed values, shown as a dropdown
+	EnumLabels   []string      `json:"enumLabels,omitempty"`   // label for each allowed value, in the same order
+	Default      interface{}   `json:"default,omitempty"`      // filled in on new tickets that don't have a value
+	DisplayOrder int           `json:"displayOrder,omitempty"` // fields are shown from lowest to highest, then by key
+	Minimum      *float64      `json:"minimum,omitempty"`      // for numbers
+	Maximum      *float64      `json:"maximum,omitempty"`      // for numbers
+	MinLength    *int          `json:"minLength,omitempty"`    // for strings
+	MaxLength    *int          `json:"maxLength,omitempty"`    // for strings
+	Format       string        `json:"format,omitempty"`       // email or phone, for strings
+	Sensitive    bool          `json:"sensitive,omitempty"`    // left out of exports & stats unless asked for by name
 }
 
 type CustomFieldsSchema struct {
@@ -23,6 +54,22 @@ type CustomFieldsSchema struct {
 	Properties map[string]CustomField `json:"properties"`
 }
 
+// OrderedKeys returns the keys of every property in display order.
+func (schema CustomFieldsSchema) OrderedKeys() []string {
+	keys := make([]string, 0, len(schema.Properties))
+	for key := range schema.Properties {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		orderI, orderJ := schema.Properties[keys[i]].DisplayOrder, schema.Properties[keys[j]].DisplayOrder
+		if orderI != orderJ {
+			return orderI < orderJ
+		}
+		return keys[i] < keys[j]
+	})
+	return keys
+}
+
 func ConvertRawCustomFieldsSchema(raw map[string]interface{}) (CustomFieldsSchema, error) {
 	schema := CustomFieldsSchema{}
 
@@ -39,8 +86,11 @@ func ConvertRawCustomFieldsSchema(raw map[string]interface{}) (CustomFieldsSchem
 
 	// Deserialize 'required' array
 	if requiredRaw, found := raw["required"]; found {
+		// Lists come back from Mongo as primitive.A, but are plain slices when decoded from JSON
 		if requiredRawMongoSerialized, ok := requiredRaw.(primitive.A); ok {
-			requiredRawList := []interface{}(requiredRawMongoSerialized)
+			requiredRaw = []interface{}(requiredRawMongoSerialized)
+		}
+		if requiredRawList, ok := requiredRaw.([]interface{}); ok {
 			required := make([]string, len(requiredRawList))
 			for i, v := range requiredRawList {
 				if requiredKey, ok := v.(string); ok {
@@ -123,6 +173,35 @@ func ConvertRawCustomFieldsSchema(raw map[string]interface{}) (CustomFieldsSchem
 						return CustomFieldsSchema{}, fmt.Errorf("key 'description' in property '%s' was not found", key)
 					}
 
+					// Deserialize optional "autoNumber" attr in property
+					if autoNumberRaw, found := rawPropertyMap["autoNumber"]; found {
+						if autoNumber, ok := autoNumberRaw.(bool); ok {
+							property.AutoNumber = autoNumber
+						} else {
+							return CustomFieldsSchema{}, fmt.Errorf("key 'autoNumber' in property '%s' is not bool", key)
+						}
+						if property.AutoNumber && property.Kind != "integer" && property.Kind != "number" {
+							return CustomFieldsSchema{}, fmt.Errorf("property '%s' must be an integer or number to be auto-numbered", key)
+						}
+					}
+
+					// Deserialize optional "autoNumberStart" attr in property
+					if property.AutoNumber {
+						property.AutoNumberStart = 1
+					}
+					if autoNumberStartRaw, found := rawPropertyMap["autoNumberStart"]; found {
+						autoNumberStart, ok := CustomFieldInt(autoNumberStartRaw)
+						if !ok {
+							return CustomFieldsSchema{}, fmt.Errorf("key 'autoNumberStart' in property '%s' is not an integer", key)
+						}
+						property.AutoNumberStart = autoNumberStart
+					}
+
+					// Deserialize the rest of the optional attrs
+					if err := parseCustomFieldOptions(key, rawPropertyMap, &property); err != nil {
+						return CustomFieldsSchema{}, err
+					}
+
 					// Add final property to map
 					properties[key] = property
 				} else {
@@ -137,3 +216,243 @@ func ConvertRawCustomFieldsSchema(raw map[string]interface{}) (CustomFieldsSchem
 
 	return schema, nil
 }
+
+// CustomFieldInt converts a number decoded from either JSON or BSON into an int, as long as it is
+// a whole number.
+func CustomFieldInt(raw interface{}) (int, bool) {
+	switch v := raw.(type) {
+	case int:
+		return v, true
+	case int32:
+		return int(v), true
+	case int64:
+		return int(v), true
+	case float64:
+		if v != float64(int(v)) {
+			return 0, false
+		}
+		return int(v), true
+	default:
+		return 0, false
+	}
+}
+
+// customFieldFloat converts a number decoded from either JSON or BSON into a float64.
+func customFieldFloat(raw interface{}) (float64, bool) {
+	switch v := raw.(type) {
+	case int:
+		return float64(v), true
+	case int32:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	case float64:
+		return v, true
+	default:
+		return 0, false
+	}
+}
+
+// parseCustomFieldOptions deserializes the optional attrs of a property, and makes sure they fit
+// together (ex. the default is one of the enum values).
+func parseCustomFieldOptions(key string, rawPropertyMap map[string]interface{}, property *CustomField) error {
+	isNumber := property.Kind == "integer" || property.Kind == "number"
+
+	// Enum values & their labels
+	if enumRaw, found := rawPropertyMap["enum"]; found {
+		if enumMongoSerialized, ok := enumRaw.(primitive.A); ok {
+			enumRaw = []interface{}(enumMongoSerialized)
+		}
+		enum, ok := enumRaw.([]interface{})
+		if !ok || len(enum) == 0 {
+			return fmt.Errorf("key 'enum' in property '%s' is not a non-empty list", key)
+		}
+		for _, choice := range enum {
+			if err := CheckCustomFieldValue(CustomField{Kind: property.Kind}, choice); err != nil {
+				return fmt.Errorf("enum value in property '%s' is invalid: %w", key, err)
+			}
+		}
+		property.Enum = enum
+	}
+	if enumLabelsRaw, found := rawPropertyMap["enumLabels"]; found {
+		if enumLabelsMongoSerialized, ok := enumLabelsRaw.(primitive.A); ok {
+			enumLabelsRaw = []interface{}(enumLabelsMongoSerialized)
+		}
+		enumLabels, ok := enumLabelsRaw.([]interface{})
+		if !ok || len(enumLabels) != len(property.Enum) {
+			return fmt.Errorf("key 'enumLabels' in property '%s' must be a list with a label for each enum value", key)
+		}
+		for _, labelRaw := range enumLabels {
+			label, ok := labelRaw.(string)
+			if !ok {
+				return fmt.Errorf("label in 'enumLabels' of property '%s' is not string", key)
+			}
+			property.EnumLabels = append(property.EnumLabels, label)
+		}
+	}
+
+	// Display order
+	if displayOrderRaw, found := rawPropertyMap["displayOrder"]; found {
+		displayOrder, ok := CustomFieldInt(displayOrderRaw)
+		if !ok {
+			return fmt.Errorf("key 'displayOrder' in property '%s' is not an integer", key)
+		}
+		property.DisplayOrder = displayOrder
+	}
+
+	// Bounds
+	for _, bound := range []struct {
+		name  string
+		dest  **float64
+		valid bool
+	}{
+		{"minimum", &property.Minimum, isNumber},
+		{"maximum", &property.Maximum, isNumber},
+	} {
+		if boundRaw, found := rawPropertyMap[bound.name]; found {
+			value, ok := customFieldFloat(boundRaw)
+			if !ok || !bound.valid {
+				return fmt.Errorf("key '%s' in property '%s' must be a number on a number field", bound.name, key)
+			}
+			*bound.dest = &value
+		}
+	}
+	for _, bound := range []struct {
+		name string
+		dest **int
+	}{
+		{"minLength", &property.MinLength},
+		{"maxLength", &property.MaxLength},
+	} {
+		if boundRaw, found := rawPropertyMap[bound.name]; found {
+			value, ok := CustomFieldInt(boundRaw)
+			if !ok || value < 0 || property.Kind != "string" {
+				return fmt.Errorf("key '%s' in property '%s' must be a non-negative integer on a string field", bound.name, key)
+			}
+			*bound.dest = &value
+		}
+	}
+	if property.Minimum != nil && property.Maximum != nil && *property.Minimum > *property.Maximum {
+		return fmt.Errorf("minimum of property '%s' is more than its maximum", key)
+	}
+	if property.MinLength != nil && property.MaxLength != nil && *property.MinLength > *property.MaxLength {
+		return fmt.Errorf("minLength of property '%s' is more than its maxLength", key)
+	}
+
+	// Format hints
+	if formatRaw, found := rawPropertyMap["format"]; found {
+		format, ok := formatRaw.(string)
+		if !ok || (format != CustomFieldFormatEmail && format != CustomFieldFormatPhone) || property.Kind != "string" {
+			return fmt.Errorf("key 'format' in property '%s' must be email or phone on a string field", key)
+		}
+		property.Format = format
+	}
+
+	// Sensitivity
+	if sensitiveRaw, found := rawPropertyMap["sensitive"]; found {
+		sensitive, ok := sensitiveRaw.(bool)
+		if !ok {
+			return fmt.Errorf("key 'sensitive' in property '%s' is not bool", key)
+		}
+		property.Sensitive = sensitive
+	}
+
+	// Owner editing, only makes sense for fields the owner can see & that aren't handed out by us
+	if ownerEditableRaw, found := rawPropertyMap["ownerEditable"]; found {
+		ownerEditable, ok := ownerEditableRaw.(bool)
+		if !ok {
+			return fmt.Errorf("key 'ownerEditable' in property '%s' is not bool", key)
+		}
+		if ownerEditable && (!property.UserVisible || property.AutoNumber) {
+			return fmt.Errorf("property '%s' can only be owner editable if it's user visible and not auto-numbered", key)
+		}
+		property.OwnerEditable = ownerEditable
+	}
+
+	// Default, checked last so it can be held to everything above
+	if defaultRaw, found := rawPropertyMap["default"]; found {
+		if property.AutoNumber {
+			return fmt.Errorf("property '%s' can't have a default since it is auto-numbered", key)
+		}
+		if err := CheckCustomFieldValue(*property, defaultRaw); err != nil {
+			return fmt.Errorf("default of property '%s' is invalid: %w", key, err)
+		}
+		property.Default = defaultRaw
+	}
+
+	return nil
+}
+
+// CheckCustomFieldValue makes sure a value fits a property's type, enum, bounds and format.
+func CheckCustomFieldValue(property CustomField, value interface{}) error {
+	switch property.Kind {
+	case "integer":
+		if _, ok := CustomFieldInt(value); !ok {
+			return fmt.Errorf("%v is not an integer", value)
+		}
+	case "number":
+		if _, ok := customFieldFloat(value); !ok {
+			return fmt.Errorf("%v is not a number", value)
+		}
+	case "string":
+		if _, ok := value.(string); !ok {
+			return fmt.Errorf("%v is not a string", value)
+		}
+	case "boolean":
+		if _, ok := value.(bool); !ok {
+			return fmt.Errorf("%v is not a boolean", value)
+		}
+	}
+
+	if len(property.Enum) > 0 {
+		found := false
+		for _, choice := range property.Enum {
+			choiceNum, choiceIsNum := customFieldFloat(choice)
+			valueNum, valueIsNum := customFieldFloat(value)
+			if reflect.DeepEqual(choice, value) || (choiceIsNum && valueIsNum && choiceNum == valueNum) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("%v is not one of the allowed values", value)
+		}
+	}
+
+	if num, ok := customFieldFloat(value); ok {
+		if property.Minimum != nil && num < *property.Minimum {
+			return fmt.Errorf("%v is less than the minimum of %v", value, *property.Minimum)
+		}
+		if property.Maximum != nil && num > *property.Maximum {
+			return fmt.Errorf("%v is more than the maximum of %v", value, *property.Maximum)
+		}
+	}
+
+	if str, ok := value.(string); ok {
+		length := len([]rune(str))
+		if property.MinLength != nil && length < *property.MinLength {
+			return fmt.Errorf("'%s' is shorter than %d characters", str, *property.MinLength)
+		}
+		if property.MaxLength != nil && length > *property.MaxLength {
+			return fmt.Errorf("'%s' is longer than %d characters", str, *property.MaxLength)
+		}
+		if !CheckCustomFieldFormat(property.Format, str) {
+			return fmt.Errorf("'%s' is not a valid %s", str, property.Format)
+		}
+	}
+
+	return nil
+}
+
+// CheckCustomFieldFormat checks a string against one of our format hints. Unknown formats always pass.
+func CheckCustomFieldFormat(format string, value string) bool {
+	switch format {
+	case CustomFieldFormatEmail:
+		address, err := mail.ParseAddress(value)
+		return err == nil && address.Address == value
+	case CustomFieldFormatPhone:
+		return customFieldPhoneRegex.MatchString(value)
+	default:
+		return true
+	}
+}
@@ -6,6 +6,28 @@ import (
 	"github.com/go-chi/render"
 )
 
+// Stable application-specific error codes, so that clients don't need to match on error text.
+// These must never be renumbered, only added to.
+const (
+	AppCodeInvalidRequest      int64 = 1000 // generic bad input
+	AppCodeMalformedBody       int64 = 1001 // body isn't valid JSON or has unknown/mistyped fields
+	AppCodeInvalidBody         int64 = 1002 // body is valid JSON but fails validation
+	AppCodeInvalidCustomFields int64 = 1003 // custom fields don't match the event's schema
+	AppCodeEditNotAllowed      int64 = 1004 // tried setting a field that can't be set
+	AppCodeNotOnRoster         int64 = 1005 // student number isn't on the roster, see suggestions
+	AppCodeEditClosed          int64 = 1006 // owner edits are closed for the event
+	AppCodeNotEligible         int64 = 1007 // user can't get a ticket for the event
+	AppCodeUnauthorized        int64 = 2000
+	AppCodeForbidden           int64 = 2001
+	AppCodeNotFound            int64 = 3000
+	AppCodeConflict            int64 = 3001
+	AppCodeUnmodified          int64 = 3002
+	AppCodeVersionConflict     int64 = 3003 // If-Match didn't match the current version
+	AppCodeServer              int64 = 5000
+	AppCodeRender              int64 = 5001
+	AppCodeUnavailable         int64 = 5002 // feature isn't set up on this deployment
+)
+
 // ErrResponse renderer type for handling all sorts of errors.
 //
 // In the best case scenario, the excellent github.com/pkg/errors package
@@ -18,6 +40,9 @@ type ErrResponse struct {
 	StatusText string `json:"status"`          // user-level status message
 	AppCode    int64  `json:"code,omitempty"`  // application-specific error code
 	ErrorText  string `json:"error,omitempty"` // application-level error message, for debugging
+
+	Suggestions []string    `json:"suggestions,omitempty"` // possible corrections for the given input, if any
+	Details     []ErrDetail `json:"details,omitempty"`     // the fields that caused the error, if known
 }
 
 func (e *ErrResponse) Render(w http.ResponseWriter, r *http.Request) error {
@@ -25,12 +50,28 @@ func (e *ErrResponse) Render(w http.ResponseWriter, r *http.Request) error {
 	return nil
 }
 
+// ErrInvalidRequest fills in the app code and field details from the error when it can, ex. for
+// body validation errors and ValidationErrors from models.
 func ErrInvalidRequest(err error) render.Renderer {
+	appCode, details := errDetailsFor(err)
+	return &ErrResponse{
+		Err:            err,
+		HTTPStatusCode: 400,
+		StatusText:     "Invalid request.",
+		AppCode:        appCode,
+		ErrorText:      err.Error(),
+		Details:        details,
+	}
+}
+
+func ErrInvalidRequestWithSuggestions(err error, suggestions []string) render.Renderer {
 	return &ErrResponse{
 		Err:            err,
 		HTTPStatusCode: 400,
 		StatusText:     "Invalid request.",
+		AppCode:        AppCodeNotOnRoster,
 		ErrorText:      err.Error(),
+		Suggestions:    suggestions,
 	}
 }
 
@@ -38,15 +79,28 @@ func ErrConflict(err error) render.Renderer {
 	return &ErrResponse{
 		Err:            err,
 		HTTPStatusCode: 409,
+		AppCode:        AppCodeConflict,
 		StatusText:     "Conflict.",
 		ErrorText:      err.Error(),
 	}
 }
 
+// ErrPreconditionFailed is for when the document was changed since the client last fetched it.
+func ErrPreconditionFailed(err error) render.Renderer {
+	return &ErrResponse{
+		Err:            err,
+		HTTPStatusCode: 412,
+		StatusText:     "Precondition failed.",
+		AppCode:        AppCodeVersionConflict,
+		ErrorText:      err.Error(),
+	}
+}
+
 func ErrRender(err error) render.Renderer {
 	return &ErrResponse{
 		Err:            err,
 		HTTPStatusCode: 422,
+		AppCode:        AppCodeRender,
 		StatusText:     "Error rendering response.",
 		ErrorText:      err.Error(),
 	}
@@ -56,15 +110,18 @@ func ErrServer(err error) render.Renderer {
 	return &ErrResponse{
 		Err:            err,
 		HTTPStatusCode: 500,
+		AppCode:        AppCodeServer,
 		StatusText:     "Server error.",
 		ErrorText:      err.Error(),
 	}
 }
 
-var ErrNotFound = &ErrResponse{HTTPStatusCode: 404, StatusText: "Resource not found."}
+var ErrNotFound = &ErrResponse{HTTPStatusCode: 404, StatusText: "Resource not found.", AppCode: AppCodeNotFound}
+
+var ErrUnmodified = &ErrResponse{HTTPStatusCode: 304, StatusText: "Resource not modified.", AppCode: AppCodeUnmodified}
 
-var ErrUnmodified = &ErrResponse{HTTPStatusCode: 304, StatusText: "Resource not modified."}
+var ErrUnauthorized = &ErrResponse{HTTPStatusCode: 401, StatusText: "Unauthorized.", AppCode: AppCodeUnauthorized}
 
-var ErrUnauthorized = &ErrResponse{HTTPStatusCode: 401, StatusText: "Unauthorized."}
+var ErrForbidden = &ErrResponse{HTTPStatusCode: 403, StatusText: "Forbidden.", AppCode: AppCodeForbidden}
 
-var ErrForbidden = &ErrResponse{HTTPStatusCode: 403, StatusText: "Forbidden."}
+var ErrUnavailable = &ErrResponse{HTTPStatusCode: 503, StatusText: "Service unavailable.", AppCode: AppCodeUnavailable}
@@ -0,0 +1,30 @@
+package util
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// ETag formats a document version as an ETag header value.
+func ETag(version int) string {
+	return fmt.Sprintf(`"%d"`, version)
+}
+
+// IfMatchVersion reads the document version a client last saw out of the If-Match header. Nil is
+// returned when the header is missing or is "*", meaning any version can be overwritten.
+func IfMatchVersion(r *http.Request) (*int, error) {
+	header := strings.TrimSpace(r.Header.Get("If-Match"))
+	if header == "" || header == "*" {
+		return nil, nil
+	}
+
+	// Only one version can be current, so lists of ETags aren't supported
+	tag := strings.Trim(strings.TrimPrefix(header, "W/"), `"`)
+	version, err := strconv.Atoi(tag)
+	if err != nil || version < 0 {
+		return nil, fmt.Errorf("If-Match header '%s' is not a version given by an ETag", header)
+	}
+	return &version, nil
+}
@@ -0,0 +1,253 @@
+package util
+
+import (
+	"archive/zip"
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	TabularFormatCSV    = "csv"
+	TabularFormatNDJSON = "ndjson"
+	TabularFormatXLSX   = "xlsx"
+)
+
+// TabularColumn is a single column of a table. Key is a stable field name used by formats with
+// named fields (ex. ndjson), and Header is the human readable name shown by spreadsheets.
+type TabularColumn struct {
+	Key    string
+	Header string
+}
+
+// TabularWriter writes rows of a table one at a time, so large exports never have to be held in
+// memory. WriteHeader must be called once before any rows are written, and Close once at the end.
+type TabularWriter interface {
+	WriteHeader(columns []TabularColumn) error
+	WriteRow(row []interface{}) error
+	Close() error
+}
+
+// NewTabularWriter creates a writer for the given format (csv, ndjson or xlsx).
+func NewTabularWriter(format string, w io.Writer) (TabularWriter, error) {
+	switch format {
+	case TabularFormatCSV:
+		return &csvTabularWriter{writer: csv.NewWriter(w)}, nil
+	case TabularFormatNDJSON:
+		return &ndjsonTabularWriter{encoder: json.NewEncoder(w)}, nil
+	case TabularFormatXLSX:
+		return &xlsxTabularWriter{zipWriter: zip.NewWriter(w)}, nil
+	default:
+		return nil, fmt.Errorf("unknown format '%s', must be csv, ndjson or xlsx", format)
+	}
+}
+
+// TabularContentType returns the MIME type and file extension of a tabular format.
+func TabularContentType(format string) (string, string) {
+	switch format {
+	case TabularFormatNDJSON:
+		return "application/x-ndjson", "ndjson"
+	case TabularFormatXLSX:
+		return "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet", "xlsx"
+	default:
+		return "text/csv", "csv"
+	}
+}
+
+// formatTabularValue converts a value to how it should look in text based formats.
+func formatTabularValue(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case bool:
+		return strconv.FormatBool(v)
+	case int:
+		return strconv.Itoa(v)
+	case int64:
+		return strconv.FormatInt(v, 10)
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case time.Time:
+		if v.IsZero() {
+			return ""
+		}
+		return v.Format(time.RFC3339)
+	case fmt.Stringer:
+		return v.String()
+	default:
+		// Arrays, objects and anything else get serialized as JSON
+		raw, err := json.Marshal(v)
+		if err != nil {
+			return fmt.Sprint(v)
+		}
+		return string(raw)
+	}
+}
+
+// escapeTabularFormula stops spreadsheet apps from running text as a formula, by prefixing text
+// that starts like one with an apostrophe.
+func escapeTabularFormula(text string) string {
+	if text != "" && strings.ContainsRune("=+-@\t\r", rune(text[0])) {
+		return "'" + text
+	}
+	return text
+}
+
+// formatTabularCell converts a value to how it should look in a spreadsheet cell. Only text is
+// escaped, so negative numbers stay numbers.
+func formatTabularCell(value interface{}) string {
+	switch value.(type) {
+	case nil, bool, int, int64, float64, time.Time:
+		return formatTabularValue(value)
+	default:
+		return escapeTabularFormula(formatTabularValue(value))
+	}
+}
+
+type csvTabularWriter struct {
+	writer *csv.Writer
+}
+
+func (cw *csvTabularWriter) WriteHeader(columns []TabularColumn) error {
+	record := make([]string, len(columns))
+	for i, column := range columns {
+		record[i] = escapeTabularFormula(column.Header)
+	}
+	return cw.writer.Write(record)
+}
+
+func (cw *csvTabularWriter) WriteRow(row []interface{}) error {
+	record := make([]string, len(row))
+	for i, value := range row {
+		record[i] = formatTabularCell(value)
+	}
+	return cw.writer.Write(record)
+}
+
+func (cw *csvTabularWriter) Close() error {
+	cw.writer.Flush()
+	return cw.writer.Error()
+}
+
+// ndjsonTabularWriter writes each row as a JSON object keyed by the column keys, so that renaming a
+// column's header doesn't break whatever reads the file.
+type ndjsonTabularWriter struct {
+	encoder *json.Encoder
+	keys    []string
+}
+
+func (nw *ndjsonTabularWriter) WriteHeader(columns []TabularColumn) error {
+	nw.keys = make([]string, len(columns))
+	for i, column := range columns {
+		nw.keys[i] = column.Key
+	}
+	return nil
+}
+
+func (nw *ndjsonTabularWriter) WriteRow(row []interface{}) error {
+	obj := make(map[string]interface{}, len(row))
+	for i, value := range row {
+		if t, ok := value.(time.Time); ok && t.IsZero() {
+			value = nil
+		}
+		obj[nw.keys[i]] = value
+	}
+	return nw.encoder.Encode(obj)
+}
+
+func (nw *ndjsonTabularWriter) Close() error {
+	return nil
+}
+
+// xlsxTabularWriter writes a bare-bones single sheet workbook. Strings are written inline instead of
+// through a shared strings table so the sheet can be streamed straight into the zip.
+type xlsxTabularWriter struct {
+	zipWriter *zip.Writer
+	sheet     io.Writer
+}
+
+var xlsxStaticParts = []struct {
+	name    string
+	content string
+}{
+	{"[Content_Types].xml", `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Types xmlns="http://schemas.openxmlformats.org/package/2006/content-types"><Default Extension="rels" ContentType="application/vnd.openxmlformats-package.relationships+xml"/><Default Extension="xml" ContentType="application/xml"/><Override PartName="/xl/workbook.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.sheet.main+xml"/><Override PartName="/xl/worksheets/sheet1.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.worksheet+xml"/></Types>`},
+	{"_rels/.rels", `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships"><Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/officeDocument" Target="xl/workbook.xml"/></Relationships>`},
+	{"xl/workbook.xml", `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<workbook xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main" xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships"><sheets><sheet name="Sheet1" sheetId="1" r:id="rId1"/></sheets></workbook>`},
+	{"xl/_rels/workbook.xml.rels", `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships"><Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/worksheet" Target="worksheets/sheet1.xml"/></Relationships>`},
+}
+
+func (xw *xlsxTabularWriter) WriteHeader(columns []TabularColumn) error {
+	for _, part := range xlsxStaticParts {
+		partWriter, err := xw.zipWriter.Create(part.name)
+		if err != nil {
+			return err
+		}
+		if _, err := io.WriteString(partWriter, part.content); err != nil {
+			return err
+		}
+	}
+
+	// The sheet has to be the last part, since nothing else can be written to the zip until it's done
+	sheet, err := xw.zipWriter.Create("xl/worksheets/sheet1.xml")
+	if err != nil {
+		return err
+	}
+	xw.sheet = sheet
+	if _, err := io.WriteString(xw.sheet, `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<worksheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main"><sheetData>`); err != nil {
+		return err
+	}
+
+	row := make([]interface{}, len(columns))
+	for i, column := range columns {
+		row[i] = column.Header
+	}
+	return xw.WriteRow(row)
+}
+
+func (xw *xlsxTabularWriter) WriteRow(row []interface{}) error {
+	var sb strings.Builder
+	sb.WriteString("<row>")
+	for _, value := range row {
+		switch v := value.(type) {
+		case nil:
+			sb.WriteString("<c/>")
+		case bool:
+			b := "0"
+			if v {
+				b = "1"
+			}
+			sb.WriteString(`<c t="b"><v>` + b + `</v></c>`)
+		case int, int64, float64:
+			sb.WriteString("<c><v>" + formatTabularValue(v) + "</v></c>")
+		default:
+			sb.WriteString(`<c t="inlineStr"><is><t xml:space="preserve">`)
+			xml.EscapeText(&sb, []byte(formatTabularCell(v)))
+			sb.WriteString("</t></is></c>")
+		}
+	}
+	sb.WriteString("</row>")
+
+	_, err := io.WriteString(xw.sheet, sb.String())
+	return err
+}
+
+func (xw *xlsxTabularWriter) Close() error {
+	if xw.sheet != nil {
+		if _, err := io.WriteString(xw.sheet, "</sheetData></worksheet>"); err != nil {
+			return err
+		}
+	}
+	return xw.zipWriter.Close()
+}
@@ -0,0 +1,72 @@
+package util
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestCSVTabularWriterEscapesFormulas(t *testing.T) {
+	var buf bytes.Buffer
+	writer, err := NewTabularWriter(TabularFormatCSV, &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	columns := []TabularColumn{{Key: "name", Header: "=Name"}, {Key: "count", Header: "Count"}}
+	if err := writer.WriteHeader(columns); err != nil {
+		t.Fatal(err)
+	}
+	rows := [][]interface{}{
+		{"=HYPERLINK(\"http://example.com\")", -5},
+		{"@SUM(A1)", 2},
+		{"+1", nil},
+		{"-1", 0},
+		{"plain", 3},
+	}
+	for _, row := range rows {
+		if err := writer.WriteRow(row); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := strings.Join([]string{
+		"'=Name,Count",
+		`"'=HYPERLINK(""http://example.com"")",-5`,
+		"'@SUM(A1),2",
+		"'+1,",
+		"'-1,0",
+		"plain,3",
+		"",
+	}, "\n")
+	if buf.String() != expected {
+		t.Errorf("expected:\n%s\ngot:\n%s", expected, buf.String())
+	}
+}
+
+func TestNDJSONTabularWriterUsesColumnKeys(t *testing.T) {
+	var buf bytes.Buffer
+	writer, err := NewTabularWriter(TabularFormatNDJSON, &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	columns := []TabularColumn{{Key: "customFields.table", Header: "Table Number"}, {Key: "note", Header: "Note"}}
+	if err := writer.WriteHeader(columns); err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.WriteRow([]interface{}{4, "=not escaped"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `{"customFields.table":4,"note":"=not escaped"}` + "\n"
+	if buf.String() != expected {
+		t.Errorf("expected %s, got %s", expected, buf.String())
+	}
+}
@@ -0,0 +1,114 @@
+package util
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/go-playground/validator/v10"
+)
+
+// ErrDetail points at a single field that failed validation, so that clients can highlight it.
+type ErrDetail struct {
+	Field   string `json:"field"`   // path to the field using JSON names, ex. customFields.mealChoice
+	Rule    string `json:"rule"`    // the rule that failed, ex. required, enum, autoNumber
+	Message string `json:"message"` // human readable explanation
+}
+
+// ValidationError is an error that can be traced back to specific fields of a request. It wraps
+// an underlying error (ex. a models sentinel) so that it can still be checked with errors.Is.
+type ValidationError struct {
+	Err     error
+	AppCode int64
+	Details []ErrDetail
+}
+
+func (e *ValidationError) Error() string {
+	messages := []string{}
+	for _, detail := range e.Details {
+		messages = append(messages, fmt.Sprintf("%s: %s", detail.Field, detail.Message))
+	}
+	if e.Err == nil {
+		return strings.Join(messages, "; ")
+	}
+	if len(messages) == 0 {
+		return e.Err.Error()
+	}
+	return fmt.Sprintf("%s: %s", e.Err.Error(), strings.Join(messages, "; "))
+}
+
+func (e *ValidationError) Unwrap() error {
+	return e.Err
+}
+
+// NewValidationError makes a validation error about one field.
+func NewValidationError(err error, appCode int64, field string, rule string, message string) *ValidationError {
+	return &ValidationError{
+		Err:     err,
+		AppCode: appCode,
+		Details: []ErrDetail{{Field: field, Rule: rule, Message: message}},
+	}
+}
+
+// NewValidator makes a struct validator that reports fields by their JSON names instead of their
+// Go names, since that's what clients send.
+func NewValidator() *validator.Validate {
+	validate := validator.New()
+	validate.RegisterTagNameFunc(func(field reflect.StructField) string {
+		name := strings.SplitN(field.Tag.Get("json"), ",", 2)[0]
+		if name == "-" {
+			return ""
+		}
+		if name == "" {
+			return field.Name
+		}
+		return name
+	})
+	return validate
+}
+
+// errDetailsFor pulls out the field-level details and app code of an error, if it has any.
+func errDetailsFor(err error) (int64, []ErrDetail) {
+	var (
+		validationErr    *ValidationError
+		validatorErrs    validator.ValidationErrors
+		unmarshalTypeErr *json.UnmarshalTypeError
+		syntaxErr        *json.SyntaxError
+	)
+
+	switch {
+	case errors.As(err, &validationErr):
+		return validationErr.AppCode, validationErr.Details
+	case errors.As(err, &validatorErrs):
+		details := []ErrDetail{}
+		for _, fieldErr := range validatorErrs {
+			// Drop the name of the top level struct, ex. ticketControllerCreateRequestBody.eventId
+			field := fieldErr.Namespace()
+			if _, rest, found := strings.Cut(field, "."); found {
+				field = rest
+			}
+			message := fmt.Sprintf("failed on the '%s' rule", fieldErr.Tag())
+			if fieldErr.Param() != "" {
+				message = fmt.Sprintf("failed on the '%s=%s' rule", fieldErr.Tag(), fieldErr.Param())
+			}
+			details = append(details, ErrDetail{Field: field, Rule: fieldErr.Tag(), Message: message})
+		}
+		return AppCodeInvalidBody, details
+	case errors.As(err, &unmarshalTypeErr):
+		return AppCodeMalformedBody, []ErrDetail{{
+			Field:   unmarshalTypeErr.Field,
+			Rule:    "type",
+			Message: fmt.Sprintf("expected %s but got %s", unmarshalTypeErr.Type.String(), unmarshalTypeErr.Value),
+		}}
+	case errors.As(err, &syntaxErr):
+		return AppCodeMalformedBody, nil
+	case strings.HasPrefix(err.Error(), "json: unknown field "):
+		// DisallowUnknownFields doesn't have its own error type
+		field := strings.Trim(strings.TrimPrefix(err.Error(), "json: unknown field "), `"`)
+		return AppCodeMalformedBody, []ErrDetail{{Field: field, Rule: "unknown", Message: "field is not allowed"}}
+	default:
+		return AppCodeInvalidRequest, nil
+	}
+}
@@ -0,0 +1,213 @@
+package workers
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/aritrosaha10/frasertickets/models"
+	"github.com/rs/zerolog/log"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+const (
+	defaultReconciliationInterval = 10 * time.Minute
+	reconciliationConcurrency     = 8 // max # of queued tickets processed at once
+)
+
+var (
+	QueuedTicketReconciler *QueuedTicketReconciliationWorker
+
+	ErrReconciliationInProgress = errors.New("workers: queued ticket reconciliation is already running")
+)
+
+// QueuedTicketReconciliationStats summarizes one run of the queued ticket reconciliation worker.
+type QueuedTicketReconciliationStats struct {
+	StartTimestamp time.Time `json:"start_timestamp"`
+	EndTimestamp   time.Time `json:"end_timestamp"`
+	DurationMs     int64     `json:"duration_ms"`
+	Checked        uint64    `json:"checked"`    // # of pending queued tickets looked at
+	Converted      uint64    `json:"converted"`  // turned into real tickets
+	CleanedUp      uint64    `json:"cleaned_up"` // owner already had a ticket, so marked as converted
+	Delayed        uint64    `json:"delayed"`    // owner hasn't signed up yet
+	Expired        uint64    `json:"expired"`    // passed their expiry time during this run
+	Failed         uint64    `json:"failed"`
+	Error          string    `json:"error,omitempty"` // set if the run couldn't complete at all
+}
+
+func (stats *QueuedTicketReconciliationStats) Render(w http.ResponseWriter, r *http.Request) error {
+	return nil
+}
+
+// QueuedTicketReconciliationWorker periodically matches pending queued tickets to users,
+// converting them into tickets or cleaning them up if the user already has one.
+type QueuedTicketReconciliationWorker struct {
+	Interval time.Duration // 0 disables the periodic runs, manual runs still work
+
+	runLock   sync.Mutex
+	statsLock sync.RWMutex
+	lastRun   *QueuedTicketReconciliationStats
+}
+
+func CreateNewQueuedTicketReconciler() *QueuedTicketReconciliationWorker {
+	worker := &QueuedTicketReconciliationWorker{Interval: defaultReconciliationInterval}
+
+	if intervalRaw := os.Getenv("QUEUED_TICKET_RECONCILE_INTERVAL"); intervalRaw != "" {
+		interval, err := time.ParseDuration(intervalRaw)
+		if err != nil || interval < 0 {
+			log.Fatal().Err(err).Str("interval", intervalRaw).Msg("could not parse queued ticket reconciliation interval")
+		}
+		worker.Interval = interval
+	}
+
+	return worker
+}
+
+// Start runs the worker right away and then on its interval until the context is cancelled. It blocks, so it
+// should be run in its own goroutine.
+func (worker *QueuedTicketReconciliationWorker) Start(ctx context.Context) {
+	if worker.Interval == 0 {
+		log.Info().Msg("queued ticket reconciliation worker disabled")
+		return
+	}
+
+	// Catch up on anything missed while the server was down instead of waiting a whole interval
+	run := func() {
+		if _, err := worker.RunOnce(ctx); err != nil && err != ErrReconciliationInProgress {
+			log.Error().Err(err).Msg("queued ticket reconciliation run failed")
+		}
+	}
+	run()
+
+	ticker := time.NewTicker(worker.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			run()
+		}
+	}
+}
+
+// LastRun returns the stats of the most recent run, if there has been one.
+func (worker *QueuedTicketReconciliationWorker) LastRun() (QueuedTicketReconciliationStats, bool) {
+	worker.statsLock.RLock()
+	defer worker.statsLock.RUnlock()
+
+	if worker.lastRun == nil {
+		return QueuedTicketReconciliationStats{}, false
+	}
+	return *worker.lastRun, true
+}
+
+// RunOnce goes through every pending queued ticket once. Only one run can happen at a time.
+func (worker *QueuedTicketReconciliationWorker) RunOnce(ctx context.Context) (QueuedTicketReconciliationStats, error) {
+	if !worker.runLock.TryLock() {
+		return QueuedTicketReconciliationStats{}, ErrReconciliationInProgress
+	}
+	defer worker.runLock.Unlock()
+
+	stats := QueuedTicketReconciliationStats{StartTimestamp: time.Now()}
+	var checked, converted, cleanedUp, delayed, failed atomic.Uint64
+
+	// Get rid of expired queued tickets first so they don't get converted
+	expired, err := models.ExpireQueuedTickets(ctx)
+	if err != nil {
+		log.Error().Err(err).Msg("could not expire queued tickets")
+	}
+	stats.Expired = uint64(expired)
+
+	queuedTickets, err := models.GetAllQueuedTickets(ctx)
+	if err == nil {
+		var waitGroup sync.WaitGroup
+		semaphore := make(chan struct{}, reconciliationConcurrency)
+		for _, queuedTicket := range queuedTickets {
+			waitGroup.Add(1)
+			semaphore <- struct{}{}
+			go func(queuedTicket models.QueuedTicket) {
+				defer waitGroup.Done()
+				defer func() { <-semaphore }()
+
+				checked.Add(1)
+				switch reconcileQueuedTicket(ctx, queuedTicket) {
+				case reconcileConverted:
+					converted.Add(1)
+				case reconcileCleanedUp:
+					cleanedUp.Add(1)
+				case reconcileDelayed:
+					delayed.Add(1)
+				default:
+					failed.Add(1)
+				}
+			}(queuedTicket)
+		}
+		waitGroup.Wait()
+	}
+
+	stats.EndTimestamp = time.Now()
+	stats.DurationMs = stats.EndTimestamp.Sub(stats.StartTimestamp).Milliseconds()
+	stats.Checked = checked.Load()
+	stats.Converted = converted.Load()
+	stats.CleanedUp = cleanedUp.Load()
+	stats.Delayed = delayed.Load()
+	stats.Failed = failed.Load()
+	if err != nil {
+		stats.Error = err.Error()
+	}
+
+	worker.statsLock.Lock()
+	worker.lastRun = &stats
+	worker.statsLock.Unlock()
+
+	log.Info().Any("stats", stats).Msg("finished queued ticket reconciliation run")
+	return stats, err
+}
+
+type reconcileOutcome int
+
+const (
+	reconcileFailed reconcileOutcome = iota
+	reconcileConverted
+	reconcileCleanedUp
+	reconcileDelayed
+)
+
+func reconcileQueuedTicket(ctx context.Context, queuedTicket models.QueuedTicket) reconcileOutcome {
+	user, err := models.FindUserForMatcher(ctx, queuedTicket.Matcher())
+	if err == mongo.ErrNoDocuments {
+		return reconcileDelayed
+	} else if err != nil {
+		log.Warn().Err(err).Any("matcher", queuedTicket.Matcher()).Msg("could not check if matching user exists")
+		return reconcileFailed
+	}
+
+	// If they already have a ticket, the queued ticket has been fulfilled already
+	ticket, err := models.SearchForTicket(ctx, queuedTicket.EventID, user.ID)
+	if err == nil {
+		if err := models.MarkQueuedTicketConverted(ctx, queuedTicket.ID, ticket.ID); err != nil {
+			log.Warn().Err(err).Any("queuedTicket", queuedTicket).Msg("could not mark queued ticket as converted")
+			return reconcileFailed
+		}
+		log.Info().Any("queuedTicket", queuedTicket).Msg("marked queued ticket with existing ticket as converted")
+		return reconcileCleanedUp
+	} else if err != mongo.ErrNoDocuments {
+		log.Warn().Err(err).Any("queuedTicket", queuedTicket).Msg("could not check for existing ticket")
+		return reconcileFailed
+	}
+
+	ticket, err = models.ConvertQueuedTicketForUser(ctx, queuedTicket, user, true)
+	if err != nil {
+		log.Error().Err(err).Any("queuedTicket", queuedTicket).Msg("could not convert queued ticket to ticket")
+		return reconcileFailed
+	}
+
+	log.Info().Any("ticket", ticket).Str("owner_uid", ticket.Owner).Msg("converted queued ticket to ticket")
+	return reconcileConverted
+}
@@ -0,0 +1,96 @@
+package workers
+
+import (
+	"context"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/aritrosaha10/frasertickets/models"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	defaultTrashRetention     = 30 * 24 * time.Hour
+	defaultTrashPurgeInterval = 6 * time.Hour
+)
+
+// TrashRetentionWorker periodically purges events and tickets that have been in the trash for
+// longer than the retention period.
+type TrashRetentionWorker struct {
+	Retention time.Duration // how long things stay in the trash before being purged
+	Interval  time.Duration // 0 disables purging
+
+	runLock sync.Mutex
+}
+
+func CreateNewTrashRetentionWorker() *TrashRetentionWorker {
+	worker := &TrashRetentionWorker{
+		Retention: defaultTrashRetention,
+		Interval:  defaultTrashPurgeInterval,
+	}
+
+	if retentionRaw := os.Getenv("TRASH_RETENTION"); retentionRaw != "" {
+		retention, err := time.ParseDuration(retentionRaw)
+		if err != nil || retention < 0 {
+			log.Fatal().Err(err).Str("retention", retentionRaw).Msg("could not parse trash retention period")
+		}
+		worker.Retention = retention
+	}
+
+	if intervalRaw := os.Getenv("TRASH_PURGE_INTERVAL"); intervalRaw != "" {
+		interval, err := time.ParseDuration(intervalRaw)
+		if err != nil || interval < 0 {
+			log.Fatal().Err(err).Str("interval", intervalRaw).Msg("could not parse trash purge interval")
+		}
+		worker.Interval = interval
+	}
+
+	return worker
+}
+
+// Start runs the worker on its interval until the context is cancelled. It blocks, so it
+// should be run in its own goroutine.
+func (worker *TrashRetentionWorker) Start(ctx context.Context) {
+	if worker.Interval == 0 {
+		log.Info().Msg("trash retention worker disabled")
+		return
+	}
+
+	ticker := time.NewTicker(worker.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if _, err := worker.RunOnce(ctx); err != nil {
+				log.Error().Err(err).Msg("trash purge run failed")
+			}
+		}
+	}
+}
+
+// RunOnce purges everything that has been in the trash for longer than the retention period.
+// Runs that start while another one is going are skipped.
+func (worker *TrashRetentionWorker) RunOnce(ctx context.Context) (models.PurgeResult, error) {
+	if !worker.runLock.TryLock() {
+		return models.PurgeResult{}, nil
+	}
+	defer worker.runLock.Unlock()
+
+	result, err := models.PurgeTrash(ctx, time.Now().Add(-worker.Retention))
+	if err != nil {
+		return models.PurgeResult{}, err
+	}
+
+	log.Info().
+		Str("type", "audit").
+		Str("controller", "trash").
+		Str("action", "purgeTrash").
+		Dur("retention", worker.Retention).
+		Any("result", result).
+		Msg("purged expired trash")
+	return result, nil
+}
@@ -0,0 +1,176 @@
+package workers
+
+import (
+	"context"
+	"errors"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/aritrosaha10/frasertickets/lib"
+	"github.com/aritrosaha10/frasertickets/models"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	defaultWalletSyncInterval    = 30 * time.Second
+	defaultWalletSyncMaxAttempts = 8
+	walletSyncBatchSize          = 100
+	walletSyncLease              = 2 * time.Minute // how long a claimed job is left alone before someone else can try it
+	walletSyncBaseBackoff        = 30 * time.Second
+	walletSyncMaxBackoff         = time.Hour
+	walletSyncExpiryLookback     = 24 * time.Hour // how far back the first sweep looks for ended events, to cover downtime
+)
+
+// WalletSyncResult is a summary of a single wallet sync run.
+type WalletSyncResult struct {
+	Synced   int `json:"synced"`
+	Retrying int `json:"retrying"`
+	Failed   int `json:"failed"` // gave up on, shown to admins
+}
+
+// WalletSyncWorker periodically pushes queued event and ticket changes to Google Wallet, retrying
+// failures with exponential backoff until it runs out of attempts. Events that ended since the last
+// run are queued too, since nothing else changes when their passes expire.
+type WalletSyncWorker struct {
+	Interval    time.Duration // 0 disables syncing
+	MaxAttempts int
+
+	runLock         sync.Mutex
+	lastExpirySweep time.Time
+}
+
+func CreateNewWalletSyncWorker() *WalletSyncWorker {
+	worker := &WalletSyncWorker{
+		Interval:    defaultWalletSyncInterval,
+		MaxAttempts: defaultWalletSyncMaxAttempts,
+	}
+
+	if intervalRaw := os.Getenv("WALLET_SYNC_INTERVAL"); intervalRaw != "" {
+		interval, err := time.ParseDuration(intervalRaw)
+		if err != nil || interval < 0 {
+			log.Fatal().Err(err).Str("interval", intervalRaw).Msg("could not parse wallet sync interval")
+		}
+		worker.Interval = interval
+	}
+
+	if maxAttemptsRaw := os.Getenv("WALLET_SYNC_MAX_ATTEMPTS"); maxAttemptsRaw != "" {
+		maxAttempts, err := strconv.Atoi(maxAttemptsRaw)
+		if err != nil || maxAttempts < 1 {
+			log.Fatal().Err(err).Str("max_attempts", maxAttemptsRaw).Msg("could not parse wallet sync max attempts")
+		}
+		worker.MaxAttempts = maxAttempts
+	}
+
+	return worker
+}
+
+// Start runs the worker on its interval until the context is cancelled. It blocks, so it
+// should be run in its own goroutine.
+func (worker *WalletSyncWorker) Start(ctx context.Context) {
+	if worker.Interval == 0 || lib.GoogleWallet == nil {
+		log.Info().Msg("wallet sync worker disabled")
+		return
+	}
+
+	// Catch up on anything that ended or changed while the server was down
+	if _, err := worker.RunOnce(ctx); err != nil {
+		log.Error().Err(err).Msg("wallet sync run failed")
+	}
+
+	ticker := time.NewTicker(worker.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if _, err := worker.RunOnce(ctx); err != nil {
+				log.Error().Err(err).Msg("wallet sync run failed")
+			}
+		}
+	}
+}
+
+// RunOnce queues events that ended since the last run, then syncs every job that's due, up to a
+// batch at a time. Runs that start while another one is going are skipped.
+func (worker *WalletSyncWorker) RunOnce(ctx context.Context) (WalletSyncResult, error) {
+	if !worker.runLock.TryLock() {
+		return WalletSyncResult{}, nil
+	}
+	defer worker.runLock.Unlock()
+
+	// Passes of ended events have to be marked as expired
+	sweepUntil := time.Now()
+	sweepSince := worker.lastExpirySweep
+	if sweepSince.IsZero() {
+		sweepSince = sweepUntil.Add(-walletSyncExpiryLookback)
+	}
+	if err := models.QueueEndedEventWalletSyncs(ctx, sweepSince, sweepUntil); err != nil {
+		return WalletSyncResult{}, err
+	}
+	worker.lastExpirySweep = sweepUntil
+
+	result := WalletSyncResult{}
+	for i := 0; i < walletSyncBatchSize; i++ {
+		job, err := models.ClaimWalletSyncJob(ctx, walletSyncLease)
+		if err == models.ErrNotFound {
+			break
+		} else if err != nil {
+			return result, err
+		}
+
+		syncErr := models.SyncWalletJob(ctx, job)
+		if syncErr == nil {
+			if err := models.CompleteWalletSyncJob(ctx, job); err != nil {
+				return result, err
+			}
+			result.Synced++
+			continue
+		}
+
+		// Give up on requests the API will never accept, and on anything that keeps failing
+		var retryAt time.Time
+		var walletErr *lib.WalletAPIError
+		if job.Attempts < worker.MaxAttempts && !(errors.As(syncErr, &walletErr) && !walletErr.Temporary()) {
+			retryAt = time.Now().Add(walletSyncBackoff(job.Attempts))
+			result.Retrying++
+		} else {
+			result.Failed++
+		}
+		log.Warn().
+			Err(syncErr).
+			Str("kind", job.Kind).
+			Str("target_id", job.TargetID.Hex()).
+			Int("attempts", job.Attempts).
+			Bool("giving_up", retryAt.IsZero()).
+			Msg("could not sync to google wallet")
+		if err := models.FailWalletSyncJob(ctx, job, syncErr, retryAt); err != nil {
+			return result, err
+		}
+	}
+
+	if result != (WalletSyncResult{}) {
+		log.Info().
+			Str("type", "audit").
+			Str("controller", "wallet").
+			Str("action", "syncWallet").
+			Any("result", result).
+			Msg("synced changes to google wallet")
+	}
+	return result, nil
+}
+
+// walletSyncBackoff doubles the wait after every failed attempt, up to a limit.
+func walletSyncBackoff(attempts int) time.Duration {
+	backoff := walletSyncBaseBackoff
+	for i := 1; i < attempts && backoff < walletSyncMaxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > walletSyncMaxBackoff {
+		backoff = walletSyncMaxBackoff
+	}
+	return backoff
+}
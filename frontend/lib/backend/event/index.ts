@@ -7,6 +7,17 @@ export type PropertySchema = {
     userVisible: boolean;
     description: string;
     displayName: string;
+    enum?: (string | number)[];
+    enumLabels?: string[];
+    default?: string | number | boolean;
+    displayOrder?: number;
+    minimum?: number;
+    maximum?: number;
+    minLength?: number;
+    maxLength?: number;
+    format?: "email" | "phone";
+    sensitive?: boolean;
+    ownerEditable?: boolean;
     [key: string]: any;
 };
 
@@ -38,6 +49,7 @@ type Event = {
     start_timestamp: Date;
     end_timestamp: Date;
     custom_fields_schema: CustomFieldsSchema;
+    owner_edit_cutoff?: Date;
 };
 
 export function convertToEvent(rawData: { [key: string]: any }): Event {
@@ -51,6 +63,11 @@ export function convertToEvent(rawData: { [key: string]: any }): Event {
         start_timestamp: new Date(rawData.start_timestamp),
         end_timestamp: new Date(rawData.end_timestamp),
         custom_fields_schema: rawData.custom_fields_schema,
+        // Go's zero time is never a real cutoff
+        owner_edit_cutoff:
+            rawData.owner_edit_cutoff && !rawData.owner_edit_cutoff.startsWith("0001-")
+                ? new Date(rawData.owner_edit_cutoff)
+                : undefined,
     };
 }
 